@@ -75,6 +75,9 @@ func (r *EventLogRepository) FindBySubAppIdAndCommandId(ctx context.Context, ten
 	}
 	var list []EventLog
 	cursor, err := r.collection.Find(ctx, filter)
+	if err = getError(err); err != nil {
+		return nil, err
+	}
 	defer func() { // 关闭
 		if err := cursor.Close(ctx); err != nil {
 			fmt.Println(err)
@@ -125,6 +125,11 @@ func (m *MongoDB) NewCollection(name string) *mongo.Collection {
 	return m.database.Collection(name, m.collectionOptions)
 }
 
+// NewDatabaseCollection returns a collection of another database with the same collection options.
+func (m *MongoDB) NewDatabaseCollection(databaseName string, name string) *mongo.Collection {
+	return m.client.Database(databaseName).Collection(name, m.collectionOptions)
+}
+
 func (m *MongoDB) Ping() error {
 	if err := m.client.Ping(context.Background(), nil); err != nil {
 		return fmt.Errorf("mongoDB store: error connecting to mongoDB at %s: %s", m.metadata.host, err)
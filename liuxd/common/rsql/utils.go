@@ -1,5 +1,7 @@
 package rsql
 
+import "time"
+
 func GetValue(value Value) interface{} {
 	var v interface{}
 	switch value.(type) {
@@ -37,3 +39,36 @@ func GetValueList(listValue ListValue) []interface{} {
 	}
 	return list
 }
+
+var timeLayouts = []string{
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+//
+// GetTimeValue
+// @Description: 将date、datetime值转换为time.Time，没有时区的值按UTC处理
+// @param value
+// @return time.Time
+// @return bool 是否为时间值
+//
+func GetTimeValue(value Value) (time.Time, bool) {
+	switch v := value.(type) {
+	case DateValue:
+		return ParseTime(v.Value)
+	case DateTimeValue:
+		return ParseTime(v.Value)
+	}
+	return time.Time{}, false
+}
+
+func ParseTime(s string) (time.Time, bool) {
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
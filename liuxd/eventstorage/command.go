@@ -0,0 +1,67 @@
+package eventstorage
+
+import (
+	"errors"
+	"fmt"
+	"github.com/liuxd6825/components-contrib/liuxd/common"
+	"time"
+)
+
+const (
+	// CommandDedupeWindowMetadataKey 命令去重时间窗口，在此时间内重复提交的CommandId返回首次处理的结果，为0时不去重
+	// 去重先查询后写入，并发重复提交只在存储使用事务时可靠
+	CommandDedupeWindowMetadataKey = "commandDedupeWindow"
+
+	DefaultCommandDedupeWindow = 24 * time.Hour
+)
+
+//
+// GetCommandDedupeWindow
+// @Description: 从组件metadata中读取命令去重时间窗口
+// @param metadata
+// @return time.Duration
+// @return error
+//
+func GetCommandDedupeWindow(metadata common.Metadata) (time.Duration, error) {
+	val, ok := metadata.Properties[CommandDedupeWindowMetadataKey]
+	if !ok || val == "" {
+		return DefaultCommandDedupeWindow, nil
+	}
+	window, err := time.ParseDuration(val)
+	if err != nil || window < 0 {
+		return 0, fmt.Errorf("incorrect %s field from metadata", CommandDedupeWindowMetadataKey)
+	}
+	return window, nil
+}
+
+//
+// NewCommandConflictError
+// @Description: CommandId已被其它聚合根处理
+// @param commandId
+// @param aggregateId
+// @return error
+//
+func NewCommandConflictError(commandId string, aggregateId string) error {
+	return errors.New(fmt.Sprintf("commandId \"%s\" is already processed by aggregate \"%s\"", commandId, aggregateId))
+}
+
+func (r *CreateEventRequest) GetCommandId() string {
+	return getCommandId(r.Events)
+}
+
+func (r *ApplyEventsRequest) GetCommandId() string {
+	return getCommandId(r.Events)
+}
+
+// getCommandId 同一请求中的事件来自同一个命令，返回第一个不为空的CommandId
+func getCommandId(events *[]EventDto) string {
+	if events == nil {
+		return ""
+	}
+	for _, event := range *events {
+		if event.CommandId != "" {
+			return event.CommandId
+		}
+	}
+	return ""
+}
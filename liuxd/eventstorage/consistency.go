@@ -0,0 +1,68 @@
+package eventstorage
+
+import (
+	"context"
+	"time"
+)
+
+// ConsistencyIssueType 一致性问题类型
+type ConsistencyIssueType string
+
+const (
+	// IssueSequenceGap 聚合根的事件序号不连续，缺少的序号无法恢复
+	IssueSequenceGap ConsistencyIssueType = "sequenceGap"
+	// IssueDuplicateSequence 同一聚合根有多个相同序号的事件
+	IssueDuplicateSequence ConsistencyIssueType = "duplicateSequence"
+	// IssueSequenceMismatch 聚合根的SequenceNumber与最后一个事件的序号不一致
+	IssueSequenceMismatch ConsistencyIssueType = "sequenceMismatch"
+	// IssueOrphanEvent 事件没有对应的聚合根
+	IssueOrphanEvent ConsistencyIssueType = "orphanEvent"
+	// IssueDeletedAggregateRelation 聚合根已删除，关系未标记删除
+	IssueDeletedAggregateRelation ConsistencyIssueType = "deletedAggregateRelation"
+	// IssueUnpublishedEvent 事件未发送成功
+	IssueUnpublishedEvent ConsistencyIssueType = "unpublishedEvent"
+)
+
+// ConsistencyChecker 支持一致性检查与修复的事件存储
+type ConsistencyChecker interface {
+	CheckConsistency(ctx context.Context, req *CheckConsistencyRequest) (*CheckConsistencyResponse, error)
+}
+
+//
+// CheckConsistencyRequest
+// @Description: 检查租户的事件存储一致性，AggregateType为空时检查所有类型。
+// Repair为true时将聚合根的SequenceNumber校正为最后一个事件的序号，并在聚合根上标记无法恢复的缺失序号。
+// 修复应在没有写入时执行。
+//
+type CheckConsistencyRequest struct {
+	TenantId      string `json:"tenantId"`
+	AggregateType string `json:"aggregateType"`
+	Repair        bool   `json:"repair"`
+	// UnpublishedBefore 只报告此时间之前写入的未发送事件，为空时报告所有未发送事件
+	UnpublishedBefore *time.Time `json:"unpublishedBefore"`
+}
+
+type CheckConsistencyResponse struct {
+	AggregateCount uint64              `json:"aggregateCount"`
+	EventCount     uint64              `json:"eventCount"`
+	RepairedCount  uint64              `json:"repairedCount"`
+	Issues         []*ConsistencyIssue `json:"issues"`
+}
+
+type ConsistencyIssue struct {
+	Type           ConsistencyIssueType `json:"type"`
+	TenantId       string               `json:"tenantId"`
+	AggregateId    string               `json:"aggregateId"`
+	AggregateType  string               `json:"aggregateType"`
+	EventId        string               `json:"eventId,omitempty"`
+	SequenceNumber uint64               `json:"sequenceNumber,omitempty"`
+	Message        string               `json:"message"`
+	Repaired       bool                 `json:"repaired"`
+}
+
+func (r *CheckConsistencyResponse) AddIssue(issue *ConsistencyIssue) {
+	r.Issues = append(r.Issues, issue)
+	if issue.Repaired {
+		r.RepairedCount++
+	}
+}
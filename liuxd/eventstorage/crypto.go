@@ -0,0 +1,350 @@
+package eventstorage
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/liuxd6825/components-contrib/liuxd/common"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	// EncryptFieldsMetadataKey 需要加密的事件数据字段，格式为 "Order:customerName,Order:address.street,User:email"
+	EncryptFieldsMetadataKey = "encryptFields"
+	// EncryptMasterKeyMetadataKey base64编码的AES主密钥，设置时数据密钥加密后保存
+	EncryptMasterKeyMetadataKey = "encryptMasterKey"
+	// DataKeyIdMetadataKey 事件metadata中的数据密钥Id，用于按主体加密，未设置时使用聚合根Id
+	DataKeyIdMetadataKey = "dataKeyId"
+
+	encryptedValuePrefix = "enc:v1:"
+	dataKeySize          = 32
+)
+
+//
+// DataKey
+// @Description: 数据密钥，Key为nil且Erased为true时密钥已销毁
+//
+type DataKey struct {
+	TenantId   string
+	KeyId      string
+	Key        []byte
+	Erased     bool
+	CreateTime time.Time
+	EraseTime  *time.Time
+}
+
+// DataKeyStore 数据密钥存储，与事件分开保存
+type DataKeyStore interface {
+	// GetDataKey 获取数据密钥，不存在时返回nil
+	GetDataKey(ctx context.Context, tenantId string, keyId string) (*DataKey, error)
+	// CreateDataKey 保存数据密钥，密钥已存在时返回已存在的密钥
+	CreateDataKey(ctx context.Context, key *DataKey) (*DataKey, error)
+	// EraseDataKey 销毁数据密钥，保留销毁记录
+	EraseDataKey(ctx context.Context, tenantId string, keyId string) error
+}
+
+//
+// EraseDataKeyRequest
+// @Description: 销毁数据密钥，使用该密钥加密的事件字段不再可读，事件流保持不变。
+// 镜像保存的是解密后的聚合数据，同时删除Id与KeyId相同的聚合根的镜像，以及事件metadata的dataKeyId为KeyId的聚合根的镜像。
+// 销毁前导出的文件中事件与镜像为明文，需由调用方删除。
+//
+type EraseDataKeyRequest struct {
+	TenantId string `json:"tenantId"`
+	KeyId    string `json:"keyId"`
+}
+
+type EraseDataKeyResponse struct {
+}
+
+//
+// FieldEncryptor
+// @Description: 使用每个聚合根(或主体)的数据密钥加密事件数据中配置的字段，密钥销毁后字段解密为nil。
+// 密文绑定租户、聚合根与字段，复制到其它聚合根或字段时无法解密。只解密配置的字段，从encryptFields中移除的字段读取时为密文
+//
+type FieldEncryptor struct {
+	fields    map[string][]string
+	store     DataKeyStore
+	masterKey []byte
+}
+
+//
+// NewFieldEncryptorFromMetadata
+// @Description: 按metadata中的encryptFields、encryptMasterKey创建，没有配置字段时只解密不加密
+// @param metadata
+// @param store
+// @return *FieldEncryptor
+// @return error
+//
+func NewFieldEncryptorFromMetadata(metadata common.Metadata, store DataKeyStore) (*FieldEncryptor, error) {
+	e := &FieldEncryptor{fields: make(map[string][]string), store: store}
+	if val, ok := metadata.Properties[EncryptFieldsMetadataKey]; ok && val != "" {
+		for _, item := range strings.Split(val, ",") {
+			aggregateType, field, ok := strings.Cut(strings.TrimSpace(item), ":")
+			aggregateType, field = strings.TrimSpace(aggregateType), strings.TrimSpace(field)
+			if !ok || aggregateType == "" || field == "" {
+				return nil, fmt.Errorf("incorrect %s field from metadata", EncryptFieldsMetadataKey)
+			}
+			e.fields[aggregateType] = append(e.fields[aggregateType], field)
+		}
+	}
+	if val, ok := metadata.Properties[EncryptMasterKeyMetadataKey]; ok && val != "" {
+		key, err := base64.StdEncoding.DecodeString(val)
+		if err != nil {
+			return nil, fmt.Errorf("incorrect %s field from metadata", EncryptMasterKeyMetadataKey)
+		}
+		if _, err := aes.NewCipher(key); err != nil {
+			return nil, fmt.Errorf("incorrect %s field from metadata", EncryptMasterKeyMetadataKey)
+		}
+		e.masterKey = key
+	}
+	return e, nil
+}
+
+//
+// Encrypt
+// @Description: 返回加密了配置字段的事件数据副本，聚合类型没有配置字段时返回原数据。
+// 配置字段的值以加密前缀开头时返回错误，不接受客户端提交的密文
+// @receiver e
+// @param ctx
+// @param tenantId
+// @param aggregateId
+// @param aggregateType
+// @param data
+// @param metadata 事件metadata，dataKeyId不为空时使用该数据密钥
+// @return map[string]interface{}
+// @return error
+//
+func (e *FieldEncryptor) Encrypt(ctx context.Context, tenantId, aggregateId, aggregateType string, data map[string]interface{}, metadata map[string]string) (map[string]interface{}, error) {
+	if e == nil {
+		return data, nil
+	}
+	fields := e.fields[aggregateType]
+	if len(fields) == 0 || len(data) == 0 {
+		return data, nil
+	}
+	keyId := aggregateId
+	if id := metadata[DataKeyIdMetadataKey]; id != "" {
+		keyId = id
+	}
+	gcm, err := e.getOrCreateCipher(ctx, tenantId, keyId)
+	if err != nil {
+		return nil, err
+	}
+	res := copyData(data)
+	for _, field := range fields {
+		parent, name := lookupParent(res, field)
+		value, ok := parent[name]
+		if !ok || value == nil {
+			continue
+		}
+		if s, ok := value.(string); ok && strings.HasPrefix(s, encryptedValuePrefix) {
+			return nil, errors.New(fmt.Sprintf("field \"%s\" value cannot start with \"%s\"", field, encryptedValuePrefix))
+		}
+		plaintext, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		ciphertext, err := seal(gcm, plaintext, additionalData(tenantId, aggregateId, field))
+		if err != nil {
+			return nil, err
+		}
+		parent[name] = encryptedValuePrefix + base64.RawURLEncoding.EncodeToString([]byte(keyId)) + ":" + base64.StdEncoding.EncodeToString(ciphertext)
+	}
+	return res, nil
+}
+
+//
+// Decrypt
+// @Description: 返回解密了配置字段的事件数据副本，没有加密字段时返回原数据，密钥已销毁的字段为nil。
+// 其它字段即使以加密前缀开头也不解密
+// @receiver e
+// @param ctx
+// @param tenantId
+// @param aggregateId
+// @param aggregateType
+// @param data
+// @return map[string]interface{}
+// @return error
+//
+func (e *FieldEncryptor) Decrypt(ctx context.Context, tenantId, aggregateId, aggregateType string, data map[string]interface{}) (map[string]interface{}, error) {
+	if e == nil || len(data) == 0 {
+		return data, nil
+	}
+	var res map[string]interface{}
+	ciphers := make(map[string]cipher.AEAD)
+	for _, field := range e.fields[aggregateType] {
+		parent, name := lookupParent(data, field)
+		value, ok := parent[name].(string)
+		if !ok || !strings.HasPrefix(value, encryptedValuePrefix) {
+			continue
+		}
+		plaintext, err := e.decryptString(ctx, tenantId, value, additionalData(tenantId, aggregateId, field), ciphers)
+		if err != nil {
+			return nil, err
+		}
+		if res == nil {
+			res = copyData(data)
+		}
+		parent, _ = lookupParent(res, field)
+		parent[name] = plaintext
+	}
+	if res == nil {
+		return data, nil
+	}
+	return res, nil
+}
+
+func (e *FieldEncryptor) decryptString(ctx context.Context, tenantId string, value string, ad []byte, ciphers map[string]cipher.AEAD) (interface{}, error) {
+	encodedKeyId, encoded, ok := strings.Cut(strings.TrimPrefix(value, encryptedValuePrefix), ":")
+	if !ok {
+		return nil, errors.New("encrypted value format is error")
+	}
+	keyIdBytes, err := base64.RawURLEncoding.DecodeString(encodedKeyId)
+	if err != nil {
+		return nil, errors.New("encrypted value format is error")
+	}
+	keyId := string(keyIdBytes)
+	gcm, ok := ciphers[keyId]
+	if !ok {
+		key, err := e.store.GetDataKey(ctx, tenantId, keyId)
+		if err != nil {
+			return nil, err
+		}
+		if key != nil && !key.Erased {
+			if gcm, err = e.newCipher(key); err != nil {
+				return nil, err
+			}
+		}
+		ciphers[keyId] = gcm
+	}
+	if gcm == nil {
+		// 密钥已销毁
+		return nil, nil
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("encrypted value format is error")
+	}
+	plaintext, err := open(gcm, ciphertext, ad)
+	if err != nil {
+		return nil, err
+	}
+	var res interface{}
+	if err := json.Unmarshal(plaintext, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (e *FieldEncryptor) getOrCreateCipher(ctx context.Context, tenantId string, keyId string) (cipher.AEAD, error) {
+	key, err := e.store.GetDataKey(ctx, tenantId, keyId)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		raw := make([]byte, dataKeySize)
+		if _, err := io.ReadFull(rand.Reader, raw); err != nil {
+			return nil, err
+		}
+		if e.masterKey != nil {
+			if raw, err = e.wrap(raw); err != nil {
+				return nil, err
+			}
+		}
+		key, err = e.store.CreateDataKey(ctx, &DataKey{TenantId: tenantId, KeyId: keyId, Key: raw, CreateTime: time.Now()})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if key.Erased {
+		return nil, errors.New(fmt.Sprintf("data key \"%s\" is erased", keyId))
+	}
+	return e.newCipher(key)
+}
+
+func (e *FieldEncryptor) newCipher(key *DataKey) (cipher.AEAD, error) {
+	raw := key.Key
+	if e.masterKey != nil {
+		gcm, err := newGCM(e.masterKey)
+		if err != nil {
+			return nil, err
+		}
+		if raw, err = open(gcm, raw, nil); err != nil {
+			return nil, errors.New(fmt.Sprintf("data key \"%s\" cannot be decrypted by master key", key.KeyId))
+		}
+	}
+	return newGCM(raw)
+}
+
+func (e *FieldEncryptor) wrap(raw []byte) ([]byte, error) {
+	gcm, err := newGCM(e.masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return seal(gcm, raw, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal 加密，结果为nonce与密文，ad为需要认证的附加数据
+func seal(gcm cipher.AEAD, plaintext []byte, ad []byte) ([]byte, error) {
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, ad), nil
+}
+
+func open(gcm cipher.AEAD, ciphertext []byte, ad []byte) ([]byte, error) {
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("encrypted value format is error")
+	}
+	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, ad)
+}
+
+// additionalData 字段密文绑定的租户、聚合根与字段
+func additionalData(tenantId, aggregateId, field string) []byte {
+	ad, _ := json.Marshal([]string{tenantId, aggregateId, field})
+	return ad
+}
+
+// copyData 复制map，嵌套的map也复制
+func copyData(data map[string]interface{}) map[string]interface{} {
+	res := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		if m, ok := v.(map[string]interface{}); ok {
+			v = copyData(m)
+		}
+		res[k] = v
+	}
+	return res
+}
+
+// lookupParent 按"."分隔的字段路径返回字段所在的map与字段名，路径中的map不存在时返回空map
+func lookupParent(data map[string]interface{}, field string) (map[string]interface{}, string) {
+	names := strings.Split(field, ".")
+	current := data
+	for _, name := range names[:len(names)-1] {
+		next, ok := current[name].(map[string]interface{})
+		if !ok {
+			return map[string]interface{}{}, names[len(names)-1]
+		}
+		current = next
+	}
+	return current, names[len(names)-1]
+}
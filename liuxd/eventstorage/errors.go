@@ -0,0 +1,80 @@
+package eventstorage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+//
+// ConcurrencyConflictError
+// @Description: 乐观锁冲突，聚合根当前的SequenceNumber与请求中期望的不一致
+//
+type ConcurrencyConflictError struct {
+	TenantId               string
+	AggregateId            string
+	ExpectedSequenceNumber uint64
+	ActualSequenceNumber   uint64
+}
+
+func NewConcurrencyConflictError(tenantId, aggregateId string, expected, actual uint64) *ConcurrencyConflictError {
+	return &ConcurrencyConflictError{
+		TenantId:               tenantId,
+		AggregateId:            aggregateId,
+		ExpectedSequenceNumber: expected,
+		ActualSequenceNumber:   actual,
+	}
+}
+
+func (e *ConcurrencyConflictError) Error() string {
+	return fmt.Sprintf("aggregate id \"%s\" concurrency conflict, expected sequenceNumber %d, actual sequenceNumber %d", e.AggregateId, e.ExpectedSequenceNumber, e.ActualSequenceNumber)
+}
+
+//
+// IsConcurrencyConflictError
+// @Description: 判断是否为乐观锁冲突错误，调用方可据此重试命令
+// @param err
+// @return bool
+//
+func IsConcurrencyConflictError(err error) bool {
+	var conflict *ConcurrencyConflictError
+	return errors.As(err, &conflict)
+}
+
+//
+// SchemaValidationError
+// @Description: 事件数据不符合注册的JSON Schema，Fields为不符合的字段
+//
+type SchemaValidationError struct {
+	AggregateType string              `json:"aggregateType"`
+	EventId       string              `json:"eventId"`
+	EventType     string              `json:"eventType"`
+	EventVersion  string              `json:"eventVersion"`
+	Fields        []*SchemaFieldError `json:"fields"`
+}
+
+// SchemaFieldError 一个字段的校验错误，Field为用"."分隔的字段路径，根对象为"(root)"
+type SchemaFieldError struct {
+	Field   string `json:"field"`
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+func (e *SchemaValidationError) Error() string {
+	fields := make([]string, 0, len(e.Fields))
+	for _, field := range e.Fields {
+		fields = append(fields, field.Field+": "+field.Message)
+	}
+	return fmt.Sprintf("event id \"%s\" %s %s schema validation failed: %s", e.EventId, e.EventType, e.EventVersion, strings.Join(fields, "; "))
+}
+
+//
+// IsSchemaValidationError
+// @Description: 判断是否为事件数据校验错误
+// @param err
+// @return bool
+//
+func IsSchemaValidationError(err error) bool {
+	var validationErr *SchemaValidationError
+	return errors.As(err, &validationErr)
+}
@@ -0,0 +1,58 @@
+package es_memory
+
+import (
+	"context"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage"
+	"sync"
+	"time"
+)
+
+//
+// dataKeyStore
+// @Description: 内存中的数据密钥存储，使用独立的锁，可在持有EventStorage锁时调用
+//
+type dataKeyStore struct {
+	mu   sync.RWMutex
+	keys map[string]*eventstorage.DataKey
+}
+
+func newDataKeyStore() *dataKeyStore {
+	return &dataKeyStore{keys: make(map[string]*eventstorage.DataKey)}
+}
+
+func (s *dataKeyStore) GetDataKey(ctx context.Context, tenantId string, keyId string) (*eventstorage.DataKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, ok := s.keys[aggregateKey(tenantId, keyId)]
+	if !ok {
+		return nil, nil
+	}
+	res := *key
+	return &res, nil
+}
+
+func (s *dataKeyStore) CreateDataKey(ctx context.Context, key *eventstorage.DataKey) (*eventstorage.DataKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := aggregateKey(key.TenantId, key.KeyId)
+	if old, ok := s.keys[id]; ok {
+		res := *old
+		return &res, nil
+	}
+	res := *key
+	s.keys[id] = &res
+	return key, nil
+}
+
+func (s *dataKeyStore) EraseDataKey(ctx context.Context, tenantId string, keyId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.keys[aggregateKey(tenantId, keyId)] = &eventstorage.DataKey{
+		TenantId:  tenantId,
+		KeyId:     keyId,
+		Erased:    true,
+		EraseTime: &now,
+	}
+	return nil
+}
@@ -0,0 +1,1327 @@
+package es_memory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dapr/kit/logger"
+	"github.com/liuxd6825/components-contrib/liuxd/common"
+	"github.com/liuxd6825/components-contrib/liuxd/common/utils"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/model"
+	"github.com/liuxd6825/components-contrib/pubsub"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+//
+// EventStorage
+// @Description: 内存中的事件存储，用于单元测试。错误信息与es_mongo保持一致。
+//
+type EventStorage struct {
+	mu               sync.RWMutex
+	log              logger.Logger
+	getPubsubAdapter eventstorage.GetPubsubAdapter
+	aggregates       map[string]*model.AggregateEntity
+	events           map[string][]*model.EventEntity
+	eventIds         map[string]bool
+	snapshots        map[string][]*model.SnapshotEntity
+	relations        map[string]map[string]*model.RelationEntity
+	stream           []*model.EventEntity
+	position         uint64
+	upcasters        *eventstorage.UpcasterRegistry
+	schemas          *eventstorage.SchemaRegistry
+	dataKeys         *dataKeyStore
+	encryptor        *eventstorage.FieldEncryptor
+	dedupeWindow     time.Duration
+	snapshotPolicy   *eventstorage.SnapshotPolicy
+}
+
+// NewMemoryEventStorage 创建
+func NewMemoryEventStorage(log logger.Logger) eventstorage.EventStorage {
+	return &EventStorage{
+		log:        log,
+		aggregates: make(map[string]*model.AggregateEntity),
+		events:     make(map[string][]*model.EventEntity),
+		eventIds:   make(map[string]bool),
+		snapshots:  make(map[string][]*model.SnapshotEntity),
+		relations:  make(map[string]map[string]*model.RelationEntity),
+		dataKeys:   newDataKeyStore(),
+	}
+}
+
+func (s *EventStorage) Init(metadata common.Metadata, adapter eventstorage.GetPubsubAdapter) error {
+	s.getPubsubAdapter = adapter
+	upcasters, err := eventstorage.NewUpcasterRegistryFromMetadata(metadata)
+	if err != nil {
+		return err
+	}
+	s.upcasters = upcasters
+	if s.schemas, err = eventstorage.NewSchemaRegistryFromMetadata(metadata); err != nil {
+		return err
+	}
+	if s.dedupeWindow, err = eventstorage.GetCommandDedupeWindow(metadata); err != nil {
+		return err
+	}
+	if s.snapshotPolicy, err = eventstorage.GetSnapshotPolicy(metadata); err != nil {
+		return err
+	}
+	if s.encryptor, err = eventstorage.NewFieldEncryptorFromMetadata(metadata, s.dataKeys); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *EventStorage) Close() error {
+	return nil
+}
+
+func (s *EventStorage) LoadEvent(ctx context.Context, req *eventstorage.LoadEventRequest) (*eventstorage.LoadResponse, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key := aggregateKey(req.TenantId, req.AggregateId)
+	toSequenceNumber := req.ToSequenceNumber
+	if req.ToTime != nil {
+		lastSequenceNumber := uint64(0)
+		for _, event := range s.events[key] {
+			if event.AggregateType == req.AggregateType && !event.TimeStamp.Time().After(*req.ToTime) && event.SequenceNumber > lastSequenceNumber {
+				lastSequenceNumber = event.SequenceNumber
+			}
+		}
+		if lastSequenceNumber == 0 {
+			eventDtos := make([]eventstorage.LoadResponseEventDto, 0)
+			return &eventstorage.LoadResponse{TenantId: req.TenantId, AggregateId: req.AggregateId, AggregateType: req.AggregateType, Events: &eventDtos}, nil
+		}
+		if toSequenceNumber == 0 || lastSequenceNumber < toSequenceNumber {
+			toSequenceNumber = lastSequenceNumber
+		}
+	}
+
+	var snapshot *model.SnapshotEntity
+	for _, item := range s.snapshots[key] {
+		if item.AggregateType != req.AggregateType {
+			continue
+		}
+		if toSequenceNumber > 0 && item.SequenceNumber > toSequenceNumber {
+			continue
+		}
+		if req.AggregateVersion != "" && item.AggregateVersion != req.AggregateVersion {
+			continue
+		}
+		if snapshot == nil || item.SequenceNumber > snapshot.SequenceNumber {
+			snapshot = item
+		}
+	}
+	sequenceNumber := uint64(0)
+	var snapshotDto *eventstorage.LoadResponseSnapshotDto
+	if snapshot != nil {
+		sequenceNumber = snapshot.SequenceNumber
+		snapshotDto = &eventstorage.LoadResponseSnapshotDto{
+			AggregateData:    snapshot.AggregateData,
+			AggregateVersion: snapshot.AggregateVersion,
+			SequenceNumber:   snapshot.SequenceNumber,
+			Metadata:         snapshot.Metadata,
+		}
+	}
+
+	eventDtos := make([]eventstorage.LoadResponseEventDto, 0)
+	for _, event := range s.events[key] {
+		if event.AggregateType != req.AggregateType || event.SequenceNumber <= sequenceNumber {
+			continue
+		}
+		if toSequenceNumber > 0 && event.SequenceNumber > toSequenceNumber {
+			continue
+		}
+		event, err := s.prepareEvent(ctx, event)
+		if err != nil {
+			return nil, err
+		}
+		eventDtos = append(eventDtos, eventstorage.LoadResponseEventDto{
+			EventId:        event.EventId,
+			EventData:      event.EventData,
+			EventType:      event.EventType,
+			EventVersion:   event.EventVersion,
+			SequenceNumber: event.SequenceNumber,
+		})
+	}
+	return &eventstorage.LoadResponse{
+		TenantId:      req.TenantId,
+		AggregateId:   req.AggregateId,
+		AggregateType: req.AggregateType,
+		Snapshot:      snapshotDto,
+		Events:        &eventDtos,
+	}, nil
+}
+
+func (s *EventStorage) CreateEvent(ctx context.Context, req *eventstorage.CreateEventRequest) (*eventstorage.CreateEventResponse, error) {
+	if err := s.schemas.ValidateEvents(req.AggregateType, req.Events); err != nil {
+		return nil, err
+	}
+	events, err := func() ([]*model.EventEntity, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		commandEvents, err := s.findCommandEvents(req.TenantId, req.AggregateId, req.GetCommandId())
+		if err != nil || len(commandEvents) > 0 {
+			return nil, err
+		}
+		key := aggregateKey(req.TenantId, req.AggregateId)
+		if _, ok := s.aggregates[key]; ok {
+			return nil, errors.New(fmt.Sprintf("aggregateId \"%s\" already exists", req.AggregateId))
+		}
+		events, err := s.newEvents(ctx, req.TenantId, req.AggregateId, req.AggregateType, req.Events, 1)
+		if err != nil {
+			return nil, err
+		}
+		s.aggregates[key] = &model.AggregateEntity{
+			Id:             req.AggregateId,
+			TenantId:       req.TenantId,
+			AggregateId:    req.AggregateId,
+			AggregateType:  req.AggregateType,
+			SequenceNumber: uint64(len(events)),
+		}
+		s.saveEvents(events)
+		return events, nil
+	}()
+	if err != nil {
+		return nil, err
+	}
+	s.publishEvents(ctx, events)
+	return &eventstorage.CreateEventResponse{}, nil
+}
+
+func (s *EventStorage) DeleteEvent(ctx context.Context, req *eventstorage.DeleteEventRequest) (*eventstorage.DeleteEventResponse, error) {
+	if err := s.schemas.Validate(req.AggregateType, req.Event); err != nil {
+		return nil, err
+	}
+	events, err := func() ([]*model.EventEntity, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		agg, ok := s.aggregates[aggregateKey(req.TenantId, req.AggregateId)]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("aggregate id \"%s\" not found", req.AggregateId))
+		}
+		if agg.Deleted {
+			return nil, errors.New(fmt.Sprintf("aggregate id \"%s\" is deleted", req.AggregateId))
+		}
+		if err := checkSequenceNumber(agg, req.ExpectedSequenceNumber); err != nil {
+			return nil, err
+		}
+		if req.Event == nil {
+			return nil, errors.New("events is nil")
+		}
+		events, err := s.newEvents(ctx, req.TenantId, req.AggregateId, req.AggregateType, &[]eventstorage.EventDto{*req.Event}, agg.SequenceNumber+1)
+		if err != nil {
+			return nil, err
+		}
+		agg.SequenceNumber++
+		agg.Deleted = true
+		s.saveEvents(events)
+		s.setRelationDeleted(req.TenantId, req.AggregateId, req.AggregateType, true)
+		return events, nil
+	}()
+	if err != nil {
+		return nil, err
+	}
+	s.publishEvents(ctx, events)
+	return &eventstorage.DeleteEventResponse{}, nil
+}
+
+func (s *EventStorage) ApplyEvent(ctx context.Context, req *eventstorage.ApplyEventsRequest) (*eventstorage.ApplyEventsResponse, error) {
+	if req == nil {
+		return nil, errors.New("request is nil")
+	}
+	if req.Events == nil || len(*req.Events) == 0 {
+		return nil, errors.New("request.events size 0 ")
+	}
+	if err := s.schemas.ValidateEvents(req.AggregateType, req.Events); err != nil {
+		return nil, err
+	}
+	var sequenceNumber uint64
+	events, err := func() ([]*model.EventEntity, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		commandEvents, err := s.findCommandEvents(req.TenantId, req.AggregateId, req.GetCommandId())
+		if err != nil {
+			return nil, err
+		}
+		if len(commandEvents) > 0 {
+			sequenceNumber = commandEvents[len(commandEvents)-1].SequenceNumber
+			return nil, nil
+		}
+		agg, ok := s.aggregates[aggregateKey(req.TenantId, req.AggregateId)]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("aggregate idValue %s does not exist", req.AggregateId))
+		}
+		if err := checkSequenceNumber(agg, req.ExpectedSequenceNumber); err != nil {
+			return nil, err
+		}
+		if agg.Deleted {
+			return nil, errors.New(fmt.Sprintf("aggregate id \"%s\" is already deleted.", req.AggregateId))
+		}
+		events, err := s.newEvents(ctx, req.TenantId, req.AggregateId, req.AggregateType, req.Events, agg.SequenceNumber+1)
+		if err != nil {
+			return nil, err
+		}
+		agg.SequenceNumber += uint64(len(events))
+		sequenceNumber = agg.SequenceNumber
+		s.saveEvents(events)
+		return events, nil
+	}()
+	if err != nil {
+		return nil, err
+	}
+	s.publishEvents(ctx, events)
+	s.mu.RLock()
+	snapshotRequired := s.isSnapshotRequired(req.TenantId, req.AggregateId, req.AggregateType, req.AggregateVersion, sequenceNumber)
+	s.mu.RUnlock()
+	return &eventstorage.ApplyEventsResponse{SequenceNumber: sequenceNumber, SnapshotRequired: snapshotRequired}, nil
+}
+
+//
+// isSnapshotRequired
+// @Description: 与es_mongo一致，距上一个镜像的事件数量是否达到镜像策略。调用方需持有锁
+// @receiver s
+// @param tenantId
+// @param aggregateId
+// @param aggregateType
+// @param aggregateVersion 聚合根当前版本，不为空时忽略其它版本的镜像
+// @param sequenceNumber 聚合根当前序号
+// @return bool
+//
+func (s *EventStorage) isSnapshotRequired(tenantId, aggregateId, aggregateType, aggregateVersion string, sequenceNumber uint64) bool {
+	eventCount := s.snapshotPolicy.GetEventCount(aggregateType)
+	if eventCount == 0 {
+		return false
+	}
+	snapshotSequenceNumber := uint64(0)
+	for _, item := range s.snapshots[aggregateKey(tenantId, aggregateId)] {
+		if aggregateVersion != "" && item.AggregateVersion != aggregateVersion {
+			continue
+		}
+		if item.AggregateType == aggregateType && item.SequenceNumber > snapshotSequenceNumber {
+			snapshotSequenceNumber = item.SequenceNumber
+		}
+	}
+	return sequenceNumber >= snapshotSequenceNumber+eventCount
+}
+
+func (s *EventStorage) SaveSnapshot(ctx context.Context, req *eventstorage.SaveSnapshotRequest) (*eventstorage.SaveSnapshotResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshot := &model.SnapshotEntity{
+		Id:               model.NewObjectID(),
+		TenantId:         req.TenantId,
+		AggregateId:      req.AggregateId,
+		AggregateType:    req.AggregateType,
+		SequenceNumber:   req.SequenceNumber,
+		Metadata:         req.Metadata,
+		AggregateData:    req.AggregateData,
+		AggregateVersion: req.AggregateVersion,
+		TimeStamp:        utils.NewMongoNow(),
+	}
+	key := aggregateKey(req.TenantId, req.AggregateId)
+	s.snapshots[key] = append(s.snapshots[key], snapshot)
+	if s.snapshotPolicy != nil && s.snapshotPolicy.RetainCount > 0 {
+		s.deleteOlderSnapshots(key, req.AggregateType, s.snapshotPolicy.RetainCount)
+	}
+	return &eventstorage.SaveSnapshotResponse{}, nil
+}
+
+// deleteOlderSnapshots 与es_mongo一致，只保留聚合类型序号最大的retainCount个镜像。调用方需持有锁
+func (s *EventStorage) deleteOlderSnapshots(key string, aggregateType string, retainCount int64) {
+	var sequenceNumbers []uint64
+	for _, item := range s.snapshots[key] {
+		if item.AggregateType == aggregateType {
+			sequenceNumbers = append(sequenceNumbers, item.SequenceNumber)
+		}
+	}
+	if int64(len(sequenceNumbers)) <= retainCount {
+		return
+	}
+	sort.Slice(sequenceNumbers, func(i, j int) bool { return sequenceNumbers[i] > sequenceNumbers[j] })
+	minSequenceNumber := sequenceNumbers[retainCount-1]
+	snapshots := make([]*model.SnapshotEntity, 0, len(s.snapshots[key]))
+	for _, item := range s.snapshots[key] {
+		if item.AggregateType != aggregateType || item.SequenceNumber >= minSequenceNumber {
+			snapshots = append(snapshots, item)
+		}
+	}
+	s.snapshots[key] = snapshots
+}
+
+func (s *EventStorage) GetRelations(ctx context.Context, req *eventstorage.GetRelationsRequest) (*eventstorage.GetRelationsResponse, error) {
+	filter, err := newRsqlFilter(req.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	var docs []document
+	for _, relation := range s.relations[utils.AsMongoName(req.AggregateType)] {
+		if relation.TenantId != req.TenantId || (relation.IsDeleted && !req.IncludeDeleted) {
+			continue
+		}
+		if doc := newRelationDocument(relation); filter.Match(doc) {
+			docs = append(docs, doc)
+		}
+	}
+	s.mu.RUnlock()
+
+	if err := sortDocuments(docs, req.Sort, fieldName); err != nil {
+		return nil, err
+	}
+	totalRows := uint64(len(docs))
+	if req.PageSize > 0 {
+		start := req.PageSize * req.PageNum
+		end := start + req.PageSize
+		if start > totalRows {
+			start = totalRows
+		}
+		if end > totalRows {
+			end = totalRows
+		}
+		docs = docs[start:end]
+	}
+	relations := make([]*eventstorage.Relation, 0, len(docs))
+	for _, doc := range docs {
+		relations = append(relations, doc.relation())
+	}
+	findRes := eventstorage.NewFindPagingResult[*eventstorage.Relation](&relations, totalRows, req, nil)
+	var data []*eventstorage.Relation
+	if len(relations) > 0 {
+		data = relations
+	}
+	return &eventstorage.GetRelationsResponse{
+		Data:       data,
+		TotalRows:  findRes.TotalRows,
+		TotalPages: findRes.TotalPages,
+		PageSize:   findRes.PageSize,
+		PageNum:    findRes.PageNum,
+		Filter:     findRes.Filter,
+		Sort:       findRes.Sort,
+	}, nil
+}
+
+//
+// FindRelationReferences
+// @Description: 与es_mongo一致，按表名、Id顺序跨关系表反向查询引用目标Id的关系，多值关系包含目标Id即匹配
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.FindRelationReferencesResponse
+// @return error
+//
+func (s *EventStorage) FindRelationReferences(ctx context.Context, req *eventstorage.FindRelationReferencesRequest) (*eventstorage.FindRelationReferencesResponse, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	name := utils.AsMongoName(req.RelationName)
+
+	s.mu.RLock()
+	aggregateTypes := req.AggregateTypes
+	if len(aggregateTypes) == 0 {
+		for _, agg := range s.aggregates {
+			if agg.TenantId == req.TenantId {
+				aggregateTypes = append(aggregateTypes, agg.AggregateType)
+			}
+		}
+	}
+	var docs []document
+	for _, tableName := range eventstorage.NewRelationTableNames(aggregateTypes) {
+		var tableDocs []document
+		for _, relation := range s.relations[tableName] {
+			if relation.TenantId != req.TenantId || (relation.IsDeleted && !req.IncludeDeleted) {
+				continue
+			}
+			if doc := newRelationDocument(relation); equals(doc[name], req.TargetId) {
+				tableDocs = append(tableDocs, doc)
+			}
+		}
+		sort.Slice(tableDocs, func(i, j int) bool {
+			return tableDocs[i]["_id"].(string) < tableDocs[j]["_id"].(string)
+		})
+		docs = append(docs, tableDocs...)
+	}
+	s.mu.RUnlock()
+
+	totalRows := uint64(len(docs))
+	if req.PageSize > 0 {
+		start := req.PageSize * req.PageNum
+		end := start + req.PageSize
+		if start > totalRows {
+			start = totalRows
+		}
+		if end > totalRows {
+			end = totalRows
+		}
+		docs = docs[start:end]
+	}
+	relations := make([]*eventstorage.Relation, 0, len(docs))
+	for _, doc := range docs {
+		relations = append(relations, doc.relation())
+	}
+	return eventstorage.NewFindRelationReferencesResponse(relations, totalRows, req), nil
+}
+
+func (s *EventStorage) ReadEventStream(ctx context.Context, req *eventstorage.ReadEventStreamRequest) (*eventstorage.ReadEventStreamResponse, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	limit := req.GetLimit()
+	res := &eventstorage.ReadEventStreamResponse{
+		Events:       make([]*eventstorage.StreamEventDto, 0),
+		LastPosition: req.FromPosition,
+	}
+	// 导入覆盖时会移除事件，Position不再与下标对应
+	start := sort.Search(len(s.stream), func(i int) bool {
+		return s.stream[i].Position > req.FromPosition
+	})
+	for _, event := range s.stream[start:] {
+		if req.TenantId != "" && event.TenantId != req.TenantId {
+			continue
+		}
+		if req.AggregateType != "" && event.AggregateType != req.AggregateType {
+			continue
+		}
+		if req.EventType != "" && event.EventType != req.EventType {
+			continue
+		}
+		if uint64(len(res.Events)) == limit {
+			res.HasMore = true
+			break
+		}
+		event, err := s.prepareEvent(ctx, event)
+		if err != nil {
+			return nil, err
+		}
+		res.Events = append(res.Events, &eventstorage.StreamEventDto{
+			Position:       event.Position,
+			TenantId:       event.TenantId,
+			AggregateId:    event.AggregateId,
+			AggregateType:  event.AggregateType,
+			CommandId:      event.CommandId,
+			EventId:        event.EventId,
+			EventData:      event.EventData,
+			EventType:      event.EventType,
+			EventVersion:   event.EventVersion,
+			SequenceNumber: event.SequenceNumber,
+			Metadata:       event.Metadata,
+			TimeStamp:      event.TimeStamp.Time(),
+		})
+		res.LastPosition = event.Position
+	}
+	return res, nil
+}
+
+func (s *EventStorage) ReplayEvents(ctx context.Context, req *eventstorage.ReplayEventsRequest) (*eventstorage.ReplayEventsResponse, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	if req.ReplayId == "" {
+		req.ReplayId = model.NewObjectID()
+	}
+	limit := req.GetLimit()
+	res := &eventstorage.ReplayEventsResponse{
+		ReplayId:     req.ReplayId,
+		LastPosition: req.FromPosition,
+	}
+
+	s.mu.RLock()
+	var events []*model.EventEntity
+	for _, event := range s.stream {
+		if !isReplayEvent(req, event) {
+			continue
+		}
+		res.TotalCount++
+		if event.Position <= req.FromPosition {
+			res.ProcessedCount++
+		} else {
+			events = append(events, event)
+		}
+	}
+	s.mu.RUnlock()
+
+	for i, event := range events {
+		if uint64(i) == limit {
+			res.HasMore = true
+			break
+		}
+		event, err := s.prepareEvent(ctx, event)
+		if err != nil {
+			return res, err
+		}
+		pubData, err := req.NewPublishRequest(newEvent(event), event.Position)
+		if err == nil {
+			err = s.getPubsubAdapter().Publish(pubData)
+		}
+		if err != nil {
+			res.HasMore = true
+			return res, newError("publishMessage() failed to replay event.", err)
+		}
+		res.PublishedCount++
+		res.ProcessedCount++
+		res.LastPosition = event.Position
+	}
+	return res, nil
+}
+
+func isReplayEvent(req *eventstorage.ReplayEventsRequest, event *model.EventEntity) bool {
+	if event.TenantId != req.TenantId || event.AggregateType != req.AggregateType {
+		return false
+	}
+	timeStamp := event.TimeStamp.Time()
+	if req.FromTime != nil && timeStamp.Before(*req.FromTime) {
+		return false
+	}
+	if req.ToTime != nil && timeStamp.After(*req.ToTime) {
+		return false
+	}
+	if req.FromSequenceNumber > 0 && event.SequenceNumber < req.FromSequenceNumber {
+		return false
+	}
+	if req.ToSequenceNumber > 0 && event.SequenceNumber > req.ToSequenceNumber {
+		return false
+	}
+	return true
+}
+
+func (s *EventStorage) GetCausalityChain(ctx context.Context, req *eventstorage.GetCausalityChainRequest) (*eventstorage.GetCausalityChainResponse, error) {
+	if req.TenantId == "" {
+		return nil, errors.New("tenantId cannot be empty")
+	}
+	if req.CorrelationId == "" {
+		return nil, errors.New("correlationId cannot be empty")
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	dtos := make([]*eventstorage.CausalityEventDto, 0)
+	for _, event := range s.stream {
+		if event.TenantId != req.TenantId || event.CorrelationId != req.CorrelationId {
+			continue
+		}
+		dtos = append(dtos, event.NewCausalityEventDto())
+		if len(dtos) > eventstorage.MaxCausalityChainEvents {
+			break
+		}
+	}
+	return eventstorage.NewGetCausalityChainResponse(req.CorrelationId, dtos), nil
+}
+
+func (s *EventStorage) FindEvents(ctx context.Context, req *eventstorage.FindEventsRequest) (*eventstorage.FindEventsResponse, error) {
+	if req.TenantId == "" {
+		return nil, errors.New("tenantId cannot be empty")
+	}
+	filter, err := newRsqlFilterWith(req.Filter, eventFieldName)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	var docs []document
+	events := make(map[string]*model.EventEntity)
+	for _, event := range s.stream {
+		if event.TenantId != req.TenantId {
+			continue
+		}
+		if doc := newEventDocument(event); filter.Match(doc) {
+			docs = append(docs, doc)
+			events[event.Id] = event
+		}
+	}
+	s.mu.RUnlock()
+
+	if err := sortDocuments(docs, req.Sort, eventFieldName); err != nil {
+		return nil, err
+	}
+	totalRows := uint64(len(docs))
+	if req.PageSize > 0 {
+		start := req.PageSize * req.PageNum
+		end := start + req.PageSize
+		if start > totalRows {
+			start = totalRows
+		}
+		if end > totalRows {
+			end = totalRows
+		}
+		docs = docs[start:end]
+	}
+	var data []*eventstorage.FindEventDto
+	for _, doc := range docs {
+		event, err := s.prepareEvent(ctx, events[doc["_id"].(string)])
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, event.NewFindEventDto())
+	}
+	return eventstorage.NewFindEventsResponse(data, totalRows, req), nil
+}
+
+func (s *EventStorage) FindAggregates(ctx context.Context, req *eventstorage.FindAggregatesRequest) (*eventstorage.FindAggregatesResponse, error) {
+	if req.TenantId == "" {
+		return nil, errors.New("tenantId cannot be empty")
+	}
+	docs, err := s.findAggregates(req.TenantId, req.AggregateType, req.Filter)
+	if err != nil {
+		return nil, err
+	}
+	if err := sortDocuments(docs, req.Sort, fieldName); err != nil {
+		return nil, err
+	}
+	totalRows := uint64(len(docs))
+	if req.PageSize > 0 {
+		start := req.PageSize * req.PageNum
+		end := start + req.PageSize
+		if start > totalRows {
+			start = totalRows
+		}
+		if end > totalRows {
+			end = totalRows
+		}
+		docs = docs[start:end]
+	}
+	var data []*eventstorage.AggregateDto
+	for _, doc := range docs {
+		data = append(data, doc.aggregate())
+	}
+	return eventstorage.NewFindAggregatesResponse(data, totalRows, req), nil
+}
+
+func (s *EventStorage) CountAggregates(ctx context.Context, req *eventstorage.CountAggregatesRequest) (*eventstorage.CountAggregatesResponse, error) {
+	if req.TenantId == "" {
+		return nil, errors.New("tenantId cannot be empty")
+	}
+	docs, err := s.findAggregates(req.TenantId, req.AggregateType, req.Filter)
+	if err != nil {
+		return nil, err
+	}
+	return &eventstorage.CountAggregatesResponse{Count: uint64(len(docs))}, nil
+}
+
+func (s *EventStorage) ExistAggregate(ctx context.Context, req *eventstorage.ExistAggregateRequest) (*eventstorage.ExistAggregateResponse, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	agg, ok := s.aggregates[aggregateKey(req.TenantId, req.AggregateId)]
+	if !ok {
+		return &eventstorage.ExistAggregateResponse{}, nil
+	}
+	return &eventstorage.ExistAggregateResponse{IsExist: true, IsDeleted: agg.Deleted}, nil
+}
+
+func (s *EventStorage) RestoreAggregate(ctx context.Context, req *eventstorage.RestoreAggregateRequest) (*eventstorage.RestoreAggregateResponse, error) {
+	if err := s.schemas.Validate(req.AggregateType, req.Event); err != nil {
+		return nil, err
+	}
+	events, err := func() ([]*model.EventEntity, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		agg, ok := s.aggregates[aggregateKey(req.TenantId, req.AggregateId)]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("aggregate id \"%s\" not found", req.AggregateId))
+		}
+		if !agg.Deleted {
+			return nil, errors.New(fmt.Sprintf("aggregate id \"%s\" is not deleted", req.AggregateId))
+		}
+		if err := checkSequenceNumber(agg, req.ExpectedSequenceNumber); err != nil {
+			return nil, err
+		}
+		if req.Event == nil {
+			return nil, errors.New("events is nil")
+		}
+		events, err := s.newEvents(ctx, req.TenantId, req.AggregateId, req.AggregateType, &[]eventstorage.EventDto{*req.Event}, agg.SequenceNumber+1)
+		if err != nil {
+			return nil, err
+		}
+		agg.SequenceNumber++
+		agg.Deleted = false
+		s.saveEvents(events)
+		s.setRelationDeleted(req.TenantId, req.AggregateId, req.AggregateType, false)
+		return events, nil
+	}()
+	if err != nil {
+		return nil, err
+	}
+	s.publishEvents(ctx, events)
+	return &eventstorage.RestoreAggregateResponse{SequenceNumber: events[0].SequenceNumber}, nil
+}
+
+func (s *EventStorage) ExportEvents(ctx context.Context, req *eventstorage.ExportEventsRequest) (*eventstorage.ExportEventsResponse, error) {
+	w, err := eventstorage.NewExportWriter(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.exportEvents(ctx, w, req.TenantId, req.AggregateType); err != nil {
+		_ = w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return w.Response(), nil
+}
+
+// exportEvents 事件数据解密后导出，不转换版本
+func (s *EventStorage) exportEvents(ctx context.Context, w *eventstorage.ExportWriter, tenantId string, aggregateType string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var aggs []*model.AggregateEntity
+	for _, agg := range s.aggregates {
+		if agg.TenantId == tenantId && (aggregateType == "" || agg.AggregateType == aggregateType) {
+			aggs = append(aggs, agg)
+		}
+	}
+	sort.Slice(aggs, func(i, j int) bool {
+		return aggs[i].AggregateId < aggs[j].AggregateId
+	})
+	for _, agg := range aggs {
+		key := aggregateKey(agg.TenantId, agg.AggregateId)
+		relation := s.relations[utils.AsMongoName(agg.AggregateType)][key]
+		events := make([]*model.EventEntity, 0, len(s.events[key]))
+		for _, event := range s.events[key] {
+			event, err := event.Decrypt(ctx, s.encryptor)
+			if err != nil {
+				return newError("decryptEvents() error.", err)
+			}
+			events = append(events, event)
+		}
+		if err := w.Write(model.NewExportAggregate(agg, events, s.snapshots[key], relation)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *EventStorage) ImportEvents(ctx context.Context, req *eventstorage.ImportEventsRequest) (*eventstorage.ImportEventsResponse, error) {
+	r, err := eventstorage.NewExportReader(req)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	for {
+		agg, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return r.Response(), err
+		}
+		entities := model.NewImportEntities(agg)
+		if err := entities.Encrypt(ctx, s.encryptor); err != nil {
+			r.Failed(agg)
+			return r.Response(), newError("encryptEvents() error.", err)
+		}
+		imported, err := s.importAggregate(entities, req.Overwrite, req.SkipExisting)
+		if err != nil {
+			r.Failed(agg)
+			return r.Response(), err
+		}
+		if !imported {
+			r.Skipped(agg)
+			continue
+		}
+		r.Imported(agg)
+	}
+	return r.Response(), nil
+}
+
+//
+// importAggregate
+// @Description: 导入一个聚合根，校验失败时不修改任何数据
+// @receiver s
+// @param entities
+// @param overwrite 聚合根已存在时是否删除后导入
+// @param skipExisting 聚合根已存在时是否跳过
+// @return bool 聚合根已存在并跳过时为false
+// @return error
+//
+func (s *EventStorage) importAggregate(entities *model.ImportEntities, overwrite bool, skipExisting bool) (bool, error) {
+	if err := entities.Validate(); err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	agg := entities.Aggregate
+	key := aggregateKey(agg.TenantId, agg.AggregateId)
+	old, exists := s.aggregates[key]
+	if exists && skipExisting {
+		return false, nil
+	}
+	if exists && !overwrite {
+		return false, errors.New(fmt.Sprintf("aggregate id \"%s\" already exists", agg.AggregateId))
+	}
+	oldIds := make(map[string]bool)
+	for _, event := range s.events[key] {
+		oldIds[event.EventId] = true
+	}
+	for _, event := range entities.Events {
+		if s.eventIds[event.EventId] && !oldIds[event.EventId] {
+			return false, errors.New(fmt.Sprintf("duplicate key event id \"%s\"", event.EventId))
+		}
+	}
+	if exists {
+		s.removeAggregate(old)
+	}
+
+	s.aggregates[key] = agg
+	for _, event := range entities.Events {
+		event.Position = s.nextPosition()
+		s.stream = append(s.stream, event)
+		s.events[key] = append(s.events[key], event)
+		s.eventIds[event.EventId] = true
+	}
+	s.snapshots[key] = entities.Snapshots
+	for _, relation := range entities.Relations {
+		table, ok := s.relations[relation.TableName]
+		if !ok {
+			table = make(map[string]*model.RelationEntity)
+			s.relations[relation.TableName] = table
+		}
+		table[aggregateKey(relation.TenantId, relation.Id)] = relation
+	}
+	return true, nil
+}
+
+// removeAggregate 删除聚合根及其事件、镜像与关系，调用方需持有锁
+func (s *EventStorage) removeAggregate(agg *model.AggregateEntity) {
+	key := aggregateKey(agg.TenantId, agg.AggregateId)
+	stream := make([]*model.EventEntity, 0, len(s.stream))
+	for _, event := range s.stream {
+		if event.TenantId == agg.TenantId && event.AggregateId == agg.AggregateId {
+			delete(s.eventIds, event.EventId)
+			continue
+		}
+		stream = append(stream, event)
+	}
+	s.stream = stream
+	delete(s.aggregates, key)
+	delete(s.events, key)
+	delete(s.snapshots, key)
+	delete(s.relations[utils.AsMongoName(agg.AggregateType)], key)
+}
+
+// nextPosition 返回下一个全局位置，与es_mongo的位置计数器一致，删除的事件位置不会重用。
+// 每次写入（包括导入）都分配位置，不存在位置为0的事件。调用方需持有锁
+func (s *EventStorage) nextPosition() uint64 {
+	s.position++
+	return s.position
+}
+
+func (s *EventStorage) EraseDataKey(ctx context.Context, req *eventstorage.EraseDataKeyRequest) (*eventstorage.EraseDataKeyResponse, error) {
+	if req.TenantId == "" || req.KeyId == "" {
+		return nil, errors.New("tenantId and keyId cannot be empty")
+	}
+	if err := s.dataKeys.EraseDataKey(ctx, req.TenantId, req.KeyId); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.snapshots, aggregateKey(req.TenantId, req.KeyId))
+	// 按主体加密的其它聚合根的镜像
+	for _, event := range s.stream {
+		if event.TenantId == req.TenantId && event.Metadata[eventstorage.DataKeyIdMetadataKey] == req.KeyId {
+			delete(s.snapshots, aggregateKey(event.TenantId, event.AggregateId))
+		}
+	}
+	return &eventstorage.EraseDataKeyResponse{}, nil
+}
+
+//
+// prepareEvent
+// @Description: 解密并转换到最新版本
+// @receiver s
+// @param ctx
+// @param event
+// @return *model.EventEntity
+// @return error
+//
+func (s *EventStorage) prepareEvent(ctx context.Context, event *model.EventEntity) (*model.EventEntity, error) {
+	event, err := event.Decrypt(ctx, s.encryptor)
+	if err != nil {
+		return nil, newError("decryptEvents() error.", err)
+	}
+	if event, err = event.Upcast(s.upcasters); err != nil {
+		return nil, newError("upcastEvents() error.", err)
+	}
+	return event, nil
+}
+
+// findAggregates 返回满足条件的聚合根，aggregateType为空时查询所有类型
+func (s *EventStorage) findAggregates(tenantId string, aggregateType string, filterText string) ([]document, error) {
+	filter, err := newRsqlFilter(filterText)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var docs []document
+	for _, agg := range s.aggregates {
+		if agg.TenantId != tenantId || (aggregateType != "" && agg.AggregateType != aggregateType) {
+			continue
+		}
+		if doc := newAggregateDocument(agg); filter.Match(doc) {
+			docs = append(docs, doc)
+		}
+	}
+	// map的遍历顺序不固定，未指定排序时按聚合根Id排序
+	if err := sortDocuments(docs, "id", fieldName); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+//
+// newEvents
+// @Description: 创建并校验事件，校验失败时不修改任何数据
+// @receiver s
+// @return []*model.EventEntity
+// @return error
+//
+func (s *EventStorage) newEvents(ctx context.Context, tenantId string, aggregateId string, aggregateType string, events *[]eventstorage.EventDto, startSequenceNumber uint64) ([]*model.EventEntity, error) {
+	if events == nil {
+		return nil, errors.New("events is nil")
+	}
+	if len(*events) == 0 {
+		return nil, errors.New("request.saveEvents size 0 ")
+	}
+	ids := make(map[string]bool)
+	var list []*model.EventEntity
+	for i, dto := range *events {
+		event := &model.EventEntity{
+			Id:             dto.EventId,
+			TenantId:       tenantId,
+			CommandId:      dto.CommandId,
+			EventId:        dto.EventId,
+			EventTime:      model.NewEventTime(dto.EventTime),
+			CausationId:    dto.GetCausationId(),
+			CorrelationId:  dto.GetCorrelationId(),
+			Metadata:       dto.Metadata,
+			EventData:      dto.EventData,
+			EventVersion:   dto.EventVersion,
+			EventType:      dto.EventType,
+			AggregateId:    aggregateId,
+			AggregateType:  aggregateType,
+			PublishName:    dto.PubsubName,
+			Topic:          dto.Topic,
+			PublishStatus:  eventstorage.PublishStatusWait,
+			SequenceNumber: startSequenceNumber + uint64(i),
+			Relations:      dto.Relations,
+			RelationLists:  dto.RelationLists,
+			TimeStamp:      utils.NewMongoNow(),
+		}
+		if err := event.Validate(); err != nil {
+			return nil, newError("createEvent() error saving event.", err)
+		}
+		eventData, err := s.encryptor.Encrypt(ctx, tenantId, aggregateId, aggregateType, event.EventData, event.Metadata)
+		if err != nil {
+			return nil, newError("createEvent() error encrypting event.", err)
+		}
+		event.EventData = eventData
+		if s.eventIds[event.EventId] || ids[event.EventId] {
+			return nil, newError("createEvent() error saving event.", errors.New(fmt.Sprintf("duplicate key event id \"%s\"", event.EventId)))
+		}
+		ids[event.EventId] = true
+		list = append(list, event)
+	}
+	return list, nil
+}
+
+func (s *EventStorage) saveEvents(events []*model.EventEntity) {
+	for _, event := range events {
+		event.Position = s.nextPosition()
+		s.stream = append(s.stream, event)
+		key := aggregateKey(event.TenantId, event.AggregateId)
+		s.events[key] = append(s.events[key], event)
+		s.eventIds[event.EventId] = true
+		if len(event.Relations) > 0 || len(event.RelationLists) > 0 {
+			s.saveRelation(model.NewRelationEntity(event.TenantId, event.AggregateId, event.AggregateType, event.Relations, event.RelationLists))
+		}
+	}
+}
+
+//
+// saveRelation
+// @Description: 与es_mongo的$set更新一致，已有的关系字段保留，新的关系字段覆盖
+// @receiver s
+// @param relation
+//
+func (s *EventStorage) saveRelation(relation *model.RelationEntity) {
+	table, ok := s.relations[relation.TableName]
+	if !ok {
+		table = make(map[string]*model.RelationEntity)
+		s.relations[relation.TableName] = table
+	}
+	key := aggregateKey(relation.TenantId, relation.Id)
+	if old, ok := table[key]; ok {
+		for k, v := range relation.Items {
+			old.Items[k] = v
+		}
+		for k, v := range relation.Lists {
+			old.AddList(k, v)
+		}
+		old.IsDeleted = relation.IsDeleted
+		return
+	}
+	table[key] = relation
+}
+
+//
+// setRelationDeleted
+// @Description: 与es_mongo的flag删除模式一致，删除聚合根时标记关系已删除，恢复时取消标记
+// @receiver s
+// @param tenantId
+// @param aggregateId
+// @param aggregateType
+// @param isDeleted
+//
+func (s *EventStorage) setRelationDeleted(tenantId string, aggregateId string, aggregateType string, isDeleted bool) {
+	if relation, ok := s.relations[utils.AsMongoName(aggregateType)][aggregateKey(tenantId, aggregateId)]; ok {
+		relation.IsDeleted = isDeleted
+	}
+}
+
+//
+// publishEvents
+// @Description: 写入后按顺序发送事件，与es_mongo一致，发送失败不影响写入结果：记录失败次数与错误，事件保持PublishStatusWait，不再发送后续事件。
+// 聚合根之前的事件仍在等待发送时不发送。内存存储没有补发任务与死信，等待发送的事件不会自动重试
+// @receiver s
+// @param ctx
+// @param events 同一聚合根的事件
+//
+func (s *EventStorage) publishEvents(ctx context.Context, events []*model.EventEntity) {
+	if len(events) == 0 {
+		return
+	}
+	s.mu.RLock()
+	first := s.findFirstNotPublished(events[0].TenantId, events[0].AggregateId)
+	s.mu.RUnlock()
+	if first != nil && first != events[0] {
+		return
+	}
+	for _, event := range events {
+		if err := s.publishMessage(ctx, event); err != nil {
+			if s.log != nil {
+				s.log.Errorf("error publishing event %s, it stays unpublished: %s", event.EventId, err.Error())
+			}
+			s.mu.Lock()
+			event.PublishAttempts++
+			event.PublishError = err.Error()
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Lock()
+		event.PublishStatus = eventstorage.PublishStatusSuccess
+		s.mu.Unlock()
+	}
+}
+
+// findFirstNotPublished 返回聚合根第一个等待发送的事件，与es_mongo一致，死信事件不阻塞后续事件。调用方需持有锁
+func (s *EventStorage) findFirstNotPublished(tenantId string, aggregateId string) *model.EventEntity {
+	for _, event := range s.events[aggregateKey(tenantId, aggregateId)] {
+		if event.PublishStatus == eventstorage.PublishStatusWait {
+			return event
+		}
+	}
+	return nil
+}
+
+func (s *EventStorage) publishMessage(ctx context.Context, event *model.EventEntity) error {
+	event, err := event.Decrypt(ctx, s.encryptor)
+	if err != nil {
+		return err
+	}
+	req := newEvent(event)
+	contentType := "json"
+	bytes, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	pubData := &pubsub.PublishRequest{
+		PubsubName:  req.PubsubName,
+		Topic:       req.Topic,
+		Metadata:    req.Metadata,
+		ContentType: &contentType,
+		Data:        bytes,
+	}
+	return s.getPubsubAdapter().Publish(pubData)
+}
+
+func newEvent(event *model.EventEntity) *eventstorage.Event {
+	return &eventstorage.Event{
+		TenantId:      event.TenantId,
+		AggregateId:   event.AggregateId,
+		AggregateType: event.AggregateType,
+		CommandId:     event.CommandId,
+		EventId:       event.EventId,
+		EventData:     event.EventData,
+		EventType:     event.EventType,
+		EventVersion:  event.EventVersion,
+		PubsubName:    event.PublishName,
+		Relations:     event.Relations,
+		RelationLists: event.RelationLists,
+		Topic:         event.Topic,
+		Metadata:      event.Metadata,
+		EventTime:     event.GetEventTime(),
+		CausationId:   event.CausationId,
+		CorrelationId: event.CorrelationId,
+	}
+}
+
+// findCommandEvents 查找去重时间窗口内由commandId产生的事件，调用方需持有锁
+func (s *EventStorage) findCommandEvents(tenantId string, aggregateId string, commandId string) ([]*model.EventEntity, error) {
+	if commandId == "" || s.dedupeWindow <= 0 {
+		return nil, nil
+	}
+	after := time.Now().Add(-s.dedupeWindow)
+	var events []*model.EventEntity
+	for _, event := range s.stream {
+		if event.TenantId != tenantId || event.CommandId != commandId || event.TimeStamp.Time().Before(after) {
+			continue
+		}
+		if event.AggregateId != aggregateId {
+			return nil, eventstorage.NewCommandConflictError(commandId, event.AggregateId)
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+func checkSequenceNumber(agg *model.AggregateEntity, expectedSequenceNumber uint64) error {
+	if expectedSequenceNumber > 0 && agg.SequenceNumber != expectedSequenceNumber {
+		return eventstorage.NewConcurrencyConflictError(agg.TenantId, agg.AggregateId, expectedSequenceNumber, agg.SequenceNumber)
+	}
+	return nil
+}
+
+func newRelationDocument(relation *model.RelationEntity) document {
+	doc := document{
+		"_id":          relation.Id,
+		"tenant_id":    relation.TenantId,
+		"table_name":   relation.TableName,
+		"aggregate_id": relation.AggregateId,
+		"is_deleted":   relation.IsDeleted,
+	}
+	for k, v := range relation.Items {
+		doc[k] = v
+	}
+	for k, v := range relation.Lists {
+		doc[k] = v
+	}
+	return doc
+}
+
+func newEventDocument(event *model.EventEntity) document {
+	doc := document{
+		"_id":              event.Id,
+		"tenant_id":        event.TenantId,
+		"command_id":       event.CommandId,
+		"event_id":         event.EventId,
+		"meta_data":        newStringMap(event.Metadata),
+		"event_data":       map[string]interface{}(event.EventData),
+		"event_type":       event.EventType,
+		"event_version":    event.EventVersion,
+		"aggregate_id":     event.AggregateId,
+		"aggregate_type":   event.AggregateType,
+		"sequence_number":  event.SequenceNumber,
+		"position":         event.Position,
+		"relations":        newStringMap(event.Relations),
+		"relation_lists":   newListMap(event.RelationLists),
+		"time_stamp":       event.TimeStamp.Time(),
+		"topic":            event.Topic,
+		"publish_name":     event.PublishName,
+		"publish_status":   int(event.PublishStatus),
+		"publish_attempts": event.PublishAttempts,
+		"publish_error":    event.PublishError,
+		"causation_id":     event.CausationId,
+		"correlation_id":   event.CorrelationId,
+	}
+	if event.EventTime != 0 {
+		doc["event_time"] = event.EventTime.Time()
+	}
+	return doc
+}
+
+func newAggregateDocument(agg *model.AggregateEntity) document {
+	return document{
+		"_id":             agg.Id,
+		"tenant_id":       agg.TenantId,
+		"aggregate_id":    agg.AggregateId,
+		"aggregate_type":  agg.AggregateType,
+		"sequence_number": agg.SequenceNumber,
+		"deleted":         agg.Deleted,
+	}
+}
+
+func (d document) aggregate() *eventstorage.AggregateDto {
+	return &eventstorage.AggregateDto{
+		TenantId:       d["tenant_id"].(string),
+		AggregateId:    d["aggregate_id"].(string),
+		AggregateType:  d["aggregate_type"].(string),
+		SequenceNumber: d["sequence_number"].(uint64),
+		Deleted:        d["deleted"].(bool),
+	}
+}
+
+func newStringMap(data map[string]string) map[string]interface{} {
+	res := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		res[k] = v
+	}
+	return res
+}
+
+func newListMap(data map[string][]string) map[string]interface{} {
+	res := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		res[k] = v
+	}
+	return res
+}
+
+func (d document) relation() *eventstorage.Relation {
+	rel := &eventstorage.Relation{
+		Items: make(map[string]string),
+	}
+	for k, v := range d {
+		switch k {
+		case "_id":
+			rel.Id = v.(string)
+		case "tenant_id":
+			rel.TenantId = v.(string)
+		case "table_name":
+			rel.TableName = v.(string)
+		case "aggregate_id":
+			rel.AggregateId = v.(string)
+		case "is_deleted":
+			rel.IsDeleted = v.(bool)
+		default:
+			switch value := v.(type) {
+			case string:
+				rel.Items[k] = value
+			case []string:
+				if rel.Lists == nil {
+					rel.Lists = make(map[string][]string)
+				}
+				rel.Lists[k] = value
+			}
+		}
+	}
+	return rel
+}
+
+func aggregateKey(tenantId, aggregateId string) string {
+	return tenantId + "/" + aggregateId
+}
+
+func newError(msgType string, err error) error {
+	return errors.New(msgType + err.Error())
+}
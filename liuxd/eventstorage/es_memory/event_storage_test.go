@@ -0,0 +1,912 @@
+package es_memory
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/liuxd6825/components-contrib/liuxd/common"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage"
+	"github.com/liuxd6825/components-contrib/pubsub"
+	pubsub_adapter "github.com/liuxd6825/dapr/pkg/runtime/pubsub"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+type testAdapter struct {
+	published []*pubsub.PublishRequest
+	err       error
+}
+
+func (a *testAdapter) GetPubSub(pubsubName string) pubsub.PubSub {
+	return nil
+}
+
+func (a *testAdapter) Publish(req *pubsub.PublishRequest) error {
+	if a.err != nil {
+		return a.err
+	}
+	a.published = append(a.published, req)
+	return nil
+}
+
+func newTestStorage(t *testing.T) (eventstorage.EventStorage, *testAdapter) {
+	adapter := &testAdapter{}
+	storage := NewMemoryEventStorage(nil)
+	err := storage.Init(common.Metadata{}, func() pubsub_adapter.Adapter { return adapter })
+	assert.NoError(t, err)
+	return storage, adapter
+}
+
+func newTestEvent(eventId string, relations map[string]string) eventstorage.EventDto {
+	return eventstorage.EventDto{
+		EventId:      eventId,
+		EventType:    "TestEvent",
+		EventVersion: "1.0",
+		EventData:    map[string]interface{}{"id": eventId},
+		PubsubName:   "pubsub",
+		Topic:        "topic",
+		Relations:    relations,
+	}
+}
+
+func TestEventStorage_ApplyEvent(t *testing.T) {
+	ctx := context.Background()
+	storage, adapter := newTestStorage(t)
+
+	_, err := storage.CreateEvent(ctx, &eventstorage.CreateEventRequest{
+		TenantId:      "t1",
+		AggregateId:   "a1",
+		AggregateType: "Order",
+		Events:        &[]eventstorage.EventDto{newTestEvent("e1", nil)},
+	})
+	assert.NoError(t, err)
+
+	_, err = storage.CreateEvent(ctx, &eventstorage.CreateEventRequest{
+		TenantId:      "t1",
+		AggregateId:   "a1",
+		AggregateType: "Order",
+		Events:        &[]eventstorage.EventDto{newTestEvent("e2", nil)},
+	})
+	assert.EqualError(t, err, "aggregateId \"a1\" already exists")
+
+	applyRes, err := storage.ApplyEvent(ctx, &eventstorage.ApplyEventsRequest{
+		TenantId:               "t1",
+		AggregateId:            "a1",
+		AggregateType:          "Order",
+		ExpectedSequenceNumber: 1,
+		Events:                 &[]eventstorage.EventDto{newTestEvent("e2", nil), newTestEvent("e3", nil)},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), applyRes.SequenceNumber)
+
+	_, err = storage.ApplyEvent(ctx, &eventstorage.ApplyEventsRequest{
+		TenantId:               "t1",
+		AggregateId:            "a1",
+		AggregateType:          "Order",
+		ExpectedSequenceNumber: 1,
+		Events:                 &[]eventstorage.EventDto{newTestEvent("e4", nil)},
+	})
+	assert.True(t, eventstorage.IsConcurrencyConflictError(err))
+
+	_, err = storage.ApplyEvent(ctx, &eventstorage.ApplyEventsRequest{
+		TenantId:      "t1",
+		AggregateId:   "a2",
+		AggregateType: "Order",
+		Events:        &[]eventstorage.EventDto{newTestEvent("e5", nil)},
+	})
+	assert.EqualError(t, err, "aggregate idValue a2 does not exist")
+
+	_, err = storage.SaveSnapshot(ctx, &eventstorage.SaveSnapshotRequest{
+		TenantId:       "t1",
+		AggregateId:    "a1",
+		AggregateType:  "Order",
+		SequenceNumber: 2,
+	})
+	assert.NoError(t, err)
+
+	res, err := storage.LoadEvent(ctx, &eventstorage.LoadEventRequest{TenantId: "t1", AggregateId: "a1", AggregateType: "Order"})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), res.Snapshot.SequenceNumber)
+	assert.Equal(t, 1, len(*res.Events))
+	assert.Equal(t, "e3", (*res.Events)[0].EventId)
+	assert.Equal(t, uint64(3), (*res.Events)[0].SequenceNumber)
+	assert.Equal(t, 3, len(adapter.published))
+
+	res, err = storage.LoadEvent(ctx, &eventstorage.LoadEventRequest{TenantId: "t1", AggregateId: "a1", AggregateType: "Order", AggregateVersion: "2.0"})
+	assert.NoError(t, err)
+	assert.Nil(t, res.Snapshot)
+	assert.Equal(t, 3, len(*res.Events))
+}
+
+func TestEventStorage_DeleteEvent(t *testing.T) {
+	ctx := context.Background()
+	storage, adapter := newTestStorage(t)
+
+	event := newTestEvent("e1", nil)
+	_, err := storage.DeleteEvent(ctx, &eventstorage.DeleteEventRequest{TenantId: "t1", AggregateId: "a1", AggregateType: "Order", Event: &event})
+	assert.EqualError(t, err, "aggregate id \"a1\" not found")
+
+	_, err = storage.CreateEvent(ctx, &eventstorage.CreateEventRequest{
+		TenantId:      "t1",
+		AggregateId:   "a1",
+		AggregateType: "Order",
+		Events:        &[]eventstorage.EventDto{event},
+	})
+	assert.NoError(t, err)
+
+	deleted := newTestEvent("e2", nil)
+	_, err = storage.DeleteEvent(ctx, &eventstorage.DeleteEventRequest{TenantId: "t1", AggregateId: "a1", AggregateType: "Order", Event: &deleted})
+	assert.NoError(t, err)
+
+	_, err = storage.ApplyEvent(ctx, &eventstorage.ApplyEventsRequest{
+		TenantId:      "t1",
+		AggregateId:   "a1",
+		AggregateType: "Order",
+		Events:        &[]eventstorage.EventDto{newTestEvent("e3", nil)},
+	})
+	assert.EqualError(t, err, "aggregate id \"a1\" is already deleted.")
+
+	adapter.err = errors.New("broker down")
+	_, err = storage.CreateEvent(ctx, &eventstorage.CreateEventRequest{
+		TenantId:      "t1",
+		AggregateId:   "a2",
+		AggregateType: "Order",
+		Events:        &[]eventstorage.EventDto{newTestEvent("e4", nil)},
+	})
+	// 与es_mongo一致，发送失败不影响写入结果，事件保持等待发送并记录失败次数
+	assert.NoError(t, err)
+	failed := storage.(*EventStorage).events[aggregateKey("t1", "a2")][0]
+	assert.Equal(t, eventstorage.PublishStatusWait, failed.PublishStatus)
+	assert.Equal(t, 1, failed.PublishAttempts)
+	assert.Equal(t, "broker down", failed.PublishError)
+
+	// 之前的事件仍在等待发送，后续事件不发送
+	adapter.err = nil
+	count := len(adapter.published)
+	_, err = storage.ApplyEvent(ctx, &eventstorage.ApplyEventsRequest{
+		TenantId:      "t1",
+		AggregateId:   "a2",
+		AggregateType: "Order",
+		Events:        &[]eventstorage.EventDto{newTestEvent("e5", nil)},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, count, len(adapter.published))
+}
+
+func TestEventStorage_GetRelations(t *testing.T) {
+	ctx := context.Background()
+	storage, _ := newTestStorage(t)
+
+	for i, customerId := range []string{"c1", "c2", "c1"} {
+		id := string(rune('a' + i))
+		_, err := storage.CreateEvent(ctx, &eventstorage.CreateEventRequest{
+			TenantId:      "t1",
+			AggregateId:   id,
+			AggregateType: "Order",
+			Events:        &[]eventstorage.EventDto{newTestEvent("e"+id, map[string]string{"CustomerId": customerId})},
+		})
+		assert.NoError(t, err)
+	}
+
+	res, err := storage.GetRelations(ctx, &eventstorage.GetRelationsRequest{
+		TenantId:      "t1",
+		AggregateType: "Order",
+		Filter:        "customerId=='c1'",
+		Sort:          "id:desc",
+		PageSize:      1,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), res.TotalRows)
+	assert.Equal(t, 1, len(res.Data))
+	assert.Equal(t, "c", res.Data[0].AggregateId)
+	assert.Equal(t, "c1", res.Data[0].Items["customer_id"])
+
+	_, err = storage.GetRelations(ctx, &eventstorage.GetRelationsRequest{TenantId: "t1", AggregateType: "Order", Filter: "customerId=="})
+	assert.Error(t, err)
+}
+
+func TestEventStorage_ReadEventStream(t *testing.T) {
+	ctx := context.Background()
+	storage, _ := newTestStorage(t)
+
+	for i, aggregateType := range []string{"Order", "Customer", "Order"} {
+		id := string(rune('a' + i))
+		_, err := storage.CreateEvent(ctx, &eventstorage.CreateEventRequest{
+			TenantId:      "t1",
+			AggregateId:   id,
+			AggregateType: aggregateType,
+			Events:        &[]eventstorage.EventDto{newTestEvent("e"+id, nil)},
+		})
+		assert.NoError(t, err)
+	}
+
+	res, err := storage.ReadEventStream(ctx, &eventstorage.ReadEventStreamRequest{TenantId: "t1", Limit: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(res.Events))
+	assert.Equal(t, uint64(2), res.LastPosition)
+	assert.True(t, res.HasMore)
+
+	res, err = storage.ReadEventStream(ctx, &eventstorage.ReadEventStreamRequest{TenantId: "t1", FromPosition: res.LastPosition})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(res.Events))
+	assert.Equal(t, "ec", res.Events[0].EventId)
+	assert.False(t, res.HasMore)
+
+	res, err = storage.ReadEventStream(ctx, &eventstorage.ReadEventStreamRequest{AggregateType: "Order"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(res.Events))
+	assert.Equal(t, uint64(3), res.LastPosition)
+}
+
+func TestEventStorage_ReplayEvents(t *testing.T) {
+	ctx := context.Background()
+	storage, adapter := newTestStorage(t)
+
+	for i, aggregateType := range []string{"Order", "Customer", "Order", "Order"} {
+		id := string(rune('a' + i))
+		_, err := storage.CreateEvent(ctx, &eventstorage.CreateEventRequest{
+			TenantId:      "t1",
+			AggregateId:   id,
+			AggregateType: aggregateType,
+			Events:        &[]eventstorage.EventDto{newTestEvent("e"+id, nil)},
+		})
+		assert.NoError(t, err)
+	}
+	adapter.published = nil
+
+	req := &eventstorage.ReplayEventsRequest{TenantId: "t1", AggregateType: "Order", PubsubName: "replay", Topic: "order-view", Limit: 2}
+	res, err := storage.ReplayEvents(ctx, req)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, res.ReplayId)
+	assert.Equal(t, uint64(2), res.PublishedCount)
+	assert.Equal(t, uint64(2), res.ProcessedCount)
+	assert.Equal(t, uint64(3), res.TotalCount)
+	assert.Equal(t, uint64(3), res.LastPosition)
+	assert.True(t, res.HasMore)
+	assert.Equal(t, "order-view", adapter.published[0].Topic)
+	assert.Equal(t, "true", adapter.published[0].Metadata[eventstorage.ReplayMetadataKey])
+	assert.Equal(t, res.ReplayId, adapter.published[1].Metadata[eventstorage.ReplayIdMetadataKey])
+	assert.Equal(t, "3", adapter.published[1].Metadata[eventstorage.ReplayPositionMetadataKey])
+
+	adapter.err = errors.New("broker down")
+	req.ReplayId, req.FromPosition = res.ReplayId, res.LastPosition
+	res, err = storage.ReplayEvents(ctx, req)
+	assert.EqualError(t, err, "publishMessage() failed to replay event.broker down")
+	assert.Equal(t, uint64(3), res.LastPosition)
+
+	adapter.err = nil
+	res, err = storage.ReplayEvents(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), res.PublishedCount)
+	assert.Equal(t, uint64(3), res.ProcessedCount)
+	assert.False(t, res.HasMore)
+
+	_, err = storage.ReplayEvents(ctx, &eventstorage.ReplayEventsRequest{TenantId: "t1", AggregateType: "Order"})
+	assert.EqualError(t, err, "pubsubName cannot be empty")
+}
+
+func TestEventStorage_Upcast(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryEventStorage(nil)
+	err := storage.Init(common.Metadata{Properties: map[string]string{
+		eventstorage.UpcastersMetadataKey: `[{"eventType":"TestEvent","fromVersion":"1.0","toVersion":"2.0","rules":[{"op":"rename","field":"id","to":"orderId"}]}]`,
+	}}, func() pubsub_adapter.Adapter { return &testAdapter{} })
+	assert.NoError(t, err)
+
+	_, err = storage.CreateEvent(ctx, &eventstorage.CreateEventRequest{
+		TenantId:      "t1",
+		AggregateId:   "a1",
+		AggregateType: "Order",
+		Events:        &[]eventstorage.EventDto{newTestEvent("e1", nil)},
+	})
+	assert.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		res, err := storage.LoadEvent(ctx, &eventstorage.LoadEventRequest{TenantId: "t1", AggregateId: "a1", AggregateType: "Order"})
+		assert.NoError(t, err)
+		assert.Equal(t, "2.0", (*res.Events)[0].EventVersion)
+		assert.Equal(t, map[string]interface{}{"orderId": "e1"}, (*res.Events)[0].EventData)
+	}
+
+	err = storage.Init(common.Metadata{Properties: map[string]string{eventstorage.UpcastersMetadataKey: "{"}}, nil)
+	assert.Error(t, err)
+}
+
+func TestEventStorage_LoadEventPointInTime(t *testing.T) {
+	ctx := context.Background()
+	storage, _ := newTestStorage(t)
+	before := time.Now().Add(-time.Minute)
+
+	_, err := storage.CreateEvent(ctx, &eventstorage.CreateEventRequest{
+		TenantId:      "t1",
+		AggregateId:   "a1",
+		AggregateType: "Order",
+		Events:        &[]eventstorage.EventDto{newTestEvent("e1", nil), newTestEvent("e2", nil)},
+	})
+	assert.NoError(t, err)
+	_, err = storage.SaveSnapshot(ctx, &eventstorage.SaveSnapshotRequest{TenantId: "t1", AggregateId: "a1", AggregateType: "Order", SequenceNumber: 2})
+	assert.NoError(t, err)
+	_, err = storage.ApplyEvent(ctx, &eventstorage.ApplyEventsRequest{
+		TenantId:      "t1",
+		AggregateId:   "a1",
+		AggregateType: "Order",
+		Events:        &[]eventstorage.EventDto{newTestEvent("e3", nil)},
+	})
+	assert.NoError(t, err)
+
+	res, err := storage.LoadEvent(ctx, &eventstorage.LoadEventRequest{TenantId: "t1", AggregateId: "a1", AggregateType: "Order", ToSequenceNumber: 1})
+	assert.NoError(t, err)
+	assert.Nil(t, res.Snapshot)
+	assert.Equal(t, 1, len(*res.Events))
+	assert.Equal(t, "e1", (*res.Events)[0].EventId)
+
+	now := time.Now()
+	res, err = storage.LoadEvent(ctx, &eventstorage.LoadEventRequest{TenantId: "t1", AggregateId: "a1", AggregateType: "Order", ToTime: &now})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), res.Snapshot.SequenceNumber)
+	assert.Equal(t, 1, len(*res.Events))
+
+	res, err = storage.LoadEvent(ctx, &eventstorage.LoadEventRequest{TenantId: "t1", AggregateId: "a1", AggregateType: "Order", ToTime: &before})
+	assert.NoError(t, err)
+	assert.Nil(t, res.Snapshot)
+	assert.Equal(t, 0, len(*res.Events))
+}
+
+func TestEventStorage_CommandDedupe(t *testing.T) {
+	ctx := context.Background()
+	storage, adapter := newTestStorage(t)
+
+	newCommandEvent := func(eventId string, commandId string) eventstorage.EventDto {
+		event := newTestEvent(eventId, nil)
+		event.CommandId = commandId
+		return event
+	}
+	createReq := &eventstorage.CreateEventRequest{
+		TenantId:      "t1",
+		AggregateId:   "a1",
+		AggregateType: "Order",
+		Events:        &[]eventstorage.EventDto{newCommandEvent("e1", "c1")},
+	}
+	_, err := storage.CreateEvent(ctx, createReq)
+	assert.NoError(t, err)
+	_, err = storage.CreateEvent(ctx, createReq)
+	assert.NoError(t, err)
+
+	applyReq := &eventstorage.ApplyEventsRequest{
+		TenantId:      "t1",
+		AggregateId:   "a1",
+		AggregateType: "Order",
+		Events:        &[]eventstorage.EventDto{newCommandEvent("e2", "c2"), newCommandEvent("e3", "c2")},
+	}
+	res, err := storage.ApplyEvent(ctx, applyReq)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), res.SequenceNumber)
+	res, err = storage.ApplyEvent(ctx, applyReq)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), res.SequenceNumber)
+	assert.Equal(t, 3, len(adapter.published))
+
+	_, err = storage.CreateEvent(ctx, &eventstorage.CreateEventRequest{
+		TenantId:      "t1",
+		AggregateId:   "a2",
+		AggregateType: "Order",
+		Events:        &[]eventstorage.EventDto{newCommandEvent("e4", "c1")},
+	})
+	assert.EqualError(t, err, "commandId \"c1\" is already processed by aggregate \"a1\"")
+
+	storage = NewMemoryEventStorage(nil)
+	err = storage.Init(common.Metadata{Properties: map[string]string{eventstorage.CommandDedupeWindowMetadataKey: "0s"}}, func() pubsub_adapter.Adapter { return adapter })
+	assert.NoError(t, err)
+	_, err = storage.CreateEvent(ctx, createReq)
+	assert.NoError(t, err)
+	createReq.Events = &[]eventstorage.EventDto{newCommandEvent("e5", "c1")}
+	createReq.AggregateId = "a3"
+	_, err = storage.CreateEvent(ctx, createReq)
+	assert.NoError(t, err)
+}
+
+func TestEventStorage_GetCausalityChain(t *testing.T) {
+	ctx := context.Background()
+	storage, adapter := newTestStorage(t)
+	eventTime := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	order := newTestEvent("e1", nil)
+	order.CommandId, order.CorrelationId, order.EventTime = "c1", "flow1", eventTime
+	_, err := storage.CreateEvent(ctx, &eventstorage.CreateEventRequest{TenantId: "t1", AggregateId: "a1", AggregateType: "Order", Events: &[]eventstorage.EventDto{order}})
+	assert.NoError(t, err)
+
+	payment := newTestEvent("e2", nil)
+	payment.CommandId, payment.CausationId, payment.Metadata = "c2", "e1", map[string]string{eventstorage.CorrelationIdMetadataKey: "flow1"}
+	_, err = storage.CreateEvent(ctx, &eventstorage.CreateEventRequest{TenantId: "t1", AggregateId: "p1", AggregateType: "Payment", Events: &[]eventstorage.EventDto{payment}})
+	assert.NoError(t, err)
+
+	other := newTestEvent("e3", nil)
+	other.CommandId = "c3"
+	_, err = storage.CreateEvent(ctx, &eventstorage.CreateEventRequest{TenantId: "t1", AggregateId: "a2", AggregateType: "Order", Events: &[]eventstorage.EventDto{other}})
+	assert.NoError(t, err)
+
+	res, err := storage.GetCausalityChain(ctx, &eventstorage.GetCausalityChainRequest{TenantId: "t1", CorrelationId: "flow1"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(res.Events))
+	assert.True(t, eventTime.Equal(res.Events[0].EventTime))
+	assert.Equal(t, "", res.Events[0].CausationId)
+	assert.Equal(t, 2, len(res.Commands))
+	assert.Equal(t, "c2", res.Commands[1].CommandId)
+	assert.Equal(t, "e1", res.Commands[1].CausationId)
+	assert.Equal(t, []string{"e2"}, res.Commands[1].EventIds)
+	assert.Contains(t, string(adapter.published[1].Data), `"correlationId":"flow1"`)
+
+	// 客户端没有发送CorrelationId时不使用CommandId代替
+	res, err = storage.GetCausalityChain(ctx, &eventstorage.GetCausalityChainRequest{TenantId: "t1", CorrelationId: "c3"})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(res.Events))
+
+	_, err = storage.GetCausalityChain(ctx, &eventstorage.GetCausalityChainRequest{CorrelationId: "flow1"})
+	assert.Error(t, err)
+}
+
+func TestEventStorage_FindEvents(t *testing.T) {
+	ctx := context.Background()
+	storage, _ := newTestStorage(t)
+
+	for i, reason := range []string{"fraud", "customer", "fraud"} {
+		event := newTestEvent(fmt.Sprintf("e%d", i+1), nil)
+		event.EventType = "OrderCancelled"
+		event.EventData = map[string]interface{}{"cancelReason": reason}
+		event.EventTime = time.Date(2022, 1, i+1, 0, 0, 0, 0, time.UTC)
+		_, err := storage.CreateEvent(ctx, &eventstorage.CreateEventRequest{TenantId: "t1", AggregateId: fmt.Sprintf("a%d", i+1), AggregateType: "Order", Events: &[]eventstorage.EventDto{event}})
+		assert.NoError(t, err)
+	}
+	_, err := storage.CreateEvent(ctx, &eventstorage.CreateEventRequest{TenantId: "t2", AggregateId: "a1", AggregateType: "Order", Events: &[]eventstorage.EventDto{newTestEvent("e4", nil)}})
+	assert.NoError(t, err)
+
+	res, err := storage.FindEvents(ctx, &eventstorage.FindEventsRequest{
+		TenantId: "t1",
+		Filter:   "eventType=='OrderCancelled' and eventData.cancelReason=='fraud' and eventTime>=2022-01-02",
+		Sort:     "sequenceNumber:asc,eventTime:desc",
+		PageSize: 10,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), res.TotalRows)
+	assert.Equal(t, "e3", res.Data[0].EventId)
+	assert.Equal(t, eventstorage.PublishStatusSuccess, res.Data[0].PublishStatus)
+
+	res, err = storage.FindEvents(ctx, &eventstorage.FindEventsRequest{TenantId: "t1", Sort: "eventTime:desc", PageNum: 1, PageSize: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), res.TotalRows)
+	assert.Equal(t, uint64(2), res.TotalPages)
+	assert.Equal(t, 1, len(res.Data))
+	assert.Equal(t, "e1", res.Data[0].EventId)
+
+	_, err = storage.FindEvents(ctx, &eventstorage.FindEventsRequest{TenantId: "t1", Filter: "eventType=="})
+	assert.Error(t, err)
+}
+
+func TestEventStorage_AggregateLifecycle(t *testing.T) {
+	ctx := context.Background()
+	storage, adapter := newTestStorage(t)
+
+	for i, aggregateType := range []string{"Order", "Order", "Customer"} {
+		_, err := storage.CreateEvent(ctx, &eventstorage.CreateEventRequest{
+			TenantId:      "t1",
+			AggregateId:   fmt.Sprintf("a%d", i+1),
+			AggregateType: aggregateType,
+			Events:        &[]eventstorage.EventDto{newTestEvent(fmt.Sprintf("e%d", i+1), nil)},
+		})
+		assert.NoError(t, err)
+	}
+	_, err := storage.DeleteEvent(ctx, &eventstorage.DeleteEventRequest{TenantId: "t1", AggregateId: "a2", AggregateType: "Order", Event: ptrEvent(newTestEvent("e4", nil))})
+	assert.NoError(t, err)
+
+	findRes, err := storage.FindAggregates(ctx, &eventstorage.FindAggregatesRequest{TenantId: "t1", AggregateType: "Order", Sort: "aggregateId:desc", PageSize: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), findRes.TotalRows)
+	assert.Equal(t, "a2", findRes.Data[0].AggregateId)
+	assert.True(t, findRes.Data[0].Deleted)
+	assert.Equal(t, uint64(2), findRes.Data[0].SequenceNumber)
+
+	countRes, err := storage.CountAggregates(ctx, &eventstorage.CountAggregatesRequest{TenantId: "t1", Filter: "deleted==false"})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), countRes.Count)
+
+	existRes, err := storage.ExistAggregate(ctx, &eventstorage.ExistAggregateRequest{TenantId: "t1", AggregateId: "a2"})
+	assert.NoError(t, err)
+	assert.True(t, existRes.IsExist)
+	assert.True(t, existRes.IsDeleted)
+	existRes, err = storage.ExistAggregate(ctx, &eventstorage.ExistAggregateRequest{TenantId: "t2", AggregateId: "a2"})
+	assert.NoError(t, err)
+	assert.False(t, existRes.IsExist)
+
+	_, err = storage.RestoreAggregate(ctx, &eventstorage.RestoreAggregateRequest{TenantId: "t1", AggregateId: "a1", AggregateType: "Order", Event: ptrEvent(newTestEvent("e5", nil))})
+	assert.EqualError(t, err, `aggregate id "a1" is not deleted`)
+
+	restoreRes, err := storage.RestoreAggregate(ctx, &eventstorage.RestoreAggregateRequest{TenantId: "t1", AggregateId: "a2", AggregateType: "Order", ExpectedSequenceNumber: 2, Event: ptrEvent(newTestEvent("e6", nil))})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), restoreRes.SequenceNumber)
+	assert.Equal(t, 5, len(adapter.published))
+
+	existRes, err = storage.ExistAggregate(ctx, &eventstorage.ExistAggregateRequest{TenantId: "t1", AggregateId: "a2"})
+	assert.NoError(t, err)
+	assert.False(t, existRes.IsDeleted)
+}
+
+func TestEventStorage_ExportImport(t *testing.T) {
+	ctx := context.Background()
+	source, _ := newTestStorage(t)
+	_, err := source.CreateEvent(ctx, &eventstorage.CreateEventRequest{
+		TenantId:      "t1",
+		AggregateId:   "a1",
+		AggregateType: "Order",
+		Events:        &[]eventstorage.EventDto{newTestEvent("e1", map[string]string{"customerId": "c1"})},
+	})
+	assert.NoError(t, err)
+	_, err = source.ApplyEvent(ctx, &eventstorage.ApplyEventsRequest{
+		TenantId:      "t1",
+		AggregateId:   "a1",
+		AggregateType: "Order",
+		Events:        &[]eventstorage.EventDto{newTestEvent("e2", nil)},
+	})
+	assert.NoError(t, err)
+	_, err = source.SaveSnapshot(ctx, &eventstorage.SaveSnapshotRequest{
+		TenantId:         "t1",
+		AggregateId:      "a1",
+		AggregateType:    "Order",
+		AggregateData:    map[string]interface{}{"id": "a1"},
+		AggregateVersion: "1.0",
+		SequenceNumber:   2,
+	})
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	exportRes, err := source.ExportEvents(ctx, &eventstorage.ExportEventsRequest{TenantId: "t1", Writer: &buf, Gzip: true})
+	assert.NoError(t, err)
+	assert.Equal(t, &eventstorage.ExportEventsResponse{AggregateCount: 1, EventCount: 2, SnapshotCount: 1, RelationCount: 1}, exportRes)
+	data := buf.Bytes()
+
+	target, _ := newTestStorage(t)
+	importRes, err := target.ImportEvents(ctx, &eventstorage.ImportEventsRequest{Reader: bytes.NewReader(data)})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), importRes.EventCount)
+
+	loadRes, err := target.LoadEvent(ctx, &eventstorage.LoadEventRequest{TenantId: "t1", AggregateId: "a1", AggregateType: "Order"})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), loadRes.Snapshot.SequenceNumber)
+	findRes, err := target.FindEvents(ctx, &eventstorage.FindEventsRequest{TenantId: "t1", Sort: "sequenceNumber"})
+	assert.NoError(t, err)
+	assert.Equal(t, "e1", findRes.Data[0].EventId)
+	assert.Equal(t, "e2", findRes.Data[1].EventId)
+	assert.Equal(t, uint64(2), findRes.Data[1].SequenceNumber)
+	relRes, err := target.GetRelations(ctx, &eventstorage.GetRelationsRequest{TenantId: "t1", AggregateType: "Order", Filter: "customerId=='c1'"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(relRes.Data))
+
+	_, err = target.ImportEvents(ctx, &eventstorage.ImportEventsRequest{Reader: bytes.NewReader(data)})
+	assert.EqualError(t, err, "aggregate id \"a1\" already exists")
+	_, err = target.ImportEvents(ctx, &eventstorage.ImportEventsRequest{Reader: bytes.NewReader(data), Overwrite: true})
+	assert.NoError(t, err)
+	streamRes, err := target.ReadEventStream(ctx, &eventstorage.ReadEventStreamRequest{TenantId: "t1"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(streamRes.Events))
+	assert.Equal(t, uint64(3), streamRes.Events[0].Position)
+
+	// 缺少事件的导出文件不能导入
+	var gap bytes.Buffer
+	writer, err := eventstorage.NewExportWriter(&eventstorage.ExportEventsRequest{TenantId: "t1", Writer: &gap})
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Write(&eventstorage.ExportAggregate{
+		Aggregate: &eventstorage.AggregateDto{TenantId: "t1", AggregateId: "a2", AggregateType: "Order", SequenceNumber: 2},
+		Events:    []*eventstorage.ExportEventDto{{Id: "e3", EventId: "e3", TenantId: "t1", AggregateId: "a2", SequenceNumber: 2}},
+	}))
+	assert.NoError(t, writer.Close())
+	importRes, err = target.ImportEvents(ctx, &eventstorage.ImportEventsRequest{Reader: &gap})
+	assert.EqualError(t, err, "aggregate id \"a2\" sequence number 1 is missing")
+	assert.Equal(t, "a2", importRes.FailedAggregateId)
+
+	// 标记的缺失序号随聚合根导出，导入后再次导出仍可导入
+	var marked bytes.Buffer
+	writer, err = eventstorage.NewExportWriter(&eventstorage.ExportEventsRequest{TenantId: "t2", Writer: &marked})
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Write(&eventstorage.ExportAggregate{
+		Aggregate: &eventstorage.AggregateDto{TenantId: "t2", AggregateId: "a2", AggregateType: "Order", SequenceNumber: 2, SequenceGaps: []uint64{1}},
+		Events:    []*eventstorage.ExportEventDto{{Id: "e3", EventId: "e3", TenantId: "t2", AggregateId: "a2", AggregateType: "Order", EventType: "Created", EventVersion: "1.0", Topic: "order", PubsubName: "pubsub", SequenceNumber: 2}},
+	}))
+	assert.NoError(t, writer.Close())
+	_, err = target.ImportEvents(ctx, &eventstorage.ImportEventsRequest{Reader: &marked})
+	assert.NoError(t, err)
+	var again bytes.Buffer
+	_, err = target.ExportEvents(ctx, &eventstorage.ExportEventsRequest{TenantId: "t2", Writer: &again})
+	assert.NoError(t, err)
+	_, err = source.ImportEvents(ctx, &eventstorage.ImportEventsRequest{Reader: &again})
+	assert.NoError(t, err)
+
+	// 导入中断后使用SkipExisting从失败的聚合根继续
+	resume, _ := newTestStorage(t)
+	_, err = resume.ImportEvents(ctx, &eventstorage.ImportEventsRequest{Reader: bytes.NewReader(data)})
+	assert.NoError(t, err)
+	importRes, err = resume.ImportEvents(ctx, &eventstorage.ImportEventsRequest{Reader: bytes.NewReader(data), SkipExisting: true})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), importRes.SkippedCount)
+	assert.Equal(t, uint64(0), importRes.AggregateCount)
+	_, err = resume.ImportEvents(ctx, &eventstorage.ImportEventsRequest{Reader: bytes.NewReader(data), SkipExisting: true, Overwrite: true})
+	assert.Error(t, err)
+}
+
+func TestEventStorage_EraseDataKey(t *testing.T) {
+	ctx := context.Background()
+	adapter := &testAdapter{}
+	storage := NewMemoryEventStorage(nil)
+	err := storage.Init(common.Metadata{Properties: map[string]string{
+		eventstorage.EncryptFieldsMetadataKey: "Customer:name,Customer:address.street,Order:customerName",
+	}}, func() pubsub_adapter.Adapter { return adapter })
+	assert.NoError(t, err)
+
+	event := newTestEvent("e1", nil)
+	event.EventData = map[string]interface{}{"id": "c1", "name": "Alice", "address": map[string]interface{}{"street": "Main"}}
+	_, err = storage.CreateEvent(ctx, &eventstorage.CreateEventRequest{
+		TenantId:      "t1",
+		AggregateId:   "c1",
+		AggregateType: "Customer",
+		Events:        &[]eventstorage.EventDto{event},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(adapter.published))
+	assert.Contains(t, string(adapter.published[0].Data), "Alice")
+
+	stored := storage.(*EventStorage).events[aggregateKey("t1", "c1")][0].EventData
+	assert.Equal(t, "c1", stored["id"])
+	assert.NotEqual(t, "Alice", stored["name"])
+	assert.Contains(t, stored["name"], "enc:v1:")
+
+	findRes, err := storage.FindEvents(ctx, &eventstorage.FindEventsRequest{TenantId: "t1"})
+	assert.NoError(t, err)
+	assert.Equal(t, event.EventData, findRes.Data[0].EventData)
+
+	// 导出解密后的明文，导入时使用导入方的数据密钥重新加密
+	var buf bytes.Buffer
+	_, err = storage.ExportEvents(ctx, &eventstorage.ExportEventsRequest{TenantId: "t1", Writer: &buf})
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), "Alice")
+	assert.NotContains(t, buf.String(), "enc:v1:")
+	target := NewMemoryEventStorage(nil)
+	err = target.Init(common.Metadata{Properties: map[string]string{
+		eventstorage.EncryptFieldsMetadataKey: "Customer:name",
+	}}, func() pubsub_adapter.Adapter { return adapter })
+	assert.NoError(t, err)
+	_, err = target.ImportEvents(ctx, &eventstorage.ImportEventsRequest{Reader: &buf})
+	assert.NoError(t, err)
+	assert.Contains(t, target.(*EventStorage).events[aggregateKey("t1", "c1")][0].EventData["name"], "enc:v1:")
+	loadRes, err := target.LoadEvent(ctx, &eventstorage.LoadEventRequest{TenantId: "t1", AggregateId: "c1", AggregateType: "Customer"})
+	assert.NoError(t, err)
+	assert.Equal(t, event.EventData, (*loadRes.Events)[0].EventData)
+
+	loadRes, err = storage.LoadEvent(ctx, &eventstorage.LoadEventRequest{TenantId: "t1", AggregateId: "c1", AggregateType: "Customer"})
+	assert.NoError(t, err)
+	assert.Equal(t, event.EventData, (*loadRes.Events)[0].EventData)
+
+	// 不接受客户端提交的密文，未配置的字段不解密
+	forged := newTestEvent("e3", nil)
+	forged.EventData = map[string]interface{}{"id": "c2", "name": stored["name"]}
+	_, err = storage.CreateEvent(ctx, &eventstorage.CreateEventRequest{TenantId: "t1", AggregateId: "c2", AggregateType: "Customer", Events: &[]eventstorage.EventDto{forged}})
+	assert.EqualError(t, err, "createEvent() error encrypting event.field \"name\" value cannot start with \"enc:v1:\"")
+	forged.EventData = map[string]interface{}{"id": "c2", "name": "Bob", "note": stored["name"]}
+	_, err = storage.CreateEvent(ctx, &eventstorage.CreateEventRequest{TenantId: "t1", AggregateId: "c2", AggregateType: "Customer", Events: &[]eventstorage.EventDto{forged}})
+	assert.NoError(t, err)
+	loadRes, err = storage.LoadEvent(ctx, &eventstorage.LoadEventRequest{TenantId: "t1", AggregateId: "c2", AggregateType: "Customer"})
+	assert.NoError(t, err)
+	assert.Equal(t, forged.EventData, (*loadRes.Events)[0].EventData)
+
+	// 密文绑定聚合根，复制到其它聚合根后无法解密
+	storage.(*EventStorage).events[aggregateKey("t1", "c2")][0].EventData["name"] = stored["name"]
+	_, err = storage.LoadEvent(ctx, &eventstorage.LoadEventRequest{TenantId: "t1", AggregateId: "c2", AggregateType: "Customer"})
+	assert.Error(t, err)
+
+	// 按主体加密的其它聚合根的镜像在销毁密钥时一并删除
+	order := newTestEvent("e4", nil)
+	order.EventData = map[string]interface{}{"id": "o1", "customerName": "Alice"}
+	order.Metadata = map[string]string{eventstorage.DataKeyIdMetadataKey: "c1"}
+	_, err = storage.CreateEvent(ctx, &eventstorage.CreateEventRequest{TenantId: "t1", AggregateId: "o1", AggregateType: "Order", Events: &[]eventstorage.EventDto{order}})
+	assert.NoError(t, err)
+	_, err = storage.SaveSnapshot(ctx, &eventstorage.SaveSnapshotRequest{TenantId: "t1", AggregateId: "o1", AggregateType: "Order", AggregateData: map[string]interface{}{"customerName": "Alice"}, SequenceNumber: 1})
+	assert.NoError(t, err)
+	_, err = storage.SaveSnapshot(ctx, &eventstorage.SaveSnapshotRequest{TenantId: "t1", AggregateId: "c1", AggregateType: "Customer", AggregateData: map[string]interface{}{"name": "Alice"}, SequenceNumber: 1})
+	assert.NoError(t, err)
+
+	_, err = storage.EraseDataKey(ctx, &eventstorage.EraseDataKeyRequest{TenantId: "t1", KeyId: "c1"})
+	assert.NoError(t, err)
+	assert.Empty(t, storage.(*EventStorage).snapshots[aggregateKey("t1", "o1")])
+	assert.Empty(t, storage.(*EventStorage).snapshots[aggregateKey("t1", "c1")])
+	loadRes, err = storage.LoadEvent(ctx, &eventstorage.LoadEventRequest{TenantId: "t1", AggregateId: "o1", AggregateType: "Order"})
+	assert.NoError(t, err)
+	assert.Nil(t, loadRes.Snapshot)
+	assert.Equal(t, map[string]interface{}{"id": "o1", "customerName": nil}, (*loadRes.Events)[0].EventData)
+	loadRes, err = storage.LoadEvent(ctx, &eventstorage.LoadEventRequest{TenantId: "t1", AggregateId: "c1", AggregateType: "Customer"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(*loadRes.Events))
+	assert.Equal(t, map[string]interface{}{"id": "c1", "name": nil, "address": map[string]interface{}{"street": nil}}, (*loadRes.Events)[0].EventData)
+
+	_, err = storage.ApplyEvent(ctx, &eventstorage.ApplyEventsRequest{
+		TenantId:      "t1",
+		AggregateId:   "c1",
+		AggregateType: "Customer",
+		Events:        &[]eventstorage.EventDto{newTestEvent("e2", nil)},
+	})
+	assert.EqualError(t, err, "createEvent() error encrypting event.data key \"c1\" is erased")
+}
+
+func TestEventStorage_SchemaValidation(t *testing.T) {
+	ctx := context.Background()
+	adapter := &testAdapter{}
+	storage := NewMemoryEventStorage(nil)
+	err := storage.Init(common.Metadata{Properties: map[string]string{
+		eventstorage.EventSchemasMetadataKey: `[{"aggregateType":"Order","eventType":"TestEvent","eventVersion":"1.0","schema":{"type":"object","required":["id","amount"]}}]`,
+	}}, func() pubsub_adapter.Adapter { return adapter })
+	assert.NoError(t, err)
+
+	_, err = storage.CreateEvent(ctx, &eventstorage.CreateEventRequest{
+		TenantId:      "t1",
+		AggregateId:   "a1",
+		AggregateType: "Order",
+		Events:        &[]eventstorage.EventDto{newTestEvent("e1", nil)},
+	})
+	assert.True(t, eventstorage.IsSchemaValidationError(err))
+	assert.EqualError(t, err, "event id \"e1\" TestEvent 1.0 schema validation failed: amount: amount is required")
+	existRes, err := storage.ExistAggregate(ctx, &eventstorage.ExistAggregateRequest{TenantId: "t1", AggregateId: "a1"})
+	assert.NoError(t, err)
+	assert.False(t, existRes.IsExist)
+	assert.Empty(t, adapter.published)
+
+	event := newTestEvent("e1", nil)
+	event.EventData["amount"] = 10
+	_, err = storage.CreateEvent(ctx, &eventstorage.CreateEventRequest{
+		TenantId:      "t1",
+		AggregateId:   "a1",
+		AggregateType: "Order",
+		Events:        &[]eventstorage.EventDto{event},
+	})
+	assert.NoError(t, err)
+	_, err = storage.ApplyEvent(ctx, &eventstorage.ApplyEventsRequest{
+		TenantId:      "t1",
+		AggregateId:   "a1",
+		AggregateType: "Order",
+		Events:        &[]eventstorage.EventDto{event, newTestEvent("e2", nil)},
+	})
+	assert.True(t, eventstorage.IsSchemaValidationError(err))
+	loadRes, err := storage.LoadEvent(ctx, &eventstorage.LoadEventRequest{TenantId: "t1", AggregateId: "a1", AggregateType: "Order"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(*loadRes.Events))
+}
+
+func TestEventStorage_RelationLifecycle(t *testing.T) {
+	ctx := context.Background()
+	storage, _ := newTestStorage(t)
+
+	for _, id := range []string{"a", "b"} {
+		_, err := storage.CreateEvent(ctx, &eventstorage.CreateEventRequest{
+			TenantId:      "t1",
+			AggregateId:   id,
+			AggregateType: "Order",
+			Events:        &[]eventstorage.EventDto{newTestEvent("e"+id, map[string]string{"CustomerId": "c1"})},
+		})
+		assert.NoError(t, err)
+	}
+	_, err := storage.DeleteEvent(ctx, &eventstorage.DeleteEventRequest{TenantId: "t1", AggregateId: "b", AggregateType: "Order", Event: ptrEvent(newTestEvent("e3", nil))})
+	assert.NoError(t, err)
+
+	res, err := storage.GetRelations(ctx, &eventstorage.GetRelationsRequest{TenantId: "t1", AggregateType: "Order", Filter: "customerId=='c1'"})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), res.TotalRows)
+	assert.Equal(t, "a", res.Data[0].AggregateId)
+
+	res, err = storage.GetRelations(ctx, &eventstorage.GetRelationsRequest{TenantId: "t1", AggregateType: "Order", Sort: "id", IncludeDeleted: true})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), res.TotalRows)
+	assert.True(t, res.Data[1].IsDeleted)
+
+	_, err = storage.RestoreAggregate(ctx, &eventstorage.RestoreAggregateRequest{TenantId: "t1", AggregateId: "b", AggregateType: "Order", Event: ptrEvent(newTestEvent("e4", nil))})
+	assert.NoError(t, err)
+	res, err = storage.GetRelations(ctx, &eventstorage.GetRelationsRequest{TenantId: "t1", AggregateType: "Order"})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), res.TotalRows)
+}
+
+func TestEventStorage_FindRelationReferences(t *testing.T) {
+	ctx := context.Background()
+	storage, _ := newTestStorage(t)
+
+	create := func(aggregateId, aggregateType string, relations map[string]string, lists map[string][]string) {
+		event := newTestEvent("e"+aggregateId, relations)
+		event.RelationLists = lists
+		_, err := storage.CreateEvent(ctx, &eventstorage.CreateEventRequest{
+			TenantId:      "t1",
+			AggregateId:   aggregateId,
+			AggregateType: aggregateType,
+			Events:        &[]eventstorage.EventDto{event},
+		})
+		assert.NoError(t, err)
+	}
+	create("o1", "Order", nil, map[string][]string{"TagId": {"x", "y", "x"}})
+	create("o2", "Order", map[string]string{"TagId": "x"}, nil)
+	create("o3", "Order", nil, map[string][]string{"TagId": {"y"}})
+	create("i1", "Invoice", nil, map[string][]string{"TagId": {"x"}})
+
+	rel, err := storage.GetRelations(ctx, &eventstorage.GetRelationsRequest{TenantId: "t1", AggregateType: "Order", Filter: "tagId=='y'", Sort: "id"})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), rel.TotalRows)
+	assert.Equal(t, []string{"x", "y"}, rel.Data[0].Lists["tag_id"])
+
+	res, err := storage.FindRelationReferences(ctx, &eventstorage.FindRelationReferencesRequest{TenantId: "t1", RelationName: "TagId", TargetId: "x"})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), res.TotalRows)
+	assert.Equal(t, []string{"i1", "o1", "o2"}, []string{res.Data[0].AggregateId, res.Data[1].AggregateId, res.Data[2].AggregateId})
+
+	res, err = storage.FindRelationReferences(ctx, &eventstorage.FindRelationReferencesRequest{TenantId: "t1", RelationName: "TagId", TargetId: "x", PageNum: 1, PageSize: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), res.TotalRows)
+	assert.Equal(t, uint64(2), res.TotalPages)
+	assert.Len(t, res.Data, 1)
+	assert.Equal(t, "o2", res.Data[0].AggregateId)
+
+	_, err = storage.DeleteEvent(ctx, &eventstorage.DeleteEventRequest{TenantId: "t1", AggregateId: "o1", AggregateType: "Order", Event: ptrEvent(newTestEvent("e5", nil))})
+	assert.NoError(t, err)
+	res, err = storage.FindRelationReferences(ctx, &eventstorage.FindRelationReferencesRequest{TenantId: "t1", RelationName: "TagId", TargetId: "x", AggregateTypes: []string{"Order"}})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), res.TotalRows)
+	assert.Equal(t, "o2", res.Data[0].AggregateId)
+
+	_, err = storage.FindRelationReferences(ctx, &eventstorage.FindRelationReferencesRequest{TenantId: "t1", TargetId: "x"})
+	assert.Error(t, err)
+}
+
+func TestEventStorage_SnapshotPolicy(t *testing.T) {
+	// 与es_mongo的镜像策略一致：距上一个镜像的事件数量达到snapshotEventCount时提示保存镜像，只保留最新的snapshotRetainCount个镜像
+	ctx := context.Background()
+	storage := NewMemoryEventStorage(nil)
+	err := storage.Init(common.Metadata{Properties: map[string]string{"snapshotEventCount": "2", "snapshotRetainCount": "1"}}, func() pubsub_adapter.Adapter { return &testAdapter{} })
+	assert.NoError(t, err)
+	_, err = storage.CreateEvent(ctx, &eventstorage.CreateEventRequest{TenantId: "t1", AggregateId: "a1", AggregateType: "Order", Events: &[]eventstorage.EventDto{newTestEvent("e1", nil)}})
+	assert.NoError(t, err)
+
+	apply := func(eventId string) *eventstorage.ApplyEventsResponse {
+		res, err := storage.ApplyEvent(ctx, &eventstorage.ApplyEventsRequest{TenantId: "t1", AggregateId: "a1", AggregateType: "Order", Events: &[]eventstorage.EventDto{newTestEvent(eventId, nil)}})
+		assert.NoError(t, err)
+		return res
+	}
+	assert.True(t, apply("e2").SnapshotRequired)
+	_, err = storage.SaveSnapshot(ctx, &eventstorage.SaveSnapshotRequest{TenantId: "t1", AggregateId: "a1", AggregateType: "Order", SequenceNumber: 2})
+	assert.NoError(t, err)
+	assert.False(t, apply("e3").SnapshotRequired)
+	assert.True(t, apply("e4").SnapshotRequired)
+
+	_, err = storage.SaveSnapshot(ctx, &eventstorage.SaveSnapshotRequest{TenantId: "t1", AggregateId: "a1", AggregateType: "Order", SequenceNumber: 4})
+	assert.NoError(t, err)
+	snapshots := storage.(*EventStorage).snapshots[aggregateKey("t1", "a1")]
+	assert.Equal(t, 1, len(snapshots))
+	assert.Equal(t, uint64(4), snapshots[0].SequenceNumber)
+}
+
+func TestEventStorage_SnapshotRequiredAggregateVersion(t *testing.T) {
+	// 其它版本的镜像无法用于加载当前版本的聚合根，不计入距上一个镜像的事件数量
+	ctx := context.Background()
+	storage := NewMemoryEventStorage(nil)
+	err := storage.Init(common.Metadata{Properties: map[string]string{"snapshotEventCount": "3"}}, func() pubsub_adapter.Adapter { return &testAdapter{} })
+	assert.NoError(t, err)
+	_, err = storage.CreateEvent(ctx, &eventstorage.CreateEventRequest{TenantId: "t1", AggregateId: "a1", AggregateType: "Order", Events: &[]eventstorage.EventDto{newTestEvent("e1", nil)}})
+	assert.NoError(t, err)
+	_, err = storage.ApplyEvent(ctx, &eventstorage.ApplyEventsRequest{TenantId: "t1", AggregateId: "a1", AggregateType: "Order", Events: &[]eventstorage.EventDto{newTestEvent("e2", nil)}})
+	assert.NoError(t, err)
+	_, err = storage.SaveSnapshot(ctx, &eventstorage.SaveSnapshotRequest{TenantId: "t1", AggregateId: "a1", AggregateType: "Order", AggregateVersion: "1.0", SequenceNumber: 2})
+	assert.NoError(t, err)
+
+	res, err := storage.ApplyEvent(ctx, &eventstorage.ApplyEventsRequest{TenantId: "t1", AggregateId: "a1", AggregateType: "Order", AggregateVersion: "1.0", Events: &[]eventstorage.EventDto{newTestEvent("e3", nil)}})
+	assert.NoError(t, err)
+	assert.False(t, res.SnapshotRequired)
+	res, err = storage.ApplyEvent(ctx, &eventstorage.ApplyEventsRequest{TenantId: "t1", AggregateId: "a1", AggregateType: "Order", AggregateVersion: "2.0", Events: &[]eventstorage.EventDto{newTestEvent("e4", nil)}})
+	assert.NoError(t, err)
+	assert.True(t, res.SnapshotRequired)
+}
+
+func ptrEvent(event eventstorage.EventDto) *eventstorage.EventDto {
+	return &event
+}
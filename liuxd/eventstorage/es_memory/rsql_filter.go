@@ -0,0 +1,308 @@
+package es_memory
+
+import (
+	"errors"
+	"fmt"
+	"github.com/liuxd6825/components-contrib/liuxd/common/rsql"
+	"github.com/liuxd6825/components-contrib/liuxd/common/utils"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+type document map[string]interface{}
+
+//
+// rsqlFilter
+// @Description: 在内存中执行rsql过滤，字段名与值的比较规则与es_mongo的MongoProcess一致
+//
+type rsqlFilter struct {
+	expr      rsql.Expression
+	fieldName fieldNameFunc
+}
+
+// fieldNameFunc 将rsql字段名转换为document中的字段路径
+type fieldNameFunc func(name string) string
+
+func newRsqlFilter(filter string) (*rsqlFilter, error) {
+	return newRsqlFilterWith(filter, fieldName)
+}
+
+func newRsqlFilterWith(filter string, name fieldNameFunc) (*rsqlFilter, error) {
+	if len(filter) == 0 {
+		return &rsqlFilter{fieldName: name}, nil
+	}
+	expr, err := rsql.Parse(filter)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("rsql %s expression error, %s", filter, err.Error()))
+	}
+	return &rsqlFilter{expr: expr, fieldName: name}, nil
+}
+
+func (f *rsqlFilter) Match(doc document) bool {
+	if f.expr == nil {
+		return true
+	}
+	return f.match(f.expr, doc)
+}
+
+func (f *rsqlFilter) match(expr rsql.Expression, doc document) bool {
+	switch ex := expr.(type) {
+	case rsql.AndExpression:
+		for _, item := range ex.Items {
+			if !f.match(item, doc) {
+				return false
+			}
+		}
+		return true
+	case rsql.OrExpression:
+		for _, item := range ex.Items {
+			if f.match(item, doc) {
+				return true
+			}
+		}
+		return false
+	case rsql.EqualsComparison:
+		return equals(doc.get(f.fieldName(ex.Identifier.Val)), rsql.GetValue(ex.Val))
+	case rsql.NotEqualsComparison:
+		return !equals(doc.get(f.fieldName(ex.Identifier.Val)), rsql.GetValue(ex.Val))
+	case rsql.LikeComparison:
+		return like(doc.get(f.fieldName(ex.Identifier.Val)), rsql.GetValue(ex.Val))
+	case rsql.NotLikeComparison:
+		return !like(doc.get(f.fieldName(ex.Identifier.Val)), rsql.GetValue(ex.Val))
+	case rsql.GreaterThanComparison:
+		c, ok := compare(doc.get(f.fieldName(ex.Identifier.Val)), rsql.GetValue(ex.Val))
+		return ok && c > 0
+	case rsql.GreaterThanOrEqualsComparison:
+		c, ok := compare(doc.get(f.fieldName(ex.Identifier.Val)), rsql.GetValue(ex.Val))
+		return ok && c >= 0
+	case rsql.LessThanComparison:
+		c, ok := compare(doc.get(f.fieldName(ex.Identifier.Val)), rsql.GetValue(ex.Val))
+		return ok && c < 0
+	case rsql.LessThanOrEqualsComparison:
+		c, ok := compare(doc.get(f.fieldName(ex.Identifier.Val)), rsql.GetValue(ex.Val))
+		return ok && c <= 0
+	case rsql.InComparison:
+		return in(doc.get(f.fieldName(ex.Identifier.Val)), rsql.GetValue(ex.Val))
+	case rsql.NotInComparison:
+		return !in(doc.get(f.fieldName(ex.Identifier.Val)), rsql.GetValue(ex.Val))
+	}
+	return false
+}
+
+//
+// get
+// @Description: 按字段路径取值，支持"."访问嵌套字段
+// @receiver d
+// @param name
+// @return interface{}
+//
+func (d document) get(name string) interface{} {
+	var current interface{} = map[string]interface{}(d)
+	for _, key := range strings.Split(name, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		current, ok = m[key]
+		if !ok {
+			return nil
+		}
+	}
+	return current
+}
+
+// fieldName 字段名转换为蛇形
+func fieldName(name string) string {
+	if name == "id" {
+		return "_id"
+	}
+	return utils.AsMongoName(name)
+}
+
+// eventFieldAliases 事件json名称与存储字段名不一致的字段，与es_mongo一致
+var eventFieldAliases = map[string]string{
+	"id":          "_id",
+	"metadata":    "meta_data",
+	"pubsub_name": "publish_name",
+}
+
+// eventFieldName 只转换第一级字段名，eventData、metadata、relations下的字段按原样使用
+func eventFieldName(name string) string {
+	head, path, nested := strings.Cut(strings.Trim(name, " "), ".")
+	head = utils.AsMongoName(head)
+	if alias, ok := eventFieldAliases[head]; ok {
+		head = alias
+	}
+	if nested {
+		return head + "." + path
+	}
+	return head
+}
+
+func equals(fieldValue, value interface{}) bool {
+	// 与MongoDB一致，数组字段包含值时相等
+	if values, ok := fieldValue.([]string); ok {
+		for _, v := range values {
+			if equals(v, value) {
+				return true
+			}
+		}
+		return false
+	}
+	c, ok := compare(fieldValue, value)
+	return ok && c == 0
+}
+
+func in(fieldValue, value interface{}) bool {
+	values, ok := value.([]interface{})
+	if !ok {
+		return equals(fieldValue, value)
+	}
+	for _, v := range values {
+		if equals(fieldValue, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func like(fieldValue, value interface{}) bool {
+	s, ok := fieldValue.(string)
+	if !ok {
+		return false
+	}
+	re, err := regexp.Compile("(?im)" + fmt.Sprintf("%s", value))
+	if err != nil {
+		return false
+	}
+	return re.MatchString(s)
+}
+
+//
+// compare
+// @Description: 比较两个值，与MongoDB一致，不同类型的值不可比较
+// @param a
+// @param b
+// @return int
+// @return bool 是否可比较
+//
+func compare(a, b interface{}) (int, bool) {
+	if af, ok := asFloat(a); ok {
+		bf, ok := asFloat(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case af < bf:
+			return -1, true
+		case af > bf:
+			return 1, true
+		}
+		return 0, true
+	}
+	switch av := a.(type) {
+	case string:
+		bv, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(av, bv), true
+	case bool:
+		bv, ok := b.(bool)
+		if !ok || av != bv {
+			return 1, ok
+		}
+		return 0, true
+	case time.Time:
+		bv, ok := asTime(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case av.Before(bv):
+			return -1, true
+		case av.After(bv):
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// asTime rsql的date、datetime值为字符串，与时间字段比较时转换为时间
+func asTime(v interface{}) (time.Time, bool) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, true
+	case string:
+		return rsql.ParseTime(t)
+	}
+	return time.Time{}, false
+}
+
+func asFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+//
+// sortDocuments
+// @Description: 按 "name:desc,id:asc" 格式排序
+// @param docs
+// @param sortText
+// @param name 字段名转换
+// @return error
+//
+func sortDocuments(docs []document, sortText string, name fieldNameFunc) error {
+	if len(sortText) == 0 {
+		return nil
+	}
+	type sortItem struct {
+		name string
+		desc bool
+	}
+	var items []sortItem
+	for _, s := range strings.Split(sortText, ",") {
+		parts := strings.Split(s, ":")
+		item := sortItem{name: name(strings.Trim(parts[0], " "))}
+		if len(parts) > 1 {
+			switch order := strings.Trim(strings.ToLower(parts[1]), " "); order {
+			case "asc":
+			case "desc":
+				item.desc = true
+			default:
+				return errors.New("order " + order + " is error")
+			}
+		}
+		items = append(items, item)
+	}
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, item := range items {
+			c, _ := compare(docs[i].get(item.name), docs[j].get(item.name))
+			if c == 0 {
+				continue
+			}
+			if item.desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+	return nil
+}
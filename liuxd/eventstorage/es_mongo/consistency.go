@@ -0,0 +1,172 @@
+package es_mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/liuxd6825/components-contrib/liuxd/common/utils"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/model"
+	"time"
+)
+
+//
+// CheckConsistency
+// @Description: 检查聚合根的事件序号、孤立事件、已删除聚合根的关系及未发送的事件。
+// transactionMode为false时ApplyEvent先递增聚合根的SequenceNumber再保存事件，保存失败会留下缺失的序号，
+// Repair为true时将聚合根的SequenceNumber校正为最后一个事件的序号，并在聚合根上标记缺失的序号，已标记的序号不再报告。
+// 重复的序号、孤立事件与关系只报告不修复。
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.CheckConsistencyResponse
+// @return error
+//
+func (s *EventStorage) CheckConsistency(ctx context.Context, req *eventstorage.CheckConsistencyRequest) (*eventstorage.CheckConsistencyResponse, error) {
+	if req.TenantId == "" {
+		return nil, errors.New("tenantId cannot be empty")
+	}
+	res := &eventstorage.CheckConsistencyResponse{Issues: make([]*eventstorage.ConsistencyIssue, 0)}
+	aggregateIds := make(map[string]bool)
+	err := s.aggregateService.ForEach(ctx, req.TenantId, req.AggregateType, func(agg *model.AggregateEntity) error {
+		aggregateIds[agg.AggregateId] = true
+		res.AggregateCount++
+		return s.checkAggregate(ctx, req, agg, res)
+	})
+	if err != nil {
+		return nil, newError("checkAggregate() error.", err)
+	}
+
+	counts, err := s.eventService.CountByAggregateId(ctx, req.TenantId, req.AggregateType)
+	if err != nil {
+		return nil, newError("countByAggregateId() error.", err)
+	}
+	for _, count := range counts {
+		if aggregateIds[count.AggregateId] {
+			continue
+		}
+		res.EventCount += count.Count
+		res.AddIssue(&eventstorage.ConsistencyIssue{
+			Type:          eventstorage.IssueOrphanEvent,
+			TenantId:      req.TenantId,
+			AggregateId:   count.AggregateId,
+			AggregateType: count.AggregateType,
+			Message:       fmt.Sprintf("%d events without aggregate", count.Count),
+		})
+	}
+	return res, nil
+}
+
+func (s *EventStorage) checkAggregate(ctx context.Context, req *eventstorage.CheckConsistencyRequest, agg *model.AggregateEntity, res *eventstorage.CheckConsistencyResponse) error {
+	events, err := s.eventService.FindSequenceNumbers(ctx, agg.TenantId, agg.AggregateId)
+	if err != nil {
+		return err
+	}
+	res.EventCount += uint64(len(*events))
+	check := checkAggregateEvents(agg, *events, req.UnpublishedBefore)
+	if req.Repair && check.needRepair() {
+		if err := s.aggregateService.Realign(ctx, agg.TenantId, agg.AggregateId, agg.SequenceNumber, check.lastSequenceNumber, check.gaps); err != nil {
+			return err
+		}
+		check.setRepaired()
+	}
+	for _, issue := range check.issues {
+		res.AddIssue(issue)
+	}
+
+	if agg.Deleted {
+		relation, err := s.relationService.FindById(ctx, utils.AsMongoName(agg.AggregateType), agg.TenantId, agg.AggregateId)
+		if err != nil {
+			return err
+		}
+		if relation != nil && !relation.IsDeleted {
+			res.AddIssue(newConsistencyIssue(eventstorage.IssueDeletedAggregateRelation, agg, "relation of deleted aggregate is not deleted"))
+		}
+	}
+	return nil
+}
+
+// aggregateCheck 一个聚合根的检查结果
+type aggregateCheck struct {
+	issues             []*eventstorage.ConsistencyIssue
+	gaps               []uint64
+	mismatch           bool
+	lastSequenceNumber uint64
+}
+
+//
+// checkAggregateEvents
+// @Description: 检查聚合根的事件序号与发送状态
+// @param agg
+// @param events 按序号排序的事件
+// @param unpublishedBefore 只报告此时间之前写入的未发送事件，为nil时报告所有未发送事件
+// @return *aggregateCheck
+//
+func checkAggregateEvents(agg *model.AggregateEntity, events []model.EventEntity, unpublishedBefore *time.Time) *aggregateCheck {
+	check := &aggregateCheck{}
+	markedGaps := make(map[uint64]bool, len(agg.SequenceGaps))
+	for _, gap := range agg.SequenceGaps {
+		markedGaps[gap] = true
+	}
+	expected := uint64(1)
+	for _, event := range events {
+		switch {
+		case event.SequenceNumber < expected:
+			issue := newConsistencyIssue(eventstorage.IssueDuplicateSequence, agg, "duplicate sequence number")
+			issue.EventId = event.EventId
+			issue.SequenceNumber = event.SequenceNumber
+			check.issues = append(check.issues, issue)
+		case event.SequenceNumber > expected:
+			for seq := expected; seq < event.SequenceNumber; seq++ {
+				if markedGaps[seq] {
+					continue
+				}
+				issue := newConsistencyIssue(eventstorage.IssueSequenceGap, agg, "sequence number is missing")
+				issue.SequenceNumber = seq
+				check.issues = append(check.issues, issue)
+				check.gaps = append(check.gaps, seq)
+			}
+		}
+		if event.SequenceNumber >= expected {
+			expected = event.SequenceNumber + 1
+		}
+		if event.PublishStatus != eventstorage.PublishStatusSuccess && (unpublishedBefore == nil || event.TimeStamp.Time().Before(*unpublishedBefore)) {
+			issue := newConsistencyIssue(eventstorage.IssueUnpublishedEvent, agg, "event is not published, status "+event.PublishStatus.ToString())
+			issue.EventId = event.EventId
+			issue.SequenceNumber = event.SequenceNumber
+			check.issues = append(check.issues, issue)
+		}
+	}
+	check.lastSequenceNumber = expected - 1
+	if agg.SequenceNumber != check.lastSequenceNumber {
+		check.mismatch = true
+		message := fmt.Sprintf("aggregate sequence number is %d, last event sequence number is %d", agg.SequenceNumber, check.lastSequenceNumber)
+		issue := newConsistencyIssue(eventstorage.IssueSequenceMismatch, agg, message)
+		issue.SequenceNumber = agg.SequenceNumber
+		check.issues = append(check.issues, issue)
+	}
+	return check
+}
+
+func (c *aggregateCheck) needRepair() bool {
+	return c.mismatch || len(c.gaps) > 0
+}
+
+// setRepaired 缺失的序号已标记，SequenceNumber已校正
+func (c *aggregateCheck) setRepaired() {
+	for _, issue := range c.issues {
+		if issue.Type == eventstorage.IssueSequenceGap || issue.Type == eventstorage.IssueSequenceMismatch {
+			issue.Repaired = true
+		}
+	}
+}
+
+func newConsistencyIssue(issueType eventstorage.ConsistencyIssueType, agg *model.AggregateEntity, message string) *eventstorage.ConsistencyIssue {
+	return &eventstorage.ConsistencyIssue{
+		Type:          issueType,
+		TenantId:      agg.TenantId,
+		AggregateId:   agg.AggregateId,
+		AggregateType: agg.AggregateType,
+		Message:       message,
+	}
+}
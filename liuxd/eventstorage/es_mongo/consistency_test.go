@@ -0,0 +1,120 @@
+package es_mongo
+
+import (
+	"context"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/service"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/model"
+	"reflect"
+	"testing"
+)
+
+type checkTestAggregateService struct {
+	service.AggregateService
+	aggregates []*model.AggregateEntity
+	realigned  map[string][]uint64
+}
+
+func (s *checkTestAggregateService) ForEach(ctx context.Context, tenantId string, aggregateType string, fun func(agg *model.AggregateEntity) error) error {
+	for _, agg := range s.aggregates {
+		if err := fun(agg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *checkTestAggregateService) Realign(ctx context.Context, tenantId, aggregateId string, fromSequenceNumber uint64, toSequenceNumber uint64, gaps []uint64) error {
+	s.realigned[aggregateId] = append([]uint64{toSequenceNumber}, gaps...)
+	return nil
+}
+
+type checkTestEventService struct {
+	service.EventService
+	events map[string][]model.EventEntity
+	counts []*model.AggregateEventCount
+}
+
+func (s *checkTestEventService) FindSequenceNumbers(ctx context.Context, tenantId string, aggregateId string) (*[]model.EventEntity, error) {
+	events := s.events[aggregateId]
+	return &events, nil
+}
+
+func (s *checkTestEventService) CountByAggregateId(ctx context.Context, tenantId string, aggregateType string) ([]*model.AggregateEventCount, error) {
+	return s.counts, nil
+}
+
+type checkTestRelationService struct {
+	service.RelationService
+	relations map[string]*model.RelationEntity
+}
+
+func (s *checkTestRelationService) FindById(ctx context.Context, tableName string, tenantId string, id string) (*model.RelationEntity, error) {
+	return s.relations[id], nil
+}
+
+func newCheckTestEvents(status eventstorage.PublishStatus, sequenceNumbers ...uint64) []model.EventEntity {
+	var events []model.EventEntity
+	for _, seq := range sequenceNumbers {
+		events = append(events, model.EventEntity{SequenceNumber: seq, PublishStatus: status})
+	}
+	return events
+}
+
+func TestEventStorage_CheckConsistency(t *testing.T) {
+	aggregateService := &checkTestAggregateService{
+		aggregates: []*model.AggregateEntity{
+			{TenantId: "t", AggregateId: "ok", AggregateType: "Order", SequenceNumber: 2},
+			{TenantId: "t", AggregateId: "gap", AggregateType: "Order", SequenceNumber: 5},
+			{TenantId: "t", AggregateId: "marked", AggregateType: "Order", SequenceNumber: 3, SequenceGaps: []uint64{2}},
+			{TenantId: "t", AggregateId: "dup", AggregateType: "Order", SequenceNumber: 2},
+			{TenantId: "t", AggregateId: "deleted", AggregateType: "Order", SequenceNumber: 1, Deleted: true},
+		},
+		realigned: map[string][]uint64{},
+	}
+	eventService := &checkTestEventService{
+		events: map[string][]model.EventEntity{
+			"ok":      newCheckTestEvents(eventstorage.PublishStatusSuccess, 1, 2),
+			"gap":     newCheckTestEvents(eventstorage.PublishStatusSuccess, 1, 3),
+			"marked":  newCheckTestEvents(eventstorage.PublishStatusSuccess, 1, 3),
+			"dup":     append(newCheckTestEvents(eventstorage.PublishStatusSuccess, 1, 2), newCheckTestEvents(eventstorage.PublishStatusWait, 2)...),
+			"deleted": newCheckTestEvents(eventstorage.PublishStatusSuccess, 1),
+		},
+		counts: []*model.AggregateEventCount{
+			{AggregateId: "ok", Count: 2},
+			{AggregateId: "orphan", AggregateType: "Order", Count: 3},
+		},
+	}
+	relationService := &checkTestRelationService{
+		relations: map[string]*model.RelationEntity{
+			"deleted": {Id: "deleted", IsDeleted: false},
+		},
+	}
+	storage := &EventStorage{aggregateService: aggregateService, eventService: eventService, relationService: relationService}
+
+	res, err := storage.CheckConsistency(context.Background(), &eventstorage.CheckConsistencyRequest{TenantId: "t", Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, issue := range res.Issues {
+		got = append(got, issue.AggregateId+":"+string(issue.Type))
+	}
+	want := []string{
+		"gap:sequenceGap",
+		"gap:sequenceMismatch",
+		"dup:duplicateSequence",
+		"dup:unpublishedEvent",
+		"deleted:deletedAggregateRelation",
+		"orphan:orphanEvent",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("issues = %v, want %v", got, want)
+	}
+	if res.AggregateCount != 5 || res.EventCount != 13 || res.RepairedCount != 2 {
+		t.Errorf("counts = %d/%d/%d, want 5/13/2", res.AggregateCount, res.EventCount, res.RepairedCount)
+	}
+	if want := map[string][]uint64{"gap": {3, 2}}; !reflect.DeepEqual(aggregateService.realigned, want) {
+		t.Errorf("realigned = %v, want %v", aggregateService.realigned, want)
+	}
+}
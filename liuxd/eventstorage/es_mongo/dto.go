@@ -2,7 +2,7 @@ package es_mongo
 
 import (
 	"github.com/liuxd6825/components-contrib/liuxd/eventstorage"
-	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/model"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/model"
 )
 
 func NewSnapshotDto(snapshotEntity *model.SnapshotEntity) *eventstorage.LoadResponseSnapshotDto {
@@ -45,3 +45,47 @@ func NewLoadResponse(tenantId string, aggregateId string, aggregateType string,
 		Events:        &eventDtos,
 	}
 }
+
+func NewStreamEventDto(event *model.EventEntity) *eventstorage.StreamEventDto {
+	return &eventstorage.StreamEventDto{
+		Position:       event.Position,
+		TenantId:       event.TenantId,
+		AggregateId:    event.AggregateId,
+		AggregateType:  event.AggregateType,
+		CommandId:      event.CommandId,
+		EventId:        event.EventId,
+		EventData:      event.EventData,
+		EventType:      event.EventType,
+		EventVersion:   event.EventVersion,
+		SequenceNumber: event.SequenceNumber,
+		Metadata:       event.Metadata,
+		TimeStamp:      event.TimeStamp.Time(),
+	}
+}
+
+//
+// NewReadEventStreamResponse
+// @Description: events按位置排序，最多limit+1个，多出的一个用于判断是否还有未读取的事件
+// @param events
+// @param fromPosition
+// @param limit
+// @return *eventstorage.ReadEventStreamResponse
+//
+func NewReadEventStreamResponse(events *[]model.EventEntity, fromPosition uint64, limit uint64) *eventstorage.ReadEventStreamResponse {
+	res := &eventstorage.ReadEventStreamResponse{
+		Events:       make([]*eventstorage.StreamEventDto, 0),
+		LastPosition: fromPosition,
+	}
+	if events == nil {
+		return res
+	}
+	for i, event := range *events {
+		if uint64(i) == limit {
+			res.HasMore = true
+			break
+		}
+		res.Events = append(res.Events, NewStreamEventDto(&event))
+		res.LastPosition = event.Position
+	}
+	return res
+}
@@ -6,14 +6,25 @@ import (
 	"errors"
 	"fmt"
 	"github.com/dapr/kit/logger"
+	"github.com/liuxd6825/components-contrib/contenttype"
 	"github.com/liuxd6825/components-contrib/liuxd/common"
+	"github.com/liuxd6825/components-contrib/liuxd/common/utils"
 	"github.com/liuxd6825/components-contrib/liuxd/eventstorage"
-	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/model"
 	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/other"
 	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/service"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/model"
 	"github.com/liuxd6825/components-contrib/pubsub"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io"
+	"time"
 )
 
+// cloudEventsBatchContentType CloudEvents JSON批量格式
+const cloudEventsBatchContentType = "application/cloudevents-batch+json"
+
+// backfillPositionBatchSize 补充全局位置时每次处理的事件数量
+const backfillPositionBatchSize = 1000
+
 type EventStorage struct {
 	mongodb          *other.MongoDB
 	log              logger.Logger
@@ -23,6 +34,13 @@ type EventStorage struct {
 	snapshotService  service.SnapshotService
 	aggregateService service.AggregateService
 	relationService  service.RelationService
+	positionService  service.PositionService
+	dataKeyService   service.DataKeyService
+	encryptor        *eventstorage.FieldEncryptor
+	outboxRelay      *outboxRelay
+	upcasters        *eventstorage.UpcasterRegistry
+	schemas          *eventstorage.SchemaRegistry
+	dedupeWindow     time.Duration
 }
 
 // NewMongoEventSourcing 创建
@@ -31,202 +49,1091 @@ func NewMongoEventSourcing(log logger.Logger) eventstorage.EventStorage {
 }
 
 //
-// Init
-// @Description: 初始化
+// Init
+// @Description: 初始化
+// @receiver s
+// @param metadata
+// @param adapter
+// @return error
+//
+func (s *EventStorage) Init(metadata common.Metadata, adapter eventstorage.GetPubsubAdapter) error {
+	s.getPubsubAdapter = adapter
+	s.metadata = metadata
+	upcasters, err := eventstorage.NewUpcasterRegistryFromMetadata(metadata)
+	if err != nil {
+		return err
+	}
+	s.upcasters = upcasters
+	if s.schemas, err = eventstorage.NewSchemaRegistryFromMetadata(metadata); err != nil {
+		return err
+	}
+	if s.dedupeWindow, err = eventstorage.GetCommandDedupeWindow(metadata); err != nil {
+		return err
+	}
+	if err := s.mongodb.Init(metadata); err != nil {
+		return err
+	}
+
+	aggregateCollection := s.mongodb.NewCollection(s.mongodb.StorageMetadata.AggregateCollectionName)
+	eventCollection := s.mongodb.NewCollection(s.mongodb.StorageMetadata.EventCollectionName)
+	snapshotCollection := s.mongodb.NewCollection(s.mongodb.StorageMetadata.SnapshotCollectionName)
+	positionCollection := s.mongodb.NewCollection(s.mongodb.StorageMetadata.PositionCollectionName)
+	dataKeyCollection := s.mongodb.NewCollection(s.mongodb.StorageMetadata.DataKeyCollectionName)
+
+	//mongoClient := s.mongodb.GetClient()
+
+	s.aggregateService = service.NewAggregateService(s.mongodb, aggregateCollection)
+	s.eventService = service.NewEventService(s.mongodb, eventCollection)
+	s.snapshotService = service.NewSnapshotService(s.mongodb, snapshotCollection)
+	s.relationService = service.NewRelationService(s.mongodb)
+	s.positionService = service.NewPositionService(s.mongodb, positionCollection)
+	s.dataKeyService = service.NewDataKeyService(s.mongodb, dataKeyCollection)
+	if s.encryptor, err = eventstorage.NewFieldEncryptorFromMetadata(metadata, s.dataKeyService); err != nil {
+		return err
+	}
+
+	if s.mongodb.StorageMetadata.CreateIndexes {
+		if err := s.createIndexes(context.Background()); err != nil {
+			return err
+		}
+	}
+	if s.mongodb.StorageMetadata.EventPosition {
+		if err := s.backfillEventPositions(context.Background()); err != nil {
+			return newError("backfillEventPositions() error.", err)
+		}
+	}
+
+	// 补发任务未启用时也用于记录发送失败
+	s.outboxRelay = newOutboxRelay(s.mongodb.StorageMetadata.OutboxRelay, s.eventService, s.publishMessage, s.publishDeadLetter, s.log)
+	if s.mongodb.StorageMetadata.OutboxRelay.Enabled {
+		s.outboxRelay.Start()
+	}
+	return nil
+}
+
+//
+// createIndexes
+// @Description: 创建聚合根、事件、镜像、关系历史集合及metadata中声明的关系字段索引，租户隔离时在租户的集合第一次使用时创建
+// @receiver s
+// @param ctx
+// @return error
+//
+func (s *EventStorage) createIndexes(ctx context.Context) error {
+	if s.mongodb.IsTenantIsolated() {
+		return nil
+	}
+	if err := s.aggregateService.CreateIndexes(ctx); err != nil {
+		return err
+	}
+	if err := s.eventService.CreateIndexes(ctx); err != nil {
+		return err
+	}
+	if err := s.snapshotService.CreateIndexes(ctx); err != nil {
+		return err
+	}
+	for aggregateType, fields := range s.mongodb.StorageMetadata.RelationIndexes {
+		if err := s.relationService.CreateIndexes(ctx, aggregateType, fields); err != nil {
+			return err
+		}
+	}
+	if s.mongodb.StorageMetadata.RelationHistory {
+		return s.relationService.CreateHistoryIndexes(ctx)
+	}
+	return nil
+}
+
+//
+// Close
+// @Description: 停止后台补发任务
+// @receiver s
+// @return error
+//
+func (s *EventStorage) Close() error {
+	if s.outboxRelay != nil {
+		s.outboxRelay.Stop()
+	}
+	return nil
+}
+
+//
+// LoadEvent
+// @Description: 加载聚合事件
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.LoadResponse
+// @return error
+//
+func (s *EventStorage) LoadEvent(ctx context.Context, req *eventstorage.LoadEventRequest) (*eventstorage.LoadResponse, error) {
+	toSequenceNumber := req.ToSequenceNumber
+	if req.ToTime != nil {
+		event, err := s.eventService.FindLastByTime(ctx, req.TenantId, req.AggregateId, req.AggregateType, primitive.NewDateTimeFromTime(*req.ToTime))
+		if err != nil {
+			return nil, newError("findLastByTime() error taking event.", err)
+		}
+		if event == nil {
+			// 指定时间之前聚合根还不存在
+			return NewLoadResponse(req.TenantId, req.AggregateId, req.AggregateType, nil, nil), nil
+		}
+		if toSequenceNumber == 0 || event.SequenceNumber < toSequenceNumber {
+			toSequenceNumber = event.SequenceNumber
+		}
+	}
+
+	sequenceNumber := uint64(0)
+	snapshot, err := s.snapshotService.FindByMaxSequenceNumber(ctx, req.TenantId, req.AggregateId, req.AggregateType, req.AggregateVersion, toSequenceNumber)
+	if err != nil {
+		return nil, newError("findByMaxSequenceNumber() error taking snapshot.", err)
+	}
+	if snapshot != nil {
+		sequenceNumber = snapshot.SequenceNumber
+	}
+	events, err := s.eventService.FindBySequenceNumber(ctx, req.TenantId, req.AggregateId, req.AggregateType, sequenceNumber, toSequenceNumber)
+	if err != nil {
+		return nil, newError("findBySequenceNumber() error taking events.", err)
+	}
+	if err := s.decryptEvents(ctx, events); err != nil {
+		return nil, newError("decryptEvents() error.", err)
+	}
+	if err := s.upcastEvents(events); err != nil {
+		return nil, newError("upcastEvents() error.", err)
+	}
+	resp := NewLoadResponse(req.TenantId, req.AggregateId, req.AggregateType, snapshot, events)
+	return resp, nil
+}
+
+//
+// CreateEvent
+// @Description: 创建聚合根并应用领域事件
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.CreateEventResponse
+// @return error
+//
+func (s *EventStorage) CreateEvent(ctx context.Context, req *eventstorage.CreateEventRequest) (*eventstorage.CreateEventResponse, error) {
+	if err := s.schemas.ValidateEvents(req.AggregateType, req.Events); err != nil {
+		return nil, err
+	}
+	var applyEvents []*eventstorage.Event
+	err := s.mongodb.WithTransaction(ctx, func(ctx context.Context) error {
+		applyEvents = nil
+		commandEvents, err := s.findCommandEvents(ctx, req.TenantId, req.AggregateId, req.GetCommandId())
+		if err != nil || len(commandEvents) > 0 {
+			// 命令已处理，返回首次处理的结果
+			return err
+		}
+
+		agg, err := s.aggregateService.FindById(ctx, req.TenantId, req.AggregateId)
+		if err != nil {
+			return err
+		}
+		if agg != nil {
+			return errors.New(fmt.Sprintf("aggregateId \"%s\" already exists", req.AggregateId))
+		}
+
+		agg, err = s.newAggregateEntity(req)
+		if err != nil {
+			return err
+		}
+		if err = s.aggregateService.Create(ctx, agg); err != nil {
+			return err
+		}
+
+		applyEvents, err = s.saveEvents(ctx, req.TenantId, req.AggregateId, req.AggregateType, req.Events, 1)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.publishEvents(ctx, applyEvents)
+	return &eventstorage.CreateEventResponse{}, nil
+}
+
+//
+// DeleteEvent
+// @Description:
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.DeleteEventResponse
+// @return error
+//
+func (s *EventStorage) DeleteEvent(ctx context.Context, req *eventstorage.DeleteEventRequest) (*eventstorage.DeleteEventResponse, error) {
+	if err := s.schemas.Validate(req.AggregateType, req.Event); err != nil {
+		return nil, err
+	}
+	var applyEvents []*eventstorage.Event
+	err := s.mongodb.WithTransaction(ctx, func(ctx context.Context) error {
+		agg, err := s.aggregateService.FindById(ctx, req.TenantId, req.AggregateId)
+		if err != nil {
+			return err
+		}
+		if agg == nil {
+			return errors.New(fmt.Sprintf("aggregate id \"%s\" not found", req.AggregateId))
+		}
+		if agg.Deleted {
+			return errors.New(fmt.Sprintf("aggregate id \"%s\" is deleted", req.AggregateId))
+		}
+		_, sequenceNumber, err := s.aggregateService.NextSequenceNumber(ctx, req.TenantId, req.AggregateId, 1, req.ExpectedSequenceNumber)
+		if err != nil {
+			return err
+		}
+		if err := s.aggregateService.Delete(ctx, req.TenantId, req.AggregateId); err != nil {
+			return err
+		}
+		events := []eventstorage.EventDto{*req.Event}
+		if applyEvents, err = s.saveEvents(ctx, req.TenantId, req.AggregateId, req.AggregateType, &events, sequenceNumber); err != nil {
+			return err
+		}
+		return s.relationService.Delete(ctx, utils.AsMongoName(req.AggregateType), req.TenantId, req.AggregateId)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.publishEvents(ctx, applyEvents)
+	return &eventstorage.DeleteEventResponse{}, nil
+}
+
+//
+// ApplyEvent
+// @Description: 应用多个领域事件
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.ApplyEventsResponse
+// @return error
+//
+func (s *EventStorage) ApplyEvent(ctx context.Context, req *eventstorage.ApplyEventsRequest) (*eventstorage.ApplyEventsResponse, error) {
+	if req == nil {
+		return nil, errors.New("request is nil")
+	}
+	length := len(*req.Events)
+	if length == 0 {
+		return nil, errors.New("request.events size 0 ")
+	}
+	if err := s.schemas.ValidateEvents(req.AggregateType, req.Events); err != nil {
+		return nil, err
+	}
+
+	var applyEvents []*eventstorage.Event
+	var lastSequenceNumber uint64
+	err := s.mongodb.WithTransaction(ctx, func(ctx context.Context) error {
+		applyEvents = nil
+		commandEvents, err := s.findCommandEvents(ctx, req.TenantId, req.AggregateId, req.GetCommandId())
+		if err != nil {
+			return err
+		}
+		if len(commandEvents) > 0 {
+			// 命令已处理，返回首次处理的结果
+			lastSequenceNumber = commandEvents[len(commandEvents)-1].SequenceNumber
+			return nil
+		}
+
+		agg, sequenceNumber, err := s.aggregateService.NextSequenceNumber(ctx, req.TenantId, req.AggregateId, uint64(length), req.ExpectedSequenceNumber)
+		if err != nil {
+			return err
+		}
+		if agg == nil {
+			return errors.New(fmt.Sprintf("aggregate id \"%s\" not found", req.AggregateId))
+		}
+		if agg.Deleted {
+			return errors.New(fmt.Sprintf("aggregate id \"%s\" is already deleted.", req.AggregateId))
+		}
+
+		lastSequenceNumber = sequenceNumber + uint64(length) - 1
+		applyEvents, err = s.saveEvents(ctx, req.TenantId, req.AggregateId, req.AggregateType, req.Events, sequenceNumber)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.publishEvents(ctx, applyEvents)
+	snapshotRequired, err := s.isSnapshotRequired(ctx, req.TenantId, req.AggregateId, req.AggregateType, req.AggregateVersion, lastSequenceNumber)
+	if err != nil {
+		return nil, newError("isSnapshotRequired() error taking snapshot.", err)
+	}
+	return &eventstorage.ApplyEventsResponse{
+		SequenceNumber:   lastSequenceNumber,
+		SnapshotRequired: snapshotRequired,
+	}, nil
+}
+
+//
+// isSnapshotRequired
+// @Description: 距上一个镜像的事件数量是否达到镜像策略
+// @receiver s
+// @param ctx
+// @param tenantId
+// @param aggregateId
+// @param aggregateType
+// @param aggregateVersion 聚合根当前版本，不为空时忽略其它版本的镜像
+// @param sequenceNumber 聚合根当前序号
+// @return bool
+// @return error
+//
+func (s *EventStorage) isSnapshotRequired(ctx context.Context, tenantId, aggregateId, aggregateType, aggregateVersion string, sequenceNumber uint64) (bool, error) {
+	eventCount := s.mongodb.StorageMetadata.SnapshotPolicy.GetEventCount(aggregateType)
+	if eventCount == 0 {
+		return false, nil
+	}
+	snapshotSequenceNumber := uint64(0)
+	if sequenceNumber >= eventCount {
+		snapshot, err := s.snapshotService.FindByMaxSequenceNumber(ctx, tenantId, aggregateId, aggregateType, aggregateVersion, 0)
+		if err != nil {
+			return false, err
+		}
+		if snapshot != nil {
+			snapshotSequenceNumber = snapshot.SequenceNumber
+		}
+	}
+	return sequenceNumber >= snapshotSequenceNumber+eventCount, nil
+}
+
+//
+// findCommandEvents
+// @Description: 查找去重时间窗口内由commandId产生的事件，commandId为空或不去重时返回nil。
+// 去重是先查询后写入，只在事务中可靠：并发的重复命令都会写入聚合根文档，后提交的事务因WriteConflict重试，重试时查到已处理的命令。
+// transactionMode为false（或auto连接单机服务器）时没有该保证，并发重试同一commandId可能重复追加事件，只有顺序重试能去重；
+// ApplyEvent设置ExpectedSequenceNumber时，重复的请求返回ConcurrencyConflictError，不会重复追加。
+// @receiver s
+// @param ctx
+// @param tenantId
+// @param aggregateId
+// @param commandId
+// @return []model.EventEntity
+// @return error
+//
+func (s *EventStorage) findCommandEvents(ctx context.Context, tenantId string, aggregateId string, commandId string) ([]model.EventEntity, error) {
+	if commandId == "" || s.dedupeWindow <= 0 {
+		return nil, nil
+	}
+	after := primitive.NewDateTimeFromTime(time.Now().Add(-s.dedupeWindow))
+	events, err := s.eventService.FindByCommandId(ctx, tenantId, commandId, after)
+	if err != nil || events == nil || len(*events) == 0 {
+		return nil, err
+	}
+	if event := (*events)[0]; event.AggregateId != aggregateId {
+		return nil, eventstorage.NewCommandConflictError(commandId, event.AggregateId)
+	}
+	return *events, nil
+}
+
+func (s *EventStorage) GetRelations(ctx context.Context, req *eventstorage.GetRelationsRequest) (*eventstorage.GetRelationsResponse, error) {
+	findRes, _, err := s.relationService.FindPaging(ctx, req.AggregateType, req, req.IncludeDeleted)
+	if err != nil {
+		return nil, err
+	}
+	var errMsg string
+	if findRes.Error != nil {
+		errMsg = findRes.Error.Error()
+	}
+	var relations []*eventstorage.Relation
+	if findRes.Data != nil {
+		for _, item := range *findRes.Data {
+			relations = append(relations, item.NewRelation())
+		}
+	}
+	res := &eventstorage.GetRelationsResponse{
+		Data:       relations,
+		TotalRows:  uint64(findRes.TotalRows),
+		TotalPages: uint64(findRes.TotalPages),
+		PageSize:   uint64(findRes.PageSize),
+		PageNum:    uint64(findRes.PageNum),
+		Filter:     findRes.Filter,
+		Sort:       findRes.Sort,
+		Error:      errMsg,
+	}
+	return res, nil
+}
+
+//
+// FindRelationReferences
+// @Description: 跨关系表反向查询引用目标Id的聚合根关系，AggregateTypes为空时查询租户已有的所有聚合类型
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.FindRelationReferencesResponse
+// @return error
+//
+func (s *EventStorage) FindRelationReferences(ctx context.Context, req *eventstorage.FindRelationReferencesRequest) (*eventstorage.FindRelationReferencesResponse, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	aggregateTypes := req.AggregateTypes
+	if len(aggregateTypes) == 0 {
+		var err error
+		if aggregateTypes, err = s.aggregateService.FindAggregateTypes(ctx, req.TenantId); err != nil {
+			return nil, err
+		}
+	}
+	list, totalRows, err := s.relationService.FindReferences(ctx, eventstorage.NewRelationTableNames(aggregateTypes), req)
+	if err != nil {
+		return nil, err
+	}
+	relations := make([]*eventstorage.Relation, 0, len(list))
+	for _, item := range list {
+		relations = append(relations, item.NewRelation())
+	}
+	return eventstorage.NewFindRelationReferencesResponse(relations, totalRows, req), nil
+}
+
+//
+// FindEvents
+// @Description: 分页查询事件及发送状态，过滤与排序使用rsql
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.FindEventsResponse
+// @return error
+//
+func (s *EventStorage) FindEvents(ctx context.Context, req *eventstorage.FindEventsRequest) (*eventstorage.FindEventsResponse, error) {
+	if req.TenantId == "" {
+		return nil, errors.New("tenantId cannot be empty")
+	}
+	findRes, _, err := s.eventService.FindPaging(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	var events []*eventstorage.FindEventDto
+	if findRes.Data != nil {
+		for _, item := range *findRes.Data {
+			item, err := item.Decrypt(ctx, s.encryptor)
+			if err != nil {
+				return nil, newError("decryptEvents() error.", err)
+			}
+			if item, err = item.Upcast(s.upcasters); err != nil {
+				return nil, newError("upcastEvents() error.", err)
+			}
+			events = append(events, item.NewFindEventDto())
+		}
+	}
+	return eventstorage.NewFindEventsResponse(events, findRes.TotalRows, req), nil
+}
+
+//
+// FindAggregates
+// @Description: 分页查询聚合根，过滤与排序使用rsql
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.FindAggregatesResponse
+// @return error
+//
+func (s *EventStorage) FindAggregates(ctx context.Context, req *eventstorage.FindAggregatesRequest) (*eventstorage.FindAggregatesResponse, error) {
+	if req.TenantId == "" {
+		return nil, errors.New("tenantId cannot be empty")
+	}
+	findRes, _, err := s.aggregateService.FindPaging(ctx, req.AggregateType, req)
+	if err != nil {
+		return nil, err
+	}
+	var aggregates []*eventstorage.AggregateDto
+	if findRes.Data != nil {
+		for _, item := range *findRes.Data {
+			aggregates = append(aggregates, item.NewAggregateDto())
+		}
+	}
+	return eventstorage.NewFindAggregatesResponse(aggregates, findRes.TotalRows, req), nil
+}
+
+//
+// CountAggregates
+// @Description: 统计租户的聚合根数量
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.CountAggregatesResponse
+// @return error
+//
+func (s *EventStorage) CountAggregates(ctx context.Context, req *eventstorage.CountAggregatesRequest) (*eventstorage.CountAggregatesResponse, error) {
+	if req.TenantId == "" {
+		return nil, errors.New("tenantId cannot be empty")
+	}
+	count, err := s.aggregateService.Count(ctx, req.TenantId, req.AggregateType, req.Filter)
+	if err != nil {
+		return nil, err
+	}
+	return &eventstorage.CountAggregatesResponse{Count: count}, nil
+}
+
+//
+// ExistAggregate
+// @Description: 聚合根是否存在，已删除的聚合根IsExist也为true
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.ExistAggregateResponse
+// @return error
+//
+func (s *EventStorage) ExistAggregate(ctx context.Context, req *eventstorage.ExistAggregateRequest) (*eventstorage.ExistAggregateResponse, error) {
+	agg, err := s.aggregateService.FindById(ctx, req.TenantId, req.AggregateId)
+	if err != nil {
+		return nil, err
+	}
+	if agg == nil {
+		return &eventstorage.ExistAggregateResponse{}, nil
+	}
+	return &eventstorage.ExistAggregateResponse{IsExist: true, IsDeleted: agg.Deleted}, nil
+}
+
+//
+// RestoreAggregate
+// @Description: 恢复已删除的聚合根，并保存与发送恢复事件
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.RestoreAggregateResponse
+// @return error
+//
+func (s *EventStorage) RestoreAggregate(ctx context.Context, req *eventstorage.RestoreAggregateRequest) (*eventstorage.RestoreAggregateResponse, error) {
+	if req.Event == nil {
+		return nil, errors.New("events is nil")
+	}
+	if err := s.schemas.Validate(req.AggregateType, req.Event); err != nil {
+		return nil, err
+	}
+	var applyEvents []*eventstorage.Event
+	var sequenceNumber uint64
+	err := s.mongodb.WithTransaction(ctx, func(ctx context.Context) error {
+		agg, err := s.aggregateService.FindById(ctx, req.TenantId, req.AggregateId)
+		if err != nil {
+			return err
+		}
+		if agg == nil {
+			return errors.New(fmt.Sprintf("aggregate id \"%s\" not found", req.AggregateId))
+		}
+		if !agg.Deleted {
+			return errors.New(fmt.Sprintf("aggregate id \"%s\" is not deleted", req.AggregateId))
+		}
+		_, sequenceNumber, err = s.aggregateService.NextSequenceNumber(ctx, req.TenantId, req.AggregateId, 1, req.ExpectedSequenceNumber)
+		if err != nil {
+			return err
+		}
+		if err := s.aggregateService.Restore(ctx, req.TenantId, req.AggregateId); err != nil {
+			return err
+		}
+		events := []eventstorage.EventDto{*req.Event}
+		if applyEvents, err = s.saveEvents(ctx, req.TenantId, req.AggregateId, req.AggregateType, &events, sequenceNumber); err != nil {
+			return err
+		}
+		return s.restoreRelations(ctx, req.TenantId, req.AggregateId, req.AggregateType)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.publishEvents(ctx, applyEvents)
+	return &eventstorage.RestoreAggregateResponse{SequenceNumber: sequenceNumber}, nil
+}
+
+//
+// ExportEvents
+// @Description: 按聚合根Id顺序导出租户的聚合根、事件、镜像与关系，事件数据解密后导出，不转换版本
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.ExportEventsResponse
+// @return error
+//
+func (s *EventStorage) ExportEvents(ctx context.Context, req *eventstorage.ExportEventsRequest) (*eventstorage.ExportEventsResponse, error) {
+	w, err := eventstorage.NewExportWriter(req)
+	if err != nil {
+		return nil, err
+	}
+	err = s.aggregateService.ForEach(ctx, req.TenantId, req.AggregateType, func(agg *model.AggregateEntity) error {
+		exportAgg, err := s.newExportAggregate(ctx, agg)
+		if err != nil {
+			return err
+		}
+		return w.Write(exportAgg)
+	})
+	if err != nil {
+		_ = w.Close()
+		return nil, newError("exportEvents() error.", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return w.Response(), nil
+}
+
+func (s *EventStorage) newExportAggregate(ctx context.Context, agg *model.AggregateEntity) (*eventstorage.ExportAggregate, error) {
+	events, err := s.eventService.FindBySequenceNumber(ctx, agg.TenantId, agg.AggregateId, agg.AggregateType, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.decryptEvents(ctx, events); err != nil {
+		return nil, err
+	}
+	snapshots, err := s.snapshotService.FindByAggregateId(ctx, agg.TenantId, agg.AggregateId)
+	if err != nil {
+		return nil, err
+	}
+	relation, err := s.relationService.FindById(ctx, utils.AsMongoName(agg.AggregateType), agg.TenantId, agg.AggregateId)
+	if err != nil {
+		return nil, err
+	}
+	eventList := make([]*model.EventEntity, 0, len(*events))
+	for i := range *events {
+		eventList = append(eventList, &(*events)[i])
+	}
+	snapshotList := make([]*model.SnapshotEntity, 0, len(*snapshots))
+	for i := range *snapshots {
+		snapshotList = append(snapshotList, &(*snapshots)[i])
+	}
+	return model.NewExportAggregate(agg, eventList, snapshotList, relation), nil
+}
+
+//
+// ImportEvents
+// @Description: 导入ExportEvents导出的文件，每个聚合根在一个事务中导入，事件重新分配全局位置，事件数据按encryptFields重新加密。
+// 导入失败时返回已导入的数量、失败的聚合根与错误，已导入的聚合根不回滚，可使用SkipExisting继续导入。
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.ImportEventsResponse
+// @return error
+//
+func (s *EventStorage) ImportEvents(ctx context.Context, req *eventstorage.ImportEventsRequest) (*eventstorage.ImportEventsResponse, error) {
+	r, err := eventstorage.NewExportReader(req)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	for {
+		agg, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return r.Response(), err
+		}
+		entities := model.NewImportEntities(agg)
+		if err := entities.Encrypt(ctx, s.encryptor); err != nil {
+			r.Failed(agg)
+			return r.Response(), newError("encryptEvents() error.", err)
+		}
+		imported, err := s.importAggregate(ctx, entities, req.Overwrite, req.SkipExisting)
+		if err != nil {
+			r.Failed(agg)
+			return r.Response(), newError("importAggregate() error.", err)
+		}
+		if !imported {
+			r.Skipped(agg)
+			continue
+		}
+		r.Imported(agg)
+	}
+	return r.Response(), nil
+}
+
+//
+// importAggregate
+// @Description: 在一个事务中导入一个聚合根
+// @receiver s
+// @param ctx
+// @param entities
+// @param overwrite 聚合根已存在时是否删除后导入
+// @param skipExisting 聚合根已存在时是否跳过
+// @return bool 聚合根已存在并跳过时为false
+// @return error
+//
+func (s *EventStorage) importAggregate(ctx context.Context, entities *model.ImportEntities, overwrite bool, skipExisting bool) (bool, error) {
+	if err := entities.Validate(); err != nil {
+		return false, err
+	}
+	agg := entities.Aggregate
+	imported := false
+	err := s.mongodb.WithTransaction(ctx, func(ctx context.Context) error {
+		imported = false
+		old, err := s.aggregateService.FindById(ctx, agg.TenantId, agg.AggregateId)
+		if err != nil {
+			return err
+		}
+		if old != nil {
+			if skipExisting {
+				return nil
+			}
+			if !overwrite {
+				return errors.New(fmt.Sprintf("aggregate id \"%s\" already exists", agg.AggregateId))
+			}
+			if err := s.removeAggregate(ctx, old); err != nil {
+				return err
+			}
+		}
+		if err := s.aggregateService.Create(ctx, agg); err != nil {
+			return err
+		}
+		if count := uint64(len(entities.Events)); count > 0 {
+			startPosition, err := s.nextEventPosition(ctx, count)
+			if err != nil {
+				return err
+			}
+			for i, event := range entities.Events {
+				event.Position = 0
+				if startPosition > 0 {
+					event.Position = startPosition + uint64(i)
+				}
+			}
+		}
+		if err := s.eventService.Import(ctx, entities.Events); err != nil {
+			return err
+		}
+		if err := s.snapshotService.Import(ctx, entities.Snapshots); err != nil {
+			return err
+		}
+		for _, relation := range entities.Relations {
+			if err := s.relationService.Save(ctx, relation); err != nil {
+				return err
+			}
+		}
+		imported = true
+		return nil
+	})
+	return imported, err
+}
+
+// removeAggregate 物理删除聚合根及其事件、镜像与关系
+func (s *EventStorage) removeAggregate(ctx context.Context, agg *model.AggregateEntity) error {
+	if err := s.eventService.DeleteByAggregateId(ctx, agg.TenantId, agg.AggregateId); err != nil {
+		return err
+	}
+	if err := s.snapshotService.DeleteByAggregateId(ctx, agg.TenantId, agg.AggregateId); err != nil {
+		return err
+	}
+	if err := s.relationService.DeleteById(ctx, utils.AsMongoName(agg.AggregateType), agg.TenantId, agg.AggregateId); err != nil {
+		return err
+	}
+	return s.aggregateService.Remove(ctx, agg.TenantId, agg.AggregateId)
+}
+
+//
+// EraseDataKey
+// @Description: 销毁数据密钥，事件保持不变，加密字段读取时为nil。
+// 同时删除Id与KeyId相同的聚合根的镜像，以及事件metadata的dataKeyId为KeyId的聚合根的镜像，查找这些聚合根时不使用索引。
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.EraseDataKeyResponse
+// @return error
+//
+func (s *EventStorage) EraseDataKey(ctx context.Context, req *eventstorage.EraseDataKeyRequest) (*eventstorage.EraseDataKeyResponse, error) {
+	if req.TenantId == "" || req.KeyId == "" {
+		return nil, errors.New("tenantId and keyId cannot be empty")
+	}
+	if err := s.dataKeyService.EraseDataKey(ctx, req.TenantId, req.KeyId); err != nil {
+		return nil, newError("eraseDataKey() error.", err)
+	}
+	aggregateIds, err := s.eventService.FindAggregateIdsByDataKeyId(ctx, req.TenantId, req.KeyId)
+	if err != nil {
+		return nil, newError("findAggregateIdsByDataKeyId() error.", err)
+	}
+	for _, aggregateId := range append([]string{req.KeyId}, aggregateIds...) {
+		if err := s.snapshotService.DeleteByAggregateId(ctx, req.TenantId, aggregateId); err != nil {
+			return nil, newError("deleteByAggregateId() error deleting snapshots.", err)
+		}
+	}
+	return &eventstorage.EraseDataKeyResponse{}, nil
+}
+
+//
+// ReadEventStream
+// @Description: 按全局位置顺序读取事件，eventPosition为false时不可用。
+// 位置在写入事务中分配，transactionMode为false时并发写入可能使位置顺序与写入完成的顺序不一致。
+// 没有位置的事件（本功能之前写入或eventPosition为false时写入）在Init时按写入时间补充位置，见 backfillEventPositions。
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.ReadEventStreamResponse
+// @return error
+//
+func (s *EventStorage) ReadEventStream(ctx context.Context, req *eventstorage.ReadEventStreamRequest) (*eventstorage.ReadEventStreamResponse, error) {
+	if err := s.checkEventPosition(); err != nil {
+		return nil, err
+	}
+	limit := req.GetLimit()
+	events, err := s.eventService.FindByPosition(ctx, req.TenantId, req.AggregateType, req.EventType, req.FromPosition, int64(limit+1))
+	if err != nil {
+		return nil, newError("findByPosition() error taking events.", err)
+	}
+	if err := s.decryptEvents(ctx, events); err != nil {
+		return nil, newError("decryptEvents() error.", err)
+	}
+	if err := s.upcastEvents(events); err != nil {
+		return nil, newError("upcastEvents() error.", err)
+	}
+	return NewReadEventStreamResponse(events, req.FromPosition, limit), nil
+}
+
+//
+// ReplayEvents
+// @Description: 按全局位置顺序将历史事件重新发布到请求指定的PubsubName/Topic，消息元数据中带有重放标记。
+// 重放不修改事件的发布状态。发布失败时返回已完成的进度和错误，使用LastPosition续传。eventPosition为false时不可用。
+// 从头开始（FromPosition为0）时先为没有位置的事件补充位置，包括Init之后由旧版本实例写入的事件，升级前的历史事件同样会被重放。
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.ReplayEventsResponse
+// @return error
+//
+func (s *EventStorage) ReplayEvents(ctx context.Context, req *eventstorage.ReplayEventsRequest) (*eventstorage.ReplayEventsResponse, error) {
+	if err := s.checkEventPosition(); err != nil {
+		return nil, err
+	}
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	if req.ReplayId == "" {
+		req.ReplayId = model.NewObjectID()
+	}
+	if req.FromPosition == 0 {
+		if err := s.backfillTenantPositions(ctx, req.TenantId); err != nil {
+			return nil, newError("backfillTenantPositions() error.", err)
+		}
+	}
+	limit := req.GetLimit()
+	events, err := s.eventService.FindForReplay(ctx, req, req.FromPosition, int64(limit+1))
+	if err != nil {
+		return nil, newError("findForReplay() error taking events.", err)
+	}
+	totalCount, err := s.eventService.CountForReplay(ctx, req, 0)
+	if err != nil {
+		return nil, newError("countForReplay() error.", err)
+	}
+
+	res := &eventstorage.ReplayEventsResponse{
+		ReplayId:     req.ReplayId,
+		TotalCount:   totalCount,
+		LastPosition: req.FromPosition,
+	}
+	var publishErr error
+	for i, event := range *events {
+		if uint64(i) == limit {
+			res.HasMore = true
+			break
+		}
+		if publishErr = s.replayEvent(ctx, req, &event); publishErr != nil {
+			res.HasMore = true
+			break
+		}
+		res.PublishedCount++
+		res.LastPosition = event.Position
+	}
+
+	if res.LastPosition > 0 {
+		processedCount, err := s.eventService.CountForReplay(ctx, req, res.LastPosition)
+		if err != nil {
+			return nil, newError("countForReplay() error.", err)
+		}
+		res.ProcessedCount = processedCount
+	}
+	if publishErr != nil {
+		return res, newError("publishMessage() failed to replay event.", publishErr)
+	}
+	return res, nil
+}
+
+func (s *EventStorage) replayEvent(ctx context.Context, req *eventstorage.ReplayEventsRequest, event *model.EventEntity) error {
+	event, err := event.Decrypt(ctx, s.encryptor)
+	if err != nil {
+		return err
+	}
+	if event, err = event.Upcast(s.upcasters); err != nil {
+		return err
+	}
+	pubData, err := req.NewPublishRequest(newEventFromEntity(event), event.Position)
+	if err != nil {
+		return err
+	}
+	return s.getPubsubAdapter().Publish(pubData)
+}
+
+//
+// backfillEventPositions
+// @Description: 为没有全局位置的事件按写入时间(time_stamp, _id)分配位置，使升级前写入的事件可以被ReadEventStream与ReplayEvents读取。
+// 补充的位置排在已有位置之后；租户隔离时按租户依次分配。多个实例同时启动时只有一个实例的位置生效，其余分配的位置成为空位
+// @receiver s
+// @param ctx
+// @return error
+//
+func (s *EventStorage) backfillEventPositions(ctx context.Context) error {
+	tenantIds := []string{""}
+	if s.mongodb.IsTenantIsolated() {
+		var err error
+		if tenantIds, err = s.mongodb.FindTenantIds(ctx, s.mongodb.StorageMetadata.EventCollectionName); err != nil {
+			return err
+		}
+	}
+	for _, tenantId := range tenantIds {
+		if err := s.backfillTenantPositions(ctx, tenantId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// backfillTenantPositions
+// @Description: 为tenantId的集合中没有全局位置的事件分配位置，租户未隔离时处理所有租户的事件
 // @receiver s
-// @param metadata
-// @param adapter
+// @param ctx
+// @param tenantId
 // @return error
 //
-func (s *EventStorage) Init(metadata common.Metadata, adapter eventstorage.GetPubsubAdapter) error {
-	s.getPubsubAdapter = adapter
-	s.metadata = metadata
-	if err := s.mongodb.Init(metadata); err != nil {
-		return err
+func (s *EventStorage) backfillTenantPositions(ctx context.Context, tenantId string) error {
+	for {
+		events, err := s.eventService.FindWithoutPosition(ctx, tenantId, backfillPositionBatchSize)
+		if err != nil {
+			return err
+		}
+		count := uint64(len(*events))
+		if count == 0 {
+			return nil
+		}
+		startPosition, err := s.nextEventPosition(ctx, count)
+		if err != nil {
+			return err
+		}
+		for i := range *events {
+			(*events)[i].Position = startPosition + uint64(i)
+		}
+		if err := s.eventService.UpdatePositions(ctx, tenantId, *events); err != nil {
+			return err
+		}
+		if count < backfillPositionBatchSize {
+			return nil
+		}
 	}
+}
 
-	aggregateCollection := s.mongodb.NewCollection(s.mongodb.StorageMetadata.AggregateCollectionName)
-	eventCollection := s.mongodb.NewCollection(s.mongodb.StorageMetadata.EventCollectionName)
-	snapshotCollection := s.mongodb.NewCollection(s.mongodb.StorageMetadata.SnapshotCollectionName)
-
-	//mongoClient := s.mongodb.GetClient()
-
-	s.aggregateService = service.NewAggregateService(s.mongodb, aggregateCollection)
-	s.eventService = service.NewEventService(s.mongodb, eventCollection)
-	s.snapshotService = service.NewSnapshotService(s.mongodb, snapshotCollection)
-	s.relationService = service.NewRelationService(s.mongodb)
-
+//
+// checkEventPosition
+// @Description: eventPosition为false时事件没有全局位置，不能按位置读取
+// @receiver s
+// @return error
+//
+func (s *EventStorage) checkEventPosition() error {
+	if !s.mongodb.StorageMetadata.EventPosition {
+		return errors.New("event stream is disabled, eventPosition is false")
+	}
 	return nil
 }
 
 //
-// LoadEvent
-// @Description: 加载聚合事件
+// nextEventPosition
+// @Description: 分配count个连续的全局位置，返回起始位置。eventPosition为false时不分配，返回0，事件的位置保持为0
 // @receiver s
 // @param ctx
-// @param req
-// @return *eventstorage.LoadResponse
+// @param count
+// @return uint64
 // @return error
 //
-func (s *EventStorage) LoadEvent(ctx context.Context, req *eventstorage.LoadEventRequest) (*eventstorage.LoadResponse, error) {
-	sequenceNumber := uint64(0)
-	snapshot, err := s.snapshotService.FindByMaxSequenceNumber(ctx, req.TenantId, req.AggregateId, req.AggregateType)
-	if err != nil {
-		return nil, newError("findByMaxSequenceNumber() error taking snapshot.", err)
-	}
-	if snapshot != nil {
-		sequenceNumber = snapshot.SequenceNumber
+func (s *EventStorage) nextEventPosition(ctx context.Context, count uint64) (uint64, error) {
+	if !s.mongodb.StorageMetadata.EventPosition {
+		return 0, nil
 	}
-	events, err := s.eventService.FindBySequenceNumber(ctx, req.TenantId, req.AggregateId, req.AggregateType, sequenceNumber)
+	position, err := s.positionService.NextEventPosition(ctx, count)
 	if err != nil {
-		return nil, newError("findBySequenceNumber() error taking events.", err)
+		return 0, newError("positionService.NextEventPosition() error.", err)
 	}
-	resp := NewLoadResponse(req.TenantId, req.AggregateId, req.AggregateType, snapshot, events)
-	return resp, nil
+	return position, nil
 }
 
 //
-// CreateEvent
-// @Description: 创建聚合根并应用领域事件
+// decryptEvents
+// @Description: 解密事件数据，只替换列表中的元素，不修改存储的数据
 // @receiver s
 // @param ctx
-// @param req
-// @return *eventstorage.CreateEventResponse
+// @param events
 // @return error
 //
-func (s *EventStorage) CreateEvent(ctx context.Context, req *eventstorage.CreateEventRequest) (*eventstorage.CreateEventResponse, error) {
-	agg, err := s.aggregateService.FindById(ctx, req.TenantId, req.AggregateId)
-	if err != nil {
-		return nil, err
-	}
-	if agg != nil {
-		return nil, errors.New(fmt.Sprintf("aggregateId \"%s\" already exists", req.AggregateId))
-	}
-
-	agg, err = s.newAggregateEntity(req)
-	if err != nil {
-		return nil, err
-	}
-	if err = s.aggregateService.Create(ctx, agg); err != nil {
-		return nil, err
+func (s *EventStorage) decryptEvents(ctx context.Context, events *[]model.EventEntity) error {
+	if events == nil {
+		return nil
 	}
-
-	err = s.saveEvents(ctx, req.TenantId, req.AggregateId, req.AggregateType, req.Events, agg.SequenceNumber)
-	if err != nil {
-		return nil, err
+	for i := range *events {
+		event, err := (*events)[i].Decrypt(ctx, s.encryptor)
+		if err != nil {
+			return err
+		}
+		(*events)[i] = *event
 	}
-
-	return &eventstorage.CreateEventResponse{}, nil
+	return nil
 }
 
 //
-// DeleteEvent
-// @Description:
+// upcastEvents
+// @Description: 将事件转换到最新版本，只替换列表中的元素，不修改存储的数据
 // @receiver s
-// @param ctx
-// @param req
-// @return *eventstorage.DeleteEventResponse
+// @param events
 // @return error
 //
-func (s *EventStorage) DeleteEvent(ctx context.Context, req *eventstorage.DeleteEventRequest) (*eventstorage.DeleteEventResponse, error) {
-	agg, err := s.aggregateService.FindById(ctx, req.TenantId, req.AggregateId)
-	if err != nil {
-		return nil, err
-	}
-	if agg == nil {
-		return nil, errors.New(fmt.Sprintf("aggregate id \"%s\" not found", req.AggregateId))
-	}
-	if agg.Deleted {
-		return nil, errors.New(fmt.Sprintf("aggregate id \"%s\" is deleted", req.AggregateId))
-	}
-	if err := s.aggregateService.Delete(ctx, req.TenantId, req.AggregateId); err != nil {
-		return nil, err
+func (s *EventStorage) upcastEvents(events *[]model.EventEntity) error {
+	if events == nil {
+		return nil
 	}
-	events := []eventstorage.EventDto{*req.Event}
-	if err := s.saveEvents(ctx, req.TenantId, req.AggregateId, req.AggregateType, &events, agg.SequenceNumber); err != nil {
-		return nil, err
+	for i := range *events {
+		event, err := (*events)[i].Upcast(s.upcasters)
+		if err != nil {
+			return err
+		}
+		(*events)[i] = *event
 	}
-	return &eventstorage.DeleteEventResponse{}, nil
+	return nil
 }
 
 //
-// ApplyEvent
-// @Description: 应用多个领域事件
+// GetCausalityChain
+// @Description: 按CorrelationId查询跨聚合根的事件与命令
 // @receiver s
 // @param ctx
 // @param req
-// @return *eventstorage.ApplyEventsResponse
+// @return *eventstorage.GetCausalityChainResponse
 // @return error
 //
-func (s *EventStorage) ApplyEvent(ctx context.Context, req *eventstorage.ApplyEventsRequest) (*eventstorage.ApplyEventsResponse, error) {
-	if req == nil {
-		return nil, errors.New("request is nil")
-	}
-	length := len(*req.Events)
-	if length == 0 {
-		return nil, errors.New("request.events size 0 ")
-	}
-	agg, sequenceNumber, err := s.aggregateService.NextSequenceNumber(ctx, req.TenantId, req.AggregateId, uint64(length))
-	if err != nil {
-		return nil, err
+func (s *EventStorage) GetCausalityChain(ctx context.Context, req *eventstorage.GetCausalityChainRequest) (*eventstorage.GetCausalityChainResponse, error) {
+	if req.TenantId == "" {
+		return nil, errors.New("tenantId cannot be empty")
 	}
-	if agg == nil {
-		return nil, errors.New(fmt.Sprintf("aggregate id \"%s\" not found", req.AggregateId))
-	}
-	if agg.Deleted {
-		return nil, errors.New(fmt.Sprintf("aggregate id \"%s\" is already deleted.", req.AggregateId))
-	}
-
-	err = s.saveEvents(ctx, req.TenantId, req.AggregateId, req.AggregateType, req.Events, sequenceNumber)
-	if err != nil {
-		return nil, err
+	if req.CorrelationId == "" {
+		return nil, errors.New("correlationId cannot be empty")
 	}
-	return &eventstorage.ApplyEventsResponse{}, nil
-}
-
-func (s *EventStorage) GetRelations(ctx context.Context, req *eventstorage.GetRelationsRequest) (*eventstorage.GetRelationsResponse, error) {
-	findRes, _, err := s.relationService.FindPaging(ctx, req.AggregateType, req)
+	events, err := s.eventService.FindByCorrelationId(ctx, req.TenantId, req.CorrelationId, eventstorage.MaxCausalityChainEvents+1)
 	if err != nil {
-		return nil, err
-	}
-	var errMsg string
-	if findRes.Error != nil {
-		errMsg = findRes.Error.Error()
+		return nil, newError("findByCorrelationId() error taking events.", err)
 	}
-	var relations []*eventstorage.Relation
-	if findRes.Data != nil {
-		for _, item := range *findRes.Data {
-			rel := eventstorage.Relation{
-				Id:          item.Id,
-				TenantId:    item.TenantId,
-				TableName:   item.TableName,
-				AggregateId: item.AggregateId,
-				IsDeleted:   item.IsDeleted,
-				Items:       item.Items,
-			}
-			relations = append(relations, &rel)
+	dtos := make([]*eventstorage.CausalityEventDto, 0)
+	if events != nil {
+		for _, event := range *events {
+			dtos = append(dtos, event.NewCausalityEventDto())
 		}
 	}
-	res := &eventstorage.GetRelationsResponse{
-		Data:       relations,
-		TotalRows:  uint64(findRes.TotalRows),
-		TotalPages: uint64(findRes.TotalPages),
-		PageSize:   uint64(findRes.PageSize),
-		PageNum:    uint64(findRes.PageNum),
-		Filter:     findRes.Filter,
-		Sort:       findRes.Sort,
-		Error:      errMsg,
-	}
-	return res, nil
+	return eventstorage.NewGetCausalityChainResponse(req.CorrelationId, dtos), nil
 }
 
-func (s *EventStorage) saveEvents(ctx context.Context, tenantId string, aggregateId string, aggregateType string, events *[]eventstorage.EventDto, startSequenceNumber uint64) error {
+//
+//  saveEvents
+//  @Description: 保存多个事件及聚合关系，需在 mongodb.WithTransaction 中调用，不发送消息
+//  @receiver s
+//  @param ctx
+//  @param tenantId
+//  @param aggregateId
+//  @param aggregateType
+//  @param events
+//  @param startSequenceNumber 第一个事件的SequenceNumber
+//  @return []*eventstorage.Event 已保存的事件
+//  @return error
+//
+func (s *EventStorage) saveEvents(ctx context.Context, tenantId string, aggregateId string, aggregateType string, events *[]eventstorage.EventDto, startSequenceNumber uint64) ([]*eventstorage.Event, error) {
 	if events == nil {
-		return errors.New("events is nil")
+		return nil, errors.New("events is nil")
 	}
 	length := len(*events)
 	if length == 0 {
-		return errors.New("request.saveEvents size 0 ")
+		return nil, errors.New("request.saveEvents size 0 ")
 	}
 
 	var applyEvents []*eventstorage.Event
@@ -234,20 +1141,137 @@ func (s *EventStorage) saveEvents(ctx context.Context, tenantId string, aggregat
 	for i := 0; i < length; i++ {
 		appReq, err := eventstorage.NewEvent(tenantId, aggregateId, aggregateType, list[i])
 		if err != nil {
-			return err
+			return nil, err
 		}
 		applyEvents = append(applyEvents, appReq)
 	}
 
 	count := uint64(length)
+	startPosition, err := s.nextEventPosition(ctx, count)
+	if err != nil {
+		return nil, err
+	}
 	for i := uint64(0); i < count; i++ {
 		applyEvent := applyEvents[i]
-		err := s.saveEvent(ctx, applyEvent, startSequenceNumber+i)
+		position := startPosition
+		if position > 0 {
+			position += i
+		}
+		err := s.saveEvent(ctx, applyEvent, startSequenceNumber+i, position)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return applyEvents, nil
+}
+
+//
+//  publishEvents
+//  @Description: 事务提交后按顺序发送事件，发送成功的事件一次更新为PublishStatusSuccess。
+//  事件已保存，发送失败不影响写入结果：某个事件发送失败时记录失败次数，不再发送后续事件，由补发任务按退避时间顺序重试。
+//  聚合根之前的事件仍在等待发送时不发送，由补发任务按顺序发送。
+//  @receiver s
+//  @param ctx
+//  @param events 同一聚合根的事件
+//
+func (s *EventStorage) publishEvents(ctx context.Context, events []*eventstorage.Event) {
+	if len(events) == 0 {
+		return
+	}
+	first, err := s.eventService.FindFirstNotPublished(ctx, events[0].TenantId, events[0].AggregateId)
+	if err != nil {
+		if s.log != nil {
+			s.log.Errorf("error finding unpublished events, they will be retried: %s", err.Error())
+		}
+		return
+	}
+	if first != nil && first.EventId != events[0].EventId {
+		return
+	}
+	var eventIds []string
+	var failedEvent *eventstorage.Event
+	var publishErr error
+	for _, batch := range s.newPublishBatches(events) {
+		if publishErr = s.publishBatch(ctx, batch); publishErr != nil {
+			failedEvent = batch[0]
+			break
+		}
+		for _, event := range batch {
+			eventIds = append(eventIds, event.EventId)
+		}
+	}
+	// 更新已发送事件的消息发送状态为成功，更新失败时由补发任务再次发送
+	if err := s.eventService.UpdatePublishStatusMany(ctx, events[0].TenantId, eventIds, eventstorage.PublishStatusSuccess); err != nil && s.log != nil {
+		s.log.Errorf("error updating publish status of events: %s", err.Error())
+	}
+	if publishErr == nil {
+		return
+	}
+	if s.log != nil {
+		s.log.Errorf("error publishing event %s, it will be retried: %s", failedEvent.EventId, publishErr.Error())
+	}
+	if err := s.outboxRelay.publishFailed(ctx, failedEvent, 1, publishErr, time.Now()); err != nil && s.log != nil {
+		s.log.Errorf("error updating publish error of event %s: %s", failedEvent.EventId, err.Error())
+	}
+}
+
+//
+//  newPublishBatches
+//  @Description: 按发送顺序分批，publishBatch为true时连续的相同PubsubName、Topic的事件为一批，否则每个事件一批
+//  @receiver s
+//  @param events
+//  @return [][]*eventstorage.Event
+//
+func (s *EventStorage) newPublishBatches(events []*eventstorage.Event) [][]*eventstorage.Event {
+	var batches [][]*eventstorage.Event
+	for _, event := range events {
+		if n := len(batches); n > 0 && s.mongodb.StorageMetadata.PublishBatch {
+			last := batches[n-1][0]
+			if last.PubsubName == event.PubsubName && last.Topic == event.Topic {
+				batches[n-1] = append(batches[n-1], event)
+				continue
+			}
+		}
+		batches = append(batches, []*eventstorage.Event{event})
+	}
+	return batches
+}
+
+//
+//  publishBatch
+//  @Description: 发送一批事件，多个事件时作为一个CloudEvents批量消息(application/cloudevents-batch+json)发送，
+//  消息metadata使用第一个事件的metadata
+//  @receiver s
+//  @param ctx
+//  @param events
+//  @return error
+//
+func (s *EventStorage) publishBatch(ctx context.Context, events []*eventstorage.Event) error {
+	if len(events) == 1 {
+		return s.publishMessage(ctx, events[0])
+	}
+	envelopes := make([]map[string]interface{}, 0, len(events))
+	for _, event := range events {
+		data, err := s.newPublishData(ctx, event)
 		if err != nil {
 			return err
 		}
+		envelopes = append(envelopes, pubsub.NewCloudEventsEnvelope(event.EventId, "", event.EventType, event.AggregateId,
+			event.Topic, event.PubsubName, contenttype.JSONContentType, data, "", ""))
 	}
-	return nil
+	bytes, err := json.Marshal(envelopes)
+	if err != nil {
+		return err
+	}
+	contentType := cloudEventsBatchContentType
+	pubData := &pubsub.PublishRequest{
+		PubsubName:  events[0].PubsubName,
+		Topic:       events[0].Topic,
+		Metadata:    events[0].Metadata,
+		ContentType: &contentType,
+		Data:        bytes,
+	}
+	return s.getPubsubAdapter().Publish(pubData)
 }
 
 //
@@ -276,12 +1300,17 @@ func (s *EventStorage) SaveSnapshot(ctx context.Context, req *eventstorage.SaveS
 	if err != nil {
 		return nil, newError("SnapshotService.Create(). error saving snapshot.", err)
 	}
+	// 镜像已保存，清理失败不影响本次结果，下次保存时会再次清理
+	retainCount := s.mongodb.StorageMetadata.SnapshotPolicy.RetainCount
+	if err := s.snapshotService.DeleteOlder(ctx, req.TenantId, req.AggregateId, req.AggregateType, retainCount); err != nil && s.log != nil {
+		s.log.Errorf("error deleting older snapshots of aggregate %s: %s", req.AggregateId, err.Error())
+	}
 	return &eventstorage.SaveSnapshotResponse{}, nil
 }
 
-func (s *EventStorage) saveEvent(ctx context.Context, req *eventstorage.Event, sequenceNumber uint64) error {
+func (s *EventStorage) saveEvent(ctx context.Context, req *eventstorage.Event, sequenceNumber uint64, position uint64) error {
 	// 创建新事件，并设置PublishStatus为Wait
-	if _, err := s.createEvent(ctx, req, sequenceNumber); err != nil {
+	if _, err := s.createEvent(ctx, req, sequenceNumber, position); err != nil {
 		return newError("createEvent() error saving event.", err)
 	}
 
@@ -289,22 +1318,43 @@ func (s *EventStorage) saveEvent(ctx context.Context, req *eventstorage.Event, s
 	if err := s.saveRelations(ctx, req); err != nil {
 		return newError("relationService.Create() error.", err)
 	}
+	return nil
+}
 
-	// 发送事件到消息队列，并设置 PublishStatus 为 PublishStatusSuccess
-	if err := s.publishMessage(ctx, req); err != nil {
-		return newError("publishMessage() failed to publish event.", err)
-	}
-
-	// 更新event的消息发送状态为成功
-	if err := s.updatePublishStatue(ctx, req.EventId, eventstorage.PublishStatusSuccess); err != nil {
-		return err
+//
+// restoreRelations
+// @Description: 恢复聚合根的关系，remove删除模式下按事件中的关系重建
+// @receiver s
+// @param ctx
+// @param tenantId
+// @param aggregateId
+// @param aggregateType
+// @return error
+//
+func (s *EventStorage) restoreRelations(ctx context.Context, tenantId string, aggregateId string, aggregateType string) error {
+	relation := model.NewRelationEntity(tenantId, aggregateId, aggregateType, nil, nil)
+	if s.mongodb.StorageMetadata.RelationDeleteMode == other.RelationDeleteModeRemove {
+		events, err := s.eventService.FindBySequenceNumber(ctx, tenantId, aggregateId, aggregateType, 0, 0)
+		if err != nil {
+			return err
+		}
+		for _, event := range *events {
+			for key, value := range event.Relations {
+				if len(value) > 0 {
+					relation.AddItem(key, value)
+				}
+			}
+			for key, values := range event.RelationLists {
+				relation.AddList(key, values)
+			}
+		}
 	}
-	return nil
+	return s.relationService.Restore(ctx, relation)
 }
 
 func (s *EventStorage) saveRelations(ctx context.Context, req *eventstorage.Event) error {
-	if req != nil && len(req.Relations) > 0 {
-		relation := model.NewRelationEntity(req.TenantId, req.AggregateId, req.AggregateType, req.Relations)
+	if req != nil && (len(req.Relations) > 0 || len(req.RelationLists) > 0) {
+		relation := model.NewRelationEntity(req.TenantId, req.AggregateId, req.AggregateType, req.Relations, req.RelationLists)
 		if err := s.relationService.Save(ctx, relation); err != nil {
 			return err
 		}
@@ -312,19 +1362,6 @@ func (s *EventStorage) saveRelations(ctx context.Context, req *eventstorage.Even
 	return nil
 }
 
-//
-//  updatePublishStatue
-//  @Description: 更新事件状态PublishStatus
-//  @receiver s
-//  @param ctx
-//  @param event
-//  @param publishStatue
-//  @return error
-//
-func (s *EventStorage) updatePublishStatue(ctx context.Context, eventId string, publishStatue eventstorage.PublishStatus) error {
-	return s.eventService.UpdatePublishStatue(ctx, eventId, publishStatue)
-}
-
 //
 //  publishMessage
 //  @Description: 发送事件到消息队列，并设置PublishStatus为PublishStatusSuccess
@@ -335,12 +1372,13 @@ func (s *EventStorage) updatePublishStatue(ctx context.Context, eventId string,
 //  @return error
 //
 func (s *EventStorage) publishMessage(ctx context.Context, req *eventstorage.Event) error {
-	contentType := "json"
-	bytes, err := json.Marshal(req)
+	bytes, err := s.newPublishData(ctx, req)
 	if err != nil {
 		return err
 	}
 
+	contentType := "json"
+
 	pubData := &pubsub.PublishRequest{
 		PubsubName:  req.PubsubName,
 		Topic:       req.Topic,
@@ -355,6 +1393,62 @@ func (s *EventStorage) publishMessage(ctx context.Context, req *eventstorage.Eve
 	return nil
 }
 
+//
+//  publishDeadLetter
+//  @Description: 将发送失败次数达到上限的事件及失败原因发送到死信主题
+//  @receiver s
+//  @param ctx
+//  @param event
+//  @param attempts
+//  @param reason
+//  @return error
+//
+func (s *EventStorage) publishDeadLetter(ctx context.Context, event *eventstorage.Event, attempts int, reason string) error {
+	eventData, err := s.encryptor.Decrypt(ctx, event.TenantId, event.AggregateId, event.AggregateType, event.EventData)
+	if err != nil {
+		return err
+	}
+	data := *event
+	data.EventData = eventData
+	bytes, err := json.Marshal(&eventstorage.DeadLetterEvent{
+		Event:      &data,
+		PubsubName: event.PubsubName,
+		Topic:      event.Topic,
+		Attempts:   attempts,
+		Error:      reason,
+		Time:       time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	options := s.mongodb.StorageMetadata.OutboxRelay
+	pubsubName := options.DeadLetterPubsubName
+	if pubsubName == "" {
+		pubsubName = event.PubsubName
+	}
+	contentType := "json"
+	pubData := &pubsub.PublishRequest{
+		PubsubName:  pubsubName,
+		Topic:       options.DeadLetterTopic,
+		Metadata:    event.Metadata,
+		ContentType: &contentType,
+		Data:        bytes,
+	}
+	return s.getPubsubAdapter().Publish(pubData)
+}
+
+// newPublishData 解密事件数据并转换为消息内容
+func (s *EventStorage) newPublishData(ctx context.Context, req *eventstorage.Event) ([]byte, error) {
+	eventData, err := s.encryptor.Decrypt(ctx, req.TenantId, req.AggregateId, req.AggregateType, req.EventData)
+	if err != nil {
+		return nil, err
+	}
+	event := *req
+	event.EventData = eventData
+	return json.Marshal(&event)
+}
+
 //
 //  createEvent
 //  @Description: 创建事件，并设置发送状态为PublishStatusWait
@@ -364,17 +1458,25 @@ func (s *EventStorage) publishMessage(ctx context.Context, req *eventstorage.Eve
 //  @return *EventEntity
 //  @return error
 //
-func (s *EventStorage) createEvent(ctx context.Context, req *eventstorage.Event, sequenceNumber uint64) (*model.EventEntity, error) {
+func (s *EventStorage) createEvent(ctx context.Context, req *eventstorage.Event, sequenceNumber uint64, position uint64) (*model.EventEntity, error) {
 	idValue, err := model.ObjectIDFromHex(req.EventId)
 	if err != nil {
 		return nil, err
 	}
+	eventData, err := s.encryptor.Encrypt(ctx, req.TenantId, req.AggregateId, req.AggregateType, req.EventData, req.Metadata)
+	if err != nil {
+		return nil, err
+	}
 	event := &model.EventEntity{
 		Id:             idValue,
 		TenantId:       req.TenantId,
+		CommandId:      req.CommandId,
 		EventId:        req.EventId,
+		EventTime:      model.NewEventTime(req.EventTime),
+		CausationId:    req.CausationId,
+		CorrelationId:  req.CorrelationId,
 		Metadata:       req.Metadata,
-		EventData:      req.EventData,
+		EventData:      eventData,
 		EventVersion:   req.EventVersion,
 		EventType:      req.EventType,
 		AggregateId:    req.AggregateId,
@@ -383,6 +1485,9 @@ func (s *EventStorage) createEvent(ctx context.Context, req *eventstorage.Event,
 		Topic:          req.Topic,
 		PublishStatus:  eventstorage.PublishStatusWait,
 		SequenceNumber: sequenceNumber,
+		Position:       position,
+		Relations:      req.Relations,
+		RelationLists:  req.RelationLists,
 	}
 	err = s.eventService.Create(ctx, event)
 	return event, err
@@ -401,11 +1506,16 @@ func (s *EventStorage) newAggregateEntity(req *eventstorage.CreateEventRequest)
 	if err != nil {
 		return nil, err
 	}
+	// 聚合根的SequenceNumber与最后一个事件的SequenceNumber一致
+	sequenceNumber := uint64(1)
+	if req.Events != nil && len(*req.Events) > 1 {
+		sequenceNumber = uint64(len(*req.Events))
+	}
 	return &model.AggregateEntity{
 		Id:             idValue,
 		TenantId:       req.TenantId,
 		AggregateId:    req.AggregateId,
 		AggregateType:  req.AggregateType,
-		SequenceNumber: 1,
+		SequenceNumber: sequenceNumber,
 	}, nil
 }
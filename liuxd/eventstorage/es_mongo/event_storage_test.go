@@ -0,0 +1,325 @@
+package es_mongo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/other"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/service"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/model"
+	"github.com/liuxd6825/components-contrib/pubsub"
+	pubsub_adapter "github.com/liuxd6825/dapr/pkg/runtime/pubsub"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+type publishTestEventService struct {
+	service.EventService
+	published []string
+	failed    map[string]eventstorage.PublishStatus
+	first     *model.EventEntity
+	created   []*model.EventEntity
+}
+
+// sequenceTestAggregateService 按 AggregateRepository.NextSequenceNumber 的条件更新方式模拟序号检查
+type sequenceTestAggregateService struct {
+	service.AggregateService
+	agg     *model.AggregateEntity
+	deleted bool
+}
+
+func (s *sequenceTestAggregateService) FindById(ctx context.Context, tenantId, aggregateId string) (*model.AggregateEntity, error) {
+	return s.agg, nil
+}
+
+func (s *sequenceTestAggregateService) NextSequenceNumber(ctx context.Context, tenantId, aggregateId string, count uint64, expectedSequenceNumber uint64) (*model.AggregateEntity, uint64, error) {
+	if expectedSequenceNumber > 0 && expectedSequenceNumber != s.agg.SequenceNumber {
+		return nil, 0, eventstorage.NewConcurrencyConflictError(tenantId, aggregateId, expectedSequenceNumber, s.agg.SequenceNumber)
+	}
+	agg := *s.agg
+	s.agg.SequenceNumber += count
+	return &agg, agg.SequenceNumber + 1, nil
+}
+
+func (s *sequenceTestAggregateService) Delete(ctx context.Context, tenantId, aggregateId string) error {
+	s.deleted = true
+	return nil
+}
+
+func (s *publishTestEventService) Create(ctx context.Context, event *model.EventEntity) error {
+	s.created = append(s.created, event)
+	return nil
+}
+
+func (s *publishTestEventService) FindFirstNotPublished(ctx context.Context, tenantId string, aggregateId string) (*model.EventEntity, error) {
+	return s.first, nil
+}
+
+func (s *publishTestEventService) UpdatePublishStatusMany(ctx context.Context, tenantId string, eventIds []string, publishStatue eventstorage.PublishStatus) error {
+	s.published = append(s.published, eventIds...)
+	return nil
+}
+
+func (s *publishTestEventService) UpdatePublishError(ctx context.Context, tenantId string, eventId string, publishStatue eventstorage.PublishStatus, attempts int, errMsg string, nextPublishTime primitive.DateTime) error {
+	s.failed[eventId] = publishStatue
+	return nil
+}
+
+type publishTestAdapter struct {
+	requests []*pubsub.PublishRequest
+	failAt   int
+	calls    int
+}
+
+func (a *publishTestAdapter) GetPubSub(pubsubName string) pubsub.PubSub {
+	return nil
+}
+
+func (a *publishTestAdapter) Publish(req *pubsub.PublishRequest) error {
+	a.calls++
+	if a.calls == a.failAt {
+		return errors.New("broker down")
+	}
+	a.requests = append(a.requests, req)
+	return nil
+}
+
+func newPublishTestStorage(publishBatch bool) (*EventStorage, *publishTestEventService, *publishTestAdapter) {
+	eventService := &publishTestEventService{failed: map[string]eventstorage.PublishStatus{}}
+	adapter := &publishTestAdapter{}
+	options := &other.OutboxRelayOptions{MinBackoff: time.Second, MaxBackoff: time.Minute, MaxAttempts: 1, DeadLetterTopic: "dead-letter"}
+	storage := &EventStorage{
+		mongodb:          &other.MongoDB{StorageMetadata: &other.StorageMetadata{PublishBatch: publishBatch, OutboxRelay: options, SnapshotPolicy: &eventstorage.SnapshotPolicy{}}},
+		eventService:     eventService,
+		getPubsubAdapter: func() pubsub_adapter.Adapter { return adapter },
+	}
+	storage.outboxRelay = newOutboxRelay(options, eventService, storage.publishMessage, storage.publishDeadLetter, nil)
+	return storage, eventService, adapter
+}
+
+func newPublishTestEvents(topics ...string) []*eventstorage.Event {
+	var events []*eventstorage.Event
+	for i, topic := range topics {
+		events = append(events, &eventstorage.Event{EventId: string(rune('a' + i)), EventType: "TestEvent", PubsubName: "pubsub", Topic: topic})
+	}
+	return events
+}
+
+func TestEventStorage_PublishEventsBatch(t *testing.T) {
+	storage, eventService, adapter := newPublishTestStorage(true)
+	storage.publishEvents(context.Background(), newPublishTestEvents("t1", "t1", "t2", "t1"))
+	if len(adapter.requests) != 3 {
+		t.Fatalf("publish count = %d, want 3", len(adapter.requests))
+	}
+	if *adapter.requests[0].ContentType != cloudEventsBatchContentType {
+		t.Errorf("content type = %s, want %s", *adapter.requests[0].ContentType, cloudEventsBatchContentType)
+	}
+	var envelopes []map[string]interface{}
+	if err := json.Unmarshal(adapter.requests[0].Data, &envelopes); err != nil {
+		t.Fatal(err)
+	}
+	if len(envelopes) != 2 || envelopes[0][pubsub.IDField] != "a" || envelopes[1][pubsub.IDField] != "b" {
+		t.Errorf("batch envelopes = %v, want events a and b", envelopes)
+	}
+	if want := []string{"a", "b", "c", "d"}; !reflect.DeepEqual(eventService.published, want) {
+		t.Errorf("published = %v, want %v", eventService.published, want)
+	}
+}
+
+func TestEventStorage_PublishEventsAfterPending(t *testing.T) {
+	storage, eventService, adapter := newPublishTestStorage(false)
+	// 聚合根之前的事件仍在等待发送，新事件由补发任务按顺序发送
+	eventService.first = &model.EventEntity{EventId: "z"}
+	storage.publishEvents(context.Background(), newPublishTestEvents("t1", "t1"))
+	if len(adapter.requests) != 0 || len(eventService.published) != 0 {
+		t.Errorf("requests = %d, published = %v, want none", len(adapter.requests), eventService.published)
+	}
+}
+
+func TestEventStorage_PublishEventsFailure(t *testing.T) {
+	storage, eventService, adapter := newPublishTestStorage(false)
+	adapter.failAt = 2
+	storage.publishEvents(context.Background(), newPublishTestEvents("t1", "t1", "t1"))
+	if want := []string{"a"}; !reflect.DeepEqual(eventService.published, want) {
+		t.Errorf("published = %v, want %v", eventService.published, want)
+	}
+	// 达到最大发送次数，复制到死信主题后标记为PublishStatusError，后续事件由补发任务发送
+	if want := map[string]eventstorage.PublishStatus{"b": eventstorage.PublishStatusError}; !reflect.DeepEqual(eventService.failed, want) {
+		t.Errorf("failed = %v, want %v", eventService.failed, want)
+	}
+	if len(adapter.requests) != 2 || adapter.requests[1].Topic != "dead-letter" {
+		t.Fatalf("requests = %d, want event a and dead letter of b", len(adapter.requests))
+	}
+	var deadLetter eventstorage.DeadLetterEvent
+	if err := json.Unmarshal(adapter.requests[1].Data, &deadLetter); err != nil {
+		t.Fatal(err)
+	}
+	if deadLetter.Event.EventId != "b" || deadLetter.Topic != "t1" || deadLetter.Attempts != 1 || deadLetter.Error != "broker down" {
+		t.Errorf("dead letter = %+v", deadLetter)
+	}
+}
+
+func TestEventStorage_EventPositionDisabled(t *testing.T) {
+	storage, _, _ := newPublishTestStorage(false)
+	// positionService为nil，关闭全局位置时不分配位置
+	position, err := storage.nextEventPosition(context.Background(), 3)
+	if err != nil || position != 0 {
+		t.Errorf("position = %d, err = %v, want 0 and no error", position, err)
+	}
+	if _, err := storage.ReadEventStream(context.Background(), &eventstorage.ReadEventStreamRequest{}); err == nil {
+		t.Error("ReadEventStream() error = nil, want event stream is disabled")
+	}
+	if _, err := storage.ReplayEvents(context.Background(), &eventstorage.ReplayEventsRequest{}); err == nil {
+		t.Error("ReplayEvents() error = nil, want event stream is disabled")
+	}
+}
+
+func newSequenceTestStorage(sequenceNumber uint64) (*EventStorage, *sequenceTestAggregateService, *publishTestEventService) {
+	storage, eventService, _ := newPublishTestStorage(false)
+	aggregateService := &sequenceTestAggregateService{agg: &model.AggregateEntity{TenantId: "t1", AggregateId: "a1", SequenceNumber: sequenceNumber}}
+	storage.aggregateService = aggregateService
+	return storage, aggregateService, eventService
+}
+
+func newSequenceTestEvent() eventstorage.EventDto {
+	return eventstorage.EventDto{EventId: primitive.NewObjectID().Hex(), EventType: "TestEvent", PubsubName: "pubsub", Topic: "t1"}
+}
+
+func TestEventStorage_ApplyEventExpectedSequenceNumber(t *testing.T) {
+	storage, aggregateService, eventService := newSequenceTestStorage(5)
+	events := []eventstorage.EventDto{newSequenceTestEvent()}
+	req := &eventstorage.ApplyEventsRequest{TenantId: "t1", AggregateId: "a1", AggregateType: "Order", ExpectedSequenceNumber: 3, Events: &events}
+	_, err := storage.ApplyEvent(context.Background(), req)
+	var conflict *eventstorage.ConcurrencyConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("ApplyEvent() error = %v, want ConcurrencyConflictError", err)
+	}
+	if conflict.ExpectedSequenceNumber != 3 || conflict.ActualSequenceNumber != 5 {
+		t.Errorf("conflict = %+v, want expected 3 and actual 5", conflict)
+	}
+	if len(eventService.created) != 0 || aggregateService.agg.SequenceNumber != 5 {
+		t.Errorf("created = %d, sequenceNumber = %d, want no events and 5", len(eventService.created), aggregateService.agg.SequenceNumber)
+	}
+
+	req.ExpectedSequenceNumber = 5
+	res, err := storage.ApplyEvent(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.SequenceNumber != 6 || len(eventService.created) != 1 || eventService.created[0].SequenceNumber != 6 {
+		t.Errorf("sequenceNumber = %d, created = %d, want one event with sequence number 6", res.SequenceNumber, len(eventService.created))
+	}
+}
+
+func TestEventStorage_DeleteEventExpectedSequenceNumber(t *testing.T) {
+	storage, aggregateService, eventService := newSequenceTestStorage(5)
+	event := newSequenceTestEvent()
+	req := &eventstorage.DeleteEventRequest{TenantId: "t1", AggregateId: "a1", AggregateType: "Order", ExpectedSequenceNumber: 4, Event: &event}
+	_, err := storage.DeleteEvent(context.Background(), req)
+	if !eventstorage.IsConcurrencyConflictError(err) {
+		t.Fatalf("DeleteEvent() error = %v, want ConcurrencyConflictError", err)
+	}
+	if aggregateService.deleted || len(eventService.created) != 0 {
+		t.Errorf("deleted = %v, created = %d, want aggregate kept and no events", aggregateService.deleted, len(eventService.created))
+	}
+}
+
+type backfillTestEventService struct {
+	service.EventService
+	events []model.EventEntity
+}
+
+func (s *backfillTestEventService) FindWithoutPosition(ctx context.Context, tenantId string, limit int64) (*[]model.EventEntity, error) {
+	var list []model.EventEntity
+	for _, event := range s.events {
+		if event.Position == 0 && int64(len(list)) < limit {
+			list = append(list, event)
+		}
+	}
+	return &list, nil
+}
+
+func (s *backfillTestEventService) UpdatePositions(ctx context.Context, tenantId string, events []model.EventEntity) error {
+	for _, event := range events {
+		for i := range s.events {
+			if s.events[i].Id == event.Id && s.events[i].Position == 0 {
+				s.events[i].Position = event.Position
+			}
+		}
+	}
+	return nil
+}
+
+func (s *backfillTestEventService) FindForReplay(ctx context.Context, req *eventstorage.ReplayEventsRequest, fromPosition uint64, limit int64) (*[]model.EventEntity, error) {
+	var list []model.EventEntity
+	for _, event := range s.events {
+		if event.Position > fromPosition {
+			list = append(list, event)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Position < list[j].Position })
+	return &list, nil
+}
+
+func (s *backfillTestEventService) CountForReplay(ctx context.Context, req *eventstorage.ReplayEventsRequest, toPosition uint64) (uint64, error) {
+	count := uint64(0)
+	for _, event := range s.events {
+		if event.Position > 0 && (toPosition == 0 || event.Position <= toPosition) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+type backfillTestPositionService struct {
+	position uint64
+}
+
+func (s *backfillTestPositionService) NextEventPosition(ctx context.Context, count uint64) (uint64, error) {
+	s.position += count
+	return s.position - count + 1, nil
+}
+
+func TestEventStorage_BackfillEventPositions(t *testing.T) {
+	// 升级前写入的事件a、c没有位置，补充的位置排在已有位置之后
+	eventService := &backfillTestEventService{events: []model.EventEntity{{Id: "a"}, {Id: "b", Position: 1}, {Id: "c"}}}
+	storage := &EventStorage{
+		mongodb:         &other.MongoDB{StorageMetadata: &other.StorageMetadata{EventPosition: true}},
+		eventService:    eventService,
+		positionService: &backfillTestPositionService{position: 1},
+	}
+	if err := storage.backfillEventPositions(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var positions []uint64
+	for _, event := range eventService.events {
+		positions = append(positions, event.Position)
+	}
+	if want := []uint64{2, 1, 3}; !reflect.DeepEqual(positions, want) {
+		t.Errorf("positions = %v, want %v", positions, want)
+	}
+}
+
+func TestEventStorage_ReplayEventsBackfill(t *testing.T) {
+	// Init之后由旧版本实例写入的事件c没有位置，从头重放时补充位置后一起重放
+	eventService := &backfillTestEventService{events: []model.EventEntity{{Id: "a", EventId: "a", Position: 1}, {Id: "c", EventId: "c"}}}
+	adapter := &publishTestAdapter{}
+	storage := &EventStorage{
+		mongodb:          &other.MongoDB{StorageMetadata: &other.StorageMetadata{EventPosition: true}},
+		eventService:     eventService,
+		positionService:  &backfillTestPositionService{position: 1},
+		getPubsubAdapter: func() pubsub_adapter.Adapter { return adapter },
+	}
+	req := &eventstorage.ReplayEventsRequest{TenantId: "t1", AggregateType: "Order", PubsubName: "pubsub", Topic: "replay"}
+	res, err := storage.ReplayEvents(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.PublishedCount != 2 || res.TotalCount != 2 || res.LastPosition != 2 || len(adapter.requests) != 2 {
+		t.Errorf("response = %+v, requests = %d, want events a and c replayed", res, len(adapter.requests))
+	}
+}
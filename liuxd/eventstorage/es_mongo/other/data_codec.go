@@ -0,0 +1,129 @@
+package other
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"go.mongodb.org/mongo-driver/bson"
+	"io"
+)
+
+// DataCodec EventData、AggregateData的保存格式
+//   bson : 默认值，按BSON文档保存，可以按eventData下的字段查询
+//   json : JSON字节
+//   gzip : gzip压缩的JSON字节
+//   zstd : zstd压缩的JSON字节
+// 除bson外的格式保存为二进制，不能按eventData下的字段查询，数字读取后为float64。
+type DataCodec string
+
+const (
+	DataCodecBson DataCodec = "bson"
+	DataCodecJson DataCodec = "json"
+	DataCodecGzip DataCodec = "gzip"
+	DataCodecZstd DataCodec = "zstd"
+)
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+//
+// ParseDataCodec
+// @Description: 解析DataCodec名称，空字符串为bson
+// @param val
+// @return DataCodec
+// @return error
+//
+func ParseDataCodec(val string) (DataCodec, error) {
+	switch codec := DataCodec(val); codec {
+	case "":
+		return DataCodecBson, nil
+	case DataCodecBson, DataCodecJson, DataCodecGzip, DataCodecZstd:
+		return codec, nil
+	}
+	return "", errors.New(fmt.Sprintf("data codec %s is error, must be bson, json, gzip or zstd", val))
+}
+
+//
+// EncodeData
+// @Description: 按codec将数据编码为字节，bson编码为BSON文档字节
+// @param codec
+// @param data
+// @return []byte
+// @return error
+//
+func EncodeData(codec DataCodec, data map[string]interface{}) ([]byte, error) {
+	switch codec {
+	case DataCodecBson, "":
+		if data == nil {
+			data = map[string]interface{}{}
+		}
+		return bson.Marshal(data)
+	case DataCodecJson:
+		return json.Marshal(data)
+	case DataCodecGzip:
+		jsonBytes, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		if _, err := writer.Write(jsonBytes); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case DataCodecZstd:
+		jsonBytes, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		return zstdEncoder.EncodeAll(jsonBytes, nil), nil
+	}
+	return nil, errors.New(fmt.Sprintf("data codec %s is error", codec))
+}
+
+//
+// DecodeData
+// @Description: 按codec将EncodeData的结果解码为数据
+// @param codec
+// @param data
+// @return map[string]interface{}
+// @return error
+//
+func DecodeData(codec DataCodec, data []byte) (map[string]interface{}, error) {
+	var res map[string]interface{}
+	switch codec {
+	case DataCodecBson, "":
+		if err := bson.Unmarshal(data, &res); err != nil {
+			return nil, err
+		}
+		return res, nil
+	case DataCodecJson:
+	case DataCodecGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if data, err = io.ReadAll(reader); err != nil {
+			return nil, err
+		}
+	case DataCodecZstd:
+		var err error
+		if data, err = zstdDecoder.DecodeAll(data, nil); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("data codec %s is error", codec))
+	}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,33 @@
+package other
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_DataCodec(t *testing.T) {
+	data := map[string]interface{}{
+		"name":  "order",
+		"count": 3.0,
+		"items": []interface{}{"a", "b"},
+		"address": map[string]interface{}{
+			"city": "beijing",
+		},
+	}
+	for _, codec := range []DataCodec{DataCodecJson, DataCodecGzip, DataCodecZstd} {
+		encoded, err := EncodeData(codec, data)
+		assert.NoError(t, err, codec)
+		decoded, err := DecodeData(codec, encoded)
+		assert.NoError(t, err, codec)
+		assert.Equal(t, data, decoded, codec)
+	}
+
+	encoded, err := EncodeData(DataCodecBson, map[string]interface{}{"name": "order", "count": int32(3)})
+	assert.NoError(t, err)
+	decoded, err := DecodeData(DataCodecBson, encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"name": "order", "count": int32(3)}, decoded)
+
+	_, err = DecodeData("lz4", encoded)
+	assert.EqualError(t, err, "data codec lz4 is error")
+}
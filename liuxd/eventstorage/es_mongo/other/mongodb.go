@@ -16,14 +16,46 @@ package other
 // mongodb package is an implementation of StateStore interface to perform operations on store
 
 import (
+	"context"
+	"fmt"
 	"github.com/dapr/kit/logger"
 	"github.com/liuxd6825/components-contrib/liuxd/common"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
 	eventCollectionName     = "eventCollectionName"
 	snapshotCollectionName  = "snapshotCollectionName"
 	aggregateCollectionName = "aggregateCollectionName"
+	positionCollectionName  = "positionCollectionName"
+	eventPosition           = "eventPosition"
+	dataKeyCollectionName   = "dataKeyCollectionName"
+	historyCollectionName   = "historyCollectionName"
+	transactionMode         = "transactionMode"
+	tenancy                 = "tenancy"
+	outboxRelayEnabled      = "outboxRelayEnabled"
+	outboxRelayInterval     = "outboxRelayInterval"
+	outboxRelayBatchSize    = "outboxRelayBatchSize"
+	outboxRelayMinBackoff   = "outboxRelayMinBackoff"
+	outboxRelayMaxBackoff   = "outboxRelayMaxBackoff"
+	outboxRelayMaxAttempts  = "outboxRelayMaxAttempts"
+	deadLetterPubsubName    = "deadLetterPubsubName"
+	deadLetterTopic         = "deadLetterTopic"
+	createIndexes           = "createIndexes"
+	publishBatch            = "publishBatch"
+	relationIndexes         = "relationIndexes"
+	relationDeleteMode      = "relationDeleteMode"
+	relationHistory         = "relationHistory"
+	dataCodec               = "dataCodec"
+	dataCodecs              = "dataCodecs"
+	snapshotFileThreshold   = "snapshotFileThreshold"
+	snapshotBucketName      = "snapshotBucketName"
 	id                      = "_id"
 	value                   = "value"
 	etag                    = "_etag"
@@ -31,12 +63,49 @@ const (
 	defaultEventCollectionName     = "dapr_event"
 	defaultSnapshotCollectionName  = "dapr_snapshot"
 	defaultAggregateCollectionName = "dapr_aggregate"
+	defaultPositionCollectionName  = "dapr_position"
+	defaultDataKeyCollectionName   = "dapr_data_key"
+	defaultHistoryCollectionName   = "dapr_relation_history"
+	defaultSnapshotBucketName      = "dapr_snapshot_data"
+
+	defaultOutboxRelayInterval   = 10 * time.Second
+	defaultOutboxRelayBatchSize  = 100
+	defaultOutboxRelayMinBackoff = 5 * time.Second
+	defaultOutboxRelayMaxBackoff = 5 * time.Minute
+)
+
+// TransactionMode 事务模式，通过组件元数据 transactionMode 配置
+//   auto  : 默认值，连接副本集或分片集群时使用事务，单机服务器时不使用事务
+//   true  : 强制使用事务，服务器不支持时 Init 返回错误
+//   false : 不使用事务，聚合根、事件与关系依次写入，进程崩溃时可能留下不完整的数据，并发重复提交同一CommandId时不保证去重
+// 单机服务器(standalone)不支持事务，只能使用 auto 或 false。
+// 事务中会隐式创建新的关系表，需要 MongoDB 4.4 及以上版本。
+type TransactionMode string
+
+const (
+	TransactionModeAuto    TransactionMode = "auto"
+	TransactionModeEnabled TransactionMode = "true"
+	TransactionModeDisable TransactionMode = "false"
+)
+
+// RelationDeleteMode 删除聚合根时关系的处理方式，通过组件元数据 relationDeleteMode 配置
+//   flag   : 默认值，关系标记为已删除(is_deleted)，恢复聚合根时取消标记
+//   remove : 删除关系，恢复聚合根时按事件中的关系重建
+type RelationDeleteMode string
+
+const (
+	RelationDeleteModeFlag   RelationDeleteMode = "flag"
+	RelationDeleteModeRemove RelationDeleteMode = "remove"
 )
 
 // MongoDB is a state store implementation for MongoDB.
 type MongoDB struct {
 	*common.MongoDB
-	StorageMetadata *StorageMetadata
+	StorageMetadata     *StorageMetadata
+	supportsTransaction bool
+	collectionsMu       sync.Mutex
+	collections         map[string]*mongo.Collection
+	logger              logger.Logger
 }
 
 type StorageMetadata struct {
@@ -44,6 +113,80 @@ type StorageMetadata struct {
 	AggregateCollectionName string
 	EventCollectionName     string
 	SnapshotCollectionName  string
+	PositionCollectionName  string
+	DataKeyCollectionName   string
+	HistoryCollectionName   string
+	TransactionMode         TransactionMode
+	Tenancy                 Tenancy
+	OutboxRelay             *OutboxRelayOptions
+	SnapshotPolicy          *eventstorage.SnapshotPolicy
+	// CreateIndexes Init时是否创建索引，默认创建
+	CreateIndexes bool
+	// RelationIndexes 需要创建索引的关系字段，key为聚合类型
+	RelationIndexes map[string][]string
+	// RelationDeleteMode 删除聚合根时关系的处理方式
+	RelationDeleteMode RelationDeleteMode
+	// RelationHistory 是否在HistoryCollectionName中保存关系的每次变更，默认false
+	RelationHistory bool
+	// PublishBatch 一次请求中连续的相同PubsubName、Topic的事件是否作为一个CloudEvents批量消息发送，默认false
+	PublishBatch bool
+	// EventPosition 是否为事件分配全局位置，默认true，ReadEventStream和ReplayEvents依赖全局位置。
+	// 全局位置由PositionCollectionName中的一个计数器文档在每个写入事务中递增分配，
+	// 所有租户的写入都在该文档上串行（租户隔离模式也是如此），并发写入会产生WriteConflict重试，
+	// 整体写入吞吐量受限于该文档的更新速度。不需要事件流时设置为false以去掉该瓶颈。
+	// 为true时Init为没有位置的事件（升级前写入或为false时写入）按写入时间补充位置
+	EventPosition bool
+	DataCodec     *DataCodecOptions
+}
+
+// OutboxRelayOptions 补发未成功发送事件的后台任务配置
+type OutboxRelayOptions struct {
+	// Enabled 是否启用，默认启用
+	Enabled bool
+	// Interval 扫描间隔
+	Interval time.Duration
+	// BatchSize 每次扫描的最大事件数量
+	BatchSize int64
+	// MinBackoff 首次重试等待时间，创建时间小于此值的事件不补发，避免与正常发送重复
+	MinBackoff time.Duration
+	// MaxBackoff 最大重试等待时间，重试等待时间按次数指数增长
+	MaxBackoff time.Duration
+	// MaxAttempts 最大发送次数，达到后事件标记为PublishStatusError并复制到死信主题，不再重试，0表示不限制。
+	// 死信事件之后的同一聚合根的事件继续发送，不再保证该聚合根的事件顺序
+	MaxAttempts int
+	// DeadLetterPubsubName 死信主题所在的pubsub，为空时使用事件的PubsubName
+	DeadLetterPubsubName string
+	// DeadLetterTopic 死信主题，为空时不复制
+	DeadLetterTopic string
+}
+
+// DataCodecOptions EventData、AggregateData的保存格式
+//   dataCodec             : 默认保存格式，bson、json、gzip或zstd，默认bson
+//   dataCodecs            : 按聚合类型设置保存格式，格式为 "Order:zstd,Customer:json"，未设置的类型使用dataCodec
+//   snapshotFileThreshold : 编码后的镜像数据超过此字节数时保存到GridFS，0表示不保存到GridFS
+//   snapshotBucketName    : 保存镜像数据的GridFS bucket，默认dapr_snapshot_data
+type DataCodecOptions struct {
+	Codec                 DataCodec
+	AggregateCodec        map[string]DataCodec
+	SnapshotFileThreshold int
+	SnapshotBucketName    string
+}
+
+//
+// GetCodec
+// @Description: 返回聚合类型的保存格式
+// @receiver o
+// @param aggregateType
+// @return DataCodec
+//
+func (o *DataCodecOptions) GetCodec(aggregateType string) DataCodec {
+	if o == nil {
+		return DataCodecBson
+	}
+	if codec, ok := o.AggregateCodec[aggregateType]; ok {
+		return codec
+	}
+	return o.Codec
 }
 
 // NewMongoDB returns a new MongoDB state store.
@@ -51,10 +194,15 @@ func NewMongoDB(logger logger.Logger) *MongoDB {
 	mdb := common.NewMongoDB(logger)
 	s := &MongoDB{
 		MongoDB: mdb,
+		logger:  logger,
 	}
 	return s
 }
 
+func (m *MongoDB) GetLogger() logger.Logger {
+	return m.logger
+}
+
 // Init establishes connection to the store based on the metadata.
 func (m *MongoDB) Init(metadata common.Metadata) error {
 	if err := m.MongoDB.Init(metadata); err != nil {
@@ -65,15 +213,93 @@ func (m *MongoDB) Init(metadata common.Metadata) error {
 		return err
 	}
 	m.StorageMetadata = storageMetadata
+
+	if storageMetadata.TransactionMode != TransactionModeDisable {
+		supports, err := m.isSupportsTransaction()
+		if err != nil {
+			return err
+		}
+		if !supports && storageMetadata.TransactionMode == TransactionModeEnabled {
+			return fmt.Errorf("%s is %s, but mongodb server does not support transactions", transactionMode, storageMetadata.TransactionMode)
+		}
+		m.supportsTransaction = supports
+	}
 	return nil
 }
 
+//
+// WithTransaction
+// @Description: 在事务中执行fn，fn中的数据库操作必须使用传入的ctx。服务器不支持事务或未启用事务时，直接执行fn。
+// @receiver m
+// @param ctx
+// @param fn
+// @return error
+//
+func (m *MongoDB) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if !m.supportsTransaction {
+		return fn(ctx)
+	}
+	session, err := m.GetClient().StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sessCtx)
+	})
+	return err
+}
+
+func (m *MongoDB) SupportsTransaction() bool {
+	return m.supportsTransaction
+}
+
+//
+// isSupportsTransaction
+// @Description: 副本集(setName)或分片集群(isdbgrid)才支持事务
+// @receiver m
+// @return bool
+// @return error
+//
+func (m *MongoDB) isSupportsTransaction() (bool, error) {
+	var result struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	cmd := bson.D{{Key: "isMaster", Value: 1}}
+	if err := m.GetClient().Database("admin").RunCommand(context.Background(), cmd).Decode(&result); err != nil {
+		return false, err
+	}
+	return result.SetName != "" || result.Msg == "isdbgrid", nil
+}
+
 func (m *MongoDB) getStorageMetadata(metadata common.Metadata) (*StorageMetadata, error) {
 	meta := StorageMetadata{
 		MongoDBMetadata:         m.MongoDB.GetMetadata(),
 		EventCollectionName:     defaultEventCollectionName,
 		SnapshotCollectionName:  defaultSnapshotCollectionName,
 		AggregateCollectionName: defaultAggregateCollectionName,
+		PositionCollectionName:  defaultPositionCollectionName,
+		DataKeyCollectionName:   defaultDataKeyCollectionName,
+		HistoryCollectionName:   defaultHistoryCollectionName,
+		TransactionMode:         TransactionModeAuto,
+		Tenancy:                 TenancyShared,
+		OutboxRelay: &OutboxRelayOptions{
+			Enabled:    true,
+			Interval:   defaultOutboxRelayInterval,
+			BatchSize:  defaultOutboxRelayBatchSize,
+			MinBackoff: defaultOutboxRelayMinBackoff,
+			MaxBackoff: defaultOutboxRelayMaxBackoff,
+		},
+		CreateIndexes:      true,
+		EventPosition:      true,
+		RelationIndexes:    make(map[string][]string),
+		RelationDeleteMode: RelationDeleteModeFlag,
+		DataCodec: &DataCodecOptions{
+			Codec:              DataCodecBson,
+			AggregateCodec:     make(map[string]DataCodec),
+			SnapshotBucketName: defaultSnapshotBucketName,
+		},
 	}
 	if val, ok := metadata.Properties[eventCollectionName]; ok && val != "" {
 		meta.EventCollectionName = val
@@ -84,5 +310,178 @@ func (m *MongoDB) getStorageMetadata(metadata common.Metadata) (*StorageMetadata
 	if val, ok := metadata.Properties[aggregateCollectionName]; ok && val != "" {
 		meta.AggregateCollectionName = val
 	}
+	if val, ok := metadata.Properties[positionCollectionName]; ok && val != "" {
+		meta.PositionCollectionName = val
+	}
+	if val, ok := metadata.Properties[dataKeyCollectionName]; ok && val != "" {
+		meta.DataKeyCollectionName = val
+	}
+	if val, ok := metadata.Properties[historyCollectionName]; ok && val != "" {
+		meta.HistoryCollectionName = val
+	}
+	if val, ok := metadata.Properties[publishBatch]; ok && val != "" {
+		var err error
+		if meta.PublishBatch, err = strconv.ParseBool(val); err != nil {
+			return nil, fmt.Errorf("incorrect %s field from metadata", publishBatch)
+		}
+	}
+	if val, ok := metadata.Properties[eventPosition]; ok && val != "" {
+		var err error
+		if meta.EventPosition, err = strconv.ParseBool(val); err != nil {
+			return nil, fmt.Errorf("incorrect %s field from metadata", eventPosition)
+		}
+	}
+	if val, ok := metadata.Properties[transactionMode]; ok && val != "" {
+		switch mode := TransactionMode(val); mode {
+		case TransactionModeAuto, TransactionModeEnabled, TransactionModeDisable:
+			meta.TransactionMode = mode
+		default:
+			return nil, fmt.Errorf("%s %s is error, must be auto, true or false", transactionMode, val)
+		}
+	}
+	if val, ok := metadata.Properties[tenancy]; ok && val != "" {
+		switch t := Tenancy(val); t {
+		case TenancyShared, TenancyCollection, TenancyDatabase:
+			meta.Tenancy = t
+		default:
+			return nil, fmt.Errorf("%s %s is error, must be shared, collection or database", tenancy, val)
+		}
+	}
+	if err := getRelationOptions(metadata, &meta); err != nil {
+		return nil, err
+	}
+	if err := getOutboxRelayOptions(metadata, meta.OutboxRelay); err != nil {
+		return nil, err
+	}
+	snapshotPolicy, err := eventstorage.GetSnapshotPolicy(metadata)
+	if err != nil {
+		return nil, err
+	}
+	meta.SnapshotPolicy = snapshotPolicy
+	if err := getIndexOptions(metadata, &meta); err != nil {
+		return nil, err
+	}
+	if err := getDataCodecOptions(metadata, meta.DataCodec); err != nil {
+		return nil, err
+	}
 	return &meta, nil
 }
+
+// getIndexOptions 索引配置
+//   createIndexes   : 是否在Init时创建索引，默认true。事件序号的唯一索引遇到已有的重复序号时只记录警告
+//   relationIndexes : 需要创建索引的关系字段，格式为 "Order:customerId,Order:userId,Payment:orderId"
+func getIndexOptions(metadata common.Metadata, meta *StorageMetadata) error {
+	var err error
+	if val, ok := metadata.Properties[createIndexes]; ok && val != "" {
+		if meta.CreateIndexes, err = strconv.ParseBool(val); err != nil {
+			return fmt.Errorf("incorrect %s field from metadata", createIndexes)
+		}
+	}
+	if val, ok := metadata.Properties[relationIndexes]; ok && val != "" {
+		for _, item := range strings.Split(val, ",") {
+			kv := strings.Split(item, ":")
+			if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+				return fmt.Errorf("incorrect %s field from metadata", relationIndexes)
+			}
+			aggregateType := strings.TrimSpace(kv[0])
+			meta.RelationIndexes[aggregateType] = append(meta.RelationIndexes[aggregateType], strings.TrimSpace(kv[1]))
+		}
+	}
+	return nil
+}
+
+// getRelationOptions 关系配置
+//   relationDeleteMode : 删除聚合根时关系的处理方式，flag或remove，默认flag
+//   relationHistory    : 是否保存关系的变更历史，默认false
+func getRelationOptions(metadata common.Metadata, meta *StorageMetadata) error {
+	if val, ok := metadata.Properties[relationDeleteMode]; ok && val != "" {
+		switch mode := RelationDeleteMode(val); mode {
+		case RelationDeleteModeFlag, RelationDeleteModeRemove:
+			meta.RelationDeleteMode = mode
+		default:
+			return fmt.Errorf("%s %s is error, must be flag or remove", relationDeleteMode, val)
+		}
+	}
+	if val, ok := metadata.Properties[relationHistory]; ok && val != "" {
+		var err error
+		if meta.RelationHistory, err = strconv.ParseBool(val); err != nil {
+			return fmt.Errorf("incorrect %s field from metadata", relationHistory)
+		}
+	}
+	return nil
+}
+
+func getDataCodecOptions(metadata common.Metadata, opts *DataCodecOptions) error {
+	var err error
+	if val, ok := metadata.Properties[dataCodec]; ok && val != "" {
+		if opts.Codec, err = ParseDataCodec(val); err != nil {
+			return fmt.Errorf("incorrect %s field from metadata", dataCodec)
+		}
+	}
+	if val, ok := metadata.Properties[dataCodecs]; ok && val != "" {
+		for _, item := range strings.Split(val, ",") {
+			kv := strings.Split(item, ":")
+			if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+				return fmt.Errorf("incorrect %s field from metadata", dataCodecs)
+			}
+			codec, err := ParseDataCodec(strings.TrimSpace(kv[1]))
+			if err != nil {
+				return fmt.Errorf("incorrect %s field from metadata", dataCodecs)
+			}
+			opts.AggregateCodec[strings.TrimSpace(kv[0])] = codec
+		}
+	}
+	if val, ok := metadata.Properties[snapshotFileThreshold]; ok && val != "" {
+		if opts.SnapshotFileThreshold, err = strconv.Atoi(val); err != nil || opts.SnapshotFileThreshold < 0 {
+			return fmt.Errorf("incorrect %s field from metadata", snapshotFileThreshold)
+		}
+	}
+	if val, ok := metadata.Properties[snapshotBucketName]; ok && val != "" {
+		opts.SnapshotBucketName = val
+	}
+	return nil
+}
+
+func getOutboxRelayOptions(metadata common.Metadata, opts *OutboxRelayOptions) error {
+	var err error
+	if val, ok := metadata.Properties[outboxRelayEnabled]; ok && val != "" {
+		if opts.Enabled, err = strconv.ParseBool(val); err != nil {
+			return fmt.Errorf("incorrect %s field from metadata", outboxRelayEnabled)
+		}
+	}
+	if val, ok := metadata.Properties[outboxRelayInterval]; ok && val != "" {
+		if opts.Interval, err = time.ParseDuration(val); err != nil || opts.Interval <= 0 {
+			return fmt.Errorf("incorrect %s field from metadata", outboxRelayInterval)
+		}
+	}
+	if val, ok := metadata.Properties[outboxRelayBatchSize]; ok && val != "" {
+		if opts.BatchSize, err = strconv.ParseInt(val, 10, 64); err != nil || opts.BatchSize <= 0 {
+			return fmt.Errorf("incorrect %s field from metadata", outboxRelayBatchSize)
+		}
+	}
+	if val, ok := metadata.Properties[outboxRelayMinBackoff]; ok && val != "" {
+		if opts.MinBackoff, err = time.ParseDuration(val); err != nil || opts.MinBackoff < 0 {
+			return fmt.Errorf("incorrect %s field from metadata", outboxRelayMinBackoff)
+		}
+	}
+	if val, ok := metadata.Properties[outboxRelayMaxBackoff]; ok && val != "" {
+		if opts.MaxBackoff, err = time.ParseDuration(val); err != nil {
+			return fmt.Errorf("incorrect %s field from metadata", outboxRelayMaxBackoff)
+		}
+	}
+	if val, ok := metadata.Properties[outboxRelayMaxAttempts]; ok && val != "" {
+		if opts.MaxAttempts, err = strconv.Atoi(val); err != nil || opts.MaxAttempts < 0 {
+			return fmt.Errorf("incorrect %s field from metadata", outboxRelayMaxAttempts)
+		}
+	}
+	if val, ok := metadata.Properties[deadLetterPubsubName]; ok && val != "" {
+		opts.DeadLetterPubsubName = val
+	}
+	if val, ok := metadata.Properties[deadLetterTopic]; ok && val != "" {
+		opts.DeadLetterTopic = val
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		return fmt.Errorf("%s %v is error, must not be less than %s %v", outboxRelayMaxBackoff, opts.MaxBackoff, outboxRelayMinBackoff, opts.MinBackoff)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package other
+
+import (
+	"github.com/liuxd6825/components-contrib/liuxd/common"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_GetIndexOptions(t *testing.T) {
+	meta := &StorageMetadata{CreateIndexes: true, RelationIndexes: make(map[string][]string)}
+	err := getIndexOptions(common.Metadata{Properties: map[string]string{
+		createIndexes:   "false",
+		relationIndexes: "Order:customerId, Order:userId,Payment:orderId",
+	}}, meta)
+	assert.NoError(t, err)
+	assert.False(t, meta.CreateIndexes)
+	assert.Equal(t, []string{"customerId", "userId"}, meta.RelationIndexes["Order"])
+	assert.Equal(t, []string{"orderId"}, meta.RelationIndexes["Payment"])
+
+	err = getIndexOptions(common.Metadata{Properties: map[string]string{relationIndexes: "Order"}}, meta)
+	assert.EqualError(t, err, "incorrect relationIndexes field from metadata")
+}
+
+func Test_GetDataCodecOptions(t *testing.T) {
+	opts := &DataCodecOptions{Codec: DataCodecBson, AggregateCodec: make(map[string]DataCodec)}
+	err := getDataCodecOptions(common.Metadata{Properties: map[string]string{
+		dataCodec:             "gzip",
+		dataCodecs:            "Order:zstd, Customer:bson",
+		snapshotFileThreshold: "1048576",
+	}}, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, DataCodecZstd, opts.GetCodec("Order"))
+	assert.Equal(t, DataCodecBson, opts.GetCodec("Customer"))
+	assert.Equal(t, DataCodecGzip, opts.GetCodec("Product"))
+	assert.Equal(t, 1048576, opts.SnapshotFileThreshold)
+
+	err = getDataCodecOptions(common.Metadata{Properties: map[string]string{dataCodecs: "Order:lz4"}}, opts)
+	assert.EqualError(t, err, "incorrect dataCodecs field from metadata")
+}
+
+func Test_GetStorageMetadataTenancy(t *testing.T) {
+	m := NewMongoDB(nil)
+	meta, err := m.getStorageMetadata(common.Metadata{Properties: map[string]string{}})
+	assert.NoError(t, err)
+	assert.Equal(t, TenancyShared, meta.Tenancy)
+
+	meta, err = m.getStorageMetadata(common.Metadata{Properties: map[string]string{tenancy: "database"}})
+	assert.NoError(t, err)
+	assert.Equal(t, TenancyDatabase, meta.Tenancy)
+	m.StorageMetadata = meta
+	assert.True(t, m.IsTenantIsolated())
+
+	_, err = m.getStorageMetadata(common.Metadata{Properties: map[string]string{tenancy: "schema"}})
+	assert.EqualError(t, err, "tenancy schema is error, must be shared, collection or database")
+
+	assert.True(t, meta.EventPosition)
+	meta, err = m.getStorageMetadata(common.Metadata{Properties: map[string]string{eventPosition: "false"}})
+	assert.NoError(t, err)
+	assert.False(t, meta.EventPosition)
+	_, err = m.getStorageMetadata(common.Metadata{Properties: map[string]string{eventPosition: "no"}})
+	assert.EqualError(t, err, "incorrect eventPosition field from metadata")
+
+	_, err = m.GetOrCreateCollection("", "dapr_event", nil)
+	assert.EqualError(t, err, "tenantId cannot be empty when tenancy is database")
+	_, err = m.GetOrCreateCollection("order_x", "dapr_event", nil)
+	assert.EqualError(t, err, "tenantId \"order_x\" is error, must be 1 to 48 letters, digits or '-'")
+}
+
+func Test_TenantNames(t *testing.T) {
+	assert.NoError(t, ValidateTenantId("tenant-01"))
+	assert.Error(t, ValidateTenantId("a.b"))
+	assert.Error(t, ValidateTenantId("a/b"))
+	assert.Error(t, ValidateTenantId(strings.Repeat("a", 49)))
+	assert.Equal(t, "user_order__x", NewTenantName("user_order", "x"))
+
+	// user__order__x 属于集合user__order，不是集合user的租户
+	names := []string{"user__t2", "user__t1", "user__order__x", "user_order__x", "user"}
+	assert.Equal(t, []string{"t1", "t2"}, newTenantIds(names, NewTenantName("user", "")))
+}
+
+func Test_GetRelationOptions(t *testing.T) {
+	meta := &StorageMetadata{RelationDeleteMode: RelationDeleteModeFlag}
+	err := getRelationOptions(common.Metadata{Properties: map[string]string{
+		relationDeleteMode: "remove",
+		relationHistory:    "true",
+	}}, meta)
+	assert.NoError(t, err)
+	assert.Equal(t, RelationDeleteModeRemove, meta.RelationDeleteMode)
+	assert.True(t, meta.RelationHistory)
+
+	err = getRelationOptions(common.Metadata{Properties: map[string]string{relationDeleteMode: "cascade"}}, meta)
+	assert.EqualError(t, err, "relationDeleteMode cascade is error, must be flag or remove")
+	err = getRelationOptions(common.Metadata{Properties: map[string]string{relationHistory: "yes"}}, meta)
+	assert.EqualError(t, err, "incorrect relationHistory field from metadata")
+}
+
+func Test_GetOutboxRelayOptions(t *testing.T) {
+	newOptions := func() *OutboxRelayOptions {
+		return &OutboxRelayOptions{Interval: defaultOutboxRelayInterval, MinBackoff: defaultOutboxRelayMinBackoff, MaxBackoff: defaultOutboxRelayMaxBackoff}
+	}
+	opts := newOptions()
+	err := getOutboxRelayOptions(common.Metadata{Properties: map[string]string{
+		outboxRelayInterval:   "1s",
+		outboxRelayMinBackoff: "0s",
+		outboxRelayMaxBackoff: "1m",
+	}}, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Second, opts.Interval)
+	assert.Equal(t, time.Duration(0), opts.MinBackoff)
+	assert.Equal(t, time.Minute, opts.MaxBackoff)
+
+	err = getOutboxRelayOptions(common.Metadata{Properties: map[string]string{outboxRelayInterval: "0s"}}, newOptions())
+	assert.EqualError(t, err, "incorrect outboxRelayInterval field from metadata")
+	err = getOutboxRelayOptions(common.Metadata{Properties: map[string]string{outboxRelayInterval: "-1s"}}, newOptions())
+	assert.EqualError(t, err, "incorrect outboxRelayInterval field from metadata")
+	err = getOutboxRelayOptions(common.Metadata{Properties: map[string]string{outboxRelayMinBackoff: "-1s"}}, newOptions())
+	assert.EqualError(t, err, "incorrect outboxRelayMinBackoff field from metadata")
+	err = getOutboxRelayOptions(common.Metadata{Properties: map[string]string{
+		outboxRelayMinBackoff: "1m",
+		outboxRelayMaxBackoff: "10s",
+	}}, newOptions())
+	assert.EqualError(t, err, "outboxRelayMaxBackoff 10s is error, must not be less than outboxRelayMinBackoff 1m0s")
+}
@@ -0,0 +1,172 @@
+package other
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Tenancy 租户数据隔离策略，通过组件元数据 tenancy 配置
+//   shared     : 默认值，所有租户共用集合，按tenant_id区分
+//   collection : 每个租户使用单独的集合，集合名称为 {collectionName}__{tenantId}
+//   database   : 每个租户使用单独的数据库，数据库名称为 {databaseName}__{tenantId}
+// 租户隔离时tenantId只能包含字母、数字与'-'，最长48个字符，名称中最后一个"__"之后为tenantId，不会与其它集合的名称混淆。
+// 全局位置计数器集合始终共用。租户的集合在第一次使用时创建索引并缓存。
+type Tenancy string
+
+const (
+	TenancyShared     Tenancy = "shared"
+	TenancyCollection Tenancy = "collection"
+	TenancyDatabase   Tenancy = "database"
+)
+
+// CollectionInitFunc 租户的集合第一次使用时调用，用于创建索引
+type CollectionInitFunc func(ctx context.Context, collection *mongo.Collection) error
+
+const (
+	// tenantSeparator 集合、数据库名称与tenantId之间的分隔符，tenantId中不能包含'_'
+	tenantSeparator = "__"
+	// maxDatabaseNameLength MongoDB数据库名称的最大字节数
+	maxDatabaseNameLength = 63
+)
+
+var tenantIdRegexp = regexp.MustCompile(`^[A-Za-z0-9-]{1,48}$`)
+
+//
+// NewTenantName
+// @Description: 租户隔离时租户的集合、数据库或GridFS bucket的名称
+// @param name
+// @param tenantId
+// @return string
+//
+func NewTenantName(name string, tenantId string) string {
+	return name + tenantSeparator + tenantId
+}
+
+//
+// ValidateTenantId
+// @Description: 校验租户隔离时的tenantId，tenantId会作为集合或数据库名称的一部分
+// @param tenantId
+// @return error
+//
+func ValidateTenantId(tenantId string) error {
+	if !tenantIdRegexp.MatchString(tenantId) {
+		return errors.New(fmt.Sprintf("tenantId \"%s\" is error, must be 1 to 48 letters, digits or '-'", tenantId))
+	}
+	return nil
+}
+
+//
+// IsTenantIsolated
+// @Description: 租户是否使用单独的集合或数据库
+// @receiver m
+// @return bool
+//
+func (m *MongoDB) IsTenantIsolated() bool {
+	return m != nil && m.StorageMetadata != nil && m.StorageMetadata.Tenancy != "" && m.StorageMetadata.Tenancy != TenancyShared
+}
+
+//
+// GetOrCreateCollection
+// @Description: 按租户隔离策略返回租户的集合并缓存，第一次使用时调用init，init失败时下次使用再次调用。
+// init在事务外执行，事务中第一次使用时也可以创建索引。init不持有锁，并发第一次使用时可能执行多次
+// @receiver m
+// @param tenantId
+// @param name 共用集合的名称
+// @param init 可以为nil
+// @return *mongo.Collection
+// @return error
+//
+func (m *MongoDB) GetOrCreateCollection(tenantId string, name string, init CollectionInitFunc) (*mongo.Collection, error) {
+	if !m.IsTenantIsolated() {
+		return m.NewCollection(name), nil
+	}
+	if tenantId == "" {
+		return nil, errors.New(fmt.Sprintf("tenantId cannot be empty when %s is %s", tenancy, m.StorageMetadata.Tenancy))
+	}
+	key := tenantId + "/" + name
+	m.collectionsMu.Lock()
+	coll, ok := m.collections[key]
+	m.collectionsMu.Unlock()
+	if ok {
+		return coll, nil
+	}
+	if err := ValidateTenantId(tenantId); err != nil {
+		return nil, err
+	}
+	switch m.StorageMetadata.Tenancy {
+	case TenancyCollection:
+		coll = m.NewCollection(NewTenantName(name, tenantId))
+	case TenancyDatabase:
+		dbName := NewTenantName(m.GetDatabase().Name(), tenantId)
+		if len(dbName) > maxDatabaseNameLength {
+			return nil, errors.New(fmt.Sprintf("database name %s is too long, must be at most %d bytes", dbName, maxDatabaseNameLength))
+		}
+		coll = m.NewDatabaseCollection(dbName, name)
+	}
+	if init != nil {
+		if err := init(context.Background(), coll); err != nil {
+			return nil, err
+		}
+	}
+	m.collectionsMu.Lock()
+	defer m.collectionsMu.Unlock()
+	if m.collections == nil {
+		m.collections = make(map[string]*mongo.Collection)
+	}
+	m.collections[key] = coll
+	return coll, nil
+}
+
+//
+// FindTenantIds
+// @Description: 查找已有集合name的租户，按租户Id排序，用于跨租户的查询。租户未隔离时返回nil。
+// 前缀之后不是合法tenantId的名称属于其它集合或数据库
+// @receiver m
+// @param ctx
+// @param name 共用集合的名称
+// @return []string
+// @return error
+//
+func (m *MongoDB) FindTenantIds(ctx context.Context, name string) ([]string, error) {
+	if !m.IsTenantIsolated() {
+		return nil, nil
+	}
+	var prefix string
+	var names []string
+	var err error
+	switch m.StorageMetadata.Tenancy {
+	case TenancyCollection:
+		prefix = NewTenantName(name, "")
+		names, err = m.GetDatabase().ListCollectionNames(ctx, newPrefixFilter(prefix))
+	case TenancyDatabase:
+		prefix = NewTenantName(m.GetDatabase().Name(), "")
+		names, err = m.GetClient().ListDatabaseNames(ctx, newPrefixFilter(prefix))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newTenantIds(names, prefix), nil
+}
+
+func newTenantIds(names []string, prefix string) []string {
+	tenantIds := make([]string, 0, len(names))
+	for _, item := range names {
+		tenantId := strings.TrimPrefix(item, prefix)
+		if len(tenantId) < len(item) && ValidateTenantId(tenantId) == nil {
+			tenantIds = append(tenantIds, tenantId)
+		}
+	}
+	sort.Strings(tenantIds)
+	return tenantIds
+}
+
+func newPrefixFilter(prefix string) bson.M {
+	return bson.M{"name": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(prefix)}}
+}
@@ -0,0 +1,226 @@
+package es_mongo
+
+import (
+	"context"
+	"github.com/dapr/kit/logger"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/other"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/service"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/model"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"sync"
+	"time"
+)
+
+type publishFunc func(ctx context.Context, event *eventstorage.Event) error
+
+// deadLetterFunc 将发送失败的事件及失败原因复制到死信主题
+type deadLetterFunc func(ctx context.Context, event *eventstorage.Event, attempts int, reason string) error
+
+//
+// outboxRelay
+// @Description: 后台补发 PublishStatusWait 状态的事件，以及旧版本中没有发送次数的 PublishStatusError 状态的事件。
+// 同一聚合根的事件按SequenceNumber顺序发送，某个事件发送失败或处于重试等待时，该聚合根的后续事件不再发送，直到该事件发送成功。
+// 发送次数达到MaxAttempts的事件复制到死信主题并标记为PublishStatusError，之后不再重试，该聚合根的后续事件继续发送，
+// 即该聚合根的事件顺序在死信事件处中断：订阅者收到的事件不包含死信事件，需要保证顺序时由死信主题的消费者补偿，或设置MaxAttempts为0一直重试。
+// 写入时的发送与本任务的补发合起来是至少一次(at-least-once)投递：发送成功但更新发送状态失败、进程在两者之间退出，
+// 或写入时的发送超过MinBackoff仍未完成时，同一事件会再次发送，订阅者需按EventId去重。
+//
+type outboxRelay struct {
+	options      *other.OutboxRelayOptions
+	eventService service.EventService
+	publish      publishFunc
+	deadLetter   deadLetterFunc
+	log          logger.Logger
+	mu           sync.Mutex
+	stopCh       chan struct{}
+	wg           sync.WaitGroup
+}
+
+func newOutboxRelay(options *other.OutboxRelayOptions, eventService service.EventService, publish publishFunc, deadLetter deadLetterFunc, log logger.Logger) *outboxRelay {
+	return &outboxRelay{
+		options:      options,
+		eventService: eventService,
+		publish:      publish,
+		deadLetter:   deadLetter,
+		log:          log,
+	}
+}
+
+//
+// Start
+// @Description: 启动后台任务，重复调用无效
+// @receiver r
+//
+func (r *outboxRelay) Start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopCh != nil {
+		return
+	}
+	r.stopCh = make(chan struct{})
+	r.wg.Add(1)
+	go r.run(r.stopCh)
+}
+
+//
+// Stop
+// @Description: 停止后台任务，并等待正在进行的扫描结束
+// @receiver r
+//
+func (r *outboxRelay) Stop() {
+	r.mu.Lock()
+	if r.stopCh == nil {
+		r.mu.Unlock()
+		return
+	}
+	close(r.stopCh)
+	r.stopCh = nil
+	r.mu.Unlock()
+	r.wg.Wait()
+}
+
+func (r *outboxRelay) run(stopCh chan struct{}) {
+	defer r.wg.Done()
+	ticker := time.NewTicker(r.options.Interval)
+	defer ticker.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			if err := r.relayOnce(ctx, time.Now()); err != nil && ctx.Err() == nil && r.log != nil {
+				r.log.Errorf("outbox relay error: %s", err.Error())
+			}
+		}
+	}
+}
+
+//
+// relayOnce
+// @Description: 扫描一次未成功发送的事件并补发
+// @receiver r
+// @param ctx
+// @param now
+// @return error
+//
+func (r *outboxRelay) relayOnce(ctx context.Context, now time.Time) error {
+	before := primitive.NewDateTimeFromTime(now.Add(-r.options.MinBackoff))
+	events, err := r.eventService.FindNotPublished(ctx, before, primitive.NewDateTimeFromTime(now), r.options.BatchSize)
+	if err != nil {
+		return err
+	}
+	blocked := make(map[string]bool)
+	checked := make(map[string]bool)
+	for _, event := range *events {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		key := event.TenantId + "/" + event.AggregateId
+		if blocked[key] {
+			continue
+		}
+		// 处于重试等待的事件不在查询结果中，聚合根第一个等待发送的事件不是本事件时，等待该事件发送成功
+		if !checked[key] {
+			checked[key] = true
+			first, err := r.eventService.FindFirstNotPublished(ctx, event.TenantId, event.AggregateId)
+			if err != nil {
+				return err
+			}
+			if first != nil && first.EventId != event.EventId {
+				blocked[key] = true
+				continue
+			}
+		}
+		if event.NextPublishTime.Time().After(now) {
+			blocked[key] = true
+			continue
+		}
+		if err := r.publish(ctx, newEventFromEntity(&event)); err != nil {
+			blocked[key] = true
+			if err := r.publishFailed(ctx, newEventFromEntity(&event), event.PublishAttempts+1, err, now); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := r.eventService.UpdatePublishStatue(ctx, event.TenantId, event.EventId, eventstorage.PublishStatusSuccess); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// publishFailed
+// @Description: 记录第attempts次发送失败。未达到MaxAttempts时按退避时间等待重试；
+// 达到MaxAttempts时复制到死信主题并标记为PublishStatusError，复制失败时继续等待，下次扫描再次复制
+// @receiver r
+// @param ctx
+// @param event
+// @param attempts
+// @param publishErr
+// @param now
+// @return error
+//
+func (r *outboxRelay) publishFailed(ctx context.Context, event *eventstorage.Event, attempts int, publishErr error, now time.Time) error {
+	errMsg := publishErr.Error()
+	if r.options.MaxAttempts > 0 && attempts >= r.options.MaxAttempts {
+		var err error
+		if r.options.DeadLetterTopic != "" {
+			err = r.deadLetter(ctx, event, attempts, errMsg)
+		}
+		if err == nil {
+			return r.eventService.UpdatePublishError(ctx, event.TenantId, event.EventId, eventstorage.PublishStatusError, attempts, errMsg, 0)
+		}
+		errMsg = errMsg + "; dead letter error: " + err.Error()
+	}
+	nextPublishTime := primitive.NewDateTimeFromTime(now.Add(r.backoff(attempts)))
+	return r.eventService.UpdatePublishError(ctx, event.TenantId, event.EventId, eventstorage.PublishStatusWait, attempts, errMsg, nextPublishTime)
+}
+
+//
+// backoff
+// @Description: 第attempts次失败后的重试等待时间，从MinBackoff开始按2的指数增长，不超过MaxBackoff
+// @receiver r
+// @param attempts
+// @return time.Duration
+//
+func (r *outboxRelay) backoff(attempts int) time.Duration {
+	d := r.options.MinBackoff
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= r.options.MaxBackoff {
+			return r.options.MaxBackoff
+		}
+	}
+	return d
+}
+
+func newEventFromEntity(entity *model.EventEntity) *eventstorage.Event {
+	return &eventstorage.Event{
+		TenantId:      entity.TenantId,
+		AggregateId:   entity.AggregateId,
+		AggregateType: entity.AggregateType,
+		CommandId:     entity.CommandId,
+		EventId:       entity.EventId,
+		EventData:     entity.EventData,
+		EventType:     entity.EventType,
+		EventVersion:  entity.EventVersion,
+		PubsubName:    entity.PublishName,
+		Relations:     entity.Relations,
+		RelationLists: entity.RelationLists,
+		Topic:         entity.Topic,
+		Metadata:      entity.Metadata,
+		EventTime:     entity.GetEventTime(),
+		CausationId:   entity.CausationId,
+		CorrelationId: entity.CorrelationId,
+	}
+}
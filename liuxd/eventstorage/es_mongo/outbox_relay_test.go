@@ -0,0 +1,167 @@
+package es_mongo
+
+import (
+	"context"
+	"errors"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/other"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/service"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/model"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+	"time"
+)
+
+type relayTestEventService struct {
+	service.EventService
+	events   []model.EventEntity
+	statuses map[string]eventstorage.PublishStatus
+	attempts map[string]int
+}
+
+func (s *relayTestEventService) FindNotPublished(ctx context.Context, before primitive.DateTime, now primitive.DateTime, limit int64) (*[]model.EventEntity, error) {
+	var list []model.EventEntity
+	for _, event := range s.events {
+		if event.NextPublishTime <= now {
+			list = append(list, event)
+		}
+	}
+	return &list, nil
+}
+
+func (s *relayTestEventService) FindFirstNotPublished(ctx context.Context, tenantId string, aggregateId string) (*model.EventEntity, error) {
+	var first *model.EventEntity
+	for i, event := range s.events {
+		if event.TenantId != tenantId || event.AggregateId != aggregateId || s.statuses[event.EventId] != eventstorage.PublishStatusWait {
+			continue
+		}
+		if first == nil || event.SequenceNumber < first.SequenceNumber {
+			first = &s.events[i]
+		}
+	}
+	return first, nil
+}
+
+func (s *relayTestEventService) UpdatePublishStatue(ctx context.Context, tenantId string, eventId string, publishStatue eventstorage.PublishStatus) error {
+	s.statuses[eventId] = publishStatue
+	return nil
+}
+
+func (s *relayTestEventService) UpdatePublishError(ctx context.Context, tenantId string, eventId string, publishStatue eventstorage.PublishStatus, attempts int, errMsg string, nextPublishTime primitive.DateTime) error {
+	s.statuses[eventId] = publishStatue
+	s.attempts[eventId] = attempts
+	return nil
+}
+
+func TestOutboxRelay_RelayOnce(t *testing.T) {
+	now := time.Now()
+	eventService := &relayTestEventService{
+		events: []model.EventEntity{
+			{EventId: "a1", TenantId: "t", AggregateId: "a", SequenceNumber: 1},
+			{EventId: "a2", TenantId: "t", AggregateId: "a", SequenceNumber: 2},
+			{EventId: "b1", TenantId: "t", AggregateId: "b", SequenceNumber: 1, NextPublishTime: primitive.NewDateTimeFromTime(now.Add(time.Minute))},
+			{EventId: "b2", TenantId: "t", AggregateId: "b", SequenceNumber: 2},
+			{EventId: "c1", TenantId: "t", AggregateId: "c", SequenceNumber: 1, PublishAttempts: 2},
+			{EventId: "d1", TenantId: "t", AggregateId: "d", SequenceNumber: 1, NextPublishTime: primitive.NewDateTimeFromTime(now.Add(time.Minute))},
+			{EventId: "d2", TenantId: "t", AggregateId: "d", SequenceNumber: 2},
+			{EventId: "d3", TenantId: "t", AggregateId: "d", SequenceNumber: 3},
+		},
+		statuses: map[string]eventstorage.PublishStatus{},
+		attempts: map[string]int{},
+	}
+	var published []string
+	publish := func(ctx context.Context, event *eventstorage.Event) error {
+		if event.EventId == "a1" {
+			return errors.New("publish error")
+		}
+		published = append(published, event.EventId)
+		return nil
+	}
+	options := &other.OutboxRelayOptions{MinBackoff: time.Second, MaxBackoff: time.Minute, BatchSize: 100}
+	relay := newOutboxRelay(options, eventService, publish, nil, nil)
+	if err := relay.relayOnce(context.Background(), now); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(published) != 1 || published[0] != "c1" {
+		t.Errorf("published = %v, want [c1]", published)
+	}
+	if eventService.statuses["a1"] != eventstorage.PublishStatusWait || eventService.attempts["a1"] != 1 {
+		t.Errorf("a1 should stay PublishStatusWait with 1 attempt")
+	}
+	if _, ok := eventService.statuses["a2"]; ok {
+		t.Errorf("a2 must wait until a1 is published")
+	}
+	if _, ok := eventService.statuses["b2"]; ok {
+		t.Errorf("b2 must wait until b1 is published")
+	}
+	// d1处于重试等待，不在查询结果中，d2、d3仍需等待d1发送成功
+	if _, ok := eventService.statuses["d2"]; ok {
+		t.Errorf("d2 must wait until d1 is published")
+	}
+	if eventService.statuses["c1"] != eventstorage.PublishStatusSuccess {
+		t.Errorf("c1 should be PublishStatusSuccess")
+	}
+}
+
+func TestOutboxRelay_DeadLetter(t *testing.T) {
+	now := time.Now()
+	eventService := &relayTestEventService{
+		events: []model.EventEntity{
+			{EventId: "a1", TenantId: "t", AggregateId: "a", SequenceNumber: 1, PublishAttempts: 1},
+			{EventId: "b1", TenantId: "t", AggregateId: "b", SequenceNumber: 1, PublishAttempts: 2},
+			{EventId: "c1", TenantId: "t", AggregateId: "c", SequenceNumber: 1, PublishAttempts: 2},
+		},
+		statuses: map[string]eventstorage.PublishStatus{},
+		attempts: map[string]int{},
+	}
+	publish := func(ctx context.Context, event *eventstorage.Event) error {
+		return errors.New("publish error")
+	}
+	var deadLetters []string
+	deadLetter := func(ctx context.Context, event *eventstorage.Event, attempts int, reason string) error {
+		if event.EventId == "c1" {
+			return errors.New("dead letter error")
+		}
+		deadLetters = append(deadLetters, event.EventId)
+		if attempts != 3 || reason != "publish error" {
+			t.Errorf("dead letter %s attempts = %d, reason = %s", event.EventId, attempts, reason)
+		}
+		return nil
+	}
+	options := &other.OutboxRelayOptions{MinBackoff: time.Second, MaxBackoff: time.Minute, BatchSize: 100, MaxAttempts: 3, DeadLetterTopic: "dead-letter"}
+	relay := newOutboxRelay(options, eventService, publish, deadLetter, nil)
+	if err := relay.relayOnce(context.Background(), now); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(deadLetters) != 1 || deadLetters[0] != "b1" {
+		t.Errorf("dead letters = %v, want [b1]", deadLetters)
+	}
+	if eventService.statuses["a1"] != eventstorage.PublishStatusWait || eventService.attempts["a1"] != 2 {
+		t.Errorf("a1 should stay PublishStatusWait with 2 attempts")
+	}
+	if eventService.statuses["b1"] != eventstorage.PublishStatusError || eventService.attempts["b1"] != 3 {
+		t.Errorf("b1 should be PublishStatusError with 3 attempts")
+	}
+	if eventService.statuses["c1"] != eventstorage.PublishStatusWait {
+		t.Errorf("c1 should stay PublishStatusWait when dead letter fails")
+	}
+}
+
+func TestOutboxRelay_Backoff(t *testing.T) {
+	options := &other.OutboxRelayOptions{MinBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	relay := newOutboxRelay(options, nil, nil, nil, nil)
+	tests := map[int]time.Duration{
+		1: time.Second,
+		2: 2 * time.Second,
+		3: 4 * time.Second,
+		4: 5 * time.Second,
+		9: 5 * time.Second,
+	}
+	for attempts, want := range tests {
+		if got := relay.backoff(attempts); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
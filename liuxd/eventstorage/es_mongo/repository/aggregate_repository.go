@@ -4,10 +4,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/model"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage"
 	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/other"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/model"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"sort"
 )
 
 type AggregateRepository struct {
@@ -18,9 +21,104 @@ func NewAggregateRepository(mongodb *other.MongoDB, collection *mongo.Collection
 	res := &AggregateRepository{}
 	res.mongodb = mongodb
 	res.collection = collection
+	res.initCollection = func(ctx context.Context, collection *mongo.Collection) error {
+		return createIndexes(ctx, collection, aggregateIndexes)
+	}
+	res.NewEntityList = func() interface{} {
+		return &[]*model.AggregateEntity{}
+	}
 	return res
 }
 
+//
+// FindPaging
+// @Description: 按rsql条件分页查询聚合根，aggregateType为空时查询所有类型
+// @receiver r
+// @param ctx
+// @param aggregateType
+// @param query
+// @return *eventstorage.FindPagingResult[*model.AggregateEntity]
+//
+func (r *AggregateRepository) FindPaging(ctx context.Context, aggregateType string, query eventstorage.FindPagingQuery) *eventstorage.FindPagingResult[*model.AggregateEntity] {
+	coll, err := r.getCollection(query.GetTenantId())
+	if err != nil {
+		return eventstorage.NewFindPagingResultWithError[*model.AggregateEntity](err)
+	}
+	return r.FindPagingWithFilter(ctx, coll, query, aggregateTypeFilter(aggregateType))
+}
+
+//
+// Count
+// @Description: 按rsql条件统计租户的聚合根数量，aggregateType为空时统计所有类型
+// @receiver r
+// @param ctx
+// @param tenantId
+// @param aggregateType
+// @param filter
+// @return uint64
+// @return error
+//
+func (r *AggregateRepository) Count(ctx context.Context, tenantId string, aggregateType string, filter string) (uint64, error) {
+	coll, err := r.getCollection(tenantId)
+	if err != nil {
+		return 0, err
+	}
+	return r.BaseRepository.Count(ctx, coll, tenantId, filter, aggregateTypeFilter(aggregateType))
+}
+
+//
+// FindAggregateTypes
+// @Description: 查找租户已有的聚合类型，按名称排序
+// @receiver r
+// @param ctx
+// @param tenantId
+// @return []string
+// @return error
+//
+func (r *AggregateRepository) FindAggregateTypes(ctx context.Context, tenantId string) ([]string, error) {
+	coll, err := r.getCollection(tenantId)
+	if err != nil {
+		return nil, err
+	}
+	values, err := coll.Distinct(ctx, AggregateTypeField, bson.M{TenantIdField: tenantId})
+	if err != nil {
+		return nil, err
+	}
+	aggregateTypes := make([]string, 0, len(values))
+	for _, value := range values {
+		if aggregateType, ok := value.(string); ok {
+			aggregateTypes = append(aggregateTypes, aggregateType)
+		}
+	}
+	sort.Strings(aggregateTypes)
+	return aggregateTypes, nil
+}
+
+//
+// CreateIndexes
+// @Description: 创建聚合根集合的索引
+// @receiver r
+// @param ctx
+// @return error
+//
+func (r *AggregateRepository) CreateIndexes(ctx context.Context) error {
+	return createIndexes(ctx, r.collection, aggregateIndexes)
+}
+
+var aggregateIndexes = []mongo.IndexModel{
+	{
+		Keys:    bson.D{{TenantIdField, 1}, {AggregateTypeField, 1}},
+		Options: options.Index().SetName("tenant_id_aggregate_type"),
+	},
+}
+
+func aggregateTypeFilter(aggregateType string) bson.M {
+	if aggregateType == "" {
+		return nil
+	}
+	return bson.M{AggregateTypeField: aggregateType}
+}
+
 func (r *AggregateRepository) FindById(ctx context.Context, tenantId string, aggregateId string) (*model.AggregateEntity, error) {
 	idValue, err := model.ObjectIDFromHex(aggregateId)
 	if err != nil {
@@ -30,11 +128,51 @@ func (r *AggregateRepository) FindById(ctx context.Context, tenantId string, agg
 		TenantIdField: tenantId,
 		IdField:       idValue,
 	}
-	return r.findOne(ctx, filter)
+	return r.findOne(ctx, tenantId, filter)
+}
+
+//
+// ForEach
+// @Description: 按聚合根Id顺序遍历租户的聚合根，aggregateType为空时遍历所有类型
+// @receiver r
+// @param ctx
+// @param tenantId
+// @param aggregateType
+// @param fun 返回错误时停止遍历
+// @return error
+//
+func (r *AggregateRepository) ForEach(ctx context.Context, tenantId string, aggregateType string, fun func(agg *model.AggregateEntity) error) error {
+	filter := bson.M{TenantIdField: tenantId}
+	if aggregateType != "" {
+		filter[AggregateTypeField] = aggregateType
+	}
+	coll, err := r.getCollection(tenantId)
+	if err != nil {
+		return err
+	}
+	cursor, err := coll.Find(ctx, filter, options.Find().SetSort(bson.D{{IdField, 1}}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var agg model.AggregateEntity
+		if err := cursor.Decode(&agg); err != nil {
+			return err
+		}
+		if err := fun(&agg); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
 }
 
 func (r *AggregateRepository) Insert(ctx context.Context, aggregate *model.AggregateEntity) error {
-	_, err := r.collection.InsertOne(ctx, aggregate)
+	coll, err := r.getCollection(aggregate.TenantId)
+	if err != nil {
+		return err
+	}
+	_, err = coll.InsertOne(ctx, aggregate)
 	if err != nil {
 		return err
 	}
@@ -46,6 +184,10 @@ func (r *AggregateRepository) Delete(ctx context.Context, tenantId, aggregateId
 	if err != nil {
 		return err
 	}
+	coll, err := r.getCollection(tenantId)
+	if err != nil {
+		return err
+	}
 	filter := bson.M{
 		TenantIdField: tenantId,
 		IdField:       idValue,
@@ -53,15 +195,130 @@ func (r *AggregateRepository) Delete(ctx context.Context, tenantId, aggregateId
 	update := bson.M{
 		"$set": bson.M{"deleted": true},
 	}
-	_, err = r.collection.UpdateOne(ctx, filter, update)
+	_, err = coll.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+//
+// Remove
+// @Description: 物理删除聚合根，用于导入时覆盖已有的聚合根
+// @receiver r
+// @param ctx
+// @param tenantId
+// @param aggregateId
+// @return error
+//
+func (r *AggregateRepository) Remove(ctx context.Context, tenantId, aggregateId string) error {
+	idValue, err := model.ObjectIDFromHex(aggregateId)
+	if err != nil {
+		return err
+	}
+	coll, err := r.getCollection(tenantId)
+	if err != nil {
+		return err
+	}
+	filter := bson.M{
+		TenantIdField: tenantId,
+		IdField:       idValue,
+	}
+	_, err = coll.DeleteOne(ctx, filter)
+	return err
+}
+
+//
+// Realign
+// @Description: 将聚合根的SequenceNumber校正为最后一个事件的序号，并标记无法恢复的缺失序号。
+// 聚合根的SequenceNumber已被修改时返回 *eventstorage.ConcurrencyConflictError
+// @receiver r
+// @param ctx
+// @param tenantId
+// @param aggregateId
+// @param fromSequenceNumber 检查时聚合根的SequenceNumber
+// @param toSequenceNumber 最后一个事件的序号
+// @param gaps 缺失的序号
+// @return error
+//
+func (r *AggregateRepository) Realign(ctx context.Context, tenantId, aggregateId string, fromSequenceNumber uint64, toSequenceNumber uint64, gaps []uint64) error {
+	idValue, err := model.ObjectIDFromHex(aggregateId)
+	if err != nil {
+		return err
+	}
+	coll, err := r.getCollection(tenantId)
+	if err != nil {
+		return err
+	}
+	filter := bson.M{
+		TenantIdField:       tenantId,
+		IdField:             idValue,
+		SequenceNumberField: fromSequenceNumber,
+	}
+	update := bson.M{
+		"$set": bson.M{SequenceNumberField: toSequenceNumber},
+	}
+	if len(gaps) > 0 {
+		update["$addToSet"] = bson.M{SequenceGapsField: bson.M{"$each": gaps}}
+	}
+	res, err := coll.UpdateOne(ctx, filter, update)
 	if err != nil {
 		return err
 	}
+	if res.MatchedCount == 0 {
+		return eventstorage.NewConcurrencyConflictError(tenantId, aggregateId, fromSequenceNumber, 0)
+	}
 	return nil
 }
 
-func (r *AggregateRepository) NextSequenceNumber(ctx context.Context, tenantId string, aggregateId string, count uint64) (*model.AggregateEntity, uint64, error) {
+//
+// Restore
+// @Description: 恢复已删除的聚合根
+// @receiver r
+// @param ctx
+// @param tenantId
+// @param aggregateId
+// @return error
+//
+func (r *AggregateRepository) Restore(ctx context.Context, tenantId, aggregateId string) error {
 	idValue, err := model.ObjectIDFromHex(aggregateId)
+	if err != nil {
+		return err
+	}
+	coll, err := r.getCollection(tenantId)
+	if err != nil {
+		return err
+	}
+	filter := bson.M{
+		TenantIdField: tenantId,
+		IdField:       idValue,
+	}
+	update := bson.M{
+		"$set": bson.M{"deleted": false},
+	}
+	_, err = coll.UpdateOne(ctx, filter, update)
+	return err
+}
+
+//
+// NextSequenceNumber
+// @Description: 递增聚合根的SequenceNumber，返回本次可用的起始SequenceNumber
+// @receiver r
+// @param ctx
+// @param tenantId
+// @param aggregateId
+// @param count 递增数量
+// @param expectedSequenceNumber 期望的当前SequenceNumber，为0时不做乐观锁检查
+// @return *model.AggregateEntity 递增前的聚合根
+// @return uint64
+// @return error 不一致时返回 *eventstorage.ConcurrencyConflictError
+//
+func (r *AggregateRepository) NextSequenceNumber(ctx context.Context, tenantId string, aggregateId string, count uint64, expectedSequenceNumber uint64) (*model.AggregateEntity, uint64, error) {
+	idValue, err := model.ObjectIDFromHex(aggregateId)
+	if err != nil {
+		return nil, 0, err
+	}
+	coll, err := r.getCollection(tenantId)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -69,12 +326,24 @@ func (r *AggregateRepository) NextSequenceNumber(ctx context.Context, tenantId s
 		TenantIdField: tenantId,
 		IdField:       idValue,
 	}
+	if expectedSequenceNumber > 0 {
+		filter[SequenceNumberField] = expectedSequenceNumber
+	}
 	update := bson.M{
 		"$inc": bson.M{SequenceNumberField: count},
 	}
-	result := r.collection.FindOneAndUpdate(ctx, filter, update)
+	result := coll.FindOneAndUpdate(ctx, filter, update)
 	err = result.Err()
 	if err == mongo.ErrNoDocuments {
+		if expectedSequenceNumber > 0 {
+			agg, findErr := r.FindById(ctx, tenantId, aggregateId)
+			if findErr != nil {
+				return nil, 0, findErr
+			}
+			if agg != nil {
+				return nil, 0, eventstorage.NewConcurrencyConflictError(tenantId, aggregateId, expectedSequenceNumber, agg.SequenceNumber)
+			}
+		}
 		return nil, 0, errors.New(fmt.Sprintf("aggregate idValue %s does not exist", aggregateId))
 	} else if err != nil {
 		return nil, 0, err
@@ -86,9 +355,13 @@ func (r *AggregateRepository) NextSequenceNumber(ctx context.Context, tenantId s
 	return &aggregate, aggregate.SequenceNumber + 1, nil
 }
 
-func (r *AggregateRepository) findOne(ctx context.Context, filter interface{}) (*model.AggregateEntity, error) {
+func (r *AggregateRepository) findOne(ctx context.Context, tenantId string, filter interface{}) (*model.AggregateEntity, error) {
+	coll, err := r.getCollection(tenantId)
+	if err != nil {
+		return nil, err
+	}
 	var result model.AggregateEntity
-	err := r.collection.FindOne(ctx, filter).Decode(&result)
+	err = coll.FindOne(ctx, filter).Decode(&result)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return nil, nil
@@ -14,23 +14,76 @@ import (
 )
 
 const (
-	IdField             = "_id"
-	TenantIdField       = "tenant_id"
-	AggregateIdField    = "aggregate_id"
-	AggregateTypeField  = "aggregate_type"
-	EventIdField        = "event_id"
-	SequenceNumberField = "sequence_number"
-	PublishStatusField  = "publish_status"
+	IdField               = "_id"
+	TenantIdField         = "tenant_id"
+	AggregateIdField      = "aggregate_id"
+	AggregateTypeField    = "aggregate_type"
+	EventIdField          = "event_id"
+	CommandIdField        = "command_id"
+	CorrelationIdField    = "correlation_id"
+	SequenceNumberField   = "sequence_number"
+	PublishStatusField    = "publish_status"
+	TimeStampField        = "time_stamp"
+	AggregateVersionField = "aggregate_version"
+	PositionField         = "position"
+	EventTypeField        = "event_type"
+	PublishAttemptsField  = "publish_attempts"
+	PublishErrorField     = "publish_error"
+	NextPublishTimeField  = "next_publish_time"
+	EventTimeField        = "event_time"
+	SequenceGapsField     = "sequence_gaps"
+	MetadataField         = "meta_data"
+	DataFileField         = "data_file"
+	DataFileIdField       = "data_file_id"
 )
 
 type BaseRepository[T any] struct {
-	mongodb       *other.MongoDB
-	collection    *mongo.Collection
-	NewEntityList func() interface{}
+	mongodb    *other.MongoDB
+	collection *mongo.Collection
+	// initCollection 租户的集合第一次使用时调用，用于创建索引
+	initCollection other.CollectionInitFunc
+	NewEntityList  func() interface{}
+	FieldName      FieldNameFunc
+	FieldValue     FieldValueFunc
+}
+
+//
+// getCollection
+// @Description: 按租户隔离策略返回租户的集合，租户未隔离时为共用集合
+// @receiver r
+// @param tenantId
+// @return *mongo.Collection
+// @return error
+//
+func (r *BaseRepository[T]) getCollection(tenantId string) (*mongo.Collection, error) {
+	if !r.mongodb.IsTenantIsolated() {
+		return r.collection, nil
+	}
+	var init other.CollectionInitFunc
+	if r.mongodb.StorageMetadata.CreateIndexes {
+		init = r.initCollection
+	}
+	return r.mongodb.GetOrCreateCollection(tenantId, r.collection.Name(), init)
 }
 
 func (r *BaseRepository[T]) FindPaging(ctx context.Context, collection *mongo.Collection, query eventstorage.FindPagingQuery, opts ...*other.FindOptions) *eventstorage.FindPagingResult[T] {
+	return r.FindPagingWithFilter(ctx, collection, query, nil, opts...)
+}
+
+//
+// FindPagingWithFilter
+// @Description: 分页查询，同时满足rsql条件与and条件
+// @receiver r
+// @param ctx
+// @param collection
+// @param query
+// @param and 附加条件，为空时不附加
+// @param opts
+// @return *eventstorage.FindPagingResult[T]
+//
+func (r *BaseRepository[T]) FindPagingWithFilter(ctx context.Context, collection *mongo.Collection, query eventstorage.FindPagingQuery, and bson.M, opts ...*other.FindOptions) *eventstorage.FindPagingResult[T] {
 	return r.DoFilter(query.GetTenantId(), query.GetFilter(), func(filter map[string]interface{}) (*eventstorage.FindPagingResult[T], bool, error) {
+		filter = andFilter(filter, and)
 		data := r.NewEntityList()
 		findOptions := getFindOptions(opts...)
 		if query.GetPageSize() > 0 {
@@ -49,7 +102,9 @@ func (r *BaseRepository[T]) FindPaging(ctx context.Context, collection *mongo.Co
 		if err != nil {
 			return nil, false, err
 		}
-		err = cursor.All(ctx, data)
+		if err = cursor.All(ctx, data); err != nil {
+			return nil, false, err
+		}
 		totalRows, err := collection.CountDocuments(ctx, filter)
 		findData := eventstorage.NewFindPagingResult[T](data.(*[]T), uint64(totalRows), query, err)
 		return findData, true, err
@@ -57,6 +112,37 @@ func (r *BaseRepository[T]) FindPaging(ctx context.Context, collection *mongo.Co
 
 }
 
+//
+// Count
+// @Description: 统计同时满足rsql条件与and条件的数量
+// @receiver r
+// @param ctx
+// @param collection
+// @param tenantId
+// @param filter rsql条件
+// @param and 附加条件，为空时不附加
+// @return uint64
+// @return error
+//
+func (r *BaseRepository[T]) Count(ctx context.Context, collection *mongo.Collection, tenantId string, filter string, and bson.M) (uint64, error) {
+	p := NewMongoProcessWith(r.FieldName, r.FieldValue)
+	if err := rsql.ParseProcess(filter, p); err != nil {
+		return 0, err
+	}
+	count, err := collection.CountDocuments(ctx, andFilter(p.GetFilter(tenantId), and))
+	if err != nil {
+		return 0, err
+	}
+	return uint64(count), nil
+}
+
+func andFilter(filter map[string]interface{}, and bson.M) map[string]interface{} {
+	if len(and) == 0 {
+		return filter
+	}
+	return map[string]interface{}{"$and": []interface{}{filter, and}}
+}
+
 func (r *BaseRepository[T]) NewFilter(tenantId string, filterMap map[string]interface{}) bson.D {
 	filter := bson.D{
 		{TenantIdField, tenantId},
@@ -77,7 +163,7 @@ func (r *BaseRepository[T]) NewFilter(tenantId string, filterMap map[string]inte
 }
 
 func (r *BaseRepository[T]) DoFilter(tenantId, filter string, fun func(filter map[string]interface{}) (*eventstorage.FindPagingResult[T], bool, error)) *eventstorage.FindPagingResult[T] {
-	p := NewMongoProcess()
+	p := NewMongoProcessWith(r.FieldName, r.FieldValue)
 	if err := rsql.ParseProcess(filter, p); err != nil {
 		return eventstorage.NewFindPagingResultWithError[T](err)
 	}
@@ -88,15 +174,28 @@ func (r *BaseRepository[T]) DoFilter(tenantId, filter string, fun func(filter ma
 			err = nil
 		}
 	}
+	if data == nil {
+		return eventstorage.NewFindPagingResultWithError[T](err)
+	}
 	return data
 }
 
-func (r *BaseRepository[T]) getSort(sort string) (map[string]interface{}, error) {
+//
+// getSort
+// @Description: 将 name:desc,id:asc 格式的排序转换为MongoDB排序，按书写顺序排列。
+// 字段名与rsql条件的字段名使用同样的转换（FieldName，为nil时使用utils.AsMongoName），
+// 关系表等以驼峰名排序时对应的是保存时的下划线字段名。
+// @receiver r
+// @param sort
+// @return bson.D
+// @return error
+//
+func (r *BaseRepository[T]) getSort(sort string) (bson.D, error) {
 	if len(sort) == 0 {
 		return nil, nil
 	}
 	//name:desc,id:asc
-	res := map[string]interface{}{}
+	res := bson.D{}
 	list := strings.Split(sort, ",")
 	for _, s := range list {
 		sortItem := strings.Split(s, ":")
@@ -104,6 +203,10 @@ func (r *BaseRepository[T]) getSort(sort string) (map[string]interface{}, error)
 		name = strings.Trim(name, " ")
 		if name == "id" {
 			name = IdField
+		} else if r.FieldName != nil {
+			name = r.FieldName(name)
+		} else {
+			name = utils.AsMongoName(name)
 		}
 		order := "asc"
 		if len(sortItem) > 1 {
@@ -126,11 +229,34 @@ func (r *BaseRepository[T]) getSort(sort string) (map[string]interface{}, error)
 		if oerr != nil {
 			return nil, oerr
 		}
-		res[name] = orderVal
+		res = append(res, bson.E{Key: name, Value: orderVal})
 	}
 	return res, nil
 }
 
+//
+// createIndexes
+// @Description: 创建索引，名称与定义相同的索引已存在时不做处理
+// @param ctx
+// @param collection
+// @param indexes
+// @return error
+//
+func createIndexes(ctx context.Context, collection *mongo.Collection, indexes []mongo.IndexModel) error {
+	if _, err := collection.Indexes().CreateMany(ctx, indexes); err != nil {
+		return errors.New("create indexes on " + collection.Name() + " error: " + err.Error())
+	}
+	return nil
+}
+
+// getDataCodec 返回聚合类型的EventData、AggregateData保存格式
+func (r *BaseRepository[T]) getDataCodec(aggregateType string) other.DataCodec {
+	if r.mongodb == nil || r.mongodb.StorageMetadata == nil {
+		return other.DataCodecBson
+	}
+	return r.mongodb.StorageMetadata.DataCodec.GetCodec(aggregateType)
+}
+
 func IsErrorMongoNoDocuments(err error) bool {
 	if err == mongo.ErrNoDocuments {
 		return true
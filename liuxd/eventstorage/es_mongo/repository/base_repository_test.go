@@ -0,0 +1,25 @@
+package repository
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"testing"
+)
+
+func Test_GetSort(t *testing.T) {
+	r := &BaseRepository[interface{}]{}
+	sort, err := r.getSort("customerId:desc, id , timeStamp:ASC")
+	assert.NoError(t, err)
+	assert.Equal(t, bson.D{{"customer_id", -1}, {IdField, 1}, {"time_stamp", 1}}, sort)
+
+	r.FieldName = func(name string) string { return "data." + name }
+	sort, err = r.getSort("amount:desc")
+	assert.NoError(t, err)
+	assert.Equal(t, bson.D{{"data.amount", -1}}, sort)
+
+	_, err = r.getSort("amount:down")
+	assert.EqualError(t, err, "order down is error")
+	sort, err = r.getSort("")
+	assert.NoError(t, err)
+	assert.Nil(t, sort)
+}
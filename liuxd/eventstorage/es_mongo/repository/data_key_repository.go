@@ -0,0 +1,90 @@
+package repository
+
+import (
+	"context"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/other"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+//
+// DataKeyRepository
+// @Description: 数据密钥集合，与事件集合分开保存，销毁密钥后保留销毁记录
+//
+type DataKeyRepository struct {
+	BaseRepository[*model.DataKeyEntity]
+}
+
+func NewDataKeyRepository(mongodb *other.MongoDB, collection *mongo.Collection) *DataKeyRepository {
+	res := &DataKeyRepository{}
+	res.mongodb = mongodb
+	res.collection = collection
+	return res
+}
+
+func (r *DataKeyRepository) FindById(ctx context.Context, tenantId string, keyId string) (*model.DataKeyEntity, error) {
+	coll, err := r.getCollection(tenantId)
+	if err != nil {
+		return nil, err
+	}
+	var entity model.DataKeyEntity
+	filter := bson.M{IdField: model.NewDataKeyId(tenantId, keyId)}
+	if err := coll.FindOne(ctx, filter).Decode(&entity); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &entity, nil
+}
+
+//
+// Insert
+// @Description: 保存数据密钥，密钥已存在时返回已存在的密钥
+// @receiver r
+// @param ctx
+// @param entity
+// @return *model.DataKeyEntity
+// @return error
+//
+func (r *DataKeyRepository) Insert(ctx context.Context, entity *model.DataKeyEntity) (*model.DataKeyEntity, error) {
+	coll, err := r.getCollection(entity.TenantId)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := coll.InsertOne(ctx, entity); err != nil {
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, err
+		}
+		return r.FindById(ctx, entity.TenantId, entity.KeyId)
+	}
+	return entity, nil
+}
+
+//
+// Erase
+// @Description: 清除密钥并标记为已销毁，密钥不存在时写入销毁记录，之后不能再用该KeyId加密
+// @receiver r
+// @param ctx
+// @param tenantId
+// @param keyId
+// @return error
+//
+func (r *DataKeyRepository) Erase(ctx context.Context, tenantId string, keyId string) error {
+	now := primitive.NewDateTimeFromTime(time.Now())
+	filter := bson.M{IdField: model.NewDataKeyId(tenantId, keyId)}
+	update := bson.M{
+		"$set":         bson.M{"key": nil, "erased": true, "erase_time": now},
+		"$setOnInsert": bson.M{TenantIdField: tenantId, "key_id": keyId, "create_time": now},
+	}
+	coll, err := r.getCollection(tenantId)
+	if err != nil {
+		return err
+	}
+	_, err = coll.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	return err
+}
@@ -2,23 +2,64 @@ package repository
 
 import (
 	"context"
-	"fmt"
+	"errors"
+	"github.com/liuxd6825/components-contrib/liuxd/common/rsql"
+	"github.com/liuxd6825/components-contrib/liuxd/common/utils"
 	"github.com/liuxd6825/components-contrib/liuxd/eventstorage"
-	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/model"
 	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/other"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/model"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"sort"
+	"strings"
+	"sync/atomic"
 )
 
 type EventRepository struct {
 	BaseRepository[*model.EventEntity]
+	// notPublishedStart 租户隔离时FindNotPublished每次从下一个租户开始查找
+	notPublishedStart uint64
 }
 
 func NewEventRepository(mongodb *other.MongoDB, collection *mongo.Collection) *EventRepository {
 	res := &EventRepository{}
 	res.mongodb = mongodb
 	res.collection = collection
+	res.initCollection = func(ctx context.Context, collection *mongo.Collection) error {
+		return createEventIndexes(ctx, mongodb, collection)
+	}
+	res.NewEntityList = func() interface{} {
+		return &[]*model.EventEntity{}
+	}
+	res.FieldName = eventFieldName
+	res.FieldValue = eventFieldValue
+	return res
+}
+
+//
+// FindPaging
+// @Description: 按rsql条件分页查询事件
+// @receiver r
+// @param ctx
+// @param query
+// @param opts
+// @return *eventstorage.FindPagingResult[*model.EventEntity]
+//
+func (r *EventRepository) FindPaging(ctx context.Context, query eventstorage.FindPagingQuery, opts ...*other.FindOptions) *eventstorage.FindPagingResult[*model.EventEntity] {
+	coll, err := r.getCollection(query.GetTenantId())
+	if err != nil {
+		return eventstorage.NewFindPagingResultWithError[*model.EventEntity](err)
+	}
+	res := r.BaseRepository.FindPaging(ctx, coll, query, opts...)
+	if res.Error == nil && res.Data != nil {
+		for _, event := range *res.Data {
+			if err := event.Decode(); err != nil {
+				return eventstorage.NewFindPagingResultWithError[*model.EventEntity](err)
+			}
+		}
+	}
 	return res
 }
 
@@ -28,21 +69,91 @@ func (r *EventRepository) Insert(ctx context.Context, entity *model.EventEntity)
 		return err
 	}
 	entity.Id = idValue
-	_, err = r.collection.InsertOne(ctx, entity)
+	doc, err := entity.Encode(r.getDataCodec(entity.AggregateType))
+	if err != nil {
+		return err
+	}
+	coll, err := r.getCollection(entity.TenantId)
+	if err != nil {
+		return err
+	}
+	_, err = coll.InsertOne(ctx, doc)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (r *EventRepository) UpdatePublishStatue(ctx context.Context, eventId string, publishStatue eventstorage.PublishStatus) error {
+func (r *EventRepository) UpdatePublishStatue(ctx context.Context, tenantId string, eventId string, publishStatue eventstorage.PublishStatus) error {
 	idValue, err := model.ObjectIDFromHex(eventId)
 	if err != nil {
 		return err
 	}
+	coll, err := r.getCollection(tenantId)
+	if err != nil {
+		return err
+	}
 	filter := bson.D{{IdField, idValue}}
 	data := bson.D{{"$set", bson.M{PublishStatusField: publishStatue}}}
-	_, err = r.collection.UpdateOne(ctx, filter, data, options.Update())
+	_, err = coll.UpdateOne(ctx, filter, data, options.Update())
+	return err
+}
+
+//
+// UpdatePublishStatusMany
+// @Description: 一次更新多个事件的发送状态
+// @receiver r
+// @param ctx
+// @param tenantId
+// @param eventIds
+// @param publishStatue
+// @return error
+//
+func (r *EventRepository) UpdatePublishStatusMany(ctx context.Context, tenantId string, eventIds []string, publishStatue eventstorage.PublishStatus) error {
+	if len(eventIds) == 0 {
+		return nil
+	}
+	coll, err := r.getCollection(tenantId)
+	if err != nil {
+		return err
+	}
+	filter := bson.M{IdField: bson.M{"$in": eventIds}}
+	data := bson.D{{"$set", bson.M{PublishStatusField: publishStatue}}}
+	_, err = coll.UpdateMany(ctx, filter, data)
+	return err
+}
+
+//
+// UpdatePublishError
+// @Description: 记录发送失败次数、错误信息及下次重试时间。重试中PublishStatus为PublishStatusWait，
+// 达到最大发送次数后为PublishStatusError
+// @receiver r
+// @param ctx
+// @param tenantId
+// @param eventId
+// @param publishStatue
+// @param attempts 已尝试次数
+// @param errMsg 最后一次错误信息
+// @param nextPublishTime 下次重试时间
+// @return error
+//
+func (r *EventRepository) UpdatePublishError(ctx context.Context, tenantId string, eventId string, publishStatue eventstorage.PublishStatus, attempts int, errMsg string, nextPublishTime primitive.DateTime) error {
+	idValue, err := model.ObjectIDFromHex(eventId)
+	if err != nil {
+		return err
+	}
+	coll, err := r.getCollection(tenantId)
+	if err != nil {
+		return err
+	}
+	filter := bson.D{{IdField, idValue}}
+	data := bson.D{{"$set", bson.M{
+		PublishStatusField:   publishStatue,
+		PublishAttemptsField: attempts,
+		PublishErrorField:    errMsg,
+		NextPublishTimeField: nextPublishTime,
+	}}}
+	_, err = coll.UpdateOne(ctx, filter, data, options.Update())
 	return err
 }
 
@@ -52,7 +163,7 @@ func (r *EventRepository) FindById(ctx context.Context, tenantId string, eventId
 		return nil, err
 	}
 	filter := bson.D{{IdField, idValue}}
-	return r.findOne(ctx, filter)
+	return r.findOne(ctx, tenantId, filter)
 }
 
 /*func (r *EventRepository) FindByEventId(ctx context.Context, tenantId string, eventId string) (*model.EventEntity, error) {
@@ -70,7 +181,124 @@ func (r *EventRepository) FindByAggregateId(ctx context.Context, tenantId string
 		AggregateIdField:   aggregateId,
 		AggregateTypeField: aggregateType,
 	}
-	return r.findList(ctx, filter)
+	return r.findList(ctx, tenantId, filter)
+}
+
+//
+// InsertMany
+// @Description: 按原样保存事件，用于导入
+// @receiver r
+// @param ctx
+// @param events
+// @return error
+//
+func (r *EventRepository) InsertMany(ctx context.Context, events []*model.EventEntity) error {
+	if len(events) == 0 {
+		return nil
+	}
+	var tenantIds []string
+	tenantDocs := make(map[string][]interface{})
+	for _, event := range events {
+		doc, err := event.Encode(r.getDataCodec(event.AggregateType))
+		if err != nil {
+			return err
+		}
+		if _, ok := tenantDocs[event.TenantId]; !ok {
+			tenantIds = append(tenantIds, event.TenantId)
+		}
+		tenantDocs[event.TenantId] = append(tenantDocs[event.TenantId], doc)
+	}
+	for _, tenantId := range tenantIds {
+		coll, err := r.getCollection(tenantId)
+		if err != nil {
+			return err
+		}
+		if _, err := coll.InsertMany(ctx, tenantDocs[tenantId]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// DeleteByAggregateId
+// @Description: 删除聚合根的所有事件，用于导入时覆盖已有的聚合根
+// @receiver r
+// @param ctx
+// @param tenantId
+// @param aggregateId
+// @return error
+//
+func (r *EventRepository) DeleteByAggregateId(ctx context.Context, tenantId string, aggregateId string) error {
+	filter := bson.M{
+		TenantIdField:    tenantId,
+		AggregateIdField: aggregateId,
+	}
+	coll, err := r.getCollection(tenantId)
+	if err != nil {
+		return err
+	}
+	_, err = coll.DeleteMany(ctx, filter)
+	return err
+}
+
+//
+// FindSequenceNumbers
+// @Description: 按序号顺序查找聚合根的事件，只返回一致性检查需要的字段
+// @receiver r
+// @param ctx
+// @param tenantId
+// @param aggregateId
+// @return *[]model.EventEntity
+// @return error
+//
+func (r *EventRepository) FindSequenceNumbers(ctx context.Context, tenantId string, aggregateId string) (*[]model.EventEntity, error) {
+	filter := bson.M{
+		TenantIdField:    tenantId,
+		AggregateIdField: aggregateId,
+	}
+	findOptions := options.Find().
+		SetSort(bson.D{{SequenceNumberField, 1}}).
+		SetProjection(bson.M{IdField: 1, EventIdField: 1, AggregateTypeField: 1, SequenceNumberField: 1, PublishStatusField: 1, TimeStampField: 1})
+	return r.findList(ctx, tenantId, filter, findOptions)
+}
+
+//
+// CountByAggregateId
+// @Description: 按聚合根分组统计租户的事件数量，aggregateType为空时统计所有类型
+// @receiver r
+// @param ctx
+// @param tenantId
+// @param aggregateType
+// @return []*model.AggregateEventCount
+// @return error
+//
+func (r *EventRepository) CountByAggregateId(ctx context.Context, tenantId string, aggregateType string) ([]*model.AggregateEventCount, error) {
+	match := bson.M{TenantIdField: tenantId}
+	if aggregateType != "" {
+		match[AggregateTypeField] = aggregateType
+	}
+	pipeline := mongo.Pipeline{
+		{{"$match", match}},
+		{{"$group", bson.M{
+			IdField:            "$" + AggregateIdField,
+			AggregateTypeField: bson.M{"$first": "$" + AggregateTypeField},
+			"count":            bson.M{"$sum": 1},
+		}}},
+	}
+	coll, err := r.getCollection(tenantId)
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var list []*model.AggregateEventCount
+	if err := cursor.All(ctx, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
 }
 
 //
@@ -90,45 +318,546 @@ func (r *EventRepository) FindNotPublishStatusSuccess(ctx context.Context, tenan
 		AggregateTypeField: aggregateType,
 		PublishStatusField: bson.M{"$ne": eventstorage.PublishStatusSuccess},
 	}
-	return r.findList(ctx, filter)
+	return r.findList(ctx, tenantId, filter)
+}
+
+//
+// FindNotPublished
+// @Description: 查找所有租户中已到重试时间的等待发送的事件，按租户、聚合根、SequenceNumber排序。死信的事件不再重试。
+// 处于重试等待的事件不返回，避免占满limit使其它聚合根的事件无法发送。
+// 租户隔离时依次查找各租户的集合，每次调用的起始租户轮换，避免排在前面的租户占满limit使后面的租户一直无法补发
+// @receiver r
+// @param ctx
+// @param before 只查找此时间之前创建的事件
+// @param now 只查找重试时间不晚于此时间的事件
+// @param limit 最大数量
+// @return *[]model.EventEntity
+// @return error
+//
+func (r *EventRepository) FindNotPublished(ctx context.Context, before primitive.DateTime, now primitive.DateTime, limit int64) (*[]model.EventEntity, error) {
+	filter := bson.M{
+		"$or":                newNotPublishedFilter(),
+		TimeStampField:       bson.M{"$lte": before},
+		NextPublishTimeField: bson.M{"$not": bson.M{"$gt": now}},
+	}
+	findOptions := options.Find().
+		SetSort(bson.D{{TenantIdField, 1}, {AggregateIdField, 1}, {SequenceNumberField, 1}}).
+		SetLimit(limit)
+	if !r.mongodb.IsTenantIsolated() {
+		return r.findList(ctx, "", filter, findOptions)
+	}
+	start := atomic.AddUint64(&r.notPublishedStart, 1) - 1
+	return r.findListAllTenants(ctx, filter, findOptions, limit, start, nil)
+}
+
+//
+// newNotPublishedFilter
+// @Description: 等待发送的事件。旧版本中发送失败的事件为PublishStatusError且没有发送次数，仍需重试；
+// 有发送次数的PublishStatusError事件已复制到死信主题，不再发送
+// @return bson.A
+//
+func newNotPublishedFilter() bson.A {
+	return bson.A{
+		bson.M{PublishStatusField: eventstorage.PublishStatusWait},
+		bson.M{PublishStatusField: eventstorage.PublishStatusError, PublishAttemptsField: bson.M{"$not": bson.M{"$gt": 0}}},
+	}
+}
+
+//
+// FindFirstNotPublished
+// @Description: 查找聚合根SequenceNumber最小的等待发送的事件，包括处于重试等待的事件，只返回EventId与SequenceNumber。
+// 用于保证同一聚合根的事件按顺序发送，不存在时返回nil
+// @receiver r
+// @param ctx
+// @param tenantId
+// @param aggregateId
+// @return *model.EventEntity
+// @return error
+//
+func (r *EventRepository) FindFirstNotPublished(ctx context.Context, tenantId string, aggregateId string) (*model.EventEntity, error) {
+	coll, err := r.getCollection(tenantId)
+	if err != nil {
+		return nil, err
+	}
+	filter := bson.M{
+		TenantIdField:    tenantId,
+		AggregateIdField: aggregateId,
+		"$or":            newNotPublishedFilter(),
+	}
+	findOptions := options.FindOne().
+		SetSort(bson.D{{SequenceNumberField, 1}}).
+		SetProjection(bson.M{EventIdField: 1, SequenceNumberField: 1})
+	var event model.EventEntity
+	if err := coll.FindOne(ctx, filter, findOptions).Decode(&event); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &event, nil
+}
+
+//
+// FindByPosition
+// @Description: 按全局位置顺序查找位置大于fromPosition的事件，tenantId、aggregateType、eventType为空时不过滤。
+// 租户隔离且tenantId为空时查找所有租户的集合后按位置合并
+// @receiver r
+// @param ctx
+// @param tenantId
+// @param aggregateType
+// @param eventType
+// @param fromPosition
+// @param limit
+// @return *[]model.EventEntity
+// @return error
+//
+func (r *EventRepository) FindByPosition(ctx context.Context, tenantId string, aggregateType string, eventType string, fromPosition uint64, limit int64) (*[]model.EventEntity, error) {
+	filter := bson.M{
+		PositionField: bson.M{"$gt": fromPosition},
+	}
+	if tenantId != "" {
+		filter[TenantIdField] = tenantId
+	}
+	if aggregateType != "" {
+		filter[AggregateTypeField] = aggregateType
+	}
+	if eventType != "" {
+		filter[EventTypeField] = eventType
+	}
+	findOptions := options.Find().SetSort(bson.D{{PositionField, 1}}).SetLimit(limit)
+	if tenantId == "" && r.mongodb.IsTenantIsolated() {
+		return r.findListAllTenants(ctx, filter, findOptions, limit, 0, func(a, b *model.EventEntity) bool {
+			return a.Position < b.Position
+		})
+	}
+	return r.findList(ctx, tenantId, filter, findOptions)
+}
+
+//
+// FindWithoutPosition
+// @Description: 按写入时间查找没有全局位置的事件（位置为0或没有位置字段），不过滤租户
+// @receiver r
+// @param ctx
+// @param tenantId 租户隔离时指定租户的集合
+// @param limit
+// @return *[]model.EventEntity
+// @return error
+//
+func (r *EventRepository) FindWithoutPosition(ctx context.Context, tenantId string, limit int64) (*[]model.EventEntity, error) {
+	filter := bson.M{PositionField: bson.M{"$not": bson.M{"$gt": 0}}}
+	findOptions := options.Find().SetSort(bson.D{{TimeStampField, 1}, {IdField, 1}}).SetLimit(limit)
+	return r.findList(ctx, tenantId, filter, findOptions)
+}
+
+//
+// UpdatePositions
+// @Description: 设置事件的全局位置，已有位置的事件不修改
+// @receiver r
+// @param ctx
+// @param tenantId
+// @param events 已设置Position的事件
+// @return error
+//
+func (r *EventRepository) UpdatePositions(ctx context.Context, tenantId string, events []model.EventEntity) error {
+	if len(events) == 0 {
+		return nil
+	}
+	coll, err := r.getCollection(tenantId)
+	if err != nil {
+		return err
+	}
+	models := make([]mongo.WriteModel, 0, len(events))
+	for _, event := range events {
+		filter := bson.M{IdField: event.Id, PositionField: bson.M{"$not": bson.M{"$gt": 0}}}
+		update := bson.M{"$set": bson.M{PositionField: event.Position}}
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update))
+	}
+	_, err = coll.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+//
+// findListAllTenants
+// @Description: 依次查找所有租户的集合，less不为nil时按less合并排序，返回前limit个事件
+// @receiver r
+// @param ctx
+// @param filter
+// @param findOptions 每个租户的查询条件，需包含limit
+// @param limit
+// @param start less为nil时从第start个租户开始查找，超出租户数量时取余
+// @param less 为nil时按租户Id顺序合并
+// @return *[]model.EventEntity
+// @return error
+//
+func (r *EventRepository) findListAllTenants(ctx context.Context, filter interface{}, findOptions *options.FindOptions, limit int64, start uint64, less func(a, b *model.EventEntity) bool) (*[]model.EventEntity, error) {
+	tenantIds, err := r.mongodb.FindTenantIds(ctx, r.collection.Name())
+	if err != nil {
+		return nil, err
+	}
+	if less == nil {
+		tenantIds = rotateTenantIds(tenantIds, start)
+	}
+	var res []model.EventEntity
+	for _, tenantId := range tenantIds {
+		if less == nil && int64(len(res)) >= limit {
+			break
+		}
+		list, err := r.findList(ctx, tenantId, filter, findOptions)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, *list...)
+	}
+	if less != nil {
+		sort.SliceStable(res, func(i, j int) bool {
+			return less(&res[i], &res[j])
+		})
+	}
+	if int64(len(res)) > limit {
+		res = res[:limit]
+	}
+	return &res, nil
+}
+
+//
+// rotateTenantIds
+// @Description: 从第start个租户开始依次排列，超出租户数量时取余
+// @param tenantIds
+// @param start
+// @return []string
+//
+func rotateTenantIds(tenantIds []string, start uint64) []string {
+	if len(tenantIds) == 0 {
+		return tenantIds
+	}
+	i := int(start % uint64(len(tenantIds)))
+	return append(append(make([]string, 0, len(tenantIds)), tenantIds[i:]...), tenantIds[:i]...)
+}
+
+//
+// FindAggregateIdsByDataKeyId
+// @Description: 查找事件metadata的dataKeyId为keyId的聚合根Id，没有索引，用于销毁数据密钥
+// @receiver r
+// @param ctx
+// @param tenantId
+// @param keyId
+// @return []string
+// @return error
+//
+func (r *EventRepository) FindAggregateIdsByDataKeyId(ctx context.Context, tenantId string, keyId string) ([]string, error) {
+	coll, err := r.getCollection(tenantId)
+	if err != nil {
+		return nil, err
+	}
+	filter := bson.M{
+		TenantIdField: tenantId,
+		MetadataField + "." + eventstorage.DataKeyIdMetadataKey: keyId,
+	}
+	values, err := coll.Distinct(ctx, AggregateIdField, filter)
+	if err != nil {
+		return nil, err
+	}
+	aggregateIds := make([]string, 0, len(values))
+	for _, value := range values {
+		if aggregateId, ok := value.(string); ok {
+			aggregateIds = append(aggregateIds, aggregateId)
+		}
+	}
+	return aggregateIds, nil
+}
+
+//
+// FindForReplay
+// @Description: 按全局位置顺序查找需要重放的事件
+// @receiver r
+// @param ctx
+// @param req
+// @param fromPosition
+// @param limit
+// @return *[]model.EventEntity
+// @return error
+//
+func (r *EventRepository) FindForReplay(ctx context.Context, req *eventstorage.ReplayEventsRequest, fromPosition uint64, limit int64) (*[]model.EventEntity, error) {
+	filter := newReplayFilter(req, bson.M{"$gt": fromPosition})
+	findOptions := options.Find().SetSort(bson.D{{PositionField, 1}}).SetLimit(limit)
+	return r.findList(ctx, req.TenantId, filter, findOptions)
+}
+
+//
+// CountForReplay
+// @Description: 统计需要重放的事件数量，toPosition大于0时只统计位置不大于toPosition的事件
+// @receiver r
+// @param ctx
+// @param req
+// @param toPosition
+// @return uint64
+// @return error
+//
+func (r *EventRepository) CountForReplay(ctx context.Context, req *eventstorage.ReplayEventsRequest, toPosition uint64) (uint64, error) {
+	position := bson.M{"$gt": 0}
+	if toPosition > 0 {
+		position["$lte"] = toPosition
+	}
+	coll, err := r.getCollection(req.TenantId)
+	if err != nil {
+		return 0, err
+	}
+	count, err := coll.CountDocuments(ctx, newReplayFilter(req, position))
+	if err != nil {
+		return 0, err
+	}
+	return uint64(count), nil
 }
 
-func (r *EventRepository) FindBySequenceNumber(ctx context.Context, tenantId string, aggregateId string, aggregateType string, sequenceNumber uint64) (*[]model.EventEntity, error) {
+func newReplayFilter(req *eventstorage.ReplayEventsRequest, position bson.M) bson.M {
+	filter := bson.M{
+		TenantIdField:      req.TenantId,
+		AggregateTypeField: req.AggregateType,
+		PositionField:      position,
+	}
+	if req.FromTime != nil || req.ToTime != nil {
+		timeStamp := bson.M{}
+		if req.FromTime != nil {
+			timeStamp["$gte"] = primitive.NewDateTimeFromTime(*req.FromTime)
+		}
+		if req.ToTime != nil {
+			timeStamp["$lte"] = primitive.NewDateTimeFromTime(*req.ToTime)
+		}
+		filter[TimeStampField] = timeStamp
+	}
+	if req.FromSequenceNumber > 0 || req.ToSequenceNumber > 0 {
+		sequenceNumber := bson.M{}
+		if req.FromSequenceNumber > 0 {
+			sequenceNumber["$gte"] = req.FromSequenceNumber
+		}
+		if req.ToSequenceNumber > 0 {
+			sequenceNumber["$lte"] = req.ToSequenceNumber
+		}
+		filter[SequenceNumberField] = sequenceNumber
+	}
+	return filter
+}
+
+//
+// FindBySequenceNumber
+// @Description: 查找序号大于sequenceNumber的事件，toSequenceNumber大于0时只查找序号不大于toSequenceNumber的事件
+// @receiver r
+// @param ctx
+// @param tenantId
+// @param aggregateId
+// @param aggregateType
+// @param sequenceNumber
+// @param toSequenceNumber
+// @return *[]model.EventEntity
+// @return error
+//
+func (r *EventRepository) FindBySequenceNumber(ctx context.Context, tenantId string, aggregateId string, aggregateType string, sequenceNumber uint64, toSequenceNumber uint64) (*[]model.EventEntity, error) {
+	sequenceNumberFilter := bson.M{"$gt": sequenceNumber}
+	if toSequenceNumber > 0 {
+		sequenceNumberFilter["$lte"] = toSequenceNumber
+	}
 	filter := bson.M{
 		TenantIdField:       tenantId,
 		AggregateIdField:    aggregateId,
 		AggregateTypeField:  aggregateType,
-		SequenceNumberField: bson.M{"$gt": sequenceNumber},
+		SequenceNumberField: sequenceNumberFilter,
 	}
 	findOptions := options.Find().SetSort(bson.D{{SequenceNumberField, 1}})
-	return r.findList(ctx, filter, findOptions)
+	return r.findList(ctx, tenantId, filter, findOptions)
 }
 
-func (r *EventRepository) findList(ctx context.Context, filter interface{}, findOptions ...*options.FindOptions) (*[]model.EventEntity, error) {
-	cursor, err := r.collection.Find(ctx, filter, findOptions...)
-	defer func() {
-		if err := cursor.Close(ctx); err != nil {
-			fmt.Println(err)
+//
+// FindLastByTime
+// @Description: 查找时间不晚于toTime的最后一个事件
+// @receiver r
+// @param ctx
+// @param tenantId
+// @param aggregateId
+// @param aggregateType
+// @param toTime
+// @return *model.EventEntity
+// @return error
+//
+func (r *EventRepository) FindLastByTime(ctx context.Context, tenantId string, aggregateId string, aggregateType string, toTime primitive.DateTime) (*model.EventEntity, error) {
+	filter := bson.M{
+		TenantIdField:      tenantId,
+		AggregateIdField:   aggregateId,
+		AggregateTypeField: aggregateType,
+		TimeStampField:     bson.M{"$lte": toTime},
+	}
+	coll, err := r.getCollection(tenantId)
+	if err != nil {
+		return nil, err
+	}
+	findOptions := options.FindOne().SetSort(bson.D{{SequenceNumberField, -1}})
+	var event model.EventEntity
+	if err := coll.FindOne(ctx, filter, findOptions).Decode(&event); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
 		}
-	}()
+		return nil, err
+	}
+	if err := event.Decode(); err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
 
-	var list []model.EventEntity
-	err = cursor.All(ctx, &list)
+//
+// FindByCommandId
+// @Description: 查找after之后由commandId产生的事件，按序号排序
+// @receiver r
+// @param ctx
+// @param tenantId
+// @param commandId
+// @param after
+// @return *[]model.EventEntity
+// @return error
+//
+func (r *EventRepository) FindByCommandId(ctx context.Context, tenantId string, commandId string, after primitive.DateTime) (*[]model.EventEntity, error) {
+	filter := bson.M{
+		TenantIdField:  tenantId,
+		CommandIdField: commandId,
+		TimeStampField: bson.M{"$gte": after},
+	}
+	findOptions := options.Find().SetSort(bson.D{{SequenceNumberField, 1}})
+	return r.findList(ctx, tenantId, filter, findOptions)
+}
+
+//
+// FindByCorrelationId
+// @Description: 查找correlationId关联的事件，按写入顺序排序
+// @receiver r
+// @param ctx
+// @param tenantId
+// @param correlationId
+// @param limit
+// @return *[]model.EventEntity
+// @return error
+//
+func (r *EventRepository) FindByCorrelationId(ctx context.Context, tenantId string, correlationId string, limit int64) (*[]model.EventEntity, error) {
+	filter := bson.M{
+		TenantIdField:      tenantId,
+		CorrelationIdField: correlationId,
+	}
+	findOptions := options.Find().SetSort(bson.D{{TimeStampField, 1}, {PositionField, 1}, {SequenceNumberField, 1}}).SetLimit(limit)
+	return r.findList(ctx, tenantId, filter, findOptions)
+}
+
+//
+// CreateIndexes
+// @Description: 创建事件集合的索引
+// @receiver r
+// @param ctx
+// @return error
+//
+func (r *EventRepository) CreateIndexes(ctx context.Context) error {
+	return createEventIndexes(ctx, r.mongodb, r.collection)
+}
+
+//
+// createEventIndexes
+// @Description: 创建事件集合的索引。已有数据中存在重复的SequenceNumber时（早期版本的DeleteEvent与多事件CreateEvent会产生），
+// 唯一索引创建失败只记录警告，不影响启动。使用CheckConsistency找出重复的序号并处理后，重新启动即可创建唯一索引。
+// @param ctx
+// @param mongodb
+// @param collection
+// @return error
+//
+func createEventIndexes(ctx context.Context, mongodb *other.MongoDB, collection *mongo.Collection) error {
+	if err := createIndexes(ctx, collection, eventIndexes); err != nil {
+		return err
+	}
+	if _, err := collection.Indexes().CreateOne(ctx, eventSequenceIndex); err != nil {
+		if !mongo.IsDuplicateKeyError(err) {
+			return errors.New("create indexes on " + collection.Name() + " error: " + err.Error())
+		}
+		if mongodb != nil && mongodb.GetLogger() != nil {
+			mongodb.GetLogger().Warnf("unique index on %s is not created, duplicate sequence numbers exist, run CheckConsistency to find them: %s", collection.Name(), err.Error())
+		}
+	}
+	return nil
+}
+
+// eventSequenceIndex 同一聚合根的SequenceNumber不能重复
+var eventSequenceIndex = mongo.IndexModel{
+	Keys:    bson.D{{TenantIdField, 1}, {AggregateIdField, 1}, {SequenceNumberField, 1}},
+	Options: options.Index().SetName("tenant_id_aggregate_id_sequence_number").SetUnique(true),
+}
+
+var eventIndexes = []mongo.IndexModel{
+	{
+		Keys:    bson.D{{TenantIdField, 1}, {AggregateIdField, 1}, {AggregateTypeField, 1}, {SequenceNumberField, 1}},
+		Options: options.Index().SetName("tenant_id_aggregate_id_aggregate_type_sequence_number"),
+	},
+	{
+		// 补发任务查找已到重试时间的未成功发送的事件
+		Keys:    bson.D{{PublishStatusField, 1}, {NextPublishTimeField, 1}, {TimeStampField, 1}},
+		Options: options.Index().SetName("publish_status_next_publish_time_time_stamp"),
+	},
+	{
+		Keys:    bson.D{{PositionField, 1}},
+		Options: options.Index().SetName("position"),
+	},
+	{
+		Keys:    bson.D{{TenantIdField, 1}, {AggregateTypeField, 1}, {PositionField, 1}},
+		Options: options.Index().SetName("tenant_id_aggregate_type_position"),
+	},
+	{
+		// 只包含有command_id的事件
+		Keys: bson.D{{TenantIdField, 1}, {CommandIdField, 1}},
+		Options: options.Index().
+			SetName("tenant_id_command_id").
+			SetPartialFilterExpression(bson.M{CommandIdField: bson.M{"$gt": ""}}),
+	},
+	{
+		// 只包含有correlation_id的事件
+		Keys: bson.D{{TenantIdField, 1}, {CorrelationIdField, 1}},
+		Options: options.Index().
+			SetName("tenant_id_correlation_id").
+			SetPartialFilterExpression(bson.M{CorrelationIdField: bson.M{"$gt": ""}}),
+	},
+}
+
+func (r *EventRepository) findList(ctx context.Context, tenantId string, filter interface{}, findOptions ...*options.FindOptions) (*[]model.EventEntity, error) {
+	coll, err := r.getCollection(tenantId)
 	if err != nil {
 		return nil, err
 	}
+	cursor, err := coll.Find(ctx, filter, findOptions...)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var list []model.EventEntity
+	if err = cursor.All(ctx, &list); err != nil {
+		return nil, err
+	}
+	for i := range list {
+		if err := list[i].Decode(); err != nil {
+			return nil, err
+		}
+	}
 	return &list, nil
 }
 
-func (r *EventRepository) findOne(ctx context.Context, filter interface{}) (*model.EventEntity, error) {
+func (r *EventRepository) findOne(ctx context.Context, tenantId string, filter interface{}) (*model.EventEntity, error) {
+	coll, err := r.getCollection(tenantId)
+	if err != nil {
+		return nil, err
+	}
 	var result model.EventEntity
-	err := r.collection.FindOne(ctx, filter).Decode(&result)
+	err = coll.FindOne(ctx, filter).Decode(&result)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return nil, nil
 		}
 		return nil, err
 	}
+	if err := result.Decode(); err != nil {
+		return nil, err
+	}
 	return &result, nil
 }
 
@@ -148,3 +877,45 @@ func (r *EventRepository) NextSequenceNumber(ctx context.Context, tenantId strin
 	return 1
 }
 */
+
+// eventFieldAliases 事件json名称与存储字段名不一致的字段
+var eventFieldAliases = map[string]string{
+	"id":          IdField,
+	"metadata":    "meta_data",
+	"pubsub_name": "publish_name",
+}
+
+// eventTimeFields 存储为时间的字段，rsql的date、datetime值转换为时间后比较
+var eventTimeFields = map[string]bool{
+	TimeStampField:       true,
+	EventTimeField:       true,
+	NextPublishTimeField: true,
+}
+
+//
+// eventFieldName
+// @Description: 将rsql字段名转换为事件的存储字段名，只转换第一级字段，
+// eventData、metadata、relations下的字段按原样使用
+// @param name
+// @return string
+//
+func eventFieldName(name string) string {
+	head, path, nested := strings.Cut(strings.Trim(name, " "), ".")
+	head = utils.AsMongoName(head)
+	if alias, ok := eventFieldAliases[head]; ok {
+		head = alias
+	}
+	if nested {
+		return head + "." + path
+	}
+	return head
+}
+
+func eventFieldValue(fieldName string, value rsql.Value) interface{} {
+	if eventTimeFields[fieldName] {
+		if t, ok := rsql.GetTimeValue(value); ok {
+			return primitive.NewDateTimeFromTime(t)
+		}
+	}
+	return rsql.GetValue(value)
+}
@@ -0,0 +1,15 @@
+package repository
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_RotateTenantIds(t *testing.T) {
+	tenantIds := []string{"t1", "t2", "t3"}
+	assert.Equal(t, []string{"t1", "t2", "t3"}, rotateTenantIds(tenantIds, 0))
+	assert.Equal(t, []string{"t2", "t3", "t1"}, rotateTenantIds(tenantIds, 1))
+	assert.Equal(t, []string{"t3", "t1", "t2"}, rotateTenantIds(tenantIds, 5))
+	assert.Equal(t, []string{"t1", "t2", "t3"}, tenantIds)
+	assert.Empty(t, rotateTenantIds(nil, 1))
+}
@@ -0,0 +1,54 @@
+package repository
+
+import (
+	"context"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/other"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const positionValueField = "value"
+
+type positionEntity struct {
+	Id    string `bson:"_id"`
+	Value uint64 `bson:"value"`
+}
+
+//
+// PositionRepository
+// @Description: 全局位置计数器，每个name对应一个计数器文档
+//
+type PositionRepository struct {
+	BaseRepository[*positionEntity]
+}
+
+func NewPositionRepository(mongodb *other.MongoDB, collection *mongo.Collection) *PositionRepository {
+	res := &PositionRepository{}
+	res.mongodb = mongodb
+	res.collection = collection
+	return res
+}
+
+//
+// Next
+// @Description: 计数器递增count，返回本次可用的起始位置。
+// 在事务中调用时，计数器文档被锁定到事务结束，位置的顺序与事务提交的顺序一致。
+// 同一计数器的所有写入事务在该文档上串行，写入吞吐量的上限见 other.StorageMetadata.EventPosition。
+// @receiver r
+// @param ctx
+// @param name 计数器名称
+// @param count 递增数量
+// @return uint64
+// @return error
+//
+func (r *PositionRepository) Next(ctx context.Context, name string, count uint64) (uint64, error) {
+	filter := bson.M{IdField: name}
+	update := bson.M{"$inc": bson.M{positionValueField: count}}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var position positionEntity
+	if err := r.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&position); err != nil {
+		return 0, err
+	}
+	return position.Value - count + 1, nil
+}
@@ -0,0 +1,87 @@
+package repository
+
+import (
+	"context"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/other"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//
+// RelationHistoryRepository
+// @Description: 关系变更历史集合，所有聚合类型的关系共用，按table_name区分
+//
+type RelationHistoryRepository struct {
+	BaseRepository[*model.RelationHistoryEntity]
+}
+
+func NewRelationHistoryRepository(mongodb *other.MongoDB, collection *mongo.Collection) *RelationHistoryRepository {
+	res := &RelationHistoryRepository{}
+	res.mongodb = mongodb
+	res.collection = collection
+	res.initCollection = func(ctx context.Context, collection *mongo.Collection) error {
+		return createIndexes(ctx, collection, relationHistoryIndexes)
+	}
+	return res
+}
+
+//
+// CreateIndexes
+// @Description: 创建关系变更历史集合的索引
+// @receiver r
+// @param ctx
+// @return error
+//
+func (r *RelationHistoryRepository) CreateIndexes(ctx context.Context) error {
+	return createIndexes(ctx, r.collection, relationHistoryIndexes)
+}
+
+var relationHistoryIndexes = []mongo.IndexModel{
+	{
+		Keys:    bson.D{{TenantIdField, 1}, {model.RelationTableName, 1}, {AggregateIdField, 1}, {TimeStampField, 1}},
+		Options: options.Index().SetName("tenant_id_table_name_aggregate_id_time_stamp"),
+	},
+}
+
+func (r *RelationHistoryRepository) Insert(ctx context.Context, history *model.RelationHistoryEntity) error {
+	coll, err := r.getCollection(history.TenantId)
+	if err != nil {
+		return err
+	}
+	_, err = coll.InsertOne(ctx, history)
+	return err
+}
+
+//
+// FindByAggregateId
+// @Description: 按时间顺序查找聚合根关系的变更历史
+// @receiver r
+// @param ctx
+// @param tableName
+// @param tenantId
+// @param aggregateId
+// @return []*model.RelationHistoryEntity
+// @return error
+//
+func (r *RelationHistoryRepository) FindByAggregateId(ctx context.Context, tableName string, tenantId string, aggregateId string) ([]*model.RelationHistoryEntity, error) {
+	coll, err := r.getCollection(tenantId)
+	if err != nil {
+		return nil, err
+	}
+	filter := bson.M{
+		TenantIdField:           tenantId,
+		model.RelationTableName: tableName,
+		AggregateIdField:        aggregateId,
+	}
+	cursor, err := coll.Find(ctx, filter, options.Find().SetSort(bson.D{{TimeStampField, 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var list []*model.RelationHistoryEntity
+	if err := cursor.All(ctx, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
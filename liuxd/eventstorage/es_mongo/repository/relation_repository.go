@@ -4,8 +4,8 @@ import (
 	"context"
 	"github.com/liuxd6825/components-contrib/liuxd/common/utils"
 	"github.com/liuxd6825/components-contrib/liuxd/eventstorage"
-	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/model"
 	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/other"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/model"
 	"github.com/orcaman/concurrent-map"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -27,22 +27,70 @@ func NewRelationRepository(mongodb *other.MongoDB) *RelationRepository {
 	return res
 }
 
-func (r *RelationRepository) Save(ctx context.Context, relation *model.RelationEntity) error {
-	coll := r.GetOrCreateCollection(relation.TableName)
+//
+// Save
+// @Description: 保存关系，已有的关系字段保留，新的关系字段覆盖
+// @receiver r
+// @param ctx
+// @param relation
+// @return *model.RelationEntity 保存后的关系
+// @return error
+//
+func (r *RelationRepository) Save(ctx context.Context, relation *model.RelationEntity) (*model.RelationEntity, error) {
+	coll, err := r.GetOrCreateCollection(relation.TenantId, relation.TableName)
+	if err != nil {
+		return nil, err
+	}
 	filterMap := make(map[string]interface{})
 	filterMap[IdField] = relation.Id
 	filter := r.NewFilter(relation.TenantId, filterMap)
 	setData := bson.M{"$set": relation}
-	_, err := coll.UpdateOne(ctx, filter, setData, options.Update().SetUpsert(true))
+	updateOptions := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var result model.RelationEntity
+	if err := coll.FindOneAndUpdate(ctx, filter, setData, updateOptions).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+//
+// UpdateIsDeleted
+// @Description: 设置关系的删除标记
+// @receiver r
+// @param ctx
+// @param tableName
+// @param tenantId
+// @param id
+// @param isDeleted
+// @return *model.RelationEntity 更新后的关系，不存在时返回nil
+// @return error
+//
+func (r *RelationRepository) UpdateIsDeleted(ctx context.Context, tableName string, tenantId string, id string, isDeleted bool) (*model.RelationEntity, error) {
+	coll, err := r.GetOrCreateCollection(tenantId, tableName)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	filter := bson.M{
+		TenantIdField: tenantId,
+		IdField:       id,
+	}
+	update := bson.M{"$set": bson.M{model.RelationIsDeleted: isDeleted}}
+	var result model.RelationEntity
+	if err := coll.FindOneAndUpdate(ctx, filter, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&result); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &result, nil
 }
 
 func (r *RelationRepository) InsertOne(ctx context.Context, relation *model.RelationEntity) error {
-	coll := r.GetOrCreateCollection(relation.TableName)
-	_, err := coll.InsertOne(ctx, relation)
+	coll, err := r.GetOrCreateCollection(relation.TenantId, relation.TableName)
+	if err != nil {
+		return err
+	}
+	_, err = coll.InsertOne(ctx, relation)
 	if err != nil {
 		return err
 	}
@@ -50,12 +98,18 @@ func (r *RelationRepository) InsertOne(ctx context.Context, relation *model.Rela
 }
 
 func (r *RelationRepository) InsertMany(ctx context.Context, tableName string, relations []*model.RelationEntity) error {
+	if len(relations) == 0 {
+		return nil
+	}
 	var docs []interface{}
 	for _, rel := range relations {
 		docs = append(docs, rel)
 	}
-	coll := r.GetOrCreateCollection(tableName)
-	_, err := coll.InsertMany(ctx, docs)
+	coll, err := r.GetOrCreateCollection(relations[0].TenantId, tableName)
+	if err != nil {
+		return err
+	}
+	_, err = coll.InsertMany(ctx, docs)
 	if err != nil {
 		return err
 	}
@@ -63,25 +117,241 @@ func (r *RelationRepository) InsertMany(ctx context.Context, tableName string, r
 }
 
 func (r *RelationRepository) UpdateOne(ctx context.Context, relation *model.RelationEntity) error {
-	coll := r.GetOrCreateCollection(relation.TableName)
-	_, err := coll.UpdateByID(ctx, relation.Id, relation)
+	coll, err := r.GetOrCreateCollection(relation.TenantId, relation.TableName)
+	if err != nil {
+		return err
+	}
+	_, err = coll.UpdateByID(ctx, relation.Id, relation)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (r *RelationRepository) FindPaging(ctx context.Context, tableName string, query eventstorage.FindPagingQuery, opts ...*other.FindOptions) *eventstorage.FindPagingResult[*model.RelationEntity] {
-	coll := r.GetOrCreateCollection(utils.AsMongoName(tableName))
-	return r.BaseRepository.FindPaging(ctx, coll, query, opts...)
+func (r *RelationRepository) FindById(ctx context.Context, tableName string, tenantId string, id string) (*model.RelationEntity, error) {
+	coll, err := r.GetOrCreateCollection(tenantId, tableName)
+	if err != nil {
+		return nil, err
+	}
+	filter := bson.M{
+		TenantIdField: tenantId,
+		IdField:       id,
+	}
+	var result model.RelationEntity
+	if err := coll.FindOne(ctx, filter).Decode(&result); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (r *RelationRepository) DeleteById(ctx context.Context, tableName string, tenantId string, id string) error {
+	coll, err := r.GetOrCreateCollection(tenantId, tableName)
+	if err != nil {
+		return err
+	}
+	filter := bson.M{
+		TenantIdField: tenantId,
+		IdField:       id,
+	}
+	_, err = coll.DeleteOne(ctx, filter)
+	return err
+}
+
+//
+// FindOneAndDelete
+// @Description: 删除关系
+// @receiver r
+// @param ctx
+// @param tableName
+// @param tenantId
+// @param id
+// @return *model.RelationEntity 删除前的关系，不存在时返回nil
+// @return error
+//
+func (r *RelationRepository) FindOneAndDelete(ctx context.Context, tableName string, tenantId string, id string) (*model.RelationEntity, error) {
+	coll, err := r.GetOrCreateCollection(tenantId, tableName)
+	if err != nil {
+		return nil, err
+	}
+	filter := bson.M{
+		TenantIdField: tenantId,
+		IdField:       id,
+	}
+	var result model.RelationEntity
+	if err := coll.FindOneAndDelete(ctx, filter).Decode(&result); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &result, nil
 }
 
-func (r *RelationRepository) GetOrCreateCollection(name string) *mongo.Collection {
+//
+// FindPaging
+// @Description: 分页查询关系
+// @receiver r
+// @param ctx
+// @param tableName
+// @param query
+// @param includeDeleted 是否包含已删除的关系
+// @param opts
+// @return *eventstorage.FindPagingResult[*model.RelationEntity]
+//
+func (r *RelationRepository) FindPaging(ctx context.Context, tableName string, query eventstorage.FindPagingQuery, includeDeleted bool, opts ...*other.FindOptions) *eventstorage.FindPagingResult[*model.RelationEntity] {
+	coll, err := r.GetOrCreateCollection(query.GetTenantId(), utils.AsMongoName(tableName))
+	if err != nil {
+		return eventstorage.NewFindPagingResultWithError[*model.RelationEntity](err)
+	}
+	var and bson.M
+	if !includeDeleted {
+		and = bson.M{model.RelationIsDeleted: bson.M{"$ne": true}}
+	}
+	return r.BaseRepository.FindPagingWithFilter(ctx, coll, query, and, opts...)
+}
+
+//
+// CountReferences
+// @Description: 统计关系表中关系name的值为targetId或多值关系包含targetId的关系数量
+// @receiver r
+// @param ctx
+// @param tableName
+// @param tenantId
+// @param name 关系名称
+// @param targetId
+// @param includeDeleted 是否包含已删除的关系
+// @return uint64
+// @return error
+//
+func (r *RelationRepository) CountReferences(ctx context.Context, tableName string, tenantId string, name string, targetId string, includeDeleted bool) (uint64, error) {
+	coll, err := r.GetOrCreateCollection(tenantId, tableName)
+	if err != nil {
+		return 0, err
+	}
+	count, err := coll.CountDocuments(ctx, newReferenceFilter(tenantId, name, targetId, includeDeleted))
+	if err != nil {
+		return 0, err
+	}
+	return uint64(count), nil
+}
+
+//
+// FindReferences
+// @Description: 按Id顺序查找关系表中关系name的值为targetId或多值关系包含targetId的关系
+// @receiver r
+// @param ctx
+// @param tableName
+// @param tenantId
+// @param name 关系名称
+// @param targetId
+// @param includeDeleted 是否包含已删除的关系
+// @param skip
+// @param limit 为0时不限制数量
+// @return []*model.RelationEntity
+// @return error
+//
+func (r *RelationRepository) FindReferences(ctx context.Context, tableName string, tenantId string, name string, targetId string, includeDeleted bool, skip int64, limit int64) ([]*model.RelationEntity, error) {
+	coll, err := r.GetOrCreateCollection(tenantId, tableName)
+	if err != nil {
+		return nil, err
+	}
+	findOptions := options.Find().SetSort(bson.D{{IdField, 1}}).SetSkip(skip)
+	if limit > 0 {
+		findOptions.SetLimit(limit)
+	}
+	cursor, err := coll.Find(ctx, newReferenceFilter(tenantId, name, targetId, includeDeleted), findOptions)
+	if err != nil {
+		return nil, err
+	}
+	var list []*model.RelationEntity
+	if err := cursor.All(ctx, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// newReferenceFilter 关系字段为数组时，MongoDB按数组中包含该值匹配
+func newReferenceFilter(tenantId string, name string, targetId string, includeDeleted bool) bson.M {
+	filter := bson.M{
+		TenantIdField:           tenantId,
+		utils.AsMongoName(name): targetId,
+	}
+	if !includeDeleted {
+		filter[model.RelationIsDeleted] = bson.M{"$ne": true}
+	}
+	return filter
+}
+
+//
+// CreateIndexes
+// @Description: 为聚合类型的关系表创建关系字段索引，租户隔离时在租户的关系表第一次使用时创建
+// @receiver r
+// @param ctx
+// @param aggregateType
+// @param fields 关系字段
+// @return error
+//
+func (r *RelationRepository) CreateIndexes(ctx context.Context, aggregateType string, fields []string) error {
+	if len(fields) == 0 || r.mongodb.IsTenantIsolated() {
+		return nil
+	}
+	coll, err := r.GetOrCreateCollection("", utils.AsMongoName(aggregateType))
+	if err != nil {
+		return err
+	}
+	return createIndexes(ctx, coll, newRelationIndexes(fields))
+}
+
+//
+// GetOrCreateCollection
+// @Description: 返回关系表的集合并缓存。租户隔离时按租户隔离策略返回租户的集合，第一次使用时创建metadata中声明的关系字段索引
+// @receiver r
+// @param tenantId
+// @param name 关系表名称
+// @return *mongo.Collection
+// @return error
+//
+func (r *RelationRepository) GetOrCreateCollection(tenantId string, name string) (*mongo.Collection, error) {
+	if r.mongodb.IsTenantIsolated() {
+		var init other.CollectionInitFunc
+		if fields := r.getIndexFields(name); len(fields) > 0 && r.mongodb.StorageMetadata.CreateIndexes {
+			init = func(ctx context.Context, collection *mongo.Collection) error {
+				return createIndexes(ctx, collection, newRelationIndexes(fields))
+			}
+		}
+		return r.mongodb.GetOrCreateCollection(tenantId, name, init)
+	}
 	value, ok := collections.Get(name)
 	if !ok {
 		value = r.BaseRepository.mongodb.NewCollection(name)
 		collections.Set(name, value)
 	}
 	coll, _ := value.(*mongo.Collection)
-	return coll
+	return coll, nil
+}
+
+// getIndexFields 返回metadata中为关系表声明的关系字段
+func (r *RelationRepository) getIndexFields(name string) []string {
+	var fields []string
+	for aggregateType, items := range r.mongodb.StorageMetadata.RelationIndexes {
+		if utils.AsMongoName(aggregateType) == name {
+			fields = append(fields, items...)
+		}
+	}
+	return fields
+}
+
+func newRelationIndexes(fields []string) []mongo.IndexModel {
+	indexes := make([]mongo.IndexModel, 0, len(fields))
+	for _, field := range fields {
+		name := utils.AsMongoName(field)
+		indexes = append(indexes, mongo.IndexModel{
+			Keys:    bson.D{{TenantIdField, 1}, {name, 1}},
+			Options: options.Index().SetName(TenantIdField + "_" + name),
+		})
+	}
+	return indexes
 }
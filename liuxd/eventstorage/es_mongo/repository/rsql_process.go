@@ -63,10 +63,18 @@ func (i *filterItem) setValue(name string, value interface{}) {
 }
 
 type MongoProcess struct {
-	item    *filterItem
-	current *filterItem
+	item       *filterItem
+	current    *filterItem
+	fieldName  FieldNameFunc
+	fieldValue FieldValueFunc
 }
 
+// FieldNameFunc 将rsql字段名转换为MongoDB字段名
+type FieldNameFunc func(name string) string
+
+// FieldValueFunc 将rsql值转换为MongoDB查询值，fieldName为转换后的字段名
+type FieldValueFunc func(fieldName string, value rsql.Value) interface{}
+
 func NewMongoProcess() *MongoProcess {
 	m := &MongoProcess{
 		item: newFilterItem(nil, "$and"),
@@ -75,6 +83,20 @@ func NewMongoProcess() *MongoProcess {
 	return m
 }
 
+//
+// NewMongoProcessWith
+// @Description: 使用自定义的字段名与值转换，为nil时使用默认转换
+// @param fieldName
+// @param fieldValue
+// @return *MongoProcess
+//
+func NewMongoProcessWith(fieldName FieldNameFunc, fieldValue FieldValueFunc) *MongoProcess {
+	m := NewMongoProcess()
+	m.fieldName = fieldName
+	m.fieldValue = fieldValue
+	return m
+}
+
 func (m *MongoProcess) init() {
 	m.current = m.item
 }
@@ -130,11 +152,13 @@ func (m *MongoProcess) OnOrEnd() {
 }
 
 func (m *MongoProcess) OnEquals(name string, value interface{}, rValue rsql.Value) {
-	m.current.addChildItem(m.asFieldName(name), rsql.GetValue(rValue))
+	field := m.asFieldName(name)
+	m.current.addChildItem(field, m.getValue(field, rValue))
 }
 
 func (m *MongoProcess) OnNotEquals(name string, value interface{}, rValue rsql.Value) {
-	m.current.addChildItem(m.asFieldName(name), bson.D{{"$ne", rsql.GetValue(rValue)}})
+	field := m.asFieldName(name)
+	m.current.addChildItem(field, bson.D{{"$ne", m.getValue(field, rValue)}})
 }
 
 func (m *MongoProcess) OnLike(name string, value interface{}, rValue rsql.Value) {
@@ -143,37 +167,59 @@ func (m *MongoProcess) OnLike(name string, value interface{}, rValue rsql.Value)
 }
 
 func (m *MongoProcess) OnNotLike(name string, value interface{}, rValue rsql.Value) {
-	m.current.addChildItem(m.asFieldName(name), bson.D{{"$lt", rsql.GetValue(rValue)}})
+	field := m.asFieldName(name)
+	m.current.addChildItem(field, bson.D{{"$lt", m.getValue(field, rValue)}})
 }
 
 func (m *MongoProcess) OnGreaterThan(name string, value interface{}, rValue rsql.Value) {
-	m.current.addChildItem(m.asFieldName(name), bson.D{{"$gt", rsql.GetValue(rValue)}})
+	field := m.asFieldName(name)
+	m.current.addChildItem(field, bson.D{{"$gt", m.getValue(field, rValue)}})
 }
 
 func (m *MongoProcess) OnGreaterThanOrEquals(name string, value interface{}, rValue rsql.Value) {
-	m.current.addChildItem(m.asFieldName(name), bson.D{{"$gte", rsql.GetValue(rValue)}})
+	field := m.asFieldName(name)
+	m.current.addChildItem(field, bson.D{{"$gte", m.getValue(field, rValue)}})
 }
 
 func (m *MongoProcess) OnLessThan(name string, value interface{}, rValue rsql.Value) {
-	m.current.addChildItem(m.asFieldName(name), bson.D{{"$lt", rsql.GetValue(rValue)}})
+	field := m.asFieldName(name)
+	m.current.addChildItem(field, bson.D{{"$lt", m.getValue(field, rValue)}})
 }
 
 func (m *MongoProcess) OnLessThanOrEquals(name string, value interface{}, rValue rsql.Value) {
-	m.current.addChildItem(m.asFieldName(name), bson.D{{"$lte", rsql.GetValue(rValue)}})
+	field := m.asFieldName(name)
+	m.current.addChildItem(field, bson.D{{"$lte", m.getValue(field, rValue)}})
 }
 
 func (m *MongoProcess) OnIn(name string, value interface{}, rValue rsql.Value) {
-	listValue, _ := rValue.(rsql.ListValue)
-	values := rsql.GetValueList(listValue)
-	m.current.addChildItem(m.asFieldName(name), bson.M{"$in": values})
+	field := m.asFieldName(name)
+	m.current.addChildItem(field, bson.M{"$in": m.getValueList(field, rValue)})
 }
 
 func (m *MongoProcess) OnNotIn(name string, value interface{}, rValue rsql.Value) {
-	listValue, _ := rValue.(rsql.ListValue)
-	values := rsql.GetValueList(listValue)
-	m.current.addChildItem(m.asFieldName(name), bson.M{"$nin": values})
+	field := m.asFieldName(name)
+	m.current.addChildItem(field, bson.M{"$nin": m.getValueList(field, rValue)})
 }
 
 func (m *MongoProcess) asFieldName(name string) string {
+	if m.fieldName != nil {
+		return m.fieldName(name)
+	}
 	return utils.AsMongoName(name)
 }
+
+func (m *MongoProcess) getValue(fieldName string, rValue rsql.Value) interface{} {
+	if m.fieldValue != nil {
+		return m.fieldValue(fieldName, rValue)
+	}
+	return rsql.GetValue(rValue)
+}
+
+func (m *MongoProcess) getValueList(fieldName string, rValue rsql.Value) []interface{} {
+	listValue, _ := rValue.(rsql.ListValue)
+	values := make([]interface{}, 0)
+	for _, v := range listValue.Value {
+		values = append(values, m.getValue(fieldName, v))
+	}
+	return values
+}
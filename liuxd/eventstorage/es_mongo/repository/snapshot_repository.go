@@ -1,72 +1,397 @@
 package repository
 
 import (
+	"bytes"
 	"context"
-	"fmt"
-	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/model"
+	"errors"
 	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/other"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/model"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"sync"
 )
 
 type SnapshotRepository struct {
 	BaseRepository[*model.SnapshotEntity]
+	bucketsMu sync.Mutex
+	buckets   map[string]*gridfs.Bucket
 }
 
 func NewSnapshotRepository(mongodb *other.MongoDB, collection *mongo.Collection) *SnapshotRepository {
-	res := &SnapshotRepository{}
+	res := &SnapshotRepository{buckets: make(map[string]*gridfs.Bucket)}
 	res.mongodb = mongodb
 	res.collection = collection
+	res.initCollection = func(ctx context.Context, collection *mongo.Collection) error {
+		return createIndexes(ctx, collection, snapshotIndexes)
+	}
 	return res
 }
 
+//
+// CreateIndexes
+// @Description: 创建镜像集合的索引
+// @receiver r
+// @param ctx
+// @return error
+//
+func (r *SnapshotRepository) CreateIndexes(ctx context.Context) error {
+	return createIndexes(ctx, r.collection, snapshotIndexes)
+}
+
+var snapshotIndexes = []mongo.IndexModel{
+	{
+		Keys:    bson.D{{TenantIdField, 1}, {AggregateIdField, 1}, {AggregateTypeField, 1}, {SequenceNumberField, 1}},
+		Options: options.Index().SetName("tenant_id_aggregate_id_aggregate_type_sequence_number"),
+	},
+}
+
 func (r *SnapshotRepository) Insert(ctx context.Context, snapshot *model.SnapshotEntity) error {
-	_, err := r.collection.InsertOne(ctx, snapshot)
+	coll, err := r.getCollection(snapshot.TenantId)
+	if err != nil {
+		return err
+	}
+	doc, err := r.encode(snapshot)
+	if err != nil {
+		return err
+	}
+	_, err = coll.InsertOne(ctx, doc)
 	return err
 }
 
-func (r *SnapshotRepository) Update(ctx context.Context, snapshot *model.SnapshotEntity) error {
-	_, err := r.collection.UpdateByID(ctx, snapshot.Id, snapshot)
+//
+// InsertMany
+// @Description: 按原样保存镜像，用于导入，镜像需属于同一租户
+// @receiver r
+// @param ctx
+// @param snapshots
+// @return error
+//
+func (r *SnapshotRepository) InsertMany(ctx context.Context, snapshots []*model.SnapshotEntity) error {
+	if len(snapshots) == 0 {
+		return nil
+	}
+	coll, err := r.getCollection(snapshots[0].TenantId)
+	if err != nil {
+		return err
+	}
+	docs := make([]interface{}, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		doc, err := r.encode(snapshot)
+		if err != nil {
+			return err
+		}
+		docs = append(docs, doc)
+	}
+	_, err = coll.InsertMany(ctx, docs)
 	return err
 }
 
-func (r *SnapshotRepository) FindByAggregateId(ctx context.Context, tenantId string, aggregateId string) (*[]model.SnapshotEntity, error) {
+func (r *SnapshotRepository) DeleteByAggregateId(ctx context.Context, tenantId string, aggregateId string) error {
 	filter := bson.M{
 		TenantIdField:    tenantId,
 		AggregateIdField: aggregateId,
 	}
-	cursor, err := r.collection.Find(ctx, filter)
-	defer func() { // 关闭
-		if err := cursor.Close(ctx); err != nil {
-			fmt.Println(err)
-		}
-	}()
+	return r.deleteMany(ctx, tenantId, filter)
+}
+
+//
+// Update
+// @Description: 按保存格式重新编码后替换镜像，原来保存在GridFS中的聚合数据在替换后删除
+// @receiver r
+// @param ctx
+// @param snapshot
+// @return error
+//
+func (r *SnapshotRepository) Update(ctx context.Context, snapshot *model.SnapshotEntity) error {
+	coll, err := r.getCollection(snapshot.TenantId)
+	if err != nil {
+		return err
+	}
+	var old model.SnapshotEntity
+	projection := options.FindOne().SetProjection(bson.M{IdField: 1, DataFileField: 1, DataFileIdField: 1})
+	if err := coll.FindOne(ctx, bson.M{IdField: snapshot.Id}, projection).Decode(&old); err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+	doc, err := r.encode(snapshot)
+	if err != nil {
+		return err
+	}
+	if _, err = coll.ReplaceOne(ctx, bson.M{IdField: snapshot.Id}, doc); err != nil {
+		return err
+	}
+	if old.DataFile {
+		return r.deleteFiles(snapshot.TenantId, []model.SnapshotEntity{old})
+	}
+	return nil
+}
 
+func (r *SnapshotRepository) FindByAggregateId(ctx context.Context, tenantId string, aggregateId string) (*[]model.SnapshotEntity, error) {
+	filter := bson.M{
+		TenantIdField:    tenantId,
+		AggregateIdField: aggregateId,
+	}
+	coll, err := r.getCollection(tenantId)
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := coll.Find(ctx, filter)
 	if err != nil {
 		return nil, err
 	}
+	defer cursor.Close(ctx)
 
 	var list []model.SnapshotEntity
 	if err = cursor.All(ctx, &list); err != nil {
 		return nil, err
 	}
-	return &list, nil
+	res := make([]model.SnapshotEntity, 0, len(list))
+	for i := range list {
+		if err := r.decode(&list[i]); errors.Is(err, gridfs.ErrFileNotFound) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		res = append(res, list[i])
+	}
+	return &res, nil
 }
 
-func (r *SnapshotRepository) FindByMaxSequenceNumber(ctx context.Context, tenantId string, aggregateId string, aggregateType string) (*model.SnapshotEntity, error) {
+//
+// FindByMaxSequenceNumber
+// @Description: 查找序号最大的镜像，aggregateVersion不为空时只查找该版本的镜像，toSequenceNumber大于0时只查找序号不大于toSequenceNumber的镜像。
+// 镜像的GridFS文件不存在时镜像不可用，返回nil，由调用方从事件重新加载
+// @receiver r
+// @param ctx
+// @param tenantId
+// @param aggregateId
+// @param aggregateType
+// @param aggregateVersion
+// @param toSequenceNumber
+// @return *model.SnapshotEntity
+// @return error
+//
+func (r *SnapshotRepository) FindByMaxSequenceNumber(ctx context.Context, tenantId string, aggregateId string, aggregateType string, aggregateVersion string, toSequenceNumber uint64) (*model.SnapshotEntity, error) {
 	filter := bson.M{
 		TenantIdField:      tenantId,
 		AggregateIdField:   aggregateId,
 		AggregateTypeField: aggregateType,
 	}
+	if aggregateVersion != "" {
+		filter[AggregateVersionField] = aggregateVersion
+	}
+	if toSequenceNumber > 0 {
+		filter[SequenceNumberField] = bson.M{"$lte": toSequenceNumber}
+	}
+	coll, err := r.getCollection(tenantId)
+	if err != nil {
+		return nil, err
+	}
 	findOptions := options.FindOne().SetSort(bson.D{{SequenceNumberField, -1}})
 	var snapshot model.SnapshotEntity
-	if err := r.collection.FindOne(ctx, filter, findOptions).Decode(&snapshot); err != nil {
+	if err := coll.FindOne(ctx, filter, findOptions).Decode(&snapshot); err != nil {
 		if err == mongo.ErrNoDocuments {
 			return nil, nil
 		}
 		return nil, err
 	}
+	if err := r.decode(&snapshot); errors.Is(err, gridfs.ErrFileNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
 	return &snapshot, nil
 }
+
+//
+// DeleteOlder
+// @Description: 只保留序号最大的retainCount个镜像，删除更早的镜像
+// @receiver r
+// @param ctx
+// @param tenantId
+// @param aggregateId
+// @param aggregateType
+// @param retainCount
+// @return error
+//
+func (r *SnapshotRepository) DeleteOlder(ctx context.Context, tenantId string, aggregateId string, aggregateType string, retainCount int64) error {
+	filter := bson.M{
+		TenantIdField:      tenantId,
+		AggregateIdField:   aggregateId,
+		AggregateTypeField: aggregateType,
+	}
+	coll, err := r.getCollection(tenantId)
+	if err != nil {
+		return err
+	}
+	findOptions := options.FindOne().SetSort(bson.D{{SequenceNumberField, -1}}).SetSkip(retainCount - 1)
+	var snapshot model.SnapshotEntity
+	if err := coll.FindOne(ctx, filter, findOptions).Decode(&snapshot); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		return err
+	}
+	filter[SequenceNumberField] = bson.M{"$lt": snapshot.SequenceNumber}
+	return r.deleteMany(ctx, tenantId, filter)
+}
+
+//
+// encode
+// @Description: 按聚合类型的保存格式编码聚合数据，编码后超过SnapshotFileThreshold字节时保存到GridFS。
+// GridFS的写入不在事务中，每次编码使用新的文件Id，事务重试时不会因文件Id重复而失败；事务回滚时已写入的文件不再被引用
+// @receiver r
+// @param snapshot
+// @return *model.SnapshotEntity
+// @return error
+//
+func (r *SnapshotRepository) encode(snapshot *model.SnapshotEntity) (*model.SnapshotEntity, error) {
+	doc, err := snapshot.Encode(r.getDataCodec(snapshot.AggregateType))
+	if err != nil {
+		return nil, err
+	}
+	threshold := r.getSnapshotFileThreshold()
+	if threshold <= 0 {
+		return doc, nil
+	}
+	data := doc.EncodedData
+	if doc.DataCodec == "" {
+		if data, err = other.EncodeData(other.DataCodecBson, doc.AggregateData); err != nil {
+			return nil, err
+		}
+	}
+	if len(data) <= threshold {
+		return doc, nil
+	}
+	bucket, err := r.getBucket(doc.TenantId)
+	if err != nil {
+		return nil, err
+	}
+	fileId := model.NewObjectID()
+	if err := bucket.UploadFromStreamWithID(fileId, doc.Id, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	res := *doc
+	if res.DataCodec == "" {
+		res.DataCodec = other.DataCodecBson
+	}
+	res.AggregateData = nil
+	res.EncodedData = nil
+	res.DataFile = true
+	res.DataFileId = fileId
+	return &res, nil
+}
+
+//
+// decode
+// @Description: 解码聚合数据，保存在GridFS中时先读取文件。
+// 文件在事务外删除，事务回滚后镜像仍存在而文件不存在时返回gridfs.ErrFileNotFound
+// @receiver r
+// @param snapshot
+// @return error
+//
+func (r *SnapshotRepository) decode(snapshot *model.SnapshotEntity) error {
+	if snapshot.DataFile {
+		bucket, err := r.getBucket(snapshot.TenantId)
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if _, err := bucket.DownloadToStream(snapshot.GetDataFileId(), &buf); err != nil {
+			return err
+		}
+		snapshot.EncodedData = buf.Bytes()
+	}
+	return snapshot.Decode()
+}
+
+//
+// deleteMany
+// @Description: 删除镜像及保存在GridFS中的聚合数据，文件在事务外删除，镜像删除后才删除文件
+// @receiver r
+// @param ctx
+// @param tenantId
+// @param filter
+// @return error
+//
+func (r *SnapshotRepository) deleteMany(ctx context.Context, tenantId string, filter bson.M) error {
+	coll, err := r.getCollection(tenantId)
+	if err != nil {
+		return err
+	}
+	fileFilter := bson.M{DataFileField: true}
+	for k, v := range filter {
+		fileFilter[k] = v
+	}
+	cursor, err := coll.Find(ctx, fileFilter, options.Find().SetProjection(bson.M{IdField: 1, DataFileIdField: 1}))
+	if err != nil {
+		return err
+	}
+	var files []model.SnapshotEntity
+	if err := cursor.All(ctx, &files); err != nil {
+		return err
+	}
+	if _, err := coll.DeleteMany(ctx, filter); err != nil {
+		return err
+	}
+	return r.deleteFiles(tenantId, files)
+}
+
+func (r *SnapshotRepository) deleteFiles(tenantId string, files []model.SnapshotEntity) error {
+	if len(files) == 0 {
+		return nil
+	}
+	bucket, err := r.getBucket(tenantId)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := bucket.Delete(file.GetDataFileId()); err != nil && err != gridfs.ErrFileNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *SnapshotRepository) getSnapshotFileThreshold() int {
+	if r.mongodb == nil || r.mongodb.StorageMetadata == nil || r.mongodb.StorageMetadata.DataCodec == nil {
+		return 0
+	}
+	return r.mongodb.StorageMetadata.DataCodec.SnapshotFileThreshold
+}
+
+//
+// getBucket
+// @Description: 保存镜像数据的GridFS bucket，与镜像集合在同一个数据库中，每个租户使用单独集合时bucket名称加租户Id
+// @receiver r
+// @param tenantId
+// @return *gridfs.Bucket
+// @return error
+//
+func (r *SnapshotRepository) getBucket(tenantId string) (*gridfs.Bucket, error) {
+	coll, err := r.getCollection(tenantId)
+	if err != nil {
+		return nil, err
+	}
+	key := coll.Database().Name() + "." + coll.Name()
+	r.bucketsMu.Lock()
+	defer r.bucketsMu.Unlock()
+	if bucket, ok := r.buckets[key]; ok {
+		return bucket, nil
+	}
+	bucketOptions := options.GridFSBucket()
+	if r.mongodb != nil && r.mongodb.StorageMetadata != nil && r.mongodb.StorageMetadata.DataCodec != nil {
+		name := r.mongodb.StorageMetadata.DataCodec.SnapshotBucketName
+		if r.mongodb.StorageMetadata.Tenancy == other.TenancyCollection {
+			name = other.NewTenantName(name, tenantId)
+		}
+		bucketOptions.SetName(name)
+	}
+	bucket, err := gridfs.NewBucket(coll.Database(), bucketOptions)
+	if err != nil {
+		return nil, err
+	}
+	r.buckets[key] = bucket
+	return bucket, nil
+}
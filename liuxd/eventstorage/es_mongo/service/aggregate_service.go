@@ -2,17 +2,26 @@ package service
 
 import (
 	"context"
-	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/model"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage"
 	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/other"
 	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/repository"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/model"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type AggregateService interface {
 	Create(ctx context.Context, req *model.AggregateEntity) error
 	Delete(ctx context.Context, tenantId, aggregateId string) error
+	Restore(ctx context.Context, tenantId, aggregateId string) error
 	FindById(ctx context.Context, tenantId, aggregateId string) (*model.AggregateEntity, error)
-	NextSequenceNumber(ctx context.Context, tenantId, aggregateId string, count uint64) (*model.AggregateEntity, uint64, error)
+	NextSequenceNumber(ctx context.Context, tenantId, aggregateId string, count uint64, expectedSequenceNumber uint64) (*model.AggregateEntity, uint64, error)
+	FindPaging(ctx context.Context, aggregateType string, query eventstorage.FindPagingQuery) (*eventstorage.FindPagingResult[*model.AggregateEntity], bool, error)
+	Count(ctx context.Context, tenantId string, aggregateType string, filter string) (uint64, error)
+	FindAggregateTypes(ctx context.Context, tenantId string) ([]string, error)
+	CreateIndexes(ctx context.Context) error
+	ForEach(ctx context.Context, tenantId string, aggregateType string, fun func(agg *model.AggregateEntity) error) error
+	Remove(ctx context.Context, tenantId, aggregateId string) error
+	Realign(ctx context.Context, tenantId, aggregateId string, fromSequenceNumber uint64, toSequenceNumber uint64, gaps []uint64) error
 }
 
 type aggregateService struct {
@@ -35,6 +44,38 @@ func (c *aggregateService) FindById(ctx context.Context, tenantId, aggregateId s
 	return c.repos.FindById(ctx, tenantId, aggregateId)
 }
 
-func (c *aggregateService) NextSequenceNumber(ctx context.Context, tenantId, aggregateId string, count uint64) (*model.AggregateEntity, uint64, error) {
-	return c.repos.NextSequenceNumber(ctx, tenantId, aggregateId, count)
+func (c *aggregateService) NextSequenceNumber(ctx context.Context, tenantId, aggregateId string, count uint64, expectedSequenceNumber uint64) (*model.AggregateEntity, uint64, error) {
+	return c.repos.NextSequenceNumber(ctx, tenantId, aggregateId, count, expectedSequenceNumber)
+}
+
+func (c *aggregateService) Restore(ctx context.Context, tenantId, aggregateId string) error {
+	return c.repos.Restore(ctx, tenantId, aggregateId)
+}
+
+func (c *aggregateService) FindPaging(ctx context.Context, aggregateType string, query eventstorage.FindPagingQuery) (*eventstorage.FindPagingResult[*model.AggregateEntity], bool, error) {
+	return c.repos.FindPaging(ctx, aggregateType, query).Result()
+}
+
+func (c *aggregateService) Count(ctx context.Context, tenantId string, aggregateType string, filter string) (uint64, error) {
+	return c.repos.Count(ctx, tenantId, aggregateType, filter)
+}
+
+func (c *aggregateService) FindAggregateTypes(ctx context.Context, tenantId string) ([]string, error) {
+	return c.repos.FindAggregateTypes(ctx, tenantId)
+}
+
+func (c *aggregateService) CreateIndexes(ctx context.Context) error {
+	return c.repos.CreateIndexes(ctx)
+}
+
+func (c *aggregateService) ForEach(ctx context.Context, tenantId string, aggregateType string, fun func(agg *model.AggregateEntity) error) error {
+	return c.repos.ForEach(ctx, tenantId, aggregateType, fun)
+}
+
+func (c *aggregateService) Remove(ctx context.Context, tenantId, aggregateId string) error {
+	return c.repos.Remove(ctx, tenantId, aggregateId)
+}
+
+func (c *aggregateService) Realign(ctx context.Context, tenantId, aggregateId string, fromSequenceNumber uint64, toSequenceNumber uint64, gaps []uint64) error {
+	return c.repos.Realign(ctx, tenantId, aggregateId, fromSequenceNumber, toSequenceNumber, gaps)
 }
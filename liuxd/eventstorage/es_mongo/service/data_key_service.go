@@ -0,0 +1,43 @@
+package service
+
+import (
+	"context"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/other"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/repository"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/model"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// DataKeyService 数据密钥存储，实现eventstorage.DataKeyStore
+type DataKeyService interface {
+	eventstorage.DataKeyStore
+}
+
+func NewDataKeyService(mongodb *other.MongoDB, collection *mongo.Collection) DataKeyService {
+	return &dataKeyService{repos: repository.NewDataKeyRepository(mongodb, collection)}
+}
+
+type dataKeyService struct {
+	repos *repository.DataKeyRepository
+}
+
+func (s *dataKeyService) GetDataKey(ctx context.Context, tenantId string, keyId string) (*eventstorage.DataKey, error) {
+	entity, err := s.repos.FindById(ctx, tenantId, keyId)
+	if err != nil || entity == nil {
+		return nil, err
+	}
+	return entity.NewDataKey(), nil
+}
+
+func (s *dataKeyService) CreateDataKey(ctx context.Context, key *eventstorage.DataKey) (*eventstorage.DataKey, error) {
+	entity, err := s.repos.Insert(ctx, model.NewDataKeyEntity(key))
+	if err != nil {
+		return nil, err
+	}
+	return entity.NewDataKey(), nil
+}
+
+func (s *dataKeyService) EraseDataKey(ctx context.Context, tenantId string, keyId string) error {
+	return s.repos.Erase(ctx, tenantId, keyId)
+}
@@ -5,9 +5,10 @@ import (
 	"errors"
 	"github.com/liuxd6825/components-contrib/liuxd/common/utils"
 	"github.com/liuxd6825/components-contrib/liuxd/eventstorage"
-	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/model"
 	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/other"
 	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/repository"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/model"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
@@ -16,8 +17,27 @@ type EventService interface {
 	Update(ctx context.Context, event *model.EventEntity) error
 	FindById(ctx context.Context, tenantId string, id string) (*model.EventEntity, error)
 	FindByAggregateId(ctx context.Context, tenantId string, aggregateId string, aggregateType string) (*[]model.EventEntity, error)
-	FindBySequenceNumber(ctx context.Context, tenantId string, aggregateId string, aggregateType string, sequenceNumber uint64) (*[]model.EventEntity, error)
-	UpdatePublishStatue(ctx context.Context, eventId string, publishStatue eventstorage.PublishStatus) error
+	FindBySequenceNumber(ctx context.Context, tenantId string, aggregateId string, aggregateType string, sequenceNumber uint64, toSequenceNumber uint64) (*[]model.EventEntity, error)
+	FindByCommandId(ctx context.Context, tenantId string, commandId string, after primitive.DateTime) (*[]model.EventEntity, error)
+	FindByCorrelationId(ctx context.Context, tenantId string, correlationId string, limit int64) (*[]model.EventEntity, error)
+	CreateIndexes(ctx context.Context) error
+	FindLastByTime(ctx context.Context, tenantId string, aggregateId string, aggregateType string, toTime primitive.DateTime) (*model.EventEntity, error)
+	UpdatePublishStatue(ctx context.Context, tenantId string, eventId string, publishStatue eventstorage.PublishStatus) error
+	UpdatePublishStatusMany(ctx context.Context, tenantId string, eventIds []string, publishStatue eventstorage.PublishStatus) error
+	UpdatePublishError(ctx context.Context, tenantId string, eventId string, publishStatue eventstorage.PublishStatus, attempts int, errMsg string, nextPublishTime primitive.DateTime) error
+	FindNotPublished(ctx context.Context, before primitive.DateTime, now primitive.DateTime, limit int64) (*[]model.EventEntity, error)
+	FindFirstNotPublished(ctx context.Context, tenantId string, aggregateId string) (*model.EventEntity, error)
+	FindByPosition(ctx context.Context, tenantId string, aggregateType string, eventType string, fromPosition uint64, limit int64) (*[]model.EventEntity, error)
+	FindForReplay(ctx context.Context, req *eventstorage.ReplayEventsRequest, fromPosition uint64, limit int64) (*[]model.EventEntity, error)
+	CountForReplay(ctx context.Context, req *eventstorage.ReplayEventsRequest, toPosition uint64) (uint64, error)
+	FindWithoutPosition(ctx context.Context, tenantId string, limit int64) (*[]model.EventEntity, error)
+	UpdatePositions(ctx context.Context, tenantId string, events []model.EventEntity) error
+	FindPaging(ctx context.Context, query eventstorage.FindPagingQuery) (*eventstorage.FindPagingResult[*model.EventEntity], bool, error)
+	Import(ctx context.Context, events []*model.EventEntity) error
+	DeleteByAggregateId(ctx context.Context, tenantId string, aggregateId string) error
+	FindSequenceNumbers(ctx context.Context, tenantId string, aggregateId string) (*[]model.EventEntity, error)
+	CountByAggregateId(ctx context.Context, tenantId string, aggregateType string) ([]*model.AggregateEventCount, error)
+	FindAggregateIdsByDataKeyId(ctx context.Context, tenantId string, keyId string) ([]string, error)
 }
 
 func NewEventService(mongodb *other.MongoDB, collection *mongo.Collection) EventService {
@@ -66,44 +86,111 @@ func (s *eventService) FindByAggregateId(ctx context.Context, tenantId string, a
 	return s.repos.FindByAggregateId(ctx, tenantId, aggregateId, aggregateType)
 }
 
-func (s *eventService) FindBySequenceNumber(ctx context.Context, tenantId string, aggregateId string, aggregateType string, sequenceNumber uint64) (*[]model.EventEntity, error) {
+func (s *eventService) FindBySequenceNumber(ctx context.Context, tenantId string, aggregateId string, aggregateType string, sequenceNumber uint64, toSequenceNumber uint64) (*[]model.EventEntity, error) {
 	if tenantId == "" {
 		return nil, errors.New("tenantId 不能为空")
 	}
-	return s.repos.FindBySequenceNumber(ctx, tenantId, aggregateId, aggregateType, sequenceNumber)
+	return s.repos.FindBySequenceNumber(ctx, tenantId, aggregateId, aggregateType, sequenceNumber, toSequenceNumber)
 }
 
-func (s *eventService) UpdatePublishStatue(ctx context.Context, eventId string, publishStatue eventstorage.PublishStatus) error {
-	return s.repos.UpdatePublishStatue(ctx, eventId, publishStatue)
+func (s *eventService) FindLastByTime(ctx context.Context, tenantId string, aggregateId string, aggregateType string, toTime primitive.DateTime) (*model.EventEntity, error) {
+	if tenantId == "" {
+		return nil, errors.New("tenantId 不能为空")
+	}
+	return s.repos.FindLastByTime(ctx, tenantId, aggregateId, aggregateType, toTime)
 }
 
-func (s *eventService) validation(event *model.EventEntity) error {
-	if event == nil {
-		return errors.New("event is nil")
-	}
-	if event.Id == model.NilObjectID {
-		return errors.New("event.id is empty")
-	}
-	if event.TenantId == "" {
-		return errors.New("event.tenantId is empty")
-	}
-	if event.EventId == "" {
-		return errors.New("event.eventId is empty")
-	}
-	if event.EventVersion == "" {
-		return errors.New("event.eventRevision is empty")
-	}
-	if event.Topic == "" {
-		return errors.New("event.topic is empty")
-	}
-	if event.AggregateType == "" {
-		return errors.New("event.aggregateType is empty")
+func (s *eventService) UpdatePublishStatue(ctx context.Context, tenantId string, eventId string, publishStatue eventstorage.PublishStatus) error {
+	return s.repos.UpdatePublishStatue(ctx, tenantId, eventId, publishStatue)
+}
+
+func (s *eventService) UpdatePublishStatusMany(ctx context.Context, tenantId string, eventIds []string, publishStatue eventstorage.PublishStatus) error {
+	return s.repos.UpdatePublishStatusMany(ctx, tenantId, eventIds, publishStatue)
+}
+
+func (s *eventService) UpdatePublishError(ctx context.Context, tenantId string, eventId string, publishStatue eventstorage.PublishStatus, attempts int, errMsg string, nextPublishTime primitive.DateTime) error {
+	return s.repos.UpdatePublishError(ctx, tenantId, eventId, publishStatue, attempts, errMsg, nextPublishTime)
+}
+
+func (s *eventService) FindNotPublished(ctx context.Context, before primitive.DateTime, now primitive.DateTime, limit int64) (*[]model.EventEntity, error) {
+	return s.repos.FindNotPublished(ctx, before, now, limit)
+}
+
+func (s *eventService) FindFirstNotPublished(ctx context.Context, tenantId string, aggregateId string) (*model.EventEntity, error) {
+	return s.repos.FindFirstNotPublished(ctx, tenantId, aggregateId)
+}
+
+func (s *eventService) FindByPosition(ctx context.Context, tenantId string, aggregateType string, eventType string, fromPosition uint64, limit int64) (*[]model.EventEntity, error) {
+	return s.repos.FindByPosition(ctx, tenantId, aggregateType, eventType, fromPosition, limit)
+}
+
+func (s *eventService) FindForReplay(ctx context.Context, req *eventstorage.ReplayEventsRequest, fromPosition uint64, limit int64) (*[]model.EventEntity, error) {
+	return s.repos.FindForReplay(ctx, req, fromPosition, limit)
+}
+
+func (s *eventService) CountForReplay(ctx context.Context, req *eventstorage.ReplayEventsRequest, toPosition uint64) (uint64, error) {
+	return s.repos.CountForReplay(ctx, req, toPosition)
+}
+
+func (s *eventService) FindWithoutPosition(ctx context.Context, tenantId string, limit int64) (*[]model.EventEntity, error) {
+	return s.repos.FindWithoutPosition(ctx, tenantId, limit)
+}
+
+func (s *eventService) UpdatePositions(ctx context.Context, tenantId string, events []model.EventEntity) error {
+	return s.repos.UpdatePositions(ctx, tenantId, events)
+}
+
+func (s *eventService) FindByCommandId(ctx context.Context, tenantId string, commandId string, after primitive.DateTime) (*[]model.EventEntity, error) {
+	return s.repos.FindByCommandId(ctx, tenantId, commandId, after)
+}
+
+func (s *eventService) FindByCorrelationId(ctx context.Context, tenantId string, correlationId string, limit int64) (*[]model.EventEntity, error) {
+	if tenantId == "" {
+		return nil, errors.New("tenantId 不能为空")
 	}
-	if event.AggregateId == "" {
-		return errors.New("event.aggregateId is empty")
+	return s.repos.FindByCorrelationId(ctx, tenantId, correlationId, limit)
+}
+
+func (s *eventService) CreateIndexes(ctx context.Context) error {
+	return s.repos.CreateIndexes(ctx)
+}
+
+func (s *eventService) validation(event *model.EventEntity) error {
+	return event.Validate()
+}
+
+func (s *eventService) FindPaging(ctx context.Context, query eventstorage.FindPagingQuery) (*eventstorage.FindPagingResult[*model.EventEntity], bool, error) {
+	return s.repos.FindPaging(ctx, query).Result()
+}
+
+// Import 保存导入的事件，保留事件的时间与发送状态
+func (s *eventService) Import(ctx context.Context, events []*model.EventEntity) error {
+	for _, event := range events {
+		if err := s.validation(event); err != nil {
+			return err
+		}
+	}
+	return s.repos.InsertMany(ctx, events)
+}
+
+func (s *eventService) DeleteByAggregateId(ctx context.Context, tenantId string, aggregateId string) error {
+	return s.repos.DeleteByAggregateId(ctx, tenantId, aggregateId)
+}
+
+func (s *eventService) FindSequenceNumbers(ctx context.Context, tenantId string, aggregateId string) (*[]model.EventEntity, error) {
+	return s.repos.FindSequenceNumbers(ctx, tenantId, aggregateId)
+}
+
+func (s *eventService) CountByAggregateId(ctx context.Context, tenantId string, aggregateType string) ([]*model.AggregateEventCount, error) {
+	if tenantId == "" {
+		return nil, errors.New("tenantId 不能为空")
 	}
-	if event.PublishName == "" {
-		return errors.New("event.publishName is empty")
+	return s.repos.CountByAggregateId(ctx, tenantId, aggregateType)
+}
+
+func (s *eventService) FindAggregateIdsByDataKeyId(ctx context.Context, tenantId string, keyId string) ([]string, error) {
+	if tenantId == "" {
+		return nil, errors.New("tenantId 不能为空")
 	}
-	return nil
+	return s.repos.FindAggregateIdsByDataKeyId(ctx, tenantId, keyId)
 }
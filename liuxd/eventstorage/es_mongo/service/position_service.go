@@ -0,0 +1,27 @@
+package service
+
+import (
+	"context"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/other"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/repository"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// eventPositionName 事件全局位置计数器名称
+const eventPositionName = "event"
+
+type PositionService interface {
+	NextEventPosition(ctx context.Context, count uint64) (uint64, error)
+}
+
+func NewPositionService(mongodb *other.MongoDB, collection *mongo.Collection) PositionService {
+	return &positionService{repos: repository.NewPositionRepository(mongodb, collection)}
+}
+
+type positionService struct {
+	repos *repository.PositionRepository
+}
+
+func (s *positionService) NextEventPosition(ctx context.Context, count uint64) (uint64, error) {
+	return s.repos.Next(ctx, eventPositionName, count)
+}
@@ -6,30 +6,163 @@ import (
 	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/other"
 
 	//"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo"
-	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/model"
 	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/repository"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/model"
 )
 
 type RelationService interface {
 	Save(ctx context.Context, relation *model.RelationEntity) error
-	FindPaging(ctx context.Context, tableName string, query eventstorage.FindPagingQuery) (*eventstorage.FindPagingResult[*model.RelationEntity], bool, error)
+	Delete(ctx context.Context, tableName string, tenantId string, id string) error
+	Restore(ctx context.Context, relation *model.RelationEntity) error
+	FindPaging(ctx context.Context, tableName string, query eventstorage.FindPagingQuery, includeDeleted bool) (*eventstorage.FindPagingResult[*model.RelationEntity], bool, error)
+	FindHistory(ctx context.Context, tableName string, tenantId string, aggregateId string) ([]*model.RelationHistoryEntity, error)
+	FindReferences(ctx context.Context, tableNames []string, req *eventstorage.FindRelationReferencesRequest) ([]*model.RelationEntity, uint64, error)
+	CreateIndexes(ctx context.Context, aggregateType string, fields []string) error
+	CreateHistoryIndexes(ctx context.Context) error
+	FindById(ctx context.Context, tableName string, tenantId string, id string) (*model.RelationEntity, error)
+	DeleteById(ctx context.Context, tableName string, tenantId string, id string) error
 }
 
 func NewRelationService(db *other.MongoDB) RelationService {
 	res := &relationService{}
 	res.resp = repository.NewRelationRepository(db)
+	if db.StorageMetadata != nil {
+		res.deleteMode = db.StorageMetadata.RelationDeleteMode
+		res.history = db.StorageMetadata.RelationHistory
+		res.historyResp = repository.NewRelationHistoryRepository(db, db.NewCollection(db.StorageMetadata.HistoryCollectionName))
+	}
 	return res
 }
 
 type relationService struct {
-	resp *repository.RelationRepository
+	resp        *repository.RelationRepository
+	historyResp *repository.RelationHistoryRepository
+	deleteMode  other.RelationDeleteMode
+	history     bool
 }
 
 func (r *relationService) Save(ctx context.Context, relation *model.RelationEntity) error {
 	if err := relation.Validate(); err != nil {
 		return err
 	}
-	return r.resp.Save(ctx, relation)
+	saved, err := r.resp.Save(ctx, relation)
+	if err != nil {
+		return err
+	}
+	return r.saveHistory(ctx, saved, model.RelationOperationSave)
+}
+
+//
+// Delete
+// @Description: 删除聚合根时按RelationDeleteMode标记删除或删除关系，关系不存在时忽略
+// @receiver r
+// @param ctx
+// @param tableName
+// @param tenantId
+// @param id
+// @return error
+//
+func (r *relationService) Delete(ctx context.Context, tableName string, tenantId string, id string) error {
+	var relation *model.RelationEntity
+	var err error
+	if r.deleteMode == other.RelationDeleteModeRemove {
+		if relation, err = r.resp.FindOneAndDelete(ctx, tableName, tenantId, id); relation != nil {
+			relation.IsDeleted = true
+		}
+	} else {
+		relation, err = r.resp.UpdateIsDeleted(ctx, tableName, tenantId, id, true)
+	}
+	if err != nil {
+		return err
+	}
+	return r.saveHistory(ctx, relation, model.RelationOperationDelete)
+}
+
+//
+// Restore
+// @Description: 恢复聚合根时恢复关系。flag删除模式下取消删除标记，remove删除模式下保存relation，relation为按事件重建的关系
+// @receiver r
+// @param ctx
+// @param relation
+// @return error
+//
+func (r *relationService) Restore(ctx context.Context, relation *model.RelationEntity) error {
+	var restored *model.RelationEntity
+	var err error
+	if r.deleteMode == other.RelationDeleteModeRemove {
+		if relation.IsEmpty() {
+			return nil
+		}
+		if err = relation.Validate(); err != nil {
+			return err
+		}
+		restored, err = r.resp.Save(ctx, relation)
+	} else {
+		restored, err = r.resp.UpdateIsDeleted(ctx, relation.TableName, relation.TenantId, relation.Id, false)
+	}
+	if err != nil {
+		return err
+	}
+	return r.saveHistory(ctx, restored, model.RelationOperationRestore)
+}
+
+func (r *relationService) FindHistory(ctx context.Context, tableName string, tenantId string, aggregateId string) ([]*model.RelationHistoryEntity, error) {
+	return r.historyResp.FindByAggregateId(ctx, tableName, tenantId, aggregateId)
+}
+
+//
+// FindReferences
+// @Description: 依次在关系表中反向查询引用req.TargetId的关系，按表名、Id顺序跨表分页
+// @receiver r
+// @param ctx
+// @param tableNames 按名称排序的关系表
+// @param req
+// @return []*model.RelationEntity 当前页的关系
+// @return uint64 所有关系表中的总数
+// @return error
+//
+func (r *relationService) FindReferences(ctx context.Context, tableNames []string, req *eventstorage.FindRelationReferencesRequest) ([]*model.RelationEntity, uint64, error) {
+	skip := int64(req.PageNum * req.PageSize)
+	limit := int64(req.PageSize)
+	var list []*model.RelationEntity
+	var totalRows uint64
+	for _, tableName := range tableNames {
+		count, err := r.resp.CountReferences(ctx, tableName, req.TenantId, req.RelationName, req.TargetId, req.IncludeDeleted)
+		if err != nil {
+			return nil, 0, err
+		}
+		totalRows += count
+		if count == 0 || (limit > 0 && int64(len(list)) >= limit) {
+			continue
+		}
+		if skip >= int64(count) {
+			skip -= int64(count)
+			continue
+		}
+		var tableLimit int64
+		if limit > 0 {
+			tableLimit = limit - int64(len(list))
+		}
+		items, err := r.resp.FindReferences(ctx, tableName, req.TenantId, req.RelationName, req.TargetId, req.IncludeDeleted, skip, tableLimit)
+		if err != nil {
+			return nil, 0, err
+		}
+		skip = 0
+		list = append(list, items...)
+	}
+	return list, totalRows, nil
+}
+
+func (r *relationService) CreateHistoryIndexes(ctx context.Context) error {
+	return r.historyResp.CreateIndexes(ctx)
+}
+
+// saveHistory 启用关系历史时保存变更后的关系，relation为nil时忽略
+func (r *relationService) saveHistory(ctx context.Context, relation *model.RelationEntity, operation model.RelationOperation) error {
+	if !r.history || relation == nil {
+		return nil
+	}
+	return r.historyResp.Insert(ctx, model.NewRelationHistoryEntity(relation, operation))
 }
 
 func (r *relationService) Create(ctx context.Context, relation *model.RelationEntity) error {
@@ -46,7 +179,19 @@ func (r *relationService) Update(ctx context.Context, relation *model.RelationEn
 	return r.resp.UpdateOne(ctx, relation)
 }
 
-func (r *relationService) FindPaging(ctx context.Context, tableName string, query eventstorage.FindPagingQuery) (*eventstorage.FindPagingResult[*model.RelationEntity], bool, error) {
-	res, ok, err := r.resp.FindPaging(ctx, tableName, query).Result()
+func (r *relationService) FindPaging(ctx context.Context, tableName string, query eventstorage.FindPagingQuery, includeDeleted bool) (*eventstorage.FindPagingResult[*model.RelationEntity], bool, error) {
+	res, ok, err := r.resp.FindPaging(ctx, tableName, query, includeDeleted).Result()
 	return res, ok, err
 }
+
+func (r *relationService) CreateIndexes(ctx context.Context, aggregateType string, fields []string) error {
+	return r.resp.CreateIndexes(ctx, aggregateType, fields)
+}
+
+func (r *relationService) FindById(ctx context.Context, tableName string, tenantId string, id string) (*model.RelationEntity, error) {
+	return r.resp.FindById(ctx, tableName, tenantId, id)
+}
+
+func (r *relationService) DeleteById(ctx context.Context, tableName string, tenantId string, id string) error {
+	return r.resp.DeleteById(ctx, tableName, tenantId, id)
+}
@@ -2,7 +2,7 @@ package service
 
 import (
 	ctx "context"
-	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/model"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/model"
 	"testing"
 )
 
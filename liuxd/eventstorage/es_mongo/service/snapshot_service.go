@@ -3,9 +3,9 @@ package service
 import (
 	"context"
 	"github.com/liuxd6825/components-contrib/liuxd/common/utils"
-	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/model"
 	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/other"
 	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/repository"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/model"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
@@ -13,7 +13,11 @@ type SnapshotService interface {
 	Create(ctx context.Context, snapshot *model.SnapshotEntity) error
 	Update(ctx context.Context, snapshot *model.SnapshotEntity) error
 	FindByAggregateId(ctx context.Context, tenantId string, aggregateId string) (*[]model.SnapshotEntity, error)
-	FindByMaxSequenceNumber(ctx context.Context, tenantId string, aggregateId string, aggregateType string) (*model.SnapshotEntity, error)
+	FindByMaxSequenceNumber(ctx context.Context, tenantId string, aggregateId string, aggregateType string, aggregateVersion string, toSequenceNumber uint64) (*model.SnapshotEntity, error)
+	DeleteOlder(ctx context.Context, tenantId string, aggregateId string, aggregateType string, retainCount int64) error
+	CreateIndexes(ctx context.Context) error
+	Import(ctx context.Context, snapshots []*model.SnapshotEntity) error
+	DeleteByAggregateId(ctx context.Context, tenantId string, aggregateId string) error
 }
 
 func NewSnapshotService(mongodb *other.MongoDB, collection *mongo.Collection) SnapshotService {
@@ -39,6 +43,26 @@ func (s *snapshotService) FindByAggregateId(ctx context.Context, tenantId string
 	return s.repos.FindByAggregateId(ctx, tenantId, aggregateId)
 }
 
-func (s *snapshotService) FindByMaxSequenceNumber(ctx context.Context, tenantId string, aggregateId string, aggregateType string) (*model.SnapshotEntity, error) {
-	return s.repos.FindByMaxSequenceNumber(ctx, tenantId, aggregateId, aggregateType)
+func (s *snapshotService) FindByMaxSequenceNumber(ctx context.Context, tenantId string, aggregateId string, aggregateType string, aggregateVersion string, toSequenceNumber uint64) (*model.SnapshotEntity, error) {
+	return s.repos.FindByMaxSequenceNumber(ctx, tenantId, aggregateId, aggregateType, aggregateVersion, toSequenceNumber)
+}
+
+func (s *snapshotService) DeleteOlder(ctx context.Context, tenantId string, aggregateId string, aggregateType string, retainCount int64) error {
+	if retainCount <= 0 {
+		return nil
+	}
+	return s.repos.DeleteOlder(ctx, tenantId, aggregateId, aggregateType, retainCount)
+}
+
+func (s *snapshotService) CreateIndexes(ctx context.Context) error {
+	return s.repos.CreateIndexes(ctx)
+}
+
+// Import 保存导入的镜像，保留镜像的时间
+func (s *snapshotService) Import(ctx context.Context, snapshots []*model.SnapshotEntity) error {
+	return s.repos.InsertMany(ctx, snapshots)
+}
+
+func (s *snapshotService) DeleteByAggregateId(ctx context.Context, tenantId string, aggregateId string) error {
+	return s.repos.DeleteByAggregateId(ctx, tenantId, aggregateId)
 }
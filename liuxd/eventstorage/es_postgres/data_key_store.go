@@ -0,0 +1,72 @@
+package es_postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage"
+	"time"
+)
+
+//
+// dataKeyStore
+// @Description: 数据密钥表，与事件表分开保存，销毁密钥后保留销毁记录
+//
+type dataKeyStore struct {
+	db        *sql.DB
+	tableName string
+}
+
+func newDataKeyStore(db *sql.DB, tableName string) *dataKeyStore {
+	return &dataKeyStore{db: db, tableName: tableName}
+}
+
+func (s *dataKeyStore) GetDataKey(ctx context.Context, tenantId string, keyId string) (*eventstorage.DataKey, error) {
+	query := fmt.Sprintf(`SELECT key, erased, create_time, erase_time FROM %s WHERE tenant_id = $1 AND key_id = $2`, quote(s.tableName))
+	key := &eventstorage.DataKey{TenantId: tenantId, KeyId: keyId}
+	var eraseTime sql.NullTime
+	err := s.db.QueryRowContext(ctx, query, tenantId, keyId).Scan(&key.Key, &key.Erased, &key.CreateTime, &eraseTime)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if eraseTime.Valid {
+		key.EraseTime = &eraseTime.Time
+	}
+	return key, nil
+}
+
+//
+// CreateDataKey
+// @Description: 保存数据密钥，并发创建时以先写入的密钥为准
+// @receiver s
+// @param ctx
+// @param key
+// @return *eventstorage.DataKey
+// @return error
+//
+func (s *dataKeyStore) CreateDataKey(ctx context.Context, key *eventstorage.DataKey) (*eventstorage.DataKey, error) {
+	query := fmt.Sprintf(`INSERT INTO %s (tenant_id, key_id, key, erased, create_time) VALUES ($1, $2, $3, FALSE, $4)
+ON CONFLICT (tenant_id, key_id) DO NOTHING`, quote(s.tableName))
+	if _, err := s.db.ExecContext(ctx, query, key.TenantId, key.KeyId, key.Key, key.CreateTime); err != nil {
+		return nil, err
+	}
+	return s.GetDataKey(ctx, key.TenantId, key.KeyId)
+}
+
+//
+// EraseDataKey
+// @Description: 清除密钥并标记为已销毁，密钥不存在时写入销毁记录，之后不能再用该KeyId加密
+// @receiver s
+// @param ctx
+// @param tenantId
+// @param keyId
+// @return error
+//
+func (s *dataKeyStore) EraseDataKey(ctx context.Context, tenantId string, keyId string) error {
+	query := fmt.Sprintf(`INSERT INTO %s (tenant_id, key_id, key, erased, create_time, erase_time) VALUES ($1, $2, NULL, TRUE, $3, $3)
+ON CONFLICT (tenant_id, key_id) DO UPDATE SET key = NULL, erased = TRUE, erase_time = EXCLUDED.erase_time`, quote(s.tableName))
+	_, err := s.db.ExecContext(ctx, query, tenantId, keyId, time.Now())
+	return err
+}
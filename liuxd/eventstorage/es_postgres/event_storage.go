@@ -0,0 +1,1830 @@
+package es_postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dapr/kit/logger"
+	"github.com/liuxd6825/components-contrib/liuxd/common"
+	"github.com/liuxd6825/components-contrib/liuxd/common/rsql"
+	"github.com/liuxd6825/components-contrib/liuxd/common/utils"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/model"
+	"github.com/liuxd6825/components-contrib/pubsub"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	// Blank import for the underlying PostgreSQL driver.
+	_ "github.com/jackc/pgx/v4/stdlib"
+)
+
+// uniqueViolation PostgreSQL唯一约束冲突的错误码
+const uniqueViolation = "23505"
+
+//
+// EventStorage
+// @Description: PostgreSQL领域事件存储
+//
+type EventStorage struct {
+	db               *sql.DB
+	log              logger.Logger
+	metadata         *storageMetadata
+	getPubsubAdapter eventstorage.GetPubsubAdapter
+	relationTables   sync.Map
+	upcasters        *eventstorage.UpcasterRegistry
+	schemas          *eventstorage.SchemaRegistry
+	dedupeWindow     time.Duration
+	dataKeys         *dataKeyStore
+	encryptor        *eventstorage.FieldEncryptor
+}
+
+// NewPostgresEventStorage 创建
+func NewPostgresEventStorage(log logger.Logger) eventstorage.EventStorage {
+	return &EventStorage{log: log}
+}
+
+//
+// Init
+// @Description: 初始化，连接数据库并创建表
+// @receiver s
+// @param metadata
+// @param adapter
+// @return error
+//
+func (s *EventStorage) Init(metadata common.Metadata, adapter eventstorage.GetPubsubAdapter) error {
+	s.getPubsubAdapter = adapter
+	meta, err := getStorageMetadata(metadata)
+	if err != nil {
+		return err
+	}
+	s.metadata = meta
+	if s.upcasters, err = eventstorage.NewUpcasterRegistryFromMetadata(metadata); err != nil {
+		return err
+	}
+	if s.schemas, err = eventstorage.NewSchemaRegistryFromMetadata(metadata); err != nil {
+		return err
+	}
+	if s.dedupeWindow, err = eventstorage.GetCommandDedupeWindow(metadata); err != nil {
+		return err
+	}
+
+	db, err := sql.Open("pgx", meta.ConnectionString)
+	if err != nil {
+		return err
+	}
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("error in connecting to postgresql: %s", err)
+	}
+	s.db = db
+	s.dataKeys = newDataKeyStore(db, meta.DataKeyTableName)
+	if s.encryptor, err = eventstorage.NewFieldEncryptorFromMetadata(metadata, s.dataKeys); err != nil {
+		return err
+	}
+	return s.ensureSchema(context.Background())
+}
+
+func (s *EventStorage) Close() error {
+	if s.db != nil {
+		return s.db.Close()
+	}
+	return nil
+}
+
+//
+// LoadEvent
+// @Description: 加载最新的镜像及其之后的事件
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.LoadResponse
+// @return error
+//
+func (s *EventStorage) LoadEvent(ctx context.Context, req *eventstorage.LoadEventRequest) (*eventstorage.LoadResponse, error) {
+	toSequenceNumber := req.ToSequenceNumber
+	if req.ToTime != nil {
+		query := fmt.Sprintf(`SELECT COALESCE(MAX(sequence_number), 0) FROM %s WHERE tenant_id = $1 AND aggregate_id = $2 AND aggregate_type = $3 AND time_stamp <= $4`,
+			quote(s.metadata.EventTableName))
+		var lastSequenceNumber uint64
+		if err := s.db.QueryRowContext(ctx, query, req.TenantId, req.AggregateId, req.AggregateType, *req.ToTime).Scan(&lastSequenceNumber); err != nil {
+			return nil, newError("findLastByTime() error taking event.", err)
+		}
+		if lastSequenceNumber == 0 {
+			// 指定时间之前聚合根还不存在
+			eventDtos := make([]eventstorage.LoadResponseEventDto, 0)
+			return &eventstorage.LoadResponse{TenantId: req.TenantId, AggregateId: req.AggregateId, AggregateType: req.AggregateType, Events: &eventDtos}, nil
+		}
+		if toSequenceNumber == 0 || lastSequenceNumber < toSequenceNumber {
+			toSequenceNumber = lastSequenceNumber
+		}
+	}
+
+	sequenceNumber := uint64(0)
+	snapshot, err := s.findSnapshotByMaxSequenceNumber(ctx, req.TenantId, req.AggregateId, req.AggregateType, req.AggregateVersion, toSequenceNumber)
+	if err != nil {
+		return nil, newError("findByMaxSequenceNumber() error taking snapshot.", err)
+	}
+	var snapshotDto *eventstorage.LoadResponseSnapshotDto
+	if snapshot != nil {
+		sequenceNumber = snapshot.SequenceNumber
+		snapshotDto = &eventstorage.LoadResponseSnapshotDto{
+			AggregateData:    snapshot.AggregateData,
+			AggregateVersion: snapshot.AggregateVersion,
+			SequenceNumber:   snapshot.SequenceNumber,
+			Metadata:         snapshot.Metadata,
+		}
+	}
+
+	query := fmt.Sprintf(`SELECT %s FROM %s WHERE tenant_id = $1 AND aggregate_id = $2 AND aggregate_type = $3 AND sequence_number > $4
+AND ($5 = 0 OR sequence_number <= $5) ORDER BY sequence_number`, eventColumns, quote(s.metadata.EventTableName))
+	events, err := s.queryEvents(ctx, s.db, query, req.TenantId, req.AggregateId, req.AggregateType, sequenceNumber, toSequenceNumber)
+	if err != nil {
+		return nil, newError("findBySequenceNumber() error taking events.", err)
+	}
+	if err := s.decryptEvents(ctx, events); err != nil {
+		return nil, newError("decryptEvents() error.", err)
+	}
+	if err := s.upcastEvents(events); err != nil {
+		return nil, newError("upcastEvents() error.", err)
+	}
+	eventDtos := make([]eventstorage.LoadResponseEventDto, len(events))
+	for i, event := range events {
+		eventDtos[i] = eventstorage.LoadResponseEventDto{
+			EventId:        event.EventId,
+			EventData:      event.EventData,
+			EventType:      event.EventType,
+			EventVersion:   event.EventVersion,
+			SequenceNumber: event.SequenceNumber,
+		}
+	}
+	return &eventstorage.LoadResponse{
+		TenantId:      req.TenantId,
+		AggregateId:   req.AggregateId,
+		AggregateType: req.AggregateType,
+		Snapshot:      snapshotDto,
+		Events:        &eventDtos,
+	}, nil
+}
+
+//
+// CreateEvent
+// @Description: 创建聚合根并应用领域事件
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.CreateEventResponse
+// @return error
+//
+func (s *EventStorage) CreateEvent(ctx context.Context, req *eventstorage.CreateEventRequest) (*eventstorage.CreateEventResponse, error) {
+	if err := s.schemas.ValidateEvents(req.AggregateType, req.Events); err != nil {
+		return nil, err
+	}
+	events, err := s.newEvents(req.TenantId, req.AggregateId, req.AggregateType, req.Events, 1)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.ensureRelationTables(ctx, req.AggregateType, req.Events); err != nil {
+		return nil, err
+	}
+	err = s.withTransaction(ctx, func(tx *sql.Tx) error {
+		commandEvents, err := s.findCommandEvents(ctx, tx, req.TenantId, req.AggregateId, req.GetCommandId())
+		if err != nil || len(commandEvents) > 0 {
+			// 命令已处理，返回首次处理的结果
+			events = nil
+			return err
+		}
+		query := fmt.Sprintf(`INSERT INTO %s (tenant_id, aggregate_id, aggregate_type, sequence_number, deleted) VALUES ($1, $2, $3, $4, FALSE) ON CONFLICT DO NOTHING`,
+			quote(s.metadata.AggregateTableName))
+		res, err := tx.ExecContext(ctx, query, req.TenantId, req.AggregateId, req.AggregateType, len(events))
+		if err != nil {
+			return err
+		}
+		if rows, err := res.RowsAffected(); err != nil {
+			return err
+		} else if rows == 0 {
+			return errors.New(fmt.Sprintf("aggregateId \"%s\" already exists", req.AggregateId))
+		}
+		return s.saveEvents(ctx, tx, events)
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.publishEvents(ctx, events)
+	return &eventstorage.CreateEventResponse{}, nil
+}
+
+//
+// DeleteEvent
+// @Description: 删除聚合根，并保存删除事件
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.DeleteEventResponse
+// @return error
+//
+func (s *EventStorage) DeleteEvent(ctx context.Context, req *eventstorage.DeleteEventRequest) (*eventstorage.DeleteEventResponse, error) {
+	if req.Event == nil {
+		return nil, errors.New("events is nil")
+	}
+	if err := s.schemas.Validate(req.AggregateType, req.Event); err != nil {
+		return nil, err
+	}
+	// 删除与恢复时更新关系的删除标记，总是创建关系表
+	if err := s.ensureRelationTable(ctx, utils.AsMongoName(req.AggregateType)); err != nil {
+		return nil, err
+	}
+	var events []*model.EventEntity
+	err := s.withTransaction(ctx, func(tx *sql.Tx) error {
+		agg, err := s.lockAggregate(ctx, tx, req.TenantId, req.AggregateId)
+		if err != nil {
+			return err
+		}
+		if agg == nil {
+			return errors.New(fmt.Sprintf("aggregate id \"%s\" not found", req.AggregateId))
+		}
+		if agg.Deleted {
+			return errors.New(fmt.Sprintf("aggregate id \"%s\" is deleted", req.AggregateId))
+		}
+		if err := checkSequenceNumber(agg, req.ExpectedSequenceNumber); err != nil {
+			return err
+		}
+		events, err = s.newEvents(req.TenantId, req.AggregateId, req.AggregateType, &[]eventstorage.EventDto{*req.Event}, agg.SequenceNumber+1)
+		if err != nil {
+			return err
+		}
+		if err := s.updateAggregate(ctx, tx, agg, agg.SequenceNumber+1, true); err != nil {
+			return err
+		}
+		if err := s.saveEvents(ctx, tx, events); err != nil {
+			return err
+		}
+		return s.updateRelationDeleted(ctx, tx, req.TenantId, req.AggregateId, req.AggregateType, true)
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.publishEvents(ctx, events)
+	return &eventstorage.DeleteEventResponse{}, nil
+}
+
+//
+// ApplyEvent
+// @Description: 应用多个领域事件，锁定聚合根行保证SequenceNumber连续
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.ApplyEventsResponse
+// @return error
+//
+func (s *EventStorage) ApplyEvent(ctx context.Context, req *eventstorage.ApplyEventsRequest) (*eventstorage.ApplyEventsResponse, error) {
+	if req == nil {
+		return nil, errors.New("request is nil")
+	}
+	if req.Events == nil || len(*req.Events) == 0 {
+		return nil, errors.New("request.events size 0 ")
+	}
+	if err := s.schemas.ValidateEvents(req.AggregateType, req.Events); err != nil {
+		return nil, err
+	}
+	if err := s.ensureRelationTables(ctx, req.AggregateType, req.Events); err != nil {
+		return nil, err
+	}
+	var events []*model.EventEntity
+	var sequenceNumber uint64
+	err := s.withTransaction(ctx, func(tx *sql.Tx) error {
+		agg, err := s.lockAggregate(ctx, tx, req.TenantId, req.AggregateId)
+		if err != nil {
+			return err
+		}
+		commandEvents, err := s.findCommandEvents(ctx, tx, req.TenantId, req.AggregateId, req.GetCommandId())
+		if err != nil {
+			return err
+		}
+		if len(commandEvents) > 0 {
+			// 命令已处理，返回首次处理的结果
+			sequenceNumber = commandEvents[len(commandEvents)-1].SequenceNumber
+			return nil
+		}
+		if agg == nil {
+			return errors.New(fmt.Sprintf("aggregate idValue %s does not exist", req.AggregateId))
+		}
+		if err := checkSequenceNumber(agg, req.ExpectedSequenceNumber); err != nil {
+			return err
+		}
+		if agg.Deleted {
+			return errors.New(fmt.Sprintf("aggregate id \"%s\" is already deleted.", req.AggregateId))
+		}
+		events, err = s.newEvents(req.TenantId, req.AggregateId, req.AggregateType, req.Events, agg.SequenceNumber+1)
+		if err != nil {
+			return err
+		}
+		sequenceNumber = agg.SequenceNumber + uint64(len(events))
+		if err := s.updateAggregate(ctx, tx, agg, sequenceNumber, false); err != nil {
+			return err
+		}
+		return s.saveEvents(ctx, tx, events)
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.publishEvents(ctx, events)
+	return &eventstorage.ApplyEventsResponse{SequenceNumber: sequenceNumber}, nil
+}
+
+//
+// SaveSnapshot
+// @Description: 保存聚合镜像对象
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.SaveSnapshotResponse
+// @return error
+//
+func (s *EventStorage) SaveSnapshot(ctx context.Context, req *eventstorage.SaveSnapshotRequest) (*eventstorage.SaveSnapshotResponse, error) {
+	aggregateData, err := toJson(req.AggregateData)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := toJson(req.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf(`INSERT INTO %s (id, tenant_id, aggregate_id, aggregate_type, aggregate_data, aggregate_version, sequence_number, metadata, time_stamp)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`, quote(s.metadata.SnapshotTableName))
+	_, err = s.db.ExecContext(ctx, query, model.NewObjectID(), req.TenantId, req.AggregateId, req.AggregateType,
+		aggregateData, req.AggregateVersion, req.SequenceNumber, metadata, time.Now())
+	if err != nil {
+		return nil, newError("SnapshotService.Create(). error saving snapshot.", err)
+	}
+	return &eventstorage.SaveSnapshotResponse{}, nil
+}
+
+//
+// GetRelations
+// @Description: 分页查询聚合根关系，过滤与排序使用rsql
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.GetRelationsResponse
+// @return error
+//
+func (s *EventStorage) GetRelations(ctx context.Context, req *eventstorage.GetRelationsRequest) (*eventstorage.GetRelationsResponse, error) {
+	tableName := utils.AsMongoName(req.AggregateType)
+	if err := s.ensureRelationTable(ctx, tableName); err != nil {
+		return nil, err
+	}
+	where, args, err := getWhere(req.TenantId, req.Filter, relationColumn)
+	if err != nil {
+		return nil, err
+	}
+	if !req.IncludeDeleted {
+		where += " AND is_deleted = FALSE"
+	}
+	orderBy, err := getOrderBy(req.Sort, relationColumn)
+	if err != nil {
+		return nil, err
+	}
+
+	var totalRows uint64
+	countQuery := fmt.Sprintf(`SELECT COUNT(*) FROM %s WHERE %s`, quote(tableName), where)
+	if err := s.db.QueryRowContext(ctx, countQuery, args...).Scan(&totalRows); err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf(`SELECT id, tenant_id, table_name, aggregate_id, is_deleted, items FROM %s WHERE %s%s%s`,
+		quote(tableName), where, orderBy, getLimit(req.PageNum, req.PageSize))
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var relations []*eventstorage.Relation
+	for rows.Next() {
+		var items []byte
+		rel := &eventstorage.Relation{}
+		if err := rows.Scan(&rel.Id, &rel.TenantId, &rel.TableName, &rel.AggregateId, &rel.IsDeleted, &items); err != nil {
+			return nil, err
+		}
+		if err := fromRelationItemsJson(items, &rel.Items, &rel.Lists); err != nil {
+			return nil, err
+		}
+		relations = append(relations, rel)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	findRes := eventstorage.NewFindPagingResult[*eventstorage.Relation](&relations, totalRows, req, nil)
+	return &eventstorage.GetRelationsResponse{
+		Data:       relations,
+		TotalRows:  findRes.TotalRows,
+		TotalPages: findRes.TotalPages,
+		PageSize:   findRes.PageSize,
+		PageNum:    findRes.PageNum,
+		Filter:     findRes.Filter,
+		Sort:       findRes.Sort,
+	}, nil
+}
+
+//
+// FindEvents
+// @Description: 分页查询事件及发送状态，过滤与排序使用rsql
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.FindEventsResponse
+// @return error
+//
+func (s *EventStorage) FindEvents(ctx context.Context, req *eventstorage.FindEventsRequest) (*eventstorage.FindEventsResponse, error) {
+	if req.TenantId == "" {
+		return nil, errors.New("tenantId cannot be empty")
+	}
+	where, args, err := getWhere(req.TenantId, req.Filter, eventColumn)
+	if err != nil {
+		return nil, err
+	}
+	orderBy, err := getOrderBy(req.Sort, eventColumn)
+	if err != nil {
+		return nil, err
+	}
+	tableName := quote(s.metadata.EventTableName)
+
+	var totalRows uint64
+	countQuery := fmt.Sprintf(`SELECT COUNT(*) FROM %s WHERE %s`, tableName, where)
+	if err := s.db.QueryRowContext(ctx, countQuery, args...).Scan(&totalRows); err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf(`SELECT %s FROM %s WHERE %s%s%s`, eventColumns, tableName, where, orderBy, getLimit(req.PageNum, req.PageSize))
+	events, err := s.queryEvents(ctx, s.db, query, args...)
+	if err != nil {
+		return nil, newError("findEvents() error taking events.", err)
+	}
+	if err := s.decryptEvents(ctx, events); err != nil {
+		return nil, newError("decryptEvents() error.", err)
+	}
+	if err := s.upcastEvents(events); err != nil {
+		return nil, newError("upcastEvents() error.", err)
+	}
+	var data []*eventstorage.FindEventDto
+	for _, event := range events {
+		data = append(data, event.NewFindEventDto())
+	}
+	return eventstorage.NewFindEventsResponse(data, totalRows, req), nil
+}
+
+//
+// FindAggregates
+// @Description: 分页查询聚合根，过滤与排序使用rsql
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.FindAggregatesResponse
+// @return error
+//
+func (s *EventStorage) FindAggregates(ctx context.Context, req *eventstorage.FindAggregatesRequest) (*eventstorage.FindAggregatesResponse, error) {
+	if req.TenantId == "" {
+		return nil, errors.New("tenantId cannot be empty")
+	}
+	where, args, err := getAggregateWhere(req.TenantId, req.AggregateType, req.Filter)
+	if err != nil {
+		return nil, err
+	}
+	orderBy, err := getOrderBy(req.Sort, aggregateColumn)
+	if err != nil {
+		return nil, err
+	}
+	if orderBy == "" {
+		orderBy = " ORDER BY aggregate_id"
+	}
+	tableName := quote(s.metadata.AggregateTableName)
+
+	var totalRows uint64
+	countQuery := fmt.Sprintf(`SELECT COUNT(*) FROM %s WHERE %s`, tableName, where)
+	if err := s.db.QueryRowContext(ctx, countQuery, args...).Scan(&totalRows); err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf(`SELECT tenant_id, aggregate_id, aggregate_type, sequence_number, deleted FROM %s WHERE %s%s%s`,
+		tableName, where, orderBy, getLimit(req.PageNum, req.PageSize))
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var aggregates []*eventstorage.AggregateDto
+	for rows.Next() {
+		agg := &eventstorage.AggregateDto{}
+		if err := rows.Scan(&agg.TenantId, &agg.AggregateId, &agg.AggregateType, &agg.SequenceNumber, &agg.Deleted); err != nil {
+			return nil, err
+		}
+		aggregates = append(aggregates, agg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return eventstorage.NewFindAggregatesResponse(aggregates, totalRows, req), nil
+}
+
+//
+// CountAggregates
+// @Description: 统计租户的聚合根数量
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.CountAggregatesResponse
+// @return error
+//
+func (s *EventStorage) CountAggregates(ctx context.Context, req *eventstorage.CountAggregatesRequest) (*eventstorage.CountAggregatesResponse, error) {
+	if req.TenantId == "" {
+		return nil, errors.New("tenantId cannot be empty")
+	}
+	where, args, err := getAggregateWhere(req.TenantId, req.AggregateType, req.Filter)
+	if err != nil {
+		return nil, err
+	}
+	res := &eventstorage.CountAggregatesResponse{}
+	query := fmt.Sprintf(`SELECT COUNT(*) FROM %s WHERE %s`, quote(s.metadata.AggregateTableName), where)
+	if err := s.db.QueryRowContext(ctx, query, args...).Scan(&res.Count); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+//
+// ExistAggregate
+// @Description: 聚合根是否存在，已删除的聚合根IsExist也为true
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.ExistAggregateResponse
+// @return error
+//
+func (s *EventStorage) ExistAggregate(ctx context.Context, req *eventstorage.ExistAggregateRequest) (*eventstorage.ExistAggregateResponse, error) {
+	query := fmt.Sprintf(`SELECT deleted FROM %s WHERE tenant_id = $1 AND aggregate_id = $2`, quote(s.metadata.AggregateTableName))
+	res := &eventstorage.ExistAggregateResponse{}
+	err := s.db.QueryRowContext(ctx, query, req.TenantId, req.AggregateId).Scan(&res.IsDeleted)
+	if err == sql.ErrNoRows {
+		return res, nil
+	} else if err != nil {
+		return nil, err
+	}
+	res.IsExist = true
+	return res, nil
+}
+
+//
+// RestoreAggregate
+// @Description: 恢复已删除的聚合根，并保存与发送恢复事件
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.RestoreAggregateResponse
+// @return error
+//
+func (s *EventStorage) RestoreAggregate(ctx context.Context, req *eventstorage.RestoreAggregateRequest) (*eventstorage.RestoreAggregateResponse, error) {
+	if req.Event == nil {
+		return nil, errors.New("events is nil")
+	}
+	if err := s.schemas.Validate(req.AggregateType, req.Event); err != nil {
+		return nil, err
+	}
+	// 删除与恢复时更新关系的删除标记，总是创建关系表
+	if err := s.ensureRelationTable(ctx, utils.AsMongoName(req.AggregateType)); err != nil {
+		return nil, err
+	}
+	var events []*model.EventEntity
+	err := s.withTransaction(ctx, func(tx *sql.Tx) error {
+		agg, err := s.lockAggregate(ctx, tx, req.TenantId, req.AggregateId)
+		if err != nil {
+			return err
+		}
+		if agg == nil {
+			return errors.New(fmt.Sprintf("aggregate id \"%s\" not found", req.AggregateId))
+		}
+		if !agg.Deleted {
+			return errors.New(fmt.Sprintf("aggregate id \"%s\" is not deleted", req.AggregateId))
+		}
+		if err := checkSequenceNumber(agg, req.ExpectedSequenceNumber); err != nil {
+			return err
+		}
+		events, err = s.newEvents(req.TenantId, req.AggregateId, req.AggregateType, &[]eventstorage.EventDto{*req.Event}, agg.SequenceNumber+1)
+		if err != nil {
+			return err
+		}
+		if err := s.updateAggregate(ctx, tx, agg, agg.SequenceNumber+1, false); err != nil {
+			return err
+		}
+		if err := s.saveEvents(ctx, tx, events); err != nil {
+			return err
+		}
+		return s.updateRelationDeleted(ctx, tx, req.TenantId, req.AggregateId, req.AggregateType, false)
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.publishEvents(ctx, events)
+	return &eventstorage.RestoreAggregateResponse{SequenceNumber: events[0].SequenceNumber}, nil
+}
+
+//
+// ExportEvents
+// @Description: 按聚合根Id顺序导出租户的聚合根、事件、镜像与关系，事件数据解密后导出，不转换版本
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.ExportEventsResponse
+// @return error
+//
+func (s *EventStorage) ExportEvents(ctx context.Context, req *eventstorage.ExportEventsRequest) (*eventstorage.ExportEventsResponse, error) {
+	w, err := eventstorage.NewExportWriter(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.exportEvents(ctx, w, req.TenantId, req.AggregateType); err != nil {
+		_ = w.Close()
+		return nil, newError("exportEvents() error.", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return w.Response(), nil
+}
+
+func (s *EventStorage) exportEvents(ctx context.Context, w *eventstorage.ExportWriter, tenantId string, aggregateType string) error {
+	where, args, err := getAggregateWhere(tenantId, aggregateType, "")
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf(`SELECT tenant_id, aggregate_id, aggregate_type, sequence_number, deleted, sequence_gaps FROM %s WHERE %s ORDER BY aggregate_id`,
+		quote(s.metadata.AggregateTableName), where)
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	var aggs []*model.AggregateEntity
+	for rows.Next() {
+		agg := &model.AggregateEntity{}
+		var sequenceGaps []byte
+		if err := rows.Scan(&agg.TenantId, &agg.AggregateId, &agg.AggregateType, &agg.SequenceNumber, &agg.Deleted, &sequenceGaps); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		if err := fromJson(sequenceGaps, &agg.SequenceGaps); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		agg.Id = agg.AggregateId
+		aggs = append(aggs, agg)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	eventQuery := fmt.Sprintf(`SELECT %s FROM %s WHERE tenant_id = $1 AND aggregate_id = $2 ORDER BY sequence_number`,
+		eventColumns, quote(s.metadata.EventTableName))
+	for _, agg := range aggs {
+		events, err := s.queryEvents(ctx, s.db, eventQuery, agg.TenantId, agg.AggregateId)
+		if err != nil {
+			return err
+		}
+		if err := s.decryptEvents(ctx, events); err != nil {
+			return err
+		}
+		snapshots, err := s.findSnapshots(ctx, agg.TenantId, agg.AggregateId)
+		if err != nil {
+			return err
+		}
+		relation, err := s.findRelation(ctx, utils.AsMongoName(agg.AggregateType), agg.TenantId, agg.AggregateId)
+		if err != nil {
+			return err
+		}
+		if err := w.Write(model.NewExportAggregate(agg, events, snapshots, relation)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// ImportEvents
+// @Description: 导入ExportEvents导出的文件，每个聚合根在一个事务中导入，事件重新分配全局位置，事件数据按encryptFields重新加密。
+// 导入失败时返回已导入的数量、失败的聚合根与错误，已导入的聚合根不回滚，可使用SkipExisting继续导入。
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.ImportEventsResponse
+// @return error
+//
+func (s *EventStorage) ImportEvents(ctx context.Context, req *eventstorage.ImportEventsRequest) (*eventstorage.ImportEventsResponse, error) {
+	r, err := eventstorage.NewExportReader(req)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	for {
+		agg, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return r.Response(), err
+		}
+		entities := model.NewImportEntities(agg)
+		if err := entities.Encrypt(ctx, s.encryptor); err != nil {
+			r.Failed(agg)
+			return r.Response(), newError("encryptEvents() error.", err)
+		}
+		imported, err := s.importAggregate(ctx, entities, req.Overwrite, req.SkipExisting)
+		if err != nil {
+			r.Failed(agg)
+			return r.Response(), newError("importAggregate() error.", err)
+		}
+		if !imported {
+			r.Skipped(agg)
+			continue
+		}
+		r.Imported(agg)
+	}
+	return r.Response(), nil
+}
+
+//
+// importAggregate
+// @Description: 在一个事务中导入一个聚合根
+// @receiver s
+// @param ctx
+// @param entities
+// @param overwrite 聚合根已存在时是否删除后导入
+// @param skipExisting 聚合根已存在时是否跳过
+// @return bool 聚合根已存在并跳过时为false
+// @return error
+//
+func (s *EventStorage) importAggregate(ctx context.Context, entities *model.ImportEntities, overwrite bool, skipExisting bool) (bool, error) {
+	if err := entities.Validate(); err != nil {
+		return false, err
+	}
+	agg := entities.Aggregate
+	if err := s.ensureRelationTable(ctx, utils.AsMongoName(agg.AggregateType)); err != nil {
+		return false, err
+	}
+	for _, relation := range entities.Relations {
+		if err := s.ensureRelationTable(ctx, relation.TableName); err != nil {
+			return false, err
+		}
+	}
+	imported := false
+	err := s.withTransaction(ctx, func(tx *sql.Tx) error {
+		imported = false
+		old, err := s.lockAggregate(ctx, tx, agg.TenantId, agg.AggregateId)
+		if err != nil {
+			return err
+		}
+		if old != nil {
+			if skipExisting {
+				return nil
+			}
+			if !overwrite {
+				return errors.New(fmt.Sprintf("aggregate id \"%s\" already exists", agg.AggregateId))
+			}
+			if err := s.removeAggregate(ctx, tx, old); err != nil {
+				return err
+			}
+		}
+		sequenceGaps, err := toJson(agg.SequenceGaps)
+		if err != nil {
+			return err
+		}
+		query := fmt.Sprintf(`INSERT INTO %s (tenant_id, aggregate_id, aggregate_type, sequence_number, deleted, sequence_gaps) VALUES ($1, $2, $3, $4, $5, $6)`,
+			quote(s.metadata.AggregateTableName))
+		if _, err := tx.ExecContext(ctx, query, agg.TenantId, agg.AggregateId, agg.AggregateType, agg.SequenceNumber, agg.Deleted, sequenceGaps); err != nil {
+			return err
+		}
+		if len(entities.Events) > 0 {
+			if err := s.saveEvents(ctx, tx, entities.Events); err != nil {
+				return err
+			}
+		}
+		if err := s.insertSnapshots(ctx, tx, entities.Snapshots); err != nil {
+			return err
+		}
+		// 事件中的关系已合并保存，按导出的关系覆盖
+		for _, relation := range entities.Relations {
+			if err := s.deleteRelation(ctx, tx, relation.TableName, relation.TenantId, relation.Id); err != nil {
+				return err
+			}
+			if err := s.saveRelation(ctx, tx, relation); err != nil {
+				return err
+			}
+		}
+		imported = true
+		return nil
+	})
+	return imported, err
+}
+
+// removeAggregate 删除聚合根及其事件、镜像与关系
+func (s *EventStorage) removeAggregate(ctx context.Context, tx *sql.Tx, agg *model.AggregateEntity) error {
+	for _, tableName := range []string{s.metadata.EventTableName, s.metadata.SnapshotTableName, s.metadata.AggregateTableName} {
+		query := fmt.Sprintf(`DELETE FROM %s WHERE tenant_id = $1 AND aggregate_id = $2`, quote(tableName))
+		if _, err := tx.ExecContext(ctx, query, agg.TenantId, agg.AggregateId); err != nil {
+			return err
+		}
+	}
+	return s.deleteRelation(ctx, tx, utils.AsMongoName(agg.AggregateType), agg.TenantId, agg.AggregateId)
+}
+
+//
+// EraseDataKey
+// @Description: 销毁数据密钥，事件保持不变，加密字段读取时为nil。
+// 同时删除Id与KeyId相同的聚合根的镜像，以及事件metadata的dataKeyId为KeyId的聚合根的镜像。
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.EraseDataKeyResponse
+// @return error
+//
+func (s *EventStorage) EraseDataKey(ctx context.Context, req *eventstorage.EraseDataKeyRequest) (*eventstorage.EraseDataKeyResponse, error) {
+	if req.TenantId == "" || req.KeyId == "" {
+		return nil, errors.New("tenantId and keyId cannot be empty")
+	}
+	if err := s.dataKeys.EraseDataKey(ctx, req.TenantId, req.KeyId); err != nil {
+		return nil, newError("eraseDataKey() error.", err)
+	}
+	query := fmt.Sprintf(`DELETE FROM %s WHERE tenant_id = $1 AND (aggregate_id = $2 OR aggregate_id IN (
+SELECT DISTINCT aggregate_id FROM %s WHERE tenant_id = $1 AND metadata ->> '%s' = $2))`,
+		quote(s.metadata.SnapshotTableName), quote(s.metadata.EventTableName), eventstorage.DataKeyIdMetadataKey)
+	if _, err := s.db.ExecContext(ctx, query, req.TenantId, req.KeyId); err != nil {
+		return nil, newError("deleteByAggregateId() error deleting snapshots.", err)
+	}
+	return &eventstorage.EraseDataKeyResponse{}, nil
+}
+
+func (s *EventStorage) insertSnapshots(ctx context.Context, tx *sql.Tx, snapshots []*model.SnapshotEntity) error {
+	query := fmt.Sprintf(`INSERT INTO %s (id, tenant_id, aggregate_id, aggregate_type, aggregate_data, aggregate_version, sequence_number, metadata, time_stamp)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`, quote(s.metadata.SnapshotTableName))
+	for _, snapshot := range snapshots {
+		aggregateData, err := toJson(snapshot.AggregateData)
+		if err != nil {
+			return err
+		}
+		metadata, err := toJson(snapshot.Metadata)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, query, snapshot.Id, snapshot.TenantId, snapshot.AggregateId, snapshot.AggregateType,
+			aggregateData, snapshot.AggregateVersion, snapshot.SequenceNumber, metadata, snapshot.TimeStamp.Time())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *EventStorage) findSnapshots(ctx context.Context, tenantId, aggregateId string) ([]*model.SnapshotEntity, error) {
+	query := fmt.Sprintf(`SELECT id, aggregate_type, aggregate_data, aggregate_version, sequence_number, metadata, time_stamp FROM %s
+WHERE tenant_id = $1 AND aggregate_id = $2 ORDER BY sequence_number`, quote(s.metadata.SnapshotTableName))
+	rows, err := s.db.QueryContext(ctx, query, tenantId, aggregateId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []*model.SnapshotEntity
+	for rows.Next() {
+		snapshot := &model.SnapshotEntity{TenantId: tenantId, AggregateId: aggregateId}
+		var aggregateData, metadata []byte
+		var timeStamp time.Time
+		if err := rows.Scan(&snapshot.Id, &snapshot.AggregateType, &aggregateData, &snapshot.AggregateVersion,
+			&snapshot.SequenceNumber, &metadata, &timeStamp); err != nil {
+			return nil, err
+		}
+		if err := fromJson(aggregateData, &snapshot.AggregateData); err != nil {
+			return nil, err
+		}
+		if err := fromJson(metadata, &snapshot.Metadata); err != nil {
+			return nil, err
+		}
+		snapshot.TimeStamp = model.NewDateTime(timeStamp)
+		list = append(list, snapshot)
+	}
+	return list, rows.Err()
+}
+
+// findRelation 查询聚合根的关系，不存在时返回nil
+func (s *EventStorage) findRelation(ctx context.Context, tableName, tenantId, id string) (*model.RelationEntity, error) {
+	if err := s.ensureRelationTable(ctx, tableName); err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf(`SELECT table_name, aggregate_id, is_deleted, items FROM %s WHERE tenant_id = $1 AND id = $2`, quote(tableName))
+	relation := &model.RelationEntity{Id: id, TenantId: tenantId}
+	var items []byte
+	err := s.db.QueryRowContext(ctx, query, tenantId, id).Scan(&relation.TableName, &relation.AggregateId, &relation.IsDeleted, &items)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := fromRelationItemsJson(items, (*map[string]string)(&relation.Items), (*map[string][]string)(&relation.Lists)); err != nil {
+		return nil, err
+	}
+	return relation, nil
+}
+
+//
+// updateRelationDeleted
+// @Description: 与es_mongo的flag删除模式一致，删除聚合根时标记关系已删除，恢复时取消标记。关系表需在事务开始前创建
+// @receiver s
+// @param ctx
+// @param tx
+// @param tenantId
+// @param aggregateId
+// @param aggregateType
+// @param isDeleted
+// @return error
+//
+func (s *EventStorage) updateRelationDeleted(ctx context.Context, tx *sql.Tx, tenantId, aggregateId, aggregateType string, isDeleted bool) error {
+	query := fmt.Sprintf(`UPDATE %s SET is_deleted = $3 WHERE tenant_id = $1 AND id = $2`, quote(utils.AsMongoName(aggregateType)))
+	_, err := tx.ExecContext(ctx, query, tenantId, aggregateId, isDeleted)
+	return err
+}
+
+func (s *EventStorage) deleteRelation(ctx context.Context, tx *sql.Tx, tableName, tenantId, id string) error {
+	query := fmt.Sprintf(`DELETE FROM %s WHERE tenant_id = $1 AND id = $2`, quote(tableName))
+	_, err := tx.ExecContext(ctx, query, tenantId, id)
+	return err
+}
+
+//
+// FindRelationReferences
+// @Description: 与es_mongo一致，按表名、Id顺序跨关系表反向查询引用目标Id的关系，多值关系包含目标Id即匹配
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.FindRelationReferencesResponse
+// @return error
+//
+func (s *EventStorage) FindRelationReferences(ctx context.Context, req *eventstorage.FindRelationReferencesRequest) (*eventstorage.FindRelationReferencesResponse, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	aggregateTypes := req.AggregateTypes
+	if len(aggregateTypes) == 0 {
+		var err error
+		if aggregateTypes, err = s.findAggregateTypes(ctx, req.TenantId); err != nil {
+			return nil, err
+		}
+	}
+	tableNames := eventstorage.NewRelationTableNames(aggregateTypes)
+	if len(tableNames) == 0 {
+		return eventstorage.NewFindRelationReferencesResponse(nil, 0, req), nil
+	}
+
+	where := "tenant_id = $1 AND items -> $2 @> to_jsonb($3::text)"
+	if !req.IncludeDeleted {
+		where += " AND is_deleted = FALSE"
+	}
+	selects := make([]string, len(tableNames))
+	for i, tableName := range tableNames {
+		if err := s.ensureRelationTable(ctx, tableName); err != nil {
+			return nil, err
+		}
+		selects[i] = fmt.Sprintf(`SELECT id, tenant_id, table_name, aggregate_id, is_deleted, items FROM %s WHERE %s`, quote(tableName), where)
+	}
+	union := strings.Join(selects, " UNION ALL ")
+	args := []interface{}{req.TenantId, utils.AsMongoName(req.RelationName), req.TargetId}
+
+	var totalRows uint64
+	countQuery := fmt.Sprintf(`SELECT COUNT(*) FROM (%s) t`, union)
+	if err := s.db.QueryRowContext(ctx, countQuery, args...).Scan(&totalRows); err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf(`%s ORDER BY table_name, id%s`, union, getLimit(req.PageNum, req.PageSize))
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var relations []*eventstorage.Relation
+	for rows.Next() {
+		var items []byte
+		rel := &eventstorage.Relation{}
+		if err := rows.Scan(&rel.Id, &rel.TenantId, &rel.TableName, &rel.AggregateId, &rel.IsDeleted, &items); err != nil {
+			return nil, err
+		}
+		if err := fromRelationItemsJson(items, &rel.Items, &rel.Lists); err != nil {
+			return nil, err
+		}
+		relations = append(relations, rel)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return eventstorage.NewFindRelationReferencesResponse(relations, totalRows, req), nil
+}
+
+// findAggregateTypes 查询租户下所有的聚合类型
+func (s *EventStorage) findAggregateTypes(ctx context.Context, tenantId string) ([]string, error) {
+	query := fmt.Sprintf(`SELECT DISTINCT aggregate_type FROM %s WHERE tenant_id = $1`, quote(s.metadata.AggregateTableName))
+	rows, err := s.db.QueryContext(ctx, query, tenantId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []string
+	for rows.Next() {
+		var aggregateType string
+		if err := rows.Scan(&aggregateType); err != nil {
+			return nil, err
+		}
+		list = append(list, aggregateType)
+	}
+	return list, rows.Err()
+}
+
+//
+// ReadEventStream
+// @Description: 按全局位置顺序读取事件。saveEvents在每次写入（包括导入）时分配位置，表中没有位置为0的事件
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.ReadEventStreamResponse
+// @return error
+//
+func (s *EventStorage) ReadEventStream(ctx context.Context, req *eventstorage.ReadEventStreamRequest) (*eventstorage.ReadEventStreamResponse, error) {
+	limit := req.GetLimit()
+	where := []string{"position > $1"}
+	args := []interface{}{req.FromPosition}
+	if req.TenantId != "" {
+		args = append(args, req.TenantId)
+		where = append(where, fmt.Sprintf("tenant_id = $%d", len(args)))
+	}
+	if req.AggregateType != "" {
+		args = append(args, req.AggregateType)
+		where = append(where, fmt.Sprintf("aggregate_type = $%d", len(args)))
+	}
+	if req.EventType != "" {
+		args = append(args, req.EventType)
+		where = append(where, fmt.Sprintf("event_type = $%d", len(args)))
+	}
+	query := fmt.Sprintf(`SELECT %s FROM %s WHERE %s ORDER BY position LIMIT %d`,
+		eventColumns, quote(s.metadata.EventTableName), strings.Join(where, " AND "), limit+1)
+	events, err := s.queryEvents(ctx, s.db, query, args...)
+	if err != nil {
+		return nil, newError("findByPosition() error taking events.", err)
+	}
+	if err := s.decryptEvents(ctx, events); err != nil {
+		return nil, newError("decryptEvents() error.", err)
+	}
+	if err := s.upcastEvents(events); err != nil {
+		return nil, newError("upcastEvents() error.", err)
+	}
+
+	res := &eventstorage.ReadEventStreamResponse{
+		Events:       make([]*eventstorage.StreamEventDto, 0),
+		LastPosition: req.FromPosition,
+	}
+	for i, event := range events {
+		if uint64(i) == limit {
+			res.HasMore = true
+			break
+		}
+		res.Events = append(res.Events, newStreamEventDto(event))
+		res.LastPosition = event.Position
+	}
+	return res, nil
+}
+
+//
+// ReplayEvents
+// @Description: 按全局位置顺序将历史事件重新发布到请求指定的PubsubName/Topic，不修改事件的发布状态。
+// 发布失败时返回已完成的进度和错误，使用LastPosition续传。所有事件在写入时都分配了位置，历史事件全部会被重放。
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.ReplayEventsResponse
+// @return error
+//
+func (s *EventStorage) ReplayEvents(ctx context.Context, req *eventstorage.ReplayEventsRequest) (*eventstorage.ReplayEventsResponse, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	if req.ReplayId == "" {
+		req.ReplayId = model.NewObjectID()
+	}
+	limit := req.GetLimit()
+	where, args := getReplayWhere(req)
+	tableName := quote(s.metadata.EventTableName)
+
+	query := fmt.Sprintf(`SELECT %s FROM %s WHERE %s AND position > $%d ORDER BY position LIMIT %d`,
+		eventColumns, tableName, where, len(args)+1, limit+1)
+	events, err := s.queryEvents(ctx, s.db, query, append(args, req.FromPosition)...)
+	if err != nil {
+		return nil, newError("findForReplay() error taking events.", err)
+	}
+	if err := s.decryptEvents(ctx, events); err != nil {
+		return nil, newError("decryptEvents() error.", err)
+	}
+	if err := s.upcastEvents(events); err != nil {
+		return nil, newError("upcastEvents() error.", err)
+	}
+
+	res := &eventstorage.ReplayEventsResponse{
+		ReplayId:     req.ReplayId,
+		LastPosition: req.FromPosition,
+	}
+	var publishErr error
+	for i, event := range events {
+		if uint64(i) == limit {
+			res.HasMore = true
+			break
+		}
+		var pubData *pubsub.PublishRequest
+		if pubData, publishErr = req.NewPublishRequest(newEvent(event), event.Position); publishErr == nil {
+			publishErr = s.getPubsubAdapter().Publish(pubData)
+		}
+		if publishErr != nil {
+			res.HasMore = true
+			break
+		}
+		res.PublishedCount++
+		res.LastPosition = event.Position
+	}
+
+	query = fmt.Sprintf(`SELECT COUNT(*), COUNT(*) FILTER (WHERE position <= $%d) FROM %s WHERE %s AND position > 0`,
+		len(args)+1, tableName, where)
+	if err := s.db.QueryRowContext(ctx, query, append(args, res.LastPosition)...).Scan(&res.TotalCount, &res.ProcessedCount); err != nil {
+		return nil, newError("countForReplay() error.", err)
+	}
+	if publishErr != nil {
+		return res, newError("publishMessage() failed to replay event.", publishErr)
+	}
+	return res, nil
+}
+
+//
+// GetCausalityChain
+// @Description: 按CorrelationId查询跨聚合根的事件与命令
+// @receiver s
+// @param ctx
+// @param req
+// @return *eventstorage.GetCausalityChainResponse
+// @return error
+//
+func (s *EventStorage) GetCausalityChain(ctx context.Context, req *eventstorage.GetCausalityChainRequest) (*eventstorage.GetCausalityChainResponse, error) {
+	if req.TenantId == "" {
+		return nil, errors.New("tenantId cannot be empty")
+	}
+	if req.CorrelationId == "" {
+		return nil, errors.New("correlationId cannot be empty")
+	}
+	query := fmt.Sprintf(`SELECT %s FROM %s WHERE tenant_id = $1 AND correlation_id = $2 ORDER BY time_stamp, position, sequence_number LIMIT %d`,
+		eventColumns, quote(s.metadata.EventTableName), eventstorage.MaxCausalityChainEvents+1)
+	events, err := s.queryEvents(ctx, s.db, query, req.TenantId, req.CorrelationId)
+	if err != nil {
+		return nil, newError("findByCorrelationId() error taking events.", err)
+	}
+	dtos := make([]*eventstorage.CausalityEventDto, len(events))
+	for i, event := range events {
+		dtos[i] = event.NewCausalityEventDto()
+	}
+	return eventstorage.NewGetCausalityChainResponse(req.CorrelationId, dtos), nil
+}
+
+//
+// newEvents
+// @Description: 创建并校验事件
+// @receiver s
+// @return []*model.EventEntity
+// @return error
+//
+func (s *EventStorage) newEvents(tenantId string, aggregateId string, aggregateType string, events *[]eventstorage.EventDto, startSequenceNumber uint64) ([]*model.EventEntity, error) {
+	if events == nil {
+		return nil, errors.New("events is nil")
+	}
+	if len(*events) == 0 {
+		return nil, errors.New("request.saveEvents size 0 ")
+	}
+	var list []*model.EventEntity
+	for i, dto := range *events {
+		event := &model.EventEntity{
+			Id:             dto.EventId,
+			TenantId:       tenantId,
+			CommandId:      dto.CommandId,
+			EventId:        dto.EventId,
+			EventTime:      model.NewEventTime(dto.EventTime),
+			CausationId:    dto.GetCausationId(),
+			CorrelationId:  dto.GetCorrelationId(),
+			Metadata:       dto.Metadata,
+			EventData:      dto.EventData,
+			EventVersion:   dto.EventVersion,
+			EventType:      dto.EventType,
+			AggregateId:    aggregateId,
+			AggregateType:  aggregateType,
+			PublishName:    dto.PubsubName,
+			Topic:          dto.Topic,
+			PublishStatus:  eventstorage.PublishStatusWait,
+			SequenceNumber: startSequenceNumber + uint64(i),
+			Relations:      dto.Relations,
+			RelationLists:  dto.RelationLists,
+			TimeStamp:      utils.NewMongoNow(),
+		}
+		if err := event.Validate(); err != nil {
+			return nil, newError("createEvent() error saving event.", err)
+		}
+		list = append(list, event)
+	}
+	return list, nil
+}
+
+//
+// saveEvents
+// @Description: 在事务中保存事件及聚合关系
+// @receiver s
+// @param ctx
+// @param tx
+// @param events
+// @return error
+//
+func (s *EventStorage) saveEvents(ctx context.Context, tx *sql.Tx, events []*model.EventEntity) error {
+	startPosition, err := s.nextEventPosition(ctx, tx, uint64(len(events)))
+	if err != nil {
+		return newError("nextEventPosition() error.", err)
+	}
+	query := fmt.Sprintf(`INSERT INTO %s (id, tenant_id, command_id, event_id, metadata, event_data, event_type, event_version,
+aggregate_id, aggregate_type, sequence_number, relations, time_stamp, topic, publish_name, publish_status, position,
+event_time, causation_id, correlation_id, relation_lists)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21)`, quote(s.metadata.EventTableName))
+	for i, event := range events {
+		event.Position = startPosition + uint64(i)
+		metadata, err := toJson(event.Metadata)
+		if err != nil {
+			return err
+		}
+		encrypted, err := s.encryptor.Encrypt(ctx, event.TenantId, event.AggregateId, event.AggregateType, event.EventData, event.Metadata)
+		if err != nil {
+			return newError("createEvent() error encrypting event.", err)
+		}
+		eventData, err := toJson(encrypted)
+		if err != nil {
+			return err
+		}
+		relations, err := toJson(event.Relations)
+		if err != nil {
+			return err
+		}
+		relationLists, err := toJson(event.RelationLists)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, query, event.Id, event.TenantId, event.CommandId, event.EventId, metadata, eventData,
+			event.EventType, event.EventVersion, event.AggregateId, event.AggregateType, event.SequenceNumber, relations,
+			event.TimeStamp.Time(), event.Topic, event.PublishName, event.PublishStatus, event.Position,
+			toNullTime(event.GetEventTime()), event.CausationId, event.CorrelationId, relationLists)
+		if err != nil {
+			if isUniqueViolation(err, fmt.Sprintf(sqlSequenceConstraint, s.metadata.EventTableName)) {
+				return eventstorage.NewConcurrencyConflictError(event.TenantId, event.AggregateId, event.SequenceNumber-1, event.SequenceNumber)
+			}
+			return newError("createEvent() error saving event.", err)
+		}
+		if len(event.Relations) > 0 || len(event.RelationLists) > 0 {
+			relation := model.NewRelationEntity(event.TenantId, event.AggregateId, event.AggregateType, event.Relations, event.RelationLists)
+			if err := s.saveRelation(ctx, tx, relation); err != nil {
+				return newError("relationService.Create() error.", err)
+			}
+		}
+	}
+	return nil
+}
+
+//
+// nextEventPosition
+// @Description: 递增全局位置计数器，返回本次可用的起始位置。
+// 计数器行被锁定到事务结束，位置的顺序与事务提交的顺序一致。
+// @receiver s
+// @param ctx
+// @param tx
+// @param count
+// @return uint64
+// @return error
+//
+func (s *EventStorage) nextEventPosition(ctx context.Context, tx *sql.Tx, count uint64) (uint64, error) {
+	tableName := quote(s.metadata.PositionTableName)
+	query := fmt.Sprintf(`INSERT INTO %s (id, value) VALUES ('event', $1) ON CONFLICT (id) DO UPDATE SET value = %s.value + EXCLUDED.value RETURNING value`,
+		tableName, tableName)
+	var value uint64
+	if err := tx.QueryRowContext(ctx, query, count).Scan(&value); err != nil {
+		return 0, err
+	}
+	return value - count + 1, nil
+}
+
+//
+// findCommandEvents
+// @Description: 查找去重时间窗口内由commandId产生的事件，commandId为空或不去重时返回nil
+// @receiver s
+// @param ctx
+// @param tx
+// @param tenantId
+// @param aggregateId
+// @param commandId
+// @return []*model.EventEntity
+// @return error
+//
+func (s *EventStorage) findCommandEvents(ctx context.Context, tx *sql.Tx, tenantId string, aggregateId string, commandId string) ([]*model.EventEntity, error) {
+	if commandId == "" || s.dedupeWindow <= 0 {
+		return nil, nil
+	}
+	query := fmt.Sprintf(`SELECT %s FROM %s WHERE tenant_id = $1 AND command_id = $2 AND time_stamp >= $3 ORDER BY sequence_number`,
+		eventColumns, quote(s.metadata.EventTableName))
+	events, err := s.queryEvents(ctx, tx, query, tenantId, commandId, time.Now().Add(-s.dedupeWindow))
+	if err != nil || len(events) == 0 {
+		return nil, err
+	}
+	if events[0].AggregateId != aggregateId {
+		return nil, eventstorage.NewCommandConflictError(commandId, events[0].AggregateId)
+	}
+	return events, nil
+}
+
+//
+// saveRelation
+// @Description: 保存聚合关系，与es_mongo的$set一致，已有的关系字段保留，新的关系字段覆盖
+// @receiver s
+// @param ctx
+// @param tx
+// @param relation
+// @return error
+//
+func (s *EventStorage) saveRelation(ctx context.Context, tx *sql.Tx, relation *model.RelationEntity) error {
+	if err := relation.Validate(); err != nil {
+		return err
+	}
+	items, err := toRelationItemsJson(relation.Items, relation.Lists)
+	if err != nil {
+		return err
+	}
+	tableName := quote(relation.TableName)
+	query := fmt.Sprintf(`INSERT INTO %s (id, tenant_id, table_name, aggregate_id, is_deleted, items) VALUES ($1, $2, $3, $4, $5, $6)
+ON CONFLICT (tenant_id, id) DO UPDATE SET table_name = EXCLUDED.table_name, aggregate_id = EXCLUDED.aggregate_id,
+is_deleted = EXCLUDED.is_deleted, items = %s.items || EXCLUDED.items`, tableName, tableName)
+	_, err = tx.ExecContext(ctx, query, relation.Id, relation.TenantId, relation.TableName, relation.AggregateId, relation.IsDeleted, items)
+	return err
+}
+
+//
+// ensureRelationTables
+// @Description: 事件包含聚合关系时，在事务开始前创建关系表
+// @receiver s
+// @param ctx
+// @param aggregateType
+// @param events
+// @return error
+//
+func (s *EventStorage) ensureRelationTables(ctx context.Context, aggregateType string, events *[]eventstorage.EventDto) error {
+	if events == nil {
+		return nil
+	}
+	for _, event := range *events {
+		if len(event.Relations) > 0 || len(event.RelationLists) > 0 {
+			return s.ensureRelationTable(ctx, utils.AsMongoName(aggregateType))
+		}
+	}
+	return nil
+}
+
+//
+// lockAggregate
+// @Description: 查询并锁定聚合根行，直到事务结束
+// @receiver s
+// @param ctx
+// @param tx
+// @param tenantId
+// @param aggregateId
+// @return *model.AggregateEntity 不存在时返回nil
+// @return error
+//
+func (s *EventStorage) lockAggregate(ctx context.Context, tx *sql.Tx, tenantId, aggregateId string) (*model.AggregateEntity, error) {
+	query := fmt.Sprintf(`SELECT tenant_id, aggregate_id, aggregate_type, sequence_number, deleted FROM %s WHERE tenant_id = $1 AND aggregate_id = $2 FOR UPDATE`,
+		quote(s.metadata.AggregateTableName))
+	agg := &model.AggregateEntity{}
+	err := tx.QueryRowContext(ctx, query, tenantId, aggregateId).Scan(&agg.TenantId, &agg.AggregateId, &agg.AggregateType, &agg.SequenceNumber, &agg.Deleted)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	agg.Id = agg.AggregateId
+	return agg, nil
+}
+
+func (s *EventStorage) updateAggregate(ctx context.Context, tx *sql.Tx, agg *model.AggregateEntity, sequenceNumber uint64, deleted bool) error {
+	query := fmt.Sprintf(`UPDATE %s SET sequence_number = $1, deleted = $2 WHERE tenant_id = $3 AND aggregate_id = $4`,
+		quote(s.metadata.AggregateTableName))
+	_, err := tx.ExecContext(ctx, query, sequenceNumber, deleted, agg.TenantId, agg.AggregateId)
+	return err
+}
+
+func (s *EventStorage) findSnapshotByMaxSequenceNumber(ctx context.Context, tenantId, aggregateId, aggregateType, aggregateVersion string, toSequenceNumber uint64) (*model.SnapshotEntity, error) {
+	query := fmt.Sprintf(`SELECT id, aggregate_data, aggregate_version, sequence_number, metadata FROM %s
+WHERE tenant_id = $1 AND aggregate_id = $2 AND aggregate_type = $3 AND ($4 = '' OR aggregate_version = $4) AND ($5 = 0 OR sequence_number <= $5)
+ORDER BY sequence_number DESC LIMIT 1`, quote(s.metadata.SnapshotTableName))
+	snapshot := &model.SnapshotEntity{TenantId: tenantId, AggregateId: aggregateId, AggregateType: aggregateType}
+	var aggregateData, metadata []byte
+	err := s.db.QueryRowContext(ctx, query, tenantId, aggregateId, aggregateType, aggregateVersion, toSequenceNumber).
+		Scan(&snapshot.Id, &aggregateData, &snapshot.AggregateVersion, &snapshot.SequenceNumber, &metadata)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := fromJson(aggregateData, &snapshot.AggregateData); err != nil {
+		return nil, err
+	}
+	if err := fromJson(metadata, &snapshot.Metadata); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+const eventColumns = `id, tenant_id, command_id, event_id, metadata, event_data, event_type, event_version, aggregate_id, aggregate_type,
+sequence_number, relations, time_stamp, topic, publish_name, publish_status, publish_attempts, publish_error, position,
+event_time, causation_id, correlation_id, relation_lists`
+
+//
+// decryptEvents
+// @Description: 解密事件数据，只替换列表中的元素
+// @receiver s
+// @param ctx
+// @param events
+// @return error
+//
+func (s *EventStorage) decryptEvents(ctx context.Context, events []*model.EventEntity) error {
+	for i, event := range events {
+		decrypted, err := event.Decrypt(ctx, s.encryptor)
+		if err != nil {
+			return err
+		}
+		events[i] = decrypted
+	}
+	return nil
+}
+
+//
+// upcastEvents
+// @Description: 将事件转换到最新版本，只替换列表中的元素
+// @receiver s
+// @param events
+// @return error
+//
+func (s *EventStorage) upcastEvents(events []*model.EventEntity) error {
+	for i, event := range events {
+		upcasted, err := event.Upcast(s.upcasters)
+		if err != nil {
+			return err
+		}
+		events[i] = upcasted
+	}
+	return nil
+}
+
+// queryer *sql.DB与*sql.Tx共同的查询方法
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func (s *EventStorage) queryEvents(ctx context.Context, q queryer, query string, args ...interface{}) ([]*model.EventEntity, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []*model.EventEntity
+	for rows.Next() {
+		event := &model.EventEntity{}
+		var metadata, eventData, relations, relationLists []byte
+		var timeStamp time.Time
+		var eventTime sql.NullTime
+		if err := rows.Scan(&event.Id, &event.TenantId, &event.CommandId, &event.EventId, &metadata, &eventData, &event.EventType,
+			&event.EventVersion, &event.AggregateId, &event.AggregateType, &event.SequenceNumber, &relations, &timeStamp,
+			&event.Topic, &event.PublishName, &event.PublishStatus, &event.PublishAttempts, &event.PublishError, &event.Position,
+			&eventTime, &event.CausationId, &event.CorrelationId, &relationLists); err != nil {
+			return nil, err
+		}
+		if err := fromJson(metadata, &event.Metadata); err != nil {
+			return nil, err
+		}
+		if err := fromJson(eventData, &event.EventData); err != nil {
+			return nil, err
+		}
+		if err := fromJson(relations, &event.Relations); err != nil {
+			return nil, err
+		}
+		if err := fromJson(relationLists, &event.RelationLists); err != nil {
+			return nil, err
+		}
+		event.TimeStamp = model.NewDateTime(timeStamp)
+		if eventTime.Valid {
+			event.EventTime = model.NewEventTime(eventTime.Time)
+		}
+		list = append(list, event)
+	}
+	return list, rows.Err()
+}
+
+//
+// publishEvents
+// @Description: 事务提交后按顺序发送事件，并更新发送状态。与es_mongo一致，发送失败不影响写入结果：
+// 记录失败次数与错误，事件保持PublishStatusWait，不再发送后续事件；聚合根之前的事件仍在等待发送时不发送。
+// es_postgres暂不提供补发任务与死信主题，等待发送的事件不会自动重试
+// @receiver s
+// @param ctx
+// @param events 同一聚合根的事件
+//
+func (s *EventStorage) publishEvents(ctx context.Context, events []*model.EventEntity) {
+	if len(events) == 0 {
+		return
+	}
+	tableName := quote(s.metadata.EventTableName)
+	var firstId string
+	query := fmt.Sprintf(`SELECT id FROM %s WHERE tenant_id = $1 AND aggregate_id = $2 AND publish_status = $3 ORDER BY sequence_number LIMIT 1`, tableName)
+	err := s.db.QueryRowContext(ctx, query, events[0].TenantId, events[0].AggregateId, eventstorage.PublishStatusWait).Scan(&firstId)
+	if err != nil && err != sql.ErrNoRows {
+		if s.log != nil {
+			s.log.Errorf("error finding unpublished events, they stay unpublished: %s", err.Error())
+		}
+		return
+	}
+	if err == nil && firstId != events[0].Id {
+		return
+	}
+	for _, event := range events {
+		if err := s.publishMessage(event); err != nil {
+			if s.log != nil {
+				s.log.Errorf("error publishing event %s, it stays unpublished: %s", event.EventId, err.Error())
+			}
+			query := fmt.Sprintf(`UPDATE %s SET publish_attempts = publish_attempts + 1, publish_error = $1 WHERE id = $2`, tableName)
+			if _, err := s.db.ExecContext(ctx, query, err.Error(), event.Id); err != nil && s.log != nil {
+				s.log.Errorf("error updating publish error of event %s: %s", event.EventId, err.Error())
+			}
+			return
+		}
+		query := fmt.Sprintf(`UPDATE %s SET publish_status = $1 WHERE id = $2`, tableName)
+		if _, err := s.db.ExecContext(ctx, query, eventstorage.PublishStatusSuccess, event.Id); err != nil && s.log != nil {
+			s.log.Errorf("error updating publish status of event %s: %s", event.EventId, err.Error())
+		}
+	}
+}
+
+func (s *EventStorage) publishMessage(event *model.EventEntity) error {
+	req := newEvent(event)
+	contentType := "json"
+	bytes, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	pubData := &pubsub.PublishRequest{
+		PubsubName:  req.PubsubName,
+		Topic:       req.Topic,
+		Metadata:    req.Metadata,
+		ContentType: &contentType,
+		Data:        bytes,
+	}
+	return s.getPubsubAdapter().Publish(pubData)
+}
+
+func newEvent(event *model.EventEntity) *eventstorage.Event {
+	return &eventstorage.Event{
+		TenantId:      event.TenantId,
+		AggregateId:   event.AggregateId,
+		AggregateType: event.AggregateType,
+		CommandId:     event.CommandId,
+		EventId:       event.EventId,
+		EventData:     event.EventData,
+		EventType:     event.EventType,
+		EventVersion:  event.EventVersion,
+		PubsubName:    event.PublishName,
+		Relations:     event.Relations,
+		RelationLists: event.RelationLists,
+		Topic:         event.Topic,
+		Metadata:      event.Metadata,
+		EventTime:     event.GetEventTime(),
+		CausationId:   event.CausationId,
+		CorrelationId: event.CorrelationId,
+	}
+}
+
+func (s *EventStorage) withTransaction(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+//
+// getWhere
+// @Description: 将rsql过滤条件转换为where语句，总是包含租户条件
+// @param tenantId
+// @param filter
+// @param column
+// @return string
+// @return []interface{}
+// @return error
+//
+func getWhere(tenantId string, filter string, column columnFunc) (string, []interface{}, error) {
+	p := NewSqlProcess(1, column)
+	if err := rsql.ParseProcess(filter, p); err != nil {
+		return "", nil, err
+	}
+	where, args, err := p.GetWhere()
+	if err != nil {
+		return "", nil, err
+	}
+	args = append([]interface{}{tenantId}, args...)
+	if len(where) == 0 {
+		return "tenant_id = $1", args, nil
+	}
+	return "tenant_id = $1 AND " + where, args, nil
+}
+
+//
+// getAggregateWhere
+// @Description: 聚合根查询的where条件，aggregateType为空时不过滤类型
+// @param tenantId
+// @param aggregateType
+// @param filter
+// @return string
+// @return []interface{}
+// @return error
+//
+func getAggregateWhere(tenantId string, aggregateType string, filter string) (string, []interface{}, error) {
+	where, args, err := getWhere(tenantId, filter, aggregateColumn)
+	if err != nil || aggregateType == "" {
+		return where, args, err
+	}
+	args = append(args, aggregateType)
+	return fmt.Sprintf("%s AND aggregate_type = $%d", where, len(args)), args, nil
+}
+
+//
+// getReplayWhere
+// @Description: 重放范围的where条件，不包含位置条件
+// @param req
+// @return string
+// @return []interface{}
+//
+func getReplayWhere(req *eventstorage.ReplayEventsRequest) (string, []interface{}) {
+	where := []string{"tenant_id = $1", "aggregate_type = $2"}
+	args := []interface{}{req.TenantId, req.AggregateType}
+	add := func(condition string, value interface{}) {
+		args = append(args, value)
+		where = append(where, fmt.Sprintf(condition, len(args)))
+	}
+	if req.FromTime != nil {
+		add("time_stamp >= $%d", *req.FromTime)
+	}
+	if req.ToTime != nil {
+		add("time_stamp <= $%d", *req.ToTime)
+	}
+	if req.FromSequenceNumber > 0 {
+		add("sequence_number >= $%d", req.FromSequenceNumber)
+	}
+	if req.ToSequenceNumber > 0 {
+		add("sequence_number <= $%d", req.ToSequenceNumber)
+	}
+	return strings.Join(where, " AND "), args
+}
+
+func getLimit(pageNum, pageSize uint64) string {
+	if pageSize == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" LIMIT %d OFFSET %d", pageSize, pageSize*pageNum)
+}
+
+func checkSequenceNumber(agg *model.AggregateEntity, expectedSequenceNumber uint64) error {
+	if expectedSequenceNumber > 0 && agg.SequenceNumber != expectedSequenceNumber {
+		return eventstorage.NewConcurrencyConflictError(agg.TenantId, agg.AggregateId, expectedSequenceNumber, agg.SequenceNumber)
+	}
+	return nil
+}
+
+//
+// isUniqueViolation
+// @Description: 判断是否为指定约束的唯一约束冲突
+// @param err
+// @param constraint
+// @return bool
+//
+func isUniqueViolation(err error, constraint string) bool {
+	var pgErr interface{ SQLState() string }
+	if !errors.As(err, &pgErr) || pgErr.SQLState() != uniqueViolation {
+		return false
+	}
+	return strings.Contains(err.Error(), constraint)
+}
+
+func toNullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+func toJson(v interface{}) (string, error) {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes), nil
+}
+
+//
+// toRelationItemsJson
+// @Description: 单值关系与多值关系保存在同一个items中，多值关系为JSON数组
+// @param items
+// @param lists
+// @return string
+// @return error
+//
+func toRelationItemsJson(items map[string]string, lists map[string][]string) (string, error) {
+	data := make(map[string]interface{}, len(items)+len(lists))
+	for k, v := range items {
+		data[k] = v
+	}
+	for k, v := range lists {
+		data[k] = v
+	}
+	return toJson(data)
+}
+
+//
+// fromRelationItemsJson
+// @Description: 从items中拆分单值关系与多值关系
+// @param data
+// @param items
+// @param lists
+// @return error
+//
+func fromRelationItemsJson(data []byte, items *map[string]string, lists *map[string][]string) error {
+	var values map[string]json.RawMessage
+	if err := fromJson(data, &values); err != nil {
+		return err
+	}
+	*items = make(map[string]string, len(values))
+	for k, v := range values {
+		var item string
+		if err := json.Unmarshal(v, &item); err == nil {
+			(*items)[k] = item
+			continue
+		}
+		var list []string
+		if err := json.Unmarshal(v, &list); err != nil {
+			return err
+		}
+		if *lists == nil {
+			*lists = make(map[string][]string)
+		}
+		(*lists)[k] = list
+	}
+	return nil
+}
+
+func fromJson(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+func newError(msgType string, err error) error {
+	return errors.New(msgType + err.Error())
+}
+
+func newStreamEventDto(event *model.EventEntity) *eventstorage.StreamEventDto {
+	return &eventstorage.StreamEventDto{
+		Position:       event.Position,
+		TenantId:       event.TenantId,
+		AggregateId:    event.AggregateId,
+		AggregateType:  event.AggregateType,
+		CommandId:      event.CommandId,
+		EventId:        event.EventId,
+		EventData:      event.EventData,
+		EventType:      event.EventType,
+		EventVersion:   event.EventVersion,
+		SequenceNumber: event.SequenceNumber,
+		Metadata:       event.Metadata,
+		TimeStamp:      event.TimeStamp.Time(),
+	}
+}
@@ -0,0 +1,61 @@
+package es_postgres
+
+import (
+	"errors"
+	"github.com/liuxd6825/components-contrib/liuxd/common"
+)
+
+const (
+	connectionString   = "connectionString"
+	eventTableName     = "eventTableName"
+	snapshotTableName  = "snapshotTableName"
+	aggregateTableName = "aggregateTableName"
+	positionTableName  = "positionTableName"
+	dataKeyTableName   = "dataKeyTableName"
+
+	defaultEventTableName     = "dapr_event"
+	defaultSnapshotTableName  = "dapr_snapshot"
+	defaultAggregateTableName = "dapr_aggregate"
+	defaultPositionTableName  = "dapr_position"
+	defaultDataKeyTableName   = "dapr_data_key"
+)
+
+type storageMetadata struct {
+	ConnectionString   string
+	EventTableName     string
+	SnapshotTableName  string
+	AggregateTableName string
+	PositionTableName  string
+	DataKeyTableName   string
+}
+
+func getStorageMetadata(metadata common.Metadata) (*storageMetadata, error) {
+	meta := storageMetadata{
+		EventTableName:     defaultEventTableName,
+		SnapshotTableName:  defaultSnapshotTableName,
+		AggregateTableName: defaultAggregateTableName,
+		PositionTableName:  defaultPositionTableName,
+		DataKeyTableName:   defaultDataKeyTableName,
+	}
+	if val, ok := metadata.Properties[connectionString]; ok && val != "" {
+		meta.ConnectionString = val
+	} else {
+		return nil, errors.New("must set 'connectionString' fields in metadata")
+	}
+	if val, ok := metadata.Properties[eventTableName]; ok && val != "" {
+		meta.EventTableName = val
+	}
+	if val, ok := metadata.Properties[snapshotTableName]; ok && val != "" {
+		meta.SnapshotTableName = val
+	}
+	if val, ok := metadata.Properties[aggregateTableName]; ok && val != "" {
+		meta.AggregateTableName = val
+	}
+	if val, ok := metadata.Properties[positionTableName]; ok && val != "" {
+		meta.PositionTableName = val
+	}
+	if val, ok := metadata.Properties[dataKeyTableName]; ok && val != "" {
+		meta.DataKeyTableName = val
+	}
+	return &meta, nil
+}
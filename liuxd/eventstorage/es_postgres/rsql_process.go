@@ -0,0 +1,316 @@
+package es_postgres
+
+import (
+	"errors"
+	"fmt"
+	"github.com/liuxd6825/components-contrib/liuxd/common/rsql"
+	"github.com/liuxd6825/components-contrib/liuxd/common/utils"
+	"regexp"
+	"strings"
+)
+
+var fieldNameRegexp = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// sqlColumn rsql字段对应的SQL表达式，text为true时参数按字符串比较
+type sqlColumn struct {
+	expr string
+	text bool
+}
+
+// columnFunc 将rsql字段名转换为SQL表达式
+type columnFunc func(name string) (*sqlColumn, error)
+
+//
+// SqlProcess
+// @Description: 将rsql表达式转换为PostgreSQL的where条件，参数使用$n占位符
+//
+type SqlProcess struct {
+	sb     strings.Builder
+	args   []interface{}
+	offset int
+	column columnFunc
+	err    error
+}
+
+func NewSqlProcess(argOffset int, column columnFunc) *SqlProcess {
+	return &SqlProcess{offset: argOffset, column: column}
+}
+
+//
+// GetWhere
+// @Description: 返回where条件及参数，没有条件时返回空字符串
+// @receiver p
+// @return string
+// @return []interface{}
+// @return error
+//
+func (p *SqlProcess) GetWhere() (string, []interface{}, error) {
+	return p.sb.String(), p.args, p.err
+}
+
+func (p *SqlProcess) OnAndItem() {
+	p.sb.WriteString(" AND ")
+}
+
+func (p *SqlProcess) OnAndStart() {
+	p.sb.WriteString("(")
+}
+
+func (p *SqlProcess) OnAndEnd() {
+	p.sb.WriteString(")")
+}
+
+func (p *SqlProcess) OnOrItem() {
+	p.sb.WriteString(" OR ")
+}
+
+func (p *SqlProcess) OnOrStart() {
+	p.sb.WriteString("(")
+}
+
+func (p *SqlProcess) OnOrEnd() {
+	p.sb.WriteString(")")
+}
+
+func (p *SqlProcess) OnEquals(name string, value interface{}, rValue rsql.Value) {
+	p.comparison(name, "%s = %s", rValue)
+}
+
+func (p *SqlProcess) OnNotEquals(name string, value interface{}, rValue rsql.Value) {
+	p.comparison(name, "%s IS DISTINCT FROM %s", rValue)
+}
+
+func (p *SqlProcess) OnLike(name string, value interface{}, rValue rsql.Value) {
+	p.comparison(name, "%s ~* %s", rValue)
+}
+
+func (p *SqlProcess) OnNotLike(name string, value interface{}, rValue rsql.Value) {
+	p.comparison(name, "%s !~* %s", rValue)
+}
+
+func (p *SqlProcess) OnGreaterThan(name string, value interface{}, rValue rsql.Value) {
+	p.comparison(name, "%s > %s", rValue)
+}
+
+func (p *SqlProcess) OnGreaterThanOrEquals(name string, value interface{}, rValue rsql.Value) {
+	p.comparison(name, "%s >= %s", rValue)
+}
+
+func (p *SqlProcess) OnLessThan(name string, value interface{}, rValue rsql.Value) {
+	p.comparison(name, "%s < %s", rValue)
+}
+
+func (p *SqlProcess) OnLessThanOrEquals(name string, value interface{}, rValue rsql.Value) {
+	p.comparison(name, "%s <= %s", rValue)
+}
+
+func (p *SqlProcess) OnIn(name string, value interface{}, rValue rsql.Value) {
+	p.list(name, false, rValue)
+}
+
+func (p *SqlProcess) OnNotIn(name string, value interface{}, rValue rsql.Value) {
+	p.list(name, true, rValue)
+}
+
+func (p *SqlProcess) comparison(name string, format string, rValue rsql.Value) {
+	column, ok := p.getColumn(name)
+	if !ok {
+		return
+	}
+	p.sb.WriteString(fmt.Sprintf(format, column.expr, p.addArg(column, rsql.GetValue(rValue))))
+}
+
+func (p *SqlProcess) list(name string, not bool, rValue rsql.Value) {
+	column, ok := p.getColumn(name)
+	if !ok {
+		return
+	}
+	listValue, _ := rValue.(rsql.ListValue)
+	values := rsql.GetValueList(listValue)
+	if len(values) == 0 {
+		if not {
+			p.sb.WriteString("TRUE")
+		} else {
+			p.sb.WriteString("FALSE")
+		}
+		return
+	}
+	params := make([]string, len(values))
+	for i, v := range values {
+		params[i] = p.addArg(column, v)
+	}
+	if not {
+		// 与MongoDB的$nin一致，字段不存在时也满足条件
+		p.sb.WriteString(fmt.Sprintf("(%s IS NULL OR %s NOT IN (%s))", column.expr, column.expr, strings.Join(params, ", ")))
+	} else {
+		p.sb.WriteString(fmt.Sprintf("%s IN (%s)", column.expr, strings.Join(params, ", ")))
+	}
+}
+
+func (p *SqlProcess) getColumn(name string) (*sqlColumn, bool) {
+	column, err := p.column(name)
+	if err != nil {
+		if p.err == nil {
+			p.err = err
+		}
+		p.sb.WriteString("FALSE")
+		return nil, false
+	}
+	return column, true
+}
+
+func (p *SqlProcess) addArg(column *sqlColumn, value interface{}) string {
+	if column.text {
+		value = fmt.Sprintf("%v", value)
+	}
+	p.args = append(p.args, value)
+	return fmt.Sprintf("$%d", p.offset+len(p.args))
+}
+
+//
+// relationColumn
+// @Description: 关系表的字段，固定字段直接映射为列，其它字段映射为items中的值
+// @param name
+// @return *sqlColumn
+// @return error
+//
+func relationColumn(name string) (*sqlColumn, error) {
+	name = asFieldName(name)
+	switch name {
+	case "id", "tenant_id", "table_name", "aggregate_id":
+		return &sqlColumn{expr: name, text: true}, nil
+	case "is_deleted":
+		return &sqlColumn{expr: name}, nil
+	}
+	if !fieldNameRegexp.MatchString(name) {
+		return nil, errors.New(fmt.Sprintf("field name %s is error", name))
+	}
+	return &sqlColumn{expr: fmt.Sprintf("items->>'%s'", name), text: true}, nil
+}
+
+var jsonKeyRegexp = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// eventColumnTexts 事件表可查询的列，值为true时参数按字符串比较
+var eventColumnTexts = map[string]bool{
+	"id":                true,
+	"tenant_id":         true,
+	"command_id":        true,
+	"event_id":          true,
+	"event_type":        true,
+	"event_version":     true,
+	"aggregate_id":      true,
+	"aggregate_type":    true,
+	"topic":             true,
+	"publish_name":      true,
+	"publish_error":     true,
+	"causation_id":      true,
+	"correlation_id":    true,
+	"sequence_number":   false,
+	"position":          false,
+	"publish_status":    false,
+	"publish_attempts":  false,
+	"time_stamp":        false,
+	"event_time":        false,
+	"next_publish_time": false,
+}
+
+//
+// eventColumn
+// @Description: 事件表的字段，第一级字段映射为列，eventData、metadata、relations下的字段按原样映射为JSON中的值
+// @param name
+// @return *sqlColumn
+// @return error
+//
+func eventColumn(name string) (*sqlColumn, error) {
+	head, path, nested := strings.Cut(strings.Trim(name, " "), ".")
+	head = asFieldName(head)
+	switch head {
+	case "meta_data":
+		head = "metadata"
+	case "pubsub_name":
+		head = "publish_name"
+	}
+	if !nested {
+		if text, ok := eventColumnTexts[head]; ok {
+			return &sqlColumn{expr: head, text: text}, nil
+		}
+		return nil, errors.New(fmt.Sprintf("field name %s is error", name))
+	}
+	switch head {
+	case "event_data", "metadata", "relations":
+	default:
+		return nil, errors.New(fmt.Sprintf("field name %s is error", name))
+	}
+	keys := strings.Split(path, ".")
+	for _, key := range keys {
+		if !jsonKeyRegexp.MatchString(key) {
+			return nil, errors.New(fmt.Sprintf("field name %s is error", name))
+		}
+	}
+	return &sqlColumn{expr: fmt.Sprintf("%s #>> '{%s}'", head, strings.Join(keys, ",")), text: true}, nil
+}
+
+//
+// aggregateColumn
+// @Description: 聚合根表的字段，id与aggregateId都映射为aggregate_id
+// @param name
+// @return *sqlColumn
+// @return error
+//
+func aggregateColumn(name string) (*sqlColumn, error) {
+	switch asFieldName(name) {
+	case "id", "aggregate_id":
+		return &sqlColumn{expr: "aggregate_id", text: true}, nil
+	case "tenant_id":
+		return &sqlColumn{expr: "tenant_id", text: true}, nil
+	case "aggregate_type":
+		return &sqlColumn{expr: "aggregate_type", text: true}, nil
+	case "sequence_number":
+		return &sqlColumn{expr: "sequence_number"}, nil
+	case "deleted":
+		return &sqlColumn{expr: "deleted"}, nil
+	}
+	return nil, errors.New(fmt.Sprintf("field name %s is error", name))
+}
+
+func asFieldName(name string) string {
+	if name == "_id" {
+		return "id"
+	}
+	return utils.AsMongoName(strings.Trim(name, " "))
+}
+
+//
+// getOrderBy
+// @Description: 将 "name:desc,id:asc" 转换为 order by 语句
+// @param sort
+// @param column
+// @return string
+// @return error
+//
+func getOrderBy(sort string, column columnFunc) (string, error) {
+	if len(sort) == 0 {
+		return "", nil
+	}
+	var items []string
+	for _, s := range strings.Split(sort, ",") {
+		sortItem := strings.Split(s, ":")
+		col, err := column(sortItem[0])
+		if err != nil {
+			return "", err
+		}
+		order := "asc"
+		if len(sortItem) > 1 {
+			order = strings.Trim(strings.ToLower(sortItem[1]), " ")
+		}
+		switch order {
+		case "asc":
+			items = append(items, col.expr+" ASC")
+		case "desc":
+			items = append(items, col.expr+" DESC")
+		default:
+			return "", errors.New("order " + order + " is error")
+		}
+	}
+	return " ORDER BY " + strings.Join(items, ", "), nil
+}
@@ -0,0 +1,67 @@
+package es_postgres
+
+import (
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_GetWhere(t *testing.T) {
+	where, args, err := getWhere("t1", "(caseId=='001' or isDeleted==false) and userId=in=('u1','u2')", relationColumn)
+	assert.NoError(t, err)
+	assert.Equal(t, "tenant_id = $1 AND ((items->>'case_id' = $2 OR is_deleted = $3) AND items->>'user_id' IN ($4, $5))", where)
+	assert.Equal(t, []interface{}{"t1", "001", false, "u1", "u2"}, args)
+
+	where, args, err = getWhere("t1", "", relationColumn)
+	assert.NoError(t, err)
+	assert.Equal(t, "tenant_id = $1", where)
+	assert.Equal(t, []interface{}{"t1"}, args)
+
+	_, _, err = getWhere("t1", "name=='x'", func(name string) (*sqlColumn, error) {
+		return relationColumn(name + "'")
+	})
+	assert.Error(t, err)
+}
+
+func Test_GetOrderBy(t *testing.T) {
+	orderBy, err := getOrderBy("caseId:desc,id", relationColumn)
+	assert.NoError(t, err)
+	assert.Equal(t, " ORDER BY items->>'case_id' DESC, id ASC", orderBy)
+
+	_, err = getOrderBy("caseId:down", relationColumn)
+	assert.Error(t, err)
+}
+
+func Test_GetReplayWhere(t *testing.T) {
+	where, args := getReplayWhere(&eventstorage.ReplayEventsRequest{TenantId: "t1", AggregateType: "Order", FromSequenceNumber: 2, ToSequenceNumber: 5})
+	assert.Equal(t, "tenant_id = $1 AND aggregate_type = $2 AND sequence_number >= $3 AND sequence_number <= $4", where)
+	assert.Equal(t, []interface{}{"t1", "Order", uint64(2), uint64(5)}, args)
+}
+
+func Test_EventColumn(t *testing.T) {
+	where, args, err := getWhere("t1", "eventType=='OrderCancelled' and eventData.order.cancelReason=='fraud' and timeStamp>=2022-01-02", eventColumn)
+	assert.NoError(t, err)
+	assert.Equal(t, "tenant_id = $1 AND (event_type = $2 AND event_data #>> '{order,cancelReason}' = $3 AND time_stamp >= $4)", where)
+	assert.Equal(t, []interface{}{"t1", "OrderCancelled", "fraud", "2022-01-02"}, args)
+
+	orderBy, err := getOrderBy("pubsubName,sequenceNumber:desc", eventColumn)
+	assert.NoError(t, err)
+	assert.Equal(t, " ORDER BY publish_name ASC, sequence_number DESC", orderBy)
+
+	_, err = eventColumn("eventData.x'y")
+	assert.Error(t, err)
+	_, err = eventColumn("unknown")
+	assert.Error(t, err)
+}
+
+func Test_GetAggregateWhere(t *testing.T) {
+	where, args, err := getAggregateWhere("t1", "Order", "deleted==true or sequenceNumber>10")
+	assert.NoError(t, err)
+	assert.Equal(t, "tenant_id = $1 AND (deleted = $2 OR sequence_number > $3) AND aggregate_type = $4", where)
+	assert.Equal(t, []interface{}{"t1", true, int64(10), "Order"}, args)
+
+	where, args, err = getAggregateWhere("t1", "", "id=='a1'")
+	assert.NoError(t, err)
+	assert.Equal(t, "tenant_id = $1 AND aggregate_id = $2", where)
+	assert.Equal(t, []interface{}{"t1", "a1"}, args)
+}
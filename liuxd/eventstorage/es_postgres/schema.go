@@ -0,0 +1,151 @@
+package es_postgres
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	// sqlSequenceConstraint 同一聚合根的SequenceNumber唯一，并发写入时作为乐观锁的最后保障
+	sqlSequenceConstraint = "%s_sequence_uk"
+
+	sqlCreateAggregateTable = `CREATE TABLE IF NOT EXISTS %s (
+	tenant_id       TEXT    NOT NULL,
+	aggregate_id    TEXT    NOT NULL,
+	aggregate_type  TEXT    NOT NULL,
+	sequence_number BIGINT  NOT NULL,
+	deleted         BOOLEAN NOT NULL DEFAULT FALSE,
+	sequence_gaps   JSONB,
+	PRIMARY KEY (tenant_id, aggregate_id)
+)`
+
+	// sqlCreateEventTable position为全局位置，由位置计数器表在写入事务中分配
+	sqlCreateEventTable = `CREATE TABLE IF NOT EXISTS %s (
+	id                TEXT        NOT NULL PRIMARY KEY,
+	tenant_id         TEXT        NOT NULL,
+	command_id        TEXT        NOT NULL DEFAULT '',
+	event_id          TEXT        NOT NULL,
+	metadata          JSONB,
+	event_data        JSONB,
+	event_type        TEXT        NOT NULL,
+	event_version     TEXT        NOT NULL,
+	aggregate_id      TEXT        NOT NULL,
+	aggregate_type    TEXT        NOT NULL,
+	sequence_number   BIGINT      NOT NULL,
+	relations         JSONB,
+	time_stamp        TIMESTAMPTZ NOT NULL,
+	topic             TEXT        NOT NULL,
+	publish_name      TEXT        NOT NULL,
+	publish_status    INTEGER     NOT NULL,
+	publish_attempts  INTEGER     NOT NULL DEFAULT 0,
+	publish_error     TEXT        NOT NULL DEFAULT '',
+	next_publish_time TIMESTAMPTZ,
+	position          BIGINT      NOT NULL,
+	event_time        TIMESTAMPTZ,
+	causation_id      TEXT        NOT NULL DEFAULT '',
+	correlation_id    TEXT        NOT NULL DEFAULT '',
+	relation_lists    JSONB,
+	CONSTRAINT %s UNIQUE (tenant_id, aggregate_id, sequence_number)
+)`
+
+	sqlCreateEventPositionIndex = `CREATE INDEX IF NOT EXISTS %s ON %s (position)`
+
+	sqlCreatePositionTable = `CREATE TABLE IF NOT EXISTS %s (
+	id    TEXT   NOT NULL PRIMARY KEY,
+	value BIGINT NOT NULL
+)`
+
+	sqlCreateEventCorrelationIndex = `CREATE INDEX IF NOT EXISTS %s ON %s (tenant_id, correlation_id) WHERE correlation_id <> ''`
+
+	sqlCreateEventCommandIndex = `CREATE INDEX IF NOT EXISTS %s ON %s (tenant_id, command_id) WHERE command_id <> ''`
+
+	sqlCreateEventPublishIndex = `CREATE INDEX IF NOT EXISTS %s ON %s (publish_status) WHERE publish_status <> 1`
+
+	// sqlCreateDataKeyTable 数据密钥，销毁后key为NULL
+	sqlCreateDataKeyTable = `CREATE TABLE IF NOT EXISTS %s (
+	tenant_id   TEXT        NOT NULL,
+	key_id      TEXT        NOT NULL,
+	key         BYTEA,
+	erased      BOOLEAN     NOT NULL DEFAULT FALSE,
+	create_time TIMESTAMPTZ NOT NULL,
+	erase_time  TIMESTAMPTZ,
+	PRIMARY KEY (tenant_id, key_id)
+)`
+
+	sqlCreateSnapshotTable = `CREATE TABLE IF NOT EXISTS %s (
+	id                TEXT        NOT NULL PRIMARY KEY,
+	tenant_id         TEXT        NOT NULL,
+	aggregate_id      TEXT        NOT NULL,
+	aggregate_type    TEXT        NOT NULL,
+	aggregate_data    JSONB,
+	aggregate_version TEXT        NOT NULL,
+	sequence_number   BIGINT      NOT NULL,
+	metadata          JSONB,
+	time_stamp        TIMESTAMPTZ NOT NULL
+)`
+
+	sqlCreateSnapshotIndex = `CREATE INDEX IF NOT EXISTS %s ON %s (tenant_id, aggregate_id, aggregate_type, sequence_number DESC)`
+
+	sqlCreateRelationTable = `CREATE TABLE IF NOT EXISTS %s (
+	id           TEXT    NOT NULL,
+	tenant_id    TEXT    NOT NULL,
+	table_name   TEXT    NOT NULL,
+	aggregate_id TEXT    NOT NULL,
+	is_deleted   BOOLEAN NOT NULL DEFAULT FALSE,
+	items        JSONB   NOT NULL DEFAULT '{}',
+	PRIMARY KEY (tenant_id, id)
+)`
+)
+
+//
+// ensureSchema
+// @Description: 创建聚合根、事件、镜像、数据密钥表
+// @receiver s
+// @param ctx
+// @return error
+//
+func (s *EventStorage) ensureSchema(ctx context.Context) error {
+	meta := s.metadata
+	statements := []string{
+		fmt.Sprintf(sqlCreateAggregateTable, quote(meta.AggregateTableName)),
+		fmt.Sprintf(sqlCreateEventTable, quote(meta.EventTableName), quote(fmt.Sprintf(sqlSequenceConstraint, meta.EventTableName))),
+		fmt.Sprintf(sqlCreateEventPublishIndex, quote(meta.EventTableName+"_publish_status_idx"), quote(meta.EventTableName)),
+		fmt.Sprintf(sqlCreateEventCommandIndex, quote(meta.EventTableName+"_command_idx"), quote(meta.EventTableName)),
+		fmt.Sprintf(sqlCreateEventPositionIndex, quote(meta.EventTableName+"_position_idx"), quote(meta.EventTableName)),
+		fmt.Sprintf(sqlCreateEventCorrelationIndex, quote(meta.EventTableName+"_correlation_idx"), quote(meta.EventTableName)),
+		fmt.Sprintf(sqlCreatePositionTable, quote(meta.PositionTableName)),
+		fmt.Sprintf(sqlCreateDataKeyTable, quote(meta.DataKeyTableName)),
+		fmt.Sprintf(sqlCreateSnapshotTable, quote(meta.SnapshotTableName)),
+		fmt.Sprintf(sqlCreateSnapshotIndex, quote(meta.SnapshotTableName+"_aggregate_idx"), quote(meta.SnapshotTableName)),
+	}
+	for _, statement := range statements {
+		if _, err := s.db.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// ensureRelationTable
+// @Description: 按聚合类型创建关系表，与es_mongo的RelationRepository.GetOrCreateCollection一样缓存已创建的表
+// @receiver s
+// @param ctx
+// @param tableName
+// @return error
+//
+func (s *EventStorage) ensureRelationTable(ctx context.Context, tableName string) error {
+	if _, ok := s.relationTables.Load(tableName); ok {
+		return nil
+	}
+	if _, err := s.db.ExecContext(ctx, fmt.Sprintf(sqlCreateRelationTable, quote(tableName))); err != nil {
+		return err
+	}
+	s.relationTables.Store(tableName, true)
+	return nil
+}
+
+func quote(name string) string {
+	return pgx.Identifier{name}.Sanitize()
+}
@@ -13,6 +13,9 @@ type EventStorage interface {
 	// Init 初始化
 	Init(metadata common.Metadata, getAdapter GetPubsubAdapter) error
 
+	// Close 关闭，停止后台任务
+	Close() error
+
 	// LoadEvent 加载事件
 	LoadEvent(ctx context.Context, req *LoadEventRequest) (*LoadResponse, error)
 
@@ -30,4 +33,40 @@ type EventStorage interface {
 
 	// GetRelations 获取聚合根关系
 	GetRelations(ctx context.Context, req *GetRelationsRequest) (*GetRelationsResponse, error)
+
+	// FindRelationReferences 跨关系表反向查询引用目标Id的聚合根关系
+	FindRelationReferences(ctx context.Context, req *FindRelationReferencesRequest) (*FindRelationReferencesResponse, error)
+
+	// ReadEventStream 按全局位置顺序读取事件，用于投影追赶与重建
+	ReadEventStream(ctx context.Context, req *ReadEventStreamRequest) (*ReadEventStreamResponse, error)
+
+	// ReplayEvents 将历史事件重新发布到指定的Topic，用于新建或重建读模型
+	ReplayEvents(ctx context.Context, req *ReplayEventsRequest) (*ReplayEventsResponse, error)
+
+	// GetCausalityChain 按CorrelationId查询跨聚合根的事件与命令
+	GetCausalityChain(ctx context.Context, req *GetCausalityChainRequest) (*GetCausalityChainResponse, error)
+
+	// FindEvents 分页查询事件，过滤与排序使用rsql
+	FindEvents(ctx context.Context, req *FindEventsRequest) (*FindEventsResponse, error)
+
+	// FindAggregates 分页查询聚合根，过滤与排序使用rsql
+	FindAggregates(ctx context.Context, req *FindAggregatesRequest) (*FindAggregatesResponse, error)
+
+	// CountAggregates 统计租户的聚合根数量
+	CountAggregates(ctx context.Context, req *CountAggregatesRequest) (*CountAggregatesResponse, error)
+
+	// ExistAggregate 聚合根是否存在
+	ExistAggregate(ctx context.Context, req *ExistAggregateRequest) (*ExistAggregateResponse, error)
+
+	// RestoreAggregate 恢复已删除的聚合根，并保存恢复事件
+	RestoreAggregate(ctx context.Context, req *RestoreAggregateRequest) (*RestoreAggregateResponse, error)
+
+	// ExportEvents 将租户的聚合根、事件、镜像与关系导出为NDJSON文件
+	ExportEvents(ctx context.Context, req *ExportEventsRequest) (*ExportEventsResponse, error)
+
+	// ImportEvents 导入ExportEvents导出的文件，保留Id与SequenceNumber
+	ImportEvents(ctx context.Context, req *ImportEventsRequest) (*ImportEventsResponse, error)
+
+	// EraseDataKey 销毁数据密钥，使用该密钥加密的事件字段不再可读
+	EraseDataKey(ctx context.Context, req *EraseDataKeyRequest) (*EraseDataKeyResponse, error)
 }
@@ -0,0 +1,512 @@
+package eventstorage
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+//
+// 导出文件为NDJSON格式，每行一条记录 {"type":"...","data":{...}}。
+// 第一行为header，之后按聚合根分组：aggregate记录后依次为该聚合根的event、snapshot、relation记录。
+//
+const (
+	ExportRecordHeader    = "header"
+	ExportRecordAggregate = "aggregate"
+	ExportRecordEvent     = "event"
+	ExportRecordSnapshot  = "snapshot"
+	ExportRecordRelation  = "relation"
+
+	ExportFormatVersion = 1
+)
+
+//
+// ExportEventsRequest
+// @Description: 导出租户的聚合根、事件、镜像与关系。AggregateType为空时导出所有类型。
+// 事件数据为解密后的明文，不导出数据密钥，导出文件需按明文数据保管；密钥已销毁的字段为nil。
+// Writer不为空时写入Writer，否则写入FileName，FileName以".gz"结尾或Gzip为true时使用gzip压缩。
+//
+type ExportEventsRequest struct {
+	TenantId      string    `json:"tenantId"`
+	AggregateType string    `json:"aggregateType"`
+	FileName      string    `json:"fileName"`
+	Gzip          bool      `json:"gzip"`
+	Writer        io.Writer `json:"-"`
+}
+
+type ExportEventsResponse struct {
+	AggregateCount uint64 `json:"aggregateCount"`
+	EventCount     uint64 `json:"eventCount"`
+	SnapshotCount  uint64 `json:"snapshotCount"`
+	RelationCount  uint64 `json:"relationCount"`
+}
+
+//
+// ImportEventsRequest
+// @Description: 导入ExportEvents导出的文件，自动识别gzip压缩。Reader不为空时读取Reader，否则读取FileName。
+// 聚合根已存在时返回错误，Overwrite为true时删除已有的聚合根、事件、镜像与关系后导入，SkipExisting为true时跳过已有的聚合根。
+// 每个聚合根单独导入，某个聚合根失败时停止导入，之前的聚合根不回滚，ImportEventsResponse.FailedAggregateId为失败的聚合根；
+// 处理失败原因后使用SkipExisting重新导入同一文件，从失败的聚合根继续。
+// 事件数据按导入方的encryptFields使用导入方的数据密钥重新加密。
+//
+type ImportEventsRequest struct {
+	FileName     string    `json:"fileName"`
+	Reader       io.Reader `json:"-"`
+	Overwrite    bool      `json:"overwrite"`
+	SkipExisting bool      `json:"skipExisting"`
+}
+
+type ImportEventsResponse struct {
+	AggregateCount uint64 `json:"aggregateCount"`
+	EventCount     uint64 `json:"eventCount"`
+	SnapshotCount  uint64 `json:"snapshotCount"`
+	RelationCount  uint64 `json:"relationCount"`
+	// SkippedCount SkipExisting为true时跳过的已有聚合根数量
+	SkippedCount uint64 `json:"skippedCount"`
+	// FailedAggregateId 导入失败的聚合根Id，之前的聚合根已导入
+	FailedAggregateId string `json:"failedAggregateId"`
+}
+
+type ExportHeader struct {
+	Version       int       `json:"version"`
+	TenantId      string    `json:"tenantId"`
+	AggregateType string    `json:"aggregateType"`
+	ExportTime    time.Time `json:"exportTime"`
+}
+
+type ExportEventDto struct {
+	Id             string                 `json:"id"`
+	TenantId       string                 `json:"tenantId"`
+	CommandId      string                 `json:"commandId"`
+	EventId        string                 `json:"eventId"`
+	Metadata       map[string]string      `json:"metadata"`
+	EventData      map[string]interface{} `json:"eventData"`
+	EventType      string                 `json:"eventType"`
+	EventVersion   string                 `json:"eventVersion"`
+	AggregateId    string                 `json:"aggregateId"`
+	AggregateType  string                 `json:"aggregateType"`
+	SequenceNumber uint64                 `json:"sequenceNumber"`
+	Relations      map[string]string      `json:"relations"`
+	RelationLists  map[string][]string    `json:"relationLists,omitempty"`
+	TimeStamp      time.Time              `json:"timeStamp"`
+	Topic          string                 `json:"topic"`
+	PubsubName     string                 `json:"pubsubName"`
+	PublishStatus  PublishStatus          `json:"publishStatus"`
+	EventTime      time.Time              `json:"eventTime"`
+	CausationId    string                 `json:"causationId"`
+	CorrelationId  string                 `json:"correlationId"`
+}
+
+type ExportSnapshotDto struct {
+	Id               string                 `json:"id"`
+	TenantId         string                 `json:"tenantId"`
+	AggregateId      string                 `json:"aggregateId"`
+	AggregateType    string                 `json:"aggregateType"`
+	AggregateData    map[string]interface{} `json:"aggregateData"`
+	AggregateVersion string                 `json:"aggregateVersion"`
+	SequenceNumber   uint64                 `json:"sequenceNumber"`
+	Metadata         map[string]string      `json:"metadata"`
+	TimeStamp        time.Time              `json:"timeStamp"`
+}
+
+// ExportRelationDto 关系记录，Items、Lists保留存储的字段名
+type ExportRelationDto struct {
+	Id          string              `json:"id"`
+	TenantId    string              `json:"tenantId"`
+	TableName   string              `json:"tableName"`
+	AggregateId string              `json:"aggregateId"`
+	IsDeleted   bool                `json:"isDeleted"`
+	Items       map[string]string   `json:"items"`
+	Lists       map[string][]string `json:"lists,omitempty"`
+}
+
+//
+// ExportAggregate
+// @Description: 一个聚合根及其事件、镜像与关系
+//
+type ExportAggregate struct {
+	Aggregate *AggregateDto
+	Events    []*ExportEventDto
+	Snapshots []*ExportSnapshotDto
+	Relations []*ExportRelationDto
+}
+
+//
+// Validate
+// @Description: 校验记录属于同一聚合根，事件的SequenceNumber从1开始连续，最后的序号与聚合根的SequenceNumber一致。
+// 与一致性检查的规则相同：聚合根SequenceGaps中标记的缺失序号，以及唯一索引创建前写入的重复序号不影响导入
+// @receiver a
+// @return error
+//
+func (a *ExportAggregate) Validate() error {
+	agg := a.Aggregate
+	if agg == nil || agg.TenantId == "" || agg.AggregateId == "" || agg.AggregateType == "" {
+		return errors.New("export aggregate record is incomplete")
+	}
+	sort.SliceStable(a.Events, func(i, j int) bool {
+		return a.Events[i].SequenceNumber < a.Events[j].SequenceNumber
+	})
+	markedGaps := make(map[uint64]bool, len(agg.SequenceGaps))
+	for _, gap := range agg.SequenceGaps {
+		markedGaps[gap] = true
+	}
+	expected := uint64(1)
+	for _, event := range a.Events {
+		if event.TenantId != agg.TenantId || event.AggregateId != agg.AggregateId {
+			return errors.New(fmt.Sprintf("event id \"%s\" does not belong to aggregate id \"%s\"", event.EventId, agg.AggregateId))
+		}
+		if event.SequenceNumber == 0 {
+			return errors.New(fmt.Sprintf("event id \"%s\" sequence number is 0", event.EventId))
+		}
+		for seq := expected; seq < event.SequenceNumber; seq++ {
+			if !markedGaps[seq] {
+				return errors.New(fmt.Sprintf("aggregate id \"%s\" sequence number %d is missing", agg.AggregateId, seq))
+			}
+		}
+		if event.SequenceNumber >= expected {
+			expected = event.SequenceNumber + 1
+		}
+	}
+	if expected-1 != agg.SequenceNumber {
+		return errors.New(fmt.Sprintf("aggregate id \"%s\" sequence number is %d, but last event sequence number is %d", agg.AggregateId, agg.SequenceNumber, expected-1))
+	}
+	for _, snapshot := range a.Snapshots {
+		if snapshot.TenantId != agg.TenantId || snapshot.AggregateId != agg.AggregateId {
+			return errors.New(fmt.Sprintf("snapshot id \"%s\" does not belong to aggregate id \"%s\"", snapshot.Id, agg.AggregateId))
+		}
+		if snapshot.SequenceNumber > agg.SequenceNumber {
+			return errors.New(fmt.Sprintf("snapshot id \"%s\" sequence number %d is greater than aggregate", snapshot.Id, snapshot.SequenceNumber))
+		}
+	}
+	for _, relation := range a.Relations {
+		if relation.TenantId != agg.TenantId || relation.AggregateId != agg.AggregateId {
+			return errors.New(fmt.Sprintf("relation id \"%s\" does not belong to aggregate id \"%s\"", relation.Id, agg.AggregateId))
+		}
+	}
+	return nil
+}
+
+type exportRecord struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+//
+// ExportWriter
+// @Description: 写入NDJSON导出文件
+//
+type ExportWriter struct {
+	enc      *json.Encoder
+	gz       *gzip.Writer
+	file     *os.File
+	response *ExportEventsResponse
+}
+
+//
+// NewExportWriter
+// @Description: 按请求创建导出文件并写入header
+// @param req
+// @return *ExportWriter
+// @return error
+//
+func NewExportWriter(req *ExportEventsRequest) (*ExportWriter, error) {
+	if req.TenantId == "" {
+		return nil, errors.New("tenantId cannot be empty")
+	}
+	w := &ExportWriter{response: &ExportEventsResponse{}}
+	out := req.Writer
+	useGzip := req.Gzip
+	if out == nil {
+		if req.FileName == "" {
+			return nil, errors.New("fileName cannot be empty")
+		}
+		file, err := os.Create(req.FileName)
+		if err != nil {
+			return nil, err
+		}
+		w.file, out = file, file
+		useGzip = useGzip || strings.HasSuffix(req.FileName, ".gz")
+	}
+	if useGzip {
+		w.gz = gzip.NewWriter(out)
+		out = w.gz
+	}
+	w.enc = json.NewEncoder(out)
+	header := &ExportHeader{
+		Version:       ExportFormatVersion,
+		TenantId:      req.TenantId,
+		AggregateType: req.AggregateType,
+		ExportTime:    time.Now(),
+	}
+	if err := w.writeRecord(ExportRecordHeader, header); err != nil {
+		_ = w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+//
+// Write
+// @Description: 写入一个聚合根及其事件、镜像与关系
+// @receiver w
+// @param agg
+// @return error
+//
+func (w *ExportWriter) Write(agg *ExportAggregate) error {
+	if err := w.writeRecord(ExportRecordAggregate, agg.Aggregate); err != nil {
+		return err
+	}
+	for _, event := range agg.Events {
+		if err := w.writeRecord(ExportRecordEvent, event); err != nil {
+			return err
+		}
+	}
+	for _, snapshot := range agg.Snapshots {
+		if err := w.writeRecord(ExportRecordSnapshot, snapshot); err != nil {
+			return err
+		}
+	}
+	for _, relation := range agg.Relations {
+		if err := w.writeRecord(ExportRecordRelation, relation); err != nil {
+			return err
+		}
+	}
+	w.response.AggregateCount++
+	w.response.EventCount += uint64(len(agg.Events))
+	w.response.SnapshotCount += uint64(len(agg.Snapshots))
+	w.response.RelationCount += uint64(len(agg.Relations))
+	return nil
+}
+
+func (w *ExportWriter) Response() *ExportEventsResponse {
+	return w.response
+}
+
+//
+// Close
+// @Description: 结束gzip压缩并关闭文件，未关闭时导出文件不完整
+// @receiver w
+// @return error
+//
+func (w *ExportWriter) Close() error {
+	var err error
+	if w.gz != nil {
+		err = w.gz.Close()
+	}
+	if w.file != nil {
+		if closeErr := w.file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (w *ExportWriter) writeRecord(recordType string, data interface{}) error {
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return w.enc.Encode(&exportRecord{Type: recordType, Data: bytes})
+}
+
+//
+// ExportReader
+// @Description: 读取NDJSON导出文件
+//
+type ExportReader struct {
+	dec      *json.Decoder
+	gz       *gzip.Reader
+	file     *os.File
+	header   *ExportHeader
+	pending  *exportRecord
+	response *ImportEventsResponse
+}
+
+//
+// NewExportReader
+// @Description: 按请求打开导出文件并读取header
+// @param req
+// @return *ExportReader
+// @return error
+//
+func NewExportReader(req *ImportEventsRequest) (*ExportReader, error) {
+	if req.Overwrite && req.SkipExisting {
+		return nil, errors.New("overwrite and skipExisting cannot both be true")
+	}
+	r := &ExportReader{response: &ImportEventsResponse{}}
+	in := req.Reader
+	if in == nil {
+		if req.FileName == "" {
+			return nil, errors.New("fileName cannot be empty")
+		}
+		file, err := os.Open(req.FileName)
+		if err != nil {
+			return nil, err
+		}
+		r.file, in = file, file
+	}
+	buf := bufio.NewReader(in)
+	if magic, err := buf.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buf)
+		if err != nil {
+			_ = r.Close()
+			return nil, err
+		}
+		r.gz = gz
+		r.dec = json.NewDecoder(gz)
+	} else {
+		r.dec = json.NewDecoder(buf)
+	}
+
+	record, err := r.readRecord()
+	if err == nil && (record == nil || record.Type != ExportRecordHeader) {
+		err = errors.New("export file header is missing")
+	}
+	if err == nil {
+		r.header = &ExportHeader{}
+		err = json.Unmarshal(record.Data, r.header)
+	}
+	if err == nil && r.header.Version != ExportFormatVersion {
+		err = errors.New(fmt.Sprintf("export file version %d is not supported", r.header.Version))
+	}
+	if err != nil {
+		_ = r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *ExportReader) Header() *ExportHeader {
+	return r.header
+}
+
+//
+// Next
+// @Description: 读取下一个聚合根及其事件、镜像与关系，并校验连续性。读取结束时返回io.EOF，校验失败时记录失败的聚合根
+// @receiver r
+// @return *ExportAggregate
+// @return error
+//
+func (r *ExportReader) Next() (*ExportAggregate, error) {
+	record, err := r.readRecord()
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, io.EOF
+	}
+	if record.Type != ExportRecordAggregate {
+		return nil, errors.New(fmt.Sprintf("export record %s is not after an aggregate", record.Type))
+	}
+	agg := &ExportAggregate{Aggregate: &AggregateDto{}}
+	if err := json.Unmarshal(record.Data, agg.Aggregate); err != nil {
+		return nil, err
+	}
+	for {
+		record, err = r.readRecord()
+		if err != nil {
+			return nil, err
+		}
+		if record == nil || record.Type == ExportRecordAggregate {
+			r.pending = record
+			break
+		}
+		switch record.Type {
+		case ExportRecordEvent:
+			event := &ExportEventDto{}
+			err = json.Unmarshal(record.Data, event)
+			agg.Events = append(agg.Events, event)
+		case ExportRecordSnapshot:
+			snapshot := &ExportSnapshotDto{}
+			err = json.Unmarshal(record.Data, snapshot)
+			agg.Snapshots = append(agg.Snapshots, snapshot)
+		case ExportRecordRelation:
+			relation := &ExportRelationDto{}
+			err = json.Unmarshal(record.Data, relation)
+			agg.Relations = append(agg.Relations, relation)
+		default:
+			err = errors.New(fmt.Sprintf("export record type %s is error", record.Type))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := agg.Validate(); err != nil {
+		r.response.FailedAggregateId = agg.Aggregate.AggregateId
+		return nil, err
+	}
+	return agg, nil
+}
+
+//
+// Imported
+// @Description: 记录已导入的聚合根
+// @receiver r
+// @param agg
+//
+func (r *ExportReader) Imported(agg *ExportAggregate) {
+	r.response.AggregateCount++
+	r.response.EventCount += uint64(len(agg.Events))
+	r.response.SnapshotCount += uint64(len(agg.Snapshots))
+	r.response.RelationCount += uint64(len(agg.Relations))
+}
+
+//
+// Skipped
+// @Description: 记录SkipExisting时跳过的已有聚合根
+// @receiver r
+// @param agg
+//
+func (r *ExportReader) Skipped(agg *ExportAggregate) {
+	r.response.SkippedCount++
+}
+
+//
+// Failed
+// @Description: 记录导入失败的聚合根
+// @receiver r
+// @param agg
+//
+func (r *ExportReader) Failed(agg *ExportAggregate) {
+	r.response.FailedAggregateId = agg.Aggregate.AggregateId
+}
+
+func (r *ExportReader) Response() *ImportEventsResponse {
+	return r.response
+}
+
+func (r *ExportReader) Close() error {
+	var err error
+	if r.gz != nil {
+		err = r.gz.Close()
+	}
+	if r.file != nil {
+		if closeErr := r.file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// readRecord 读取下一条记录，读取结束时返回nil
+func (r *ExportReader) readRecord() (*exportRecord, error) {
+	if r.pending != nil {
+		record := r.pending
+		r.pending = nil
+		return record, nil
+	}
+	record := &exportRecord{}
+	if err := r.dec.Decode(record); err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
@@ -0,0 +1,28 @@
+package eventstorage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestExportAggregate_Validate(t *testing.T) {
+	newAggregate := func(sequenceNumber uint64, gaps []uint64, sequenceNumbers ...uint64) *ExportAggregate {
+		agg := &ExportAggregate{Aggregate: &AggregateDto{TenantId: "t1", AggregateId: "a1", AggregateType: "Order", SequenceNumber: sequenceNumber, SequenceGaps: gaps}}
+		for _, seq := range sequenceNumbers {
+			agg.Events = append(agg.Events, &ExportEventDto{TenantId: "t1", AggregateId: "a1", SequenceNumber: seq})
+		}
+		return agg
+	}
+	assert.NoError(t, newAggregate(3, nil, 3, 1, 2).Validate())
+	assert.NoError(t, newAggregate(0, nil).Validate())
+
+	// 一致性修复时标记的缺失序号
+	assert.NoError(t, newAggregate(4, []uint64{2, 3}, 1, 4).Validate())
+	assert.EqualError(t, newAggregate(4, []uint64{2}, 1, 4).Validate(), "aggregate id \"a1\" sequence number 3 is missing")
+
+	// 唯一索引创建前写入的重复序号
+	assert.NoError(t, newAggregate(2, nil, 1, 2, 2).Validate())
+
+	assert.EqualError(t, newAggregate(3, nil, 1, 2).Validate(), "aggregate id \"a1\" sequence number is 3, but last event sequence number is 2")
+	assert.EqualError(t, newAggregate(1, nil, 0, 1).Validate(), "event id \"\" sequence number is 0")
+}
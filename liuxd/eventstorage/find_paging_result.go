@@ -57,7 +57,7 @@ func getTotalPage(totalRows uint64, pageSize uint64) uint64 {
 		return 0
 	}
 	totalPage := totalRows / pageSize
-	if totalRows%pageSize > 1 {
+	if totalRows%pageSize > 0 {
 		totalPage++
 	}
 	return totalPage
@@ -0,0 +1,16 @@
+package eventstorage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_GetTotalPage(t *testing.T) {
+	assert.Equal(t, uint64(0), getTotalPage(10, 0))
+	assert.Equal(t, uint64(0), getTotalPage(0, 10))
+	assert.Equal(t, uint64(1), getTotalPage(1, 10))
+	assert.Equal(t, uint64(1), getTotalPage(10, 10))
+	// 余数为1时也需要增加一页
+	assert.Equal(t, uint64(2), getTotalPage(11, 10))
+	assert.Equal(t, uint64(3), getTotalPage(21, 10))
+}
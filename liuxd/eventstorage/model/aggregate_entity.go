@@ -0,0 +1,32 @@
+package model
+
+import "github.com/liuxd6825/components-contrib/liuxd/eventstorage"
+
+type AggregateEntity struct {
+	Id             string `bson:"_id"`
+	TenantId       string `bson:"tenant_id" `
+	AggregateId    string `bson:"aggregate_id"`
+	AggregateType  string `bson:"aggregate_type"`
+	SequenceNumber uint64 `bson:"sequence_number"`
+	Deleted        bool   `bson:"deleted"`
+	// SequenceGaps 一致性修复时标记的无法恢复的缺失序号
+	SequenceGaps []uint64 `bson:"sequence_gaps,omitempty"`
+}
+
+// AggregateEventCount 按聚合根分组统计的事件数量
+type AggregateEventCount struct {
+	AggregateId   string `bson:"_id"`
+	AggregateType string `bson:"aggregate_type"`
+	Count         uint64 `bson:"count"`
+}
+
+func (a *AggregateEntity) NewAggregateDto() *eventstorage.AggregateDto {
+	return &eventstorage.AggregateDto{
+		TenantId:       a.TenantId,
+		AggregateId:    a.AggregateId,
+		AggregateType:  a.AggregateType,
+		SequenceNumber: a.SequenceNumber,
+		Deleted:        a.Deleted,
+		SequenceGaps:   a.SequenceGaps,
+	}
+}
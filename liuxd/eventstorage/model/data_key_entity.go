@@ -0,0 +1,50 @@
+package model
+
+import (
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+//
+// DataKeyEntity
+// @Description: 数据密钥，Id为tenantId/keyId，销毁后Key为nil
+//
+type DataKeyEntity struct {
+	Id         string             `bson:"_id"`
+	TenantId   string             `bson:"tenant_id"`
+	KeyId      string             `bson:"key_id"`
+	Key        []byte             `bson:"key"`
+	Erased     bool               `bson:"erased"`
+	CreateTime primitive.DateTime `bson:"create_time"`
+	EraseTime  primitive.DateTime `bson:"erase_time,omitempty"`
+}
+
+func NewDataKeyEntity(key *eventstorage.DataKey) *DataKeyEntity {
+	return &DataKeyEntity{
+		Id:         NewDataKeyId(key.TenantId, key.KeyId),
+		TenantId:   key.TenantId,
+		KeyId:      key.KeyId,
+		Key:        key.Key,
+		Erased:     key.Erased,
+		CreateTime: primitive.NewDateTimeFromTime(key.CreateTime),
+	}
+}
+
+func NewDataKeyId(tenantId string, keyId string) string {
+	return tenantId + "/" + keyId
+}
+
+func (e *DataKeyEntity) NewDataKey() *eventstorage.DataKey {
+	res := &eventstorage.DataKey{
+		TenantId:   e.TenantId,
+		KeyId:      e.KeyId,
+		Key:        e.Key,
+		Erased:     e.Erased,
+		CreateTime: e.CreateTime.Time(),
+	}
+	if e.EraseTime != 0 {
+		eraseTime := e.EraseTime.Time()
+		res.EraseTime = &eraseTime
+	}
+	return res
+}
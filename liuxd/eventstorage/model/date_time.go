@@ -0,0 +1,16 @@
+package model
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+//
+// NewDateTime
+// @Description: 将time.Time转换为实体的时间字段类型，其它存储不需要直接依赖mongo的primitive包
+// @param t
+// @return primitive.DateTime
+//
+func NewDateTime(t time.Time) primitive.DateTime {
+	return primitive.NewDateTimeFromTime(t)
+}
@@ -0,0 +1,237 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/other"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+type EventEntity struct {
+	Id              string                     `bson:"_id"`
+	TenantId        string                     `bson:"tenant_id" `
+	CommandId       string                     `bson:"command_id"`
+	EventId         string                     `bson:"event_id"`
+	Metadata        map[string]string          `bson:"meta_data"`
+	EventData       map[string]interface{}     `bson:"event_data"`
+	EventType       string                     `bson:"event_type"`
+	EventVersion    string                     `bson:"event_version"`
+	AggregateId     string                     `bson:"aggregate_id"`
+	AggregateType   string                     `bson:"aggregate_type"`
+	SequenceNumber  uint64                     `bson:"sequence_number"`
+	Position        uint64                     `bson:"position"`
+	Relations       map[string]string          `bson:"relations"`
+	RelationLists   map[string][]string        `bson:"relation_lists,omitempty"`
+	TimeStamp       primitive.DateTime         `bson:"time_stamp"`
+	Topic           string                     `bson:"topic"`
+	PublishName     string                     `bson:"publish_name"`
+	PublishStatus   eventstorage.PublishStatus `bson:"publish_status"`
+	PublishAttempts int                        `bson:"publish_attempts"`
+	PublishError    string                     `bson:"publish_error"`
+	NextPublishTime primitive.DateTime         `bson:"next_publish_time"`
+	EventTime       primitive.DateTime         `bson:"event_time,omitempty"`
+	CausationId     string                     `bson:"causation_id"`
+	CorrelationId   string                     `bson:"correlation_id"`
+	// DataCodec EventData的保存格式，为空时EventData按BSON文档保存，否则EventData为空，编码后的数据保存在EncodedData
+	DataCodec   other.DataCodec `bson:"data_codec,omitempty"`
+	EncodedData []byte          `bson:"encoded_data,omitempty"`
+}
+
+func (e *EventEntity) Validate() error {
+	if e == nil {
+		return errors.New("event is nil")
+	}
+	if e.Id == NilObjectID {
+		return errors.New("event.id is empty")
+	}
+	if e.TenantId == "" {
+		return errors.New("event.tenantId is empty")
+	}
+	if e.EventId == "" {
+		return errors.New("event.eventId is empty")
+	}
+	if e.EventVersion == "" {
+		return errors.New("event.eventRevision is empty")
+	}
+	if e.Topic == "" {
+		return errors.New("event.topic is empty")
+	}
+	if e.AggregateType == "" {
+		return errors.New("event.aggregateType is empty")
+	}
+	if e.AggregateId == "" {
+		return errors.New("event.aggregateId is empty")
+	}
+	if e.PublishName == "" {
+		return errors.New("event.publishName is empty")
+	}
+	return nil
+}
+
+//
+// Upcast
+// @Description: 返回转换到最新版本的事件副本，没有可用的转换时返回自身
+// @receiver e
+// @param registry
+// @return *EventEntity
+// @return error
+//
+func (e *EventEntity) Upcast(registry *eventstorage.UpcasterRegistry) (*EventEntity, error) {
+	if registry == nil {
+		return e, nil
+	}
+	data, version, err := registry.Upcast(e.EventType, e.EventVersion, e.EventData)
+	if err != nil {
+		return nil, err
+	}
+	if version == e.EventVersion {
+		return e, nil
+	}
+	res := *e
+	res.EventData = data
+	res.EventVersion = version
+	return &res, nil
+}
+
+//
+// Decrypt
+// @Description: 返回解密事件数据后的事件副本，需在Upcast之前调用
+// @receiver e
+// @param ctx
+// @param encryptor
+// @return *EventEntity
+// @return error
+//
+func (e *EventEntity) Decrypt(ctx context.Context, encryptor *eventstorage.FieldEncryptor) (*EventEntity, error) {
+	data, err := encryptor.Decrypt(ctx, e.TenantId, e.AggregateId, e.AggregateType, e.EventData)
+	if err != nil {
+		return nil, err
+	}
+	res := *e
+	res.EventData = data
+	return &res, nil
+}
+
+//
+// Encrypt
+// @Description: 返回加密事件数据后的事件副本，用于导入
+// @receiver e
+// @param ctx
+// @param encryptor
+// @return *EventEntity
+// @return error
+//
+func (e *EventEntity) Encrypt(ctx context.Context, encryptor *eventstorage.FieldEncryptor) (*EventEntity, error) {
+	data, err := encryptor.Encrypt(ctx, e.TenantId, e.AggregateId, e.AggregateType, e.EventData, e.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	res := *e
+	res.EventData = data
+	return &res, nil
+}
+
+//
+// Encode
+// @Description: 返回按codec编码事件数据后的事件副本，codec为bson时返回自身
+// @receiver e
+// @param codec
+// @return *EventEntity
+// @return error
+//
+func (e *EventEntity) Encode(codec other.DataCodec) (*EventEntity, error) {
+	if codec == "" || codec == other.DataCodecBson || e.DataCodec != "" {
+		return e, nil
+	}
+	data, err := other.EncodeData(codec, e.EventData)
+	if err != nil {
+		return nil, err
+	}
+	res := *e
+	res.EventData = nil
+	res.DataCodec = codec
+	res.EncodedData = data
+	return &res, nil
+}
+
+//
+// Decode
+// @Description: 解码Encode保存的事件数据
+// @receiver e
+// @return error
+//
+func (e *EventEntity) Decode() error {
+	if e.DataCodec == "" {
+		return nil
+	}
+	data, err := other.DecodeData(e.DataCodec, e.EncodedData)
+	if err != nil {
+		return err
+	}
+	e.EventData = data
+	e.DataCodec = ""
+	e.EncodedData = nil
+	return nil
+}
+
+// NewEventTime 客户端未设置事件时间时不保存
+func NewEventTime(t time.Time) primitive.DateTime {
+	if t.IsZero() {
+		return 0
+	}
+	return primitive.NewDateTimeFromTime(t)
+}
+
+// GetEventTime 客户端未设置事件时间时返回零值
+func (e *EventEntity) GetEventTime() time.Time {
+	if e.EventTime == 0 {
+		return time.Time{}
+	}
+	return e.EventTime.Time()
+}
+
+func (e *EventEntity) NewCausalityEventDto() *eventstorage.CausalityEventDto {
+	return &eventstorage.CausalityEventDto{
+		TenantId:       e.TenantId,
+		AggregateId:    e.AggregateId,
+		AggregateType:  e.AggregateType,
+		CommandId:      e.CommandId,
+		EventId:        e.EventId,
+		EventType:      e.EventType,
+		EventVersion:   e.EventVersion,
+		SequenceNumber: e.SequenceNumber,
+		CausationId:    e.CausationId,
+		CorrelationId:  e.CorrelationId,
+		EventTime:      e.GetEventTime(),
+		TimeStamp:      e.TimeStamp.Time(),
+	}
+}
+
+func (e *EventEntity) NewFindEventDto() *eventstorage.FindEventDto {
+	return &eventstorage.FindEventDto{
+		TenantId:        e.TenantId,
+		AggregateId:     e.AggregateId,
+		AggregateType:   e.AggregateType,
+		CommandId:       e.CommandId,
+		EventId:         e.EventId,
+		EventData:       e.EventData,
+		EventType:       e.EventType,
+		EventVersion:    e.EventVersion,
+		SequenceNumber:  e.SequenceNumber,
+		Position:        e.Position,
+		Metadata:        e.Metadata,
+		Relations:       e.Relations,
+		RelationLists:   e.RelationLists,
+		Topic:           e.Topic,
+		PubsubName:      e.PublishName,
+		PublishStatus:   e.PublishStatus,
+		PublishAttempts: e.PublishAttempts,
+		PublishError:    e.PublishError,
+		CausationId:     e.CausationId,
+		CorrelationId:   e.CorrelationId,
+		EventTime:       e.GetEventTime(),
+		TimeStamp:       e.TimeStamp.Time(),
+	}
+}
@@ -0,0 +1,206 @@
+package model
+
+import (
+	"context"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+//
+// NewExportAggregate
+// @Description: 将聚合根及其事件、镜像与关系转换为导出记录
+// @param agg
+// @param events 按SequenceNumber排序的事件
+// @param snapshots
+// @param relation 聚合根的关系，没有关系时为nil
+// @return *eventstorage.ExportAggregate
+//
+func NewExportAggregate(agg *AggregateEntity, events []*EventEntity, snapshots []*SnapshotEntity, relation *RelationEntity) *eventstorage.ExportAggregate {
+	res := &eventstorage.ExportAggregate{
+		Aggregate: agg.NewAggregateDto(),
+		Events:    make([]*eventstorage.ExportEventDto, 0, len(events)),
+		Snapshots: make([]*eventstorage.ExportSnapshotDto, 0, len(snapshots)),
+	}
+	for _, e := range events {
+		res.Events = append(res.Events, &eventstorage.ExportEventDto{
+			Id:             e.Id,
+			TenantId:       e.TenantId,
+			CommandId:      e.CommandId,
+			EventId:        e.EventId,
+			Metadata:       e.Metadata,
+			EventData:      e.EventData,
+			EventType:      e.EventType,
+			EventVersion:   e.EventVersion,
+			AggregateId:    e.AggregateId,
+			AggregateType:  e.AggregateType,
+			SequenceNumber: e.SequenceNumber,
+			Relations:      e.Relations,
+			RelationLists:  e.RelationLists,
+			TimeStamp:      e.TimeStamp.Time(),
+			Topic:          e.Topic,
+			PubsubName:     e.PublishName,
+			PublishStatus:  e.PublishStatus,
+			EventTime:      e.GetEventTime(),
+			CausationId:    e.CausationId,
+			CorrelationId:  e.CorrelationId,
+		})
+	}
+	for _, s := range snapshots {
+		res.Snapshots = append(res.Snapshots, &eventstorage.ExportSnapshotDto{
+			Id:               s.Id,
+			TenantId:         s.TenantId,
+			AggregateId:      s.AggregateId,
+			AggregateType:    s.AggregateType,
+			AggregateData:    s.AggregateData,
+			AggregateVersion: s.AggregateVersion,
+			SequenceNumber:   s.SequenceNumber,
+			Metadata:         s.Metadata,
+			TimeStamp:        s.TimeStamp.Time(),
+		})
+	}
+	if relation != nil {
+		res.Relations = append(res.Relations, &eventstorage.ExportRelationDto{
+			Id:          relation.Id,
+			TenantId:    relation.TenantId,
+			TableName:   relation.TableName,
+			AggregateId: relation.AggregateId,
+			IsDeleted:   relation.IsDeleted,
+			Items:       relation.Items,
+			Lists:       relation.Lists,
+		})
+	}
+	return res
+}
+
+//
+// ImportEntities
+// @Description: 导入记录转换后的实体，Id与SequenceNumber保持不变，Position由存储重新分配
+//
+type ImportEntities struct {
+	Aggregate *AggregateEntity
+	Events    []*EventEntity
+	Snapshots []*SnapshotEntity
+	Relations []*RelationEntity
+}
+
+func NewImportEntities(agg *eventstorage.ExportAggregate) *ImportEntities {
+	dto := agg.Aggregate
+	res := &ImportEntities{
+		Aggregate: &AggregateEntity{
+			Id:             dto.AggregateId,
+			TenantId:       dto.TenantId,
+			AggregateId:    dto.AggregateId,
+			AggregateType:  dto.AggregateType,
+			SequenceNumber: dto.SequenceNumber,
+			Deleted:        dto.Deleted,
+			SequenceGaps:   dto.SequenceGaps,
+		},
+	}
+	for _, e := range agg.Events {
+		res.Events = append(res.Events, &EventEntity{
+			Id:             e.Id,
+			TenantId:       e.TenantId,
+			CommandId:      e.CommandId,
+			EventId:        e.EventId,
+			Metadata:       e.Metadata,
+			EventData:      e.EventData,
+			EventType:      e.EventType,
+			EventVersion:   e.EventVersion,
+			AggregateId:    e.AggregateId,
+			AggregateType:  e.AggregateType,
+			SequenceNumber: e.SequenceNumber,
+			Relations:      e.Relations,
+			RelationLists:  e.RelationLists,
+			TimeStamp:      newDateTime(e.TimeStamp),
+			Topic:          e.Topic,
+			PublishName:    e.PubsubName,
+			PublishStatus:  e.PublishStatus,
+			EventTime:      NewEventTime(e.EventTime),
+			CausationId:    e.CausationId,
+			CorrelationId:  e.CorrelationId,
+		})
+	}
+	for _, s := range agg.Snapshots {
+		res.Snapshots = append(res.Snapshots, &SnapshotEntity{
+			Id:               s.Id,
+			TenantId:         s.TenantId,
+			AggregateId:      s.AggregateId,
+			AggregateType:    s.AggregateType,
+			AggregateData:    s.AggregateData,
+			AggregateVersion: s.AggregateVersion,
+			SequenceNumber:   s.SequenceNumber,
+			Metadata:         s.Metadata,
+			TimeStamp:        newDateTime(s.TimeStamp),
+		})
+	}
+	for _, r := range agg.Relations {
+		items := RelationItems{}
+		for k, v := range r.Items {
+			items[k] = v
+		}
+		var lists RelationLists
+		for k, v := range r.Lists {
+			if lists == nil {
+				lists = RelationLists{}
+			}
+			lists[k] = v
+		}
+		res.Relations = append(res.Relations, &RelationEntity{
+			Id:          r.Id,
+			TenantId:    r.TenantId,
+			TableName:   r.TableName,
+			AggregateId: r.AggregateId,
+			IsDeleted:   r.IsDeleted,
+			Items:       items,
+			Lists:       lists,
+		})
+	}
+	return res
+}
+
+//
+// Encrypt
+// @Description: 导出的事件数据为明文，导入前按encryptor的配置重新加密
+// @receiver i
+// @param ctx
+// @param encryptor
+// @return error
+//
+func (i *ImportEntities) Encrypt(ctx context.Context, encryptor *eventstorage.FieldEncryptor) error {
+	for j, event := range i.Events {
+		encrypted, err := event.Encrypt(ctx, encryptor)
+		if err != nil {
+			return err
+		}
+		i.Events[j] = encrypted
+	}
+	return nil
+}
+
+//
+// Validate
+// @Description: 校验导入的事件与关系
+// @receiver i
+// @return error
+//
+func (i *ImportEntities) Validate() error {
+	for _, event := range i.Events {
+		if err := event.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, relation := range i.Relations {
+		if err := relation.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newDateTime(t time.Time) primitive.DateTime {
+	if t.IsZero() {
+		return primitive.NewDateTimeFromTime(time.Now())
+	}
+	return primitive.NewDateTimeFromTime(t)
+}
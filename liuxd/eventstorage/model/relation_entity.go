@@ -0,0 +1,308 @@
+package model
+
+import (
+	"errors"
+	"github.com/liuxd6825/components-contrib/liuxd/common/utils"
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	RelationIdField     = "_id"
+	RelationTenantId    = "tenant_id"
+	RelationTableName   = "table_name"
+	RelationAggregateId = "aggregate_id"
+	RelationIsDeleted   = "is_deleted"
+)
+
+/*
+type RelationEntity map[string]interface{}
+
+func (r RelationEntity) SetId(v string) {
+	r[RelationIdField] = v
+}
+
+func (r RelationEntity) GetId() string {
+	return r.GetString(RelationIdField)
+}
+
+func (r RelationEntity) SetTenantId(v string) {
+	r[RelationTenantId] = v
+}
+
+func (r RelationEntity) GetTenantId() string {
+	return r.GetString(RelationTenantId)
+}
+
+func (r RelationEntity) SetTableName(v string) {
+	r[RelationTableName] = v
+}
+
+func (r RelationEntity) GetTableName() string {
+	return r.GetString(RelationTableName)
+}
+
+func (r RelationEntity) SetAggregateId(v string) {
+	r[RelationAggregateId] = v
+}
+
+func (r RelationEntity) GetTableAggregateId() string {
+	return r.GetString(RelationAggregateId)
+}
+
+func (r RelationEntity) SetIsDeleted(v bool) {
+	r[RelationIsDeleted] = v
+}
+
+func (r RelationEntity) GetIsDeleted() bool {
+	return r.GetBool(RelationIsDeleted)
+}
+
+func (r RelationEntity) AddItem(idName, idValue string) {
+	name := utils.AsMongoName(idName)
+	r[name] = idValue
+}
+
+func (r RelationEntity) GetBool(key string) bool {
+	v, ok := r[key]
+	if ok {
+		return v.(bool)
+	}
+	return false
+}
+
+func (r RelationEntity) GetString(key string) string {
+	v, ok := r[key]
+	if ok {
+		return v.(string)
+	}
+	return ""
+}
+*/
+
+type RelationItems map[string]string
+
+// RelationLists 多值关系，一个关系名称对应多个Id
+type RelationLists map[string][]string
+
+//
+// RelationEntity
+// @Description: 聚合根的关系，Items与Lists都保存为文档的第一级字段，Lists保存为数组，按关系名称查询时包含该值即匹配
+//
+type RelationEntity struct {
+	Id          string        `bson:"_id"`
+	TenantId    string        `bson:"tenant_id"`
+	TableName   string        `bson:"table_name"`
+	AggregateId string        `bson:"aggregate_id"`
+	IsDeleted   bool          `bson:"is_deleted"`
+	Items       RelationItems `bson:",inline"`
+	Lists       RelationLists `bson:"-"`
+}
+
+func NewRelationEntity(tenantId, aggregateId, aggregateType string, items map[string]string, lists map[string][]string) *RelationEntity {
+	tableName := utils.AsMongoName(aggregateType)
+	/*
+		res := &RelationEntity{}
+		res.SetTableName(tableName)
+		res.SetAggregateId(aggregateId)
+		res.SetAggregateId(aggregateId)
+		res.SetTenantId(tenantId)
+		res.SetIsDeleted(false)
+	*/
+	res := &RelationEntity{
+		Id:          aggregateId,
+		TenantId:    tenantId,
+		AggregateId: aggregateId,
+		TableName:   tableName,
+		IsDeleted:   false,
+		Items:       map[string]string{},
+	}
+	// 添加关系。注意：如果关系值是空，则不添加。
+	if items != nil && len(items) > 0 {
+		for key, value := range items {
+			if len(value) > 0 {
+				res.AddItem(key, value)
+			}
+		}
+	}
+	for key, values := range lists {
+		res.AddList(key, values)
+	}
+	return res
+}
+
+func (r RelationEntity) AddItem(idName, idValue string) {
+	name := utils.AsMongoName(idName)
+	r.Items[name] = idValue
+}
+
+//
+// AddList
+// @Description: 添加多值关系，忽略空值与重复值，没有值时不添加
+// @receiver r
+// @param idName
+// @param idValues
+//
+func (r *RelationEntity) AddList(idName string, idValues []string) {
+	values := make([]string, 0, len(idValues))
+	exists := make(map[string]bool, len(idValues))
+	for _, value := range idValues {
+		if len(value) > 0 && !exists[value] {
+			exists[value] = true
+			values = append(values, value)
+		}
+	}
+	if len(values) == 0 {
+		return
+	}
+	if r.Lists == nil {
+		r.Lists = RelationLists{}
+	}
+	r.Lists[utils.AsMongoName(idName)] = values
+}
+
+func (r *RelationEntity) NewRelation() *eventstorage.Relation {
+	return &eventstorage.Relation{
+		Id:          r.Id,
+		TenantId:    r.TenantId,
+		TableName:   r.TableName,
+		AggregateId: r.AggregateId,
+		IsDeleted:   r.IsDeleted,
+		Items:       r.Items,
+		Lists:       r.Lists,
+	}
+}
+
+// IsEmpty 是否没有关系
+func (r *RelationEntity) IsEmpty() bool {
+	return len(r.Items) == 0 && len(r.Lists) == 0
+}
+
+//
+// MarshalBSON
+// @Description: Items、Lists保存为文档的第一级字段
+// @receiver r
+// @return []byte
+// @return error
+//
+func (r RelationEntity) MarshalBSON() ([]byte, error) {
+	doc := bson.M{
+		RelationIdField:     r.Id,
+		RelationTenantId:    r.TenantId,
+		RelationTableName:   r.TableName,
+		RelationAggregateId: r.AggregateId,
+		RelationIsDeleted:   r.IsDeleted,
+	}
+	for k, v := range r.Items {
+		doc[k] = v
+	}
+	for k, v := range r.Lists {
+		doc[k] = v
+	}
+	return bson.Marshal(doc)
+}
+
+//
+// UnmarshalBSON
+// @Description: 文档的第一级字段中，字符串为Items，数组为Lists
+// @receiver r
+// @param data
+// @return error
+//
+func (r *RelationEntity) UnmarshalBSON(data []byte) error {
+	var doc bson.M
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	*r = RelationEntity{Items: RelationItems{}}
+	for k, v := range doc {
+		switch k {
+		case RelationIdField:
+			r.Id, _ = v.(string)
+		case RelationTenantId:
+			r.TenantId, _ = v.(string)
+		case RelationTableName:
+			r.TableName, _ = v.(string)
+		case RelationAggregateId:
+			r.AggregateId, _ = v.(string)
+		case RelationIsDeleted:
+			r.IsDeleted, _ = v.(bool)
+		default:
+			switch value := v.(type) {
+			case string:
+				r.Items[k] = value
+			case primitive.A:
+				if r.Lists == nil {
+					r.Lists = RelationLists{}
+				}
+				list := make([]string, 0, len(value))
+				for _, item := range value {
+					if str, ok := item.(string); ok {
+						list = append(list, str)
+					}
+				}
+				r.Lists[k] = list
+			}
+		}
+	}
+	return nil
+}
+
+func (r *RelationEntity) Validate() error {
+	if r == nil {
+		return errors.New("relation is nil")
+	}
+	if len(r.TableName) == 0 {
+		return errors.New("Relation.TableName cannot be empty")
+	}
+	if len(r.TenantId) == 0 {
+		return errors.New("Relation.TenantId cannot be empty")
+	}
+	if len(r.AggregateId) == 0 {
+		return errors.New("Relation.AggregateId cannot be empty")
+	}
+	if len(r.Id) == 0 {
+		return errors.New("Relation.Id cannot be empty")
+	}
+	return nil
+}
+
+// RelationOperation 关系变更的操作
+type RelationOperation string
+
+const (
+	RelationOperationSave    RelationOperation = "save"
+	RelationOperationDelete  RelationOperation = "delete"
+	RelationOperationRestore RelationOperation = "restore"
+)
+
+//
+// RelationHistoryEntity
+// @Description: 关系的一次变更，IsDeleted、Items为变更后的关系，remove删除模式下删除时为删除前的关系
+//
+type RelationHistoryEntity struct {
+	Id          string             `bson:"_id"`
+	TenantId    string             `bson:"tenant_id"`
+	TableName   string             `bson:"table_name"`
+	AggregateId string             `bson:"aggregate_id"`
+	Operation   RelationOperation  `bson:"operation"`
+	IsDeleted   bool               `bson:"is_deleted"`
+	Items       RelationItems      `bson:"items"`
+	Lists       RelationLists      `bson:"lists,omitempty"`
+	TimeStamp   primitive.DateTime `bson:"time_stamp"`
+}
+
+func NewRelationHistoryEntity(relation *RelationEntity, operation RelationOperation) *RelationHistoryEntity {
+	return &RelationHistoryEntity{
+		Id:          NewObjectID(),
+		TenantId:    relation.TenantId,
+		TableName:   relation.TableName,
+		AggregateId: relation.AggregateId,
+		Operation:   operation,
+		IsDeleted:   relation.IsDeleted,
+		Items:       relation.Items,
+		Lists:       relation.Lists,
+		TimeStamp:   utils.NewMongoNow(),
+	}
+}
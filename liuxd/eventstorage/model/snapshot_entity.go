@@ -0,0 +1,77 @@
+package model
+
+import (
+	"github.com/liuxd6825/components-contrib/liuxd/eventstorage/es_mongo/other"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type SnapshotEntity struct {
+	Id               string                 `bson:"_id"`
+	TenantId         string                 `bson:"tenant_id"`
+	AggregateId      string                 `bson:"aggregate_id"`
+	AggregateType    string                 `bson:"aggregate_type"`
+	AggregateData    map[string]interface{} `bson:"aggregate_data"`
+	AggregateVersion string                 `bson:"aggregate_version"`
+	SequenceNumber   uint64                 `bson:"sequence_number"`
+	Metadata         map[string]string      `bson:"metadata"`
+	TimeStamp        primitive.DateTime     `bson:"time_stamp"`
+	// DataCodec AggregateData的保存格式，为空时AggregateData按BSON文档保存，否则编码后的数据保存在EncodedData
+	DataCodec   other.DataCodec `bson:"data_codec,omitempty"`
+	EncodedData []byte          `bson:"encoded_data,omitempty"`
+	// DataFile 编码后的数据是否保存在GridFS中
+	DataFile bool `bson:"data_file,omitempty"`
+	// DataFileId GridFS文件Id，每次保存生成新的Id，为空时与镜像Id相同
+	DataFileId string `bson:"data_file_id,omitempty"`
+}
+
+func (s *SnapshotEntity) GetDataFileId() string {
+	if s.DataFileId != "" {
+		return s.DataFileId
+	}
+	return s.Id
+}
+
+//
+// Encode
+// @Description: 返回按codec编码聚合数据后的镜像副本，codec为bson时返回自身
+// @receiver s
+// @param codec
+// @return *SnapshotEntity
+// @return error
+//
+func (s *SnapshotEntity) Encode(codec other.DataCodec) (*SnapshotEntity, error) {
+	if codec == "" || codec == other.DataCodecBson || s.DataCodec != "" {
+		return s, nil
+	}
+	data, err := other.EncodeData(codec, s.AggregateData)
+	if err != nil {
+		return nil, err
+	}
+	res := *s
+	res.AggregateData = nil
+	res.DataCodec = codec
+	res.EncodedData = data
+	return &res, nil
+}
+
+//
+// Decode
+// @Description: 解码Encode保存的聚合数据，保存在GridFS中的数据需先读取到EncodedData
+// @receiver s
+// @return error
+//
+func (s *SnapshotEntity) Decode() error {
+	if s.DataCodec == "" {
+		return nil
+	}
+	data, err := other.DecodeData(s.DataCodec, s.EncodedData)
+	if err != nil {
+		return err
+	}
+	s.AggregateData = data
+	s.DataCodec = ""
+	s.EncodedData = nil
+	s.DataFile = false
+	s.DataFileId = ""
+	return nil
+}
@@ -2,7 +2,12 @@ package eventstorage
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/liuxd6825/components-contrib/liuxd/common/utils"
+	"github.com/liuxd6825/components-contrib/pubsub"
+	"sort"
+	"strconv"
 	"time"
 )
 
@@ -10,6 +15,12 @@ type LoadEventRequest struct {
 	TenantId      string `json:"tenantId"`
 	AggregateId   string `json:"aggregateId"`
 	AggregateType string `json:"aggregateType"`
+	// AggregateVersion 聚合根当前版本，不为空时忽略AggregateVersion不同的镜像
+	AggregateVersion string `json:"aggregateVersion"`
+	// ToSequenceNumber 只加载序号不大于此值的镜像与事件，为0时加载最新状态
+	ToSequenceNumber uint64 `json:"toSequenceNumber"`
+	// ToTime 只加载此时间及之前的事件，与ToSequenceNumber同时设置时取较早的位置
+	ToTime *time.Time `json:"toTime"`
 }
 
 type LoadResponse struct {
@@ -46,8 +57,12 @@ type Event struct {
 	EventVersion  string                 `json:"eventVersion"`
 	PubsubName    string                 `json:"pubsubName"`
 	Relations     map[string]string      `json:"relations"`
+	RelationLists map[string][]string    `json:"relationLists"`
 	Topic         string                 `json:"topic"`
 	Metadata      map[string]string      `json:"metadata"`
+	EventTime     time.Time              `json:"eventTime"`
+	CausationId   string                 `json:"causationId"`
+	CorrelationId string                 `json:"correlationId"`
 }
 
 func NewEvent(tenantId string, aggregateId string, aggregateType string, event EventDto) (*Event, error) {
@@ -64,10 +79,48 @@ func NewEvent(tenantId string, aggregateId string, aggregateType string, event E
 		Topic:         event.Topic,
 		Metadata:      event.Metadata,
 		Relations:     event.Relations,
+		RelationLists: event.RelationLists,
+		EventTime:     event.EventTime,
+		CausationId:   event.GetCausationId(),
+		CorrelationId: event.GetCorrelationId(),
 	}
 	return res, nil
 }
 
+//
+// DeadLetterEvent
+// @Description: 发送失败次数达到上限的事件，复制到死信主题，PubsubName、Topic为事件原来的发送目标。
+// 同一聚合根的后续事件继续发送，原主题的订阅者不会收到该事件
+//
+type DeadLetterEvent struct {
+	Event      *Event    `json:"event"`
+	PubsubName string    `json:"pubsubName"`
+	Topic      string    `json:"topic"`
+	Attempts   int       `json:"attempts"`
+	Error      string    `json:"error"`
+	Time       time.Time `json:"time"`
+}
+
+const (
+	CausationIdMetadataKey   = "causationId"
+	CorrelationIdMetadataKey = "correlationId"
+)
+
+func (e *EventDto) GetCausationId() string {
+	return e.getTraceId(e.CausationId, CausationIdMetadataKey)
+}
+
+func (e *EventDto) GetCorrelationId() string {
+	return e.getTraceId(e.CorrelationId, CorrelationIdMetadataKey)
+}
+
+func (e *EventDto) getTraceId(value string, metadataKey string) string {
+	if value != "" {
+		return value
+	}
+	return e.Metadata[metadataKey]
+}
+
 type EventDto struct {
 	Metadata     map[string]string      `json:"metadata"`
 	CommandId    string                 `json:"commandId"`
@@ -79,16 +132,30 @@ type EventDto struct {
 	EventTime    time.Time              `json:"eventTime"`
 	PubsubName   string                 `json:"pubsubName"`
 	Topic        string                 `json:"topic"`
+	// RelationLists 多值关系，一个关系名称对应多个Id，如 {"tagIds": ["t1", "t2"]}
+	RelationLists map[string][]string `json:"relationLists"`
+	// CausationId 引起本事件的消息Id，为空时使用Metadata中的causationId，都为空时不记录
+	CausationId string `json:"causationId"`
+	// CorrelationId 同一业务流程的关联Id，为空时使用Metadata中的correlationId，都为空时不记录
+	CorrelationId string `json:"correlationId"`
 }
 
 type ApplyEventsRequest struct {
 	TenantId      string `json:"tenantId"`
 	AggregateId   string `json:"aggregateId"`
 	AggregateType string `json:"aggregateType"`
-	Events        *[]EventDto
+	// ExpectedSequenceNumber 加载聚合根时的SequenceNumber，为0时不做乐观锁检查
+	ExpectedSequenceNumber uint64 `json:"expectedSequenceNumber"`
+	// AggregateVersion 聚合根当前版本，不为空时计算SnapshotRequired只考虑该版本的镜像
+	AggregateVersion string `json:"aggregateVersion"`
+	Events           *[]EventDto
 }
 
 type ApplyEventsResponse struct {
+	// SequenceNumber 应用事件后聚合根的序号
+	SequenceNumber uint64 `json:"sequenceNumber"`
+	// SnapshotRequired 距上一个镜像的事件数量达到镜像策略，调用方应保存镜像
+	SnapshotRequired bool `json:"snapshotRequired"`
 }
 
 type CreateEventRequest struct {
@@ -105,7 +172,9 @@ type DeleteEventRequest struct {
 	TenantId      string `json:"tenantId"`
 	AggregateId   string `json:"aggregateId"`
 	AggregateType string `json:"aggregateType"`
-	Event         *EventDto
+	// ExpectedSequenceNumber 加载聚合根时的SequenceNumber，为0时不做乐观锁检查
+	ExpectedSequenceNumber uint64 `json:"expectedSequenceNumber"`
+	Event                  *EventDto
 }
 
 type DeleteEventResponse struct {
@@ -124,13 +193,379 @@ type SaveSnapshotRequest struct {
 type SaveSnapshotResponse struct {
 }
 
+//
+// ReadEventStreamRequest
+// @Description: 按全局位置读取事件。TenantId、AggregateType、EventType为空时不过滤。
+//
+type ReadEventStreamRequest struct {
+	TenantId      string `json:"tenantId"`
+	AggregateType string `json:"aggregateType"`
+	EventType     string `json:"eventType"`
+	// FromPosition 检查点，返回位置大于此值的事件，从头读取时为0
+	FromPosition uint64 `json:"fromPosition"`
+	// Limit 最大数量，为0时使用默认值
+	Limit uint64 `json:"limit"`
+}
+
+type ReadEventStreamResponse struct {
+	Events []*StreamEventDto `json:"events"`
+	// LastPosition 本次读取的最后位置，作为下一次读取的FromPosition
+	LastPosition uint64 `json:"lastPosition"`
+	// HasMore 是否还有未读取的事件
+	HasMore bool `json:"hasMore"`
+}
+
+type StreamEventDto struct {
+	Position       uint64                 `json:"position"`
+	TenantId       string                 `json:"tenantId"`
+	AggregateId    string                 `json:"aggregateId"`
+	AggregateType  string                 `json:"aggregateType"`
+	CommandId      string                 `json:"commandId"`
+	EventId        string                 `json:"eventId"`
+	EventData      map[string]interface{} `json:"eventData"`
+	EventType      string                 `json:"eventType"`
+	EventVersion   string                 `json:"eventVersion"`
+	SequenceNumber uint64                 `json:"sequenceNumber"`
+	Metadata       map[string]string      `json:"metadata"`
+	TimeStamp      time.Time              `json:"timeStamp"`
+}
+
+const (
+	DefaultReadEventStreamLimit = 100
+	MaxReadEventStreamLimit     = 1000
+)
+
+//
+// GetLimit
+// @Description: 返回有效的读取数量，为0时使用默认值，不超过最大值
+// @receiver r
+// @return uint64
+//
+func (r *ReadEventStreamRequest) GetLimit() uint64 {
+	if r.Limit == 0 {
+		return DefaultReadEventStreamLimit
+	}
+	if r.Limit > MaxReadEventStreamLimit {
+		return MaxReadEventStreamLimit
+	}
+	return r.Limit
+}
+
+//
+// ReplayEventsRequest
+// @Description: 将历史事件按全局位置顺序重新发布到指定的PubsubName/Topic，用于新建或重建读模型。
+// 每次调用最多发布Limit个事件，使用响应中的LastPosition作为下一次的FromPosition，直到HasMore为false。
+//
+type ReplayEventsRequest struct {
+	TenantId      string `json:"tenantId"`
+	AggregateType string `json:"aggregateType"`
+	// FromTime、ToTime 事件时间范围，为空时不限制
+	FromTime *time.Time `json:"fromTime"`
+	ToTime   *time.Time `json:"toTime"`
+	// FromSequenceNumber、ToSequenceNumber 聚合根内事件序号范围，为0时不限制
+	FromSequenceNumber uint64 `json:"fromSequenceNumber"`
+	ToSequenceNumber   uint64 `json:"toSequenceNumber"`
+	PubsubName         string `json:"pubsubName"`
+	Topic              string `json:"topic"`
+	// ReplayId 重放标识，写入消息元数据，为空时生成新的标识，续传时需使用响应中返回的值
+	ReplayId string `json:"replayId"`
+	// FromPosition 检查点，从位置大于此值的事件开始重放，从头开始时为0
+	FromPosition uint64 `json:"fromPosition"`
+	// Limit 本次调用最多发布的事件数量，为0时使用默认值
+	Limit uint64 `json:"limit"`
+}
+
+type ReplayEventsResponse struct {
+	ReplayId string `json:"replayId"`
+	// PublishedCount 本次调用发布的事件数量
+	PublishedCount uint64 `json:"publishedCount"`
+	// ProcessedCount 到LastPosition为止已重放的事件数量
+	ProcessedCount uint64 `json:"processedCount"`
+	// TotalCount 范围内的事件总数
+	TotalCount uint64 `json:"totalCount"`
+	// LastPosition 最后一个已发布事件的位置，作为续传的FromPosition
+	LastPosition uint64 `json:"lastPosition"`
+	HasMore      bool   `json:"hasMore"`
+}
+
+const (
+	// ReplayMetadataKey 重放消息的元数据标记，值为"true"，消费者据此区分重放与实时事件
+	ReplayMetadataKey         = "replay"
+	ReplayIdMetadataKey       = "replayId"
+	ReplayPositionMetadataKey = "replayPosition"
+)
+
+//
+// Validate
+// @Description: 检查必填字段
+// @receiver r
+// @return error
+//
+func (r *ReplayEventsRequest) Validate() error {
+	if r.TenantId == "" {
+		return errors.New("tenantId cannot be empty")
+	}
+	if r.AggregateType == "" {
+		return errors.New("aggregateType cannot be empty")
+	}
+	if r.PubsubName == "" {
+		return errors.New("pubsubName cannot be empty")
+	}
+	if r.Topic == "" {
+		return errors.New("topic cannot be empty")
+	}
+	if r.ToSequenceNumber > 0 && r.ToSequenceNumber < r.FromSequenceNumber {
+		return errors.New(fmt.Sprintf("toSequenceNumber %d is less than fromSequenceNumber %d", r.ToSequenceNumber, r.FromSequenceNumber))
+	}
+	return nil
+}
+
+//
+// GetLimit
+// @Description: 返回有效的发布数量，与ReadEventStreamRequest.GetLimit一致
+// @receiver r
+// @return uint64
+//
+func (r *ReplayEventsRequest) GetLimit() uint64 {
+	if r.Limit == 0 {
+		return DefaultReadEventStreamLimit
+	}
+	if r.Limit > MaxReadEventStreamLimit {
+		return MaxReadEventStreamLimit
+	}
+	return r.Limit
+}
+
+//
+// NewPublishRequest
+// @Description: 创建重放消息，消息体与实时发布的事件相同，元数据中增加重放标记
+// @receiver r
+// @param event
+// @param position
+// @return *pubsub.PublishRequest
+// @return error
+//
+func (r *ReplayEventsRequest) NewPublishRequest(event *Event, position uint64) (*pubsub.PublishRequest, error) {
+	replayEvent := *event
+	replayEvent.PubsubName = r.PubsubName
+	replayEvent.Topic = r.Topic
+	replayEvent.Metadata = make(map[string]string, len(event.Metadata)+3)
+	for k, v := range event.Metadata {
+		replayEvent.Metadata[k] = v
+	}
+	replayEvent.Metadata[ReplayMetadataKey] = "true"
+	replayEvent.Metadata[ReplayIdMetadataKey] = r.ReplayId
+	replayEvent.Metadata[ReplayPositionMetadataKey] = strconv.FormatUint(position, 10)
+
+	bytes, err := json.Marshal(replayEvent)
+	if err != nil {
+		return nil, err
+	}
+	contentType := "json"
+	return &pubsub.PublishRequest{
+		PubsubName:  replayEvent.PubsubName,
+		Topic:       replayEvent.Topic,
+		Metadata:    replayEvent.Metadata,
+		ContentType: &contentType,
+		Data:        bytes,
+	}, nil
+}
+
+//
+// GetCausalityChainRequest
+// @Description: 按CorrelationId查询跨聚合根的事件与命令
+//
+type GetCausalityChainRequest struct {
+	TenantId      string `json:"tenantId"`
+	CorrelationId string `json:"correlationId"`
+}
+
+type GetCausalityChainResponse struct {
+	CorrelationId string `json:"correlationId"`
+	// Events 按写入顺序排列的事件
+	Events []*CausalityEventDto `json:"events"`
+	// Commands 按首次出现的顺序排列的命令
+	Commands []*CausalityCommandDto `json:"commands"`
+	// HasMore 事件数量超过MaxCausalityChainEvents时为true，只返回前面的事件
+	HasMore bool `json:"hasMore"`
+}
+
+type CausalityEventDto struct {
+	TenantId       string    `json:"tenantId"`
+	AggregateId    string    `json:"aggregateId"`
+	AggregateType  string    `json:"aggregateType"`
+	CommandId      string    `json:"commandId"`
+	EventId        string    `json:"eventId"`
+	EventType      string    `json:"eventType"`
+	EventVersion   string    `json:"eventVersion"`
+	SequenceNumber uint64    `json:"sequenceNumber"`
+	CausationId    string    `json:"causationId"`
+	CorrelationId  string    `json:"correlationId"`
+	EventTime      time.Time `json:"eventTime"`
+	TimeStamp      time.Time `json:"timeStamp"`
+}
+
+type CausalityCommandDto struct {
+	CommandId string `json:"commandId"`
+	// CausationId 引起命令的消息Id，取命令第一个事件的CausationId
+	CausationId   string   `json:"causationId"`
+	AggregateId   string   `json:"aggregateId"`
+	AggregateType string   `json:"aggregateType"`
+	EventIds      []string `json:"eventIds"`
+}
+
+const MaxCausalityChainEvents = 1000
+
+//
+// NewGetCausalityChainResponse
+// @Description: events按写入顺序排列，最多MaxCausalityChainEvents+1个，多出的一个用于判断是否还有更多事件
+// @param correlationId
+// @param events
+// @return *GetCausalityChainResponse
+//
+func NewGetCausalityChainResponse(correlationId string, events []*CausalityEventDto) *GetCausalityChainResponse {
+	res := &GetCausalityChainResponse{
+		CorrelationId: correlationId,
+		Events:        events,
+		Commands:      make([]*CausalityCommandDto, 0),
+	}
+	if len(res.Events) > MaxCausalityChainEvents {
+		res.Events = res.Events[:MaxCausalityChainEvents]
+		res.HasMore = true
+	}
+	commands := make(map[string]*CausalityCommandDto)
+	for _, event := range res.Events {
+		if event.CommandId == "" {
+			continue
+		}
+		command, ok := commands[event.CommandId]
+		if !ok {
+			command = &CausalityCommandDto{
+				CommandId:     event.CommandId,
+				CausationId:   event.CausationId,
+				AggregateId:   event.AggregateId,
+				AggregateType: event.AggregateType,
+			}
+			commands[event.CommandId] = command
+			res.Commands = append(res.Commands, command)
+		}
+		command.EventIds = append(command.EventIds, event.EventId)
+	}
+	return res
+}
+
 type ExistAggregateRequest struct {
 	TenantId    string `json:"tenantId"`
 	AggregateId string `json:"aggregateId"`
 }
 
 type ExistAggregateResponse struct {
+	// IsExist 聚合根是否存在，包括已删除的聚合根
 	IsExist bool `json:"isExist"`
+	// IsDeleted 聚合根是否已删除
+	IsDeleted bool `json:"isDeleted"`
+}
+
+//
+// FindAggregatesRequest
+// @Description: 分页查询聚合根，Filter、Sort使用rsql，可用字段为aggregateId、aggregateType、sequenceNumber、deleted。
+// AggregateType为空时查询所有类型。
+//
+type FindAggregatesRequest struct {
+	TenantId      string `json:"tenantId"`
+	AggregateType string `json:"aggregateType"`
+	Filter        string `json:"filter"`
+	Sort          string `json:"sort"`
+	PageNum       uint64 `json:"pageNum"`
+	PageSize      uint64 `json:"pageSize"`
+}
+
+func (r *FindAggregatesRequest) GetTenantId() string {
+	return r.TenantId
+}
+
+func (r *FindAggregatesRequest) GetFilter() string {
+	return r.Filter
+}
+
+func (r *FindAggregatesRequest) GetSort() string {
+	return r.Sort
+}
+
+func (r *FindAggregatesRequest) GetPageNum() uint64 {
+	return r.PageNum
+}
+
+func (r *FindAggregatesRequest) GetPageSize() uint64 {
+	return r.PageSize
+}
+
+type FindAggregatesResponse struct {
+	Data       []*AggregateDto `json:"data"`
+	TotalRows  uint64          `json:"totalRows"`
+	TotalPages uint64          `json:"totalPages"`
+	PageNum    uint64          `json:"pageNum"`
+	PageSize   uint64          `json:"pageSize"`
+	Filter     string          `json:"filter"`
+	Sort       string          `json:"sort"`
+	Error      string          `json:"error"`
+	IsFound    bool            `json:"isFound"`
+}
+
+type AggregateDto struct {
+	TenantId       string `json:"tenantId"`
+	AggregateId    string `json:"aggregateId"`
+	AggregateType  string `json:"aggregateType"`
+	SequenceNumber uint64 `json:"sequenceNumber"`
+	Deleted        bool   `json:"deleted"`
+	// SequenceGaps 一致性修复时标记的无法恢复的缺失序号
+	SequenceGaps []uint64 `json:"sequenceGaps,omitempty"`
+}
+
+func NewFindAggregatesResponse(data []*AggregateDto, totalRows uint64, req *FindAggregatesRequest) *FindAggregatesResponse {
+	findRes := NewFindPagingResult[*AggregateDto](&data, totalRows, req, nil)
+	return &FindAggregatesResponse{
+		Data:       data,
+		TotalRows:  findRes.TotalRows,
+		TotalPages: findRes.TotalPages,
+		PageSize:   findRes.PageSize,
+		PageNum:    findRes.PageNum,
+		Filter:     findRes.Filter,
+		Sort:       findRes.Sort,
+		IsFound:    findRes.IsFound,
+	}
+}
+
+//
+// CountAggregatesRequest
+// @Description: 统计租户的聚合根数量，Filter使用rsql，AggregateType为空时统计所有类型
+//
+type CountAggregatesRequest struct {
+	TenantId      string `json:"tenantId"`
+	AggregateType string `json:"aggregateType"`
+	Filter        string `json:"filter"`
+}
+
+type CountAggregatesResponse struct {
+	Count uint64 `json:"count"`
+}
+
+//
+// RestoreAggregateRequest
+// @Description: 恢复已删除的聚合根，Event为恢复事件，与DeleteEventRequest一致保存并发送
+//
+type RestoreAggregateRequest struct {
+	TenantId      string `json:"tenantId"`
+	AggregateId   string `json:"aggregateId"`
+	AggregateType string `json:"aggregateType"`
+	// ExpectedSequenceNumber 加载聚合根时的SequenceNumber，为0时不做乐观锁检查
+	ExpectedSequenceNumber uint64 `json:"expectedSequenceNumber"`
+	Event                  *EventDto
+}
+
+type RestoreAggregateResponse struct {
+	// SequenceNumber 恢复事件的序号
+	SequenceNumber uint64 `json:"sequenceNumber"`
 }
 
 type CreateEventLogRequest struct {
@@ -183,6 +618,8 @@ type GetRelationsRequest struct {
 	Sort          string `json:"sort"`
 	PageNum       uint64 `json:"pageNum"`
 	PageSize      uint64 `json:"pageSize"`
+	// IncludeDeleted 是否包含已删除聚合根的关系，默认不包含
+	IncludeDeleted bool `json:"includeDeleted"`
 }
 
 func (g *GetRelationsRequest) GetTenantId() string {
@@ -217,12 +654,13 @@ type GetRelationsResponse struct {
 }
 
 type Relation struct {
-	Id          string            `json:"id"`
-	TenantId    string            `json:"tenantId"`
-	TableName   string            `json:"tableName"`
-	AggregateId string            `json:"aggregateId"`
-	IsDeleted   bool              `json:"isDeleted"`
-	Items       map[string]string `json:"items"`
+	Id          string              `json:"id"`
+	TenantId    string              `json:"tenantId"`
+	TableName   string              `json:"tableName"`
+	AggregateId string              `json:"aggregateId"`
+	IsDeleted   bool                `json:"isDeleted"`
+	Items       map[string]string   `json:"items"`
+	Lists       map[string][]string `json:"lists"`
 }
 
 func (r *Relation) MarshalJSON() ([]byte, error) {
@@ -236,5 +674,193 @@ func (r *Relation) MarshalJSON() ([]byte, error) {
 		name := utils.AsJsonName(k)
 		data[name] = v
 	}
+	for k, v := range r.Lists {
+		name := utils.AsJsonName(k)
+		data[name] = v
+	}
 	return json.Marshal(data)
 }
+
+//
+// FindRelationReferencesRequest
+// @Description: 反向查询关系，查找关系RelationName的值为TargetId或多值关系包含TargetId的聚合根，
+// AggregateTypes为空时查询租户所有聚合类型的关系表。结果按TableName、Id排序
+//
+type FindRelationReferencesRequest struct {
+	TenantId       string   `json:"tenantId"`
+	RelationName   string   `json:"relationName"`
+	TargetId       string   `json:"targetId"`
+	AggregateTypes []string `json:"aggregateTypes"`
+	// IncludeDeleted 是否包含已删除聚合根的关系，默认不包含
+	IncludeDeleted bool   `json:"includeDeleted"`
+	PageNum        uint64 `json:"pageNum"`
+	PageSize       uint64 `json:"pageSize"`
+}
+
+func (r *FindRelationReferencesRequest) GetTenantId() string {
+	return r.TenantId
+}
+
+func (r *FindRelationReferencesRequest) GetFilter() string {
+	return ""
+}
+
+func (r *FindRelationReferencesRequest) GetSort() string {
+	return ""
+}
+
+func (r *FindRelationReferencesRequest) GetPageNum() uint64 {
+	return r.PageNum
+}
+
+func (r *FindRelationReferencesRequest) GetPageSize() uint64 {
+	return r.PageSize
+}
+
+//
+// Validate
+// @Description: 校验TenantId、RelationName、TargetId不能为空
+// @receiver r
+// @return error
+//
+func (r *FindRelationReferencesRequest) Validate() error {
+	if r.TenantId == "" {
+		return errors.New("tenantId cannot be empty")
+	}
+	if r.RelationName == "" {
+		return errors.New("relationName cannot be empty")
+	}
+	if r.TargetId == "" {
+		return errors.New("targetId cannot be empty")
+	}
+	return nil
+}
+
+//
+// NewRelationTableNames
+// @Description: 聚合类型对应的关系表名称，去重并按名称排序，用于跨关系表分页
+// @param aggregateTypes
+// @return []string
+//
+func NewRelationTableNames(aggregateTypes []string) []string {
+	exists := make(map[string]bool, len(aggregateTypes))
+	tableNames := make([]string, 0, len(aggregateTypes))
+	for _, aggregateType := range aggregateTypes {
+		tableName := utils.AsMongoName(aggregateType)
+		if tableName != "" && !exists[tableName] {
+			exists[tableName] = true
+			tableNames = append(tableNames, tableName)
+		}
+	}
+	sort.Strings(tableNames)
+	return tableNames
+}
+
+type FindRelationReferencesResponse struct {
+	Data       []*Relation `json:"data"`
+	TotalRows  uint64      `json:"totalRows"`
+	TotalPages uint64      `json:"totalPages"`
+	PageNum    uint64      `json:"pageNum"`
+	PageSize   uint64      `json:"pageSize"`
+	IsFound    bool        `json:"isFound"`
+}
+
+func NewFindRelationReferencesResponse(data []*Relation, totalRows uint64, req *FindRelationReferencesRequest) *FindRelationReferencesResponse {
+	findRes := NewFindPagingResult[*Relation](&data, totalRows, req, nil)
+	return &FindRelationReferencesResponse{
+		Data:       data,
+		TotalRows:  findRes.TotalRows,
+		TotalPages: findRes.TotalPages,
+		PageSize:   findRes.PageSize,
+		PageNum:    findRes.PageNum,
+		IsFound:    findRes.IsFound,
+	}
+}
+
+//
+// FindEventsRequest
+// @Description: 分页查询事件，Filter、Sort使用rsql，字段名与事件的json名称一致，
+// eventData、metadata、relations下的字段使用"."访问，如 eventType=='OrderCancelled';eventData.reason=='fraud'
+//
+type FindEventsRequest struct {
+	TenantId string `json:"tenantId"`
+	Filter   string `json:"filter"`
+	Sort     string `json:"sort"`
+	PageNum  uint64 `json:"pageNum"`
+	PageSize uint64 `json:"pageSize"`
+}
+
+func (r *FindEventsRequest) GetTenantId() string {
+	return r.TenantId
+}
+
+func (r *FindEventsRequest) GetFilter() string {
+	return r.Filter
+}
+
+func (r *FindEventsRequest) GetSort() string {
+	return r.Sort
+}
+
+func (r *FindEventsRequest) GetPageNum() uint64 {
+	return r.PageNum
+}
+
+func (r *FindEventsRequest) GetPageSize() uint64 {
+	return r.PageSize
+}
+
+type FindEventsResponse struct {
+	Data       []*FindEventDto `json:"data"`
+	TotalRows  uint64          `json:"totalRows"`
+	TotalPages uint64          `json:"totalPages"`
+	PageNum    uint64          `json:"pageNum"`
+	PageSize   uint64          `json:"pageSize"`
+	Filter     string          `json:"filter"`
+	Sort       string          `json:"sort"`
+	Error      string          `json:"error"`
+	IsFound    bool            `json:"isFound"`
+}
+
+//
+// FindEventDto
+// @Description: 查询到的事件，EventData为存储的原始数据，不做版本升级
+//
+type FindEventDto struct {
+	TenantId        string                 `json:"tenantId"`
+	AggregateId     string                 `json:"aggregateId"`
+	AggregateType   string                 `json:"aggregateType"`
+	CommandId       string                 `json:"commandId"`
+	EventId         string                 `json:"eventId"`
+	EventData       map[string]interface{} `json:"eventData"`
+	EventType       string                 `json:"eventType"`
+	EventVersion    string                 `json:"eventVersion"`
+	SequenceNumber  uint64                 `json:"sequenceNumber"`
+	Position        uint64                 `json:"position"`
+	Metadata        map[string]string      `json:"metadata"`
+	Relations       map[string]string      `json:"relations"`
+	RelationLists   map[string][]string    `json:"relationLists"`
+	Topic           string                 `json:"topic"`
+	PubsubName      string                 `json:"pubsubName"`
+	PublishStatus   PublishStatus          `json:"publishStatus"`
+	PublishAttempts int                    `json:"publishAttempts"`
+	PublishError    string                 `json:"publishError"`
+	CausationId     string                 `json:"causationId"`
+	CorrelationId   string                 `json:"correlationId"`
+	EventTime       time.Time              `json:"eventTime"`
+	TimeStamp       time.Time              `json:"timeStamp"`
+}
+
+func NewFindEventsResponse(data []*FindEventDto, totalRows uint64, req *FindEventsRequest) *FindEventsResponse {
+	findRes := NewFindPagingResult[*FindEventDto](&data, totalRows, req, nil)
+	return &FindEventsResponse{
+		Data:       data,
+		TotalRows:  findRes.TotalRows,
+		TotalPages: findRes.TotalPages,
+		PageSize:   findRes.PageSize,
+		PageNum:    findRes.PageNum,
+		Filter:     findRes.Filter,
+		Sort:       findRes.Sort,
+		IsFound:    findRes.IsFound,
+	}
+}
@@ -0,0 +1,220 @@
+package eventstorage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/liuxd6825/components-contrib/liuxd/common"
+	"github.com/xeipuuv/gojsonschema"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// EventSchemasMetadataKey 存储组件metadata中事件数据JSON Schema的键，值为EventSchemaConfig数组的JSON
+	EventSchemasMetadataKey = "eventSchemas"
+	// EventSchemaDirMetadataKey 存储组件metadata中JSON Schema目录的键，文件路径为 {dir}/{aggregateType}/{eventType}/{eventVersion}.json
+	EventSchemaDirMetadataKey = "eventSchemaDir"
+)
+
+//
+// EventSchemaConfig
+// @Description: 一个聚合类型的一个事件类型版本的JSON Schema，用于metadata中的eventSchemas配置
+//
+type EventSchemaConfig struct {
+	AggregateType string          `json:"aggregateType"`
+	EventType     string          `json:"eventType"`
+	EventVersion  string          `json:"eventVersion"`
+	Schema        json.RawMessage `json:"schema"`
+}
+
+//
+// SchemaRegistry
+// @Description: 事件数据JSON Schema注册表，按AggregateType、EventType和EventVersion查找。
+// 没有注册Schema的事件不校验。
+//
+type SchemaRegistry struct {
+	mu      sync.RWMutex
+	schemas map[string]*gojsonschema.Schema
+}
+
+func NewSchemaRegistry() *SchemaRegistry {
+	return &SchemaRegistry{schemas: make(map[string]*gojsonschema.Schema)}
+}
+
+//
+// NewSchemaRegistryFromMetadata
+// @Description: 创建存储使用的注册表，注册metadata中的eventSchemas及eventSchemaDir目录中的Schema
+// @param metadata
+// @return *SchemaRegistry
+// @return error
+//
+func NewSchemaRegistryFromMetadata(metadata common.Metadata) (*SchemaRegistry, error) {
+	registry := NewSchemaRegistry()
+	if val, ok := metadata.Properties[EventSchemasMetadataKey]; ok && val != "" {
+		if err := registry.RegisterJson(val); err != nil {
+			return nil, err
+		}
+	}
+	if val, ok := metadata.Properties[EventSchemaDirMetadataKey]; ok && val != "" {
+		if err := registry.RegisterDir(val); err != nil {
+			return nil, err
+		}
+	}
+	return registry, nil
+}
+
+//
+// Register
+// @Description: 注册JSON Schema，同一聚合类型的同一事件类型版本只能注册一次
+// @receiver r
+// @param aggregateType
+// @param eventType
+// @param eventVersion
+// @param schema JSON Schema文本
+// @return error
+//
+func (r *SchemaRegistry) Register(aggregateType, eventType, eventVersion string, schema []byte) error {
+	if aggregateType == "" || eventType == "" || eventVersion == "" {
+		return errors.New("event schema aggregateType, eventType and eventVersion cannot be empty")
+	}
+	compiled, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(schema))
+	if err != nil {
+		return errors.New(fmt.Sprintf("event schema %s %s %s error: %s", aggregateType, eventType, eventVersion, err.Error()))
+	}
+	key := schemaKey(aggregateType, eventType, eventVersion)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.schemas[key]; ok {
+		return errors.New(fmt.Sprintf("event schema %s %s %s already registered", aggregateType, eventType, eventVersion))
+	}
+	r.schemas[key] = compiled
+	return nil
+}
+
+//
+// RegisterJson
+// @Description: 注册EventSchemaConfig数组的JSON
+// @receiver r
+// @param data
+// @return error
+//
+func (r *SchemaRegistry) RegisterJson(data string) error {
+	var configs []EventSchemaConfig
+	if err := json.Unmarshal([]byte(data), &configs); err != nil {
+		return fmt.Errorf("incorrect %s field from metadata", EventSchemasMetadataKey)
+	}
+	for _, config := range configs {
+		if err := r.Register(config.AggregateType, config.EventType, config.EventVersion, config.Schema); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// RegisterDir
+// @Description: 注册目录中的Schema文件，路径为 {dir}/{aggregateType}/{eventType}/{eventVersion}.json，其他文件忽略
+// @receiver r
+// @param dir
+// @return error
+//
+func (r *SchemaRegistry) RegisterDir(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || filepath.Ext(path) != ".json" {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		if len(parts) != 3 {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return r.Register(parts[0], parts[1], strings.TrimSuffix(parts[2], ".json"), data)
+	})
+}
+
+//
+// Validate
+// @Description: 按聚合类型、事件类型和版本校验事件数据，没有注册Schema时不校验
+// @receiver r
+// @param aggregateType
+// @param event
+// @return error 校验失败时为*SchemaValidationError
+//
+func (r *SchemaRegistry) Validate(aggregateType string, event *EventDto) error {
+	if r == nil || event == nil {
+		return nil
+	}
+	r.mu.RLock()
+	schema, ok := r.schemas[schemaKey(aggregateType, event.EventType, event.EventVersion)]
+	r.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	result, err := schema.Validate(gojsonschema.NewGoLoader(event.EventData))
+	if err != nil {
+		return err
+	}
+	if result.Valid() {
+		return nil
+	}
+	validationErr := &SchemaValidationError{
+		AggregateType: aggregateType,
+		EventId:       event.EventId,
+		EventType:     event.EventType,
+		EventVersion:  event.EventVersion,
+	}
+	for _, resultErr := range result.Errors() {
+		field := resultErr.Field()
+		if property, ok := resultErr.Details()["property"].(string); ok && resultErr.Type() == "required" {
+			if field == gojsonschema.STRING_ROOT_SCHEMA_PROPERTY {
+				field = property
+			} else {
+				field = field + "." + property
+			}
+		}
+		validationErr.Fields = append(validationErr.Fields, &SchemaFieldError{
+			Field:   field,
+			Type:    resultErr.Type(),
+			Message: resultErr.Description(),
+		})
+	}
+	return validationErr
+}
+
+//
+// ValidateEvents
+// @Description: 依次校验事件，返回第一个校验失败的错误
+// @receiver r
+// @param aggregateType
+// @param events
+// @return error
+//
+func (r *SchemaRegistry) ValidateEvents(aggregateType string, events *[]EventDto) error {
+	if r == nil || events == nil {
+		return nil
+	}
+	for i := range *events {
+		if err := r.Validate(aggregateType, &(*events)[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func schemaKey(aggregateType, eventType, eventVersion string) string {
+	return aggregateType + "/" + eventType + "/" + eventVersion
+}
@@ -0,0 +1,55 @@
+package eventstorage
+
+import (
+	"github.com/liuxd6825/components-contrib/liuxd/common"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testOrderSchema = `{"type":"object","required":["orderId","amount"],"properties":{
+	"orderId":{"type":"string"},
+	"amount":{"type":"number","minimum":0},
+	"customer":{"type":"object","required":["name"]}}}`
+
+func TestSchemaRegistry_Validate(t *testing.T) {
+	registry := NewSchemaRegistry()
+	assert.NoError(t, registry.RegisterJson(`[{"aggregateType":"Order","eventType":"OrderCreated","eventVersion":"1.0","schema":`+testOrderSchema+`}]`))
+
+	event := &EventDto{EventId: "e1", EventType: "OrderCreated", EventVersion: "1.0", EventData: map[string]interface{}{"orderId": "o1", "amount": 1.5}}
+	assert.NoError(t, registry.Validate("Order", event))
+
+	event.EventData = map[string]interface{}{"amount": -1, "customer": map[string]interface{}{}}
+	err := registry.Validate("Order", event)
+	assert.True(t, IsSchemaValidationError(err))
+	validationErr := err.(*SchemaValidationError)
+	var fields []string
+	for _, field := range validationErr.Fields {
+		fields = append(fields, field.Field+":"+field.Type)
+	}
+	assert.ElementsMatch(t, []string{"orderId:required", "amount:number_gte", "customer.name:required"}, fields)
+
+	// 没有注册Schema的聚合类型与版本不校验
+	assert.NoError(t, registry.Validate("Customer", event))
+	event.EventVersion = "2.0"
+	assert.NoError(t, registry.Validate("Order", event))
+
+	assert.EqualError(t, registry.Register("Order", "OrderCreated", "1.0", []byte(testOrderSchema)), "event schema Order OrderCreated 1.0 already registered")
+	assert.Error(t, registry.Register("Order", "OrderPaid", "1.0", []byte(`{"type":1}`)))
+}
+
+func TestSchemaRegistry_FromMetadata(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "Order", "OrderCreated"), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "Order", "OrderCreated", "1.0.json"), []byte(testOrderSchema), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "README.md"), []byte("schemas"), 0o644))
+
+	registry, err := NewSchemaRegistryFromMetadata(common.Metadata{Properties: map[string]string{EventSchemaDirMetadataKey: dir}})
+	assert.NoError(t, err)
+	err = registry.Validate("Order", &EventDto{EventId: "e1", EventType: "OrderCreated", EventVersion: "1.0", EventData: map[string]interface{}{"orderId": "o1"}})
+	assert.EqualError(t, err, "event id \"e1\" OrderCreated 1.0 schema validation failed: amount: amount is required")
+
+	_, err = NewSchemaRegistryFromMetadata(common.Metadata{Properties: map[string]string{EventSchemasMetadataKey: "{"}})
+	assert.EqualError(t, err, "incorrect eventSchemas field from metadata")
+}
@@ -0,0 +1,77 @@
+package eventstorage
+
+import (
+	"fmt"
+	"github.com/liuxd6825/components-contrib/liuxd/common"
+	"strconv"
+	"strings"
+)
+
+const (
+	snapshotEventCount  = "snapshotEventCount"
+	snapshotEventCounts = "snapshotEventCounts"
+	snapshotRetainCount = "snapshotRetainCount"
+)
+
+// SnapshotPolicy 镜像策略
+//   snapshotEventCount  : 距上一个镜像的事件数量达到此值时，ApplyEventsResponse.SnapshotRequired为true，0表示不提示
+//   snapshotEventCounts : 按聚合类型设置事件数量，格式为 "Order:100,Customer:50"，未设置的类型使用snapshotEventCount
+//   snapshotRetainCount : 每个聚合根保留的最新镜像数量，保存镜像后删除更早的镜像，0表示全部保留
+type SnapshotPolicy struct {
+	EventCount          uint64
+	AggregateEventCount map[string]uint64
+	RetainCount         int64
+}
+
+//
+// GetSnapshotPolicy
+// @Description: 从组件metadata中读取镜像策略
+// @param metadata
+// @return *SnapshotPolicy
+// @return error
+//
+func GetSnapshotPolicy(metadata common.Metadata) (*SnapshotPolicy, error) {
+	policy := &SnapshotPolicy{AggregateEventCount: make(map[string]uint64)}
+	var err error
+	if val, ok := metadata.Properties[snapshotEventCount]; ok && val != "" {
+		if policy.EventCount, err = strconv.ParseUint(val, 10, 64); err != nil {
+			return nil, fmt.Errorf("incorrect %s field from metadata", snapshotEventCount)
+		}
+	}
+	if val, ok := metadata.Properties[snapshotEventCounts]; ok && val != "" {
+		for _, item := range strings.Split(val, ",") {
+			kv := strings.Split(item, ":")
+			if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+				return nil, fmt.Errorf("incorrect %s field from metadata", snapshotEventCounts)
+			}
+			count, err := strconv.ParseUint(strings.TrimSpace(kv[1]), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("incorrect %s field from metadata", snapshotEventCounts)
+			}
+			policy.AggregateEventCount[strings.TrimSpace(kv[0])] = count
+		}
+	}
+	if val, ok := metadata.Properties[snapshotRetainCount]; ok && val != "" {
+		if policy.RetainCount, err = strconv.ParseInt(val, 10, 64); err != nil || policy.RetainCount < 0 {
+			return nil, fmt.Errorf("incorrect %s field from metadata", snapshotRetainCount)
+		}
+	}
+	return policy, nil
+}
+
+//
+// GetEventCount
+// @Description: 返回聚合类型的镜像事件数量，p为nil时返回0
+// @receiver p
+// @param aggregateType
+// @return uint64
+//
+func (p *SnapshotPolicy) GetEventCount(aggregateType string) uint64 {
+	if p == nil {
+		return 0
+	}
+	if count, ok := p.AggregateEventCount[aggregateType]; ok {
+		return count
+	}
+	return p.EventCount
+}
@@ -0,0 +1,23 @@
+package eventstorage
+
+import (
+	"github.com/liuxd6825/components-contrib/liuxd/common"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestGetSnapshotPolicy(t *testing.T) {
+	policy, err := GetSnapshotPolicy(common.Metadata{Properties: map[string]string{
+		snapshotEventCount:  "100",
+		snapshotEventCounts: "Order:20, Customer:0",
+		snapshotRetainCount: "3",
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(20), policy.GetEventCount("Order"))
+	assert.Equal(t, uint64(0), policy.GetEventCount("Customer"))
+	assert.Equal(t, uint64(100), policy.GetEventCount("Product"))
+	assert.Equal(t, int64(3), policy.RetainCount)
+
+	_, err = GetSnapshotPolicy(common.Metadata{Properties: map[string]string{snapshotEventCounts: "Order=20"}})
+	assert.EqualError(t, err, "incorrect snapshotEventCounts field from metadata")
+}
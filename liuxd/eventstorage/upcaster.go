@@ -0,0 +1,324 @@
+package eventstorage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/liuxd6825/components-contrib/liuxd/common"
+	"strings"
+	"sync"
+)
+
+// UpcastFunc 将事件数据从旧版本转换为新版本，data是存储数据的副本，可以直接修改
+type UpcastFunc func(data map[string]interface{}) (map[string]interface{}, error)
+
+// UpcastersMetadataKey 存储组件metadata中声明式转换配置的键，值为UpcasterConfig数组的JSON
+const UpcastersMetadataKey = "upcasters"
+
+const (
+	UpcastRuleRename  = "rename"
+	UpcastRuleDefault = "default"
+	UpcastRuleRemove  = "remove"
+)
+
+//
+// UpcastRule
+// @Description: 声明式转换规则，Field、To支持用"."分隔的嵌套字段。
+// rename: 将Field改名为To；default: Field不存在时设置为Value；remove: 删除Field。
+//
+type UpcastRule struct {
+	Op    string      `json:"op"`
+	Field string      `json:"field"`
+	To    string      `json:"to"`
+	Value interface{} `json:"value"`
+}
+
+//
+// UpcasterConfig
+// @Description: 一个事件类型从FromVersion到ToVersion的声明式转换，用于metadata中的upcasters配置
+//
+type UpcasterConfig struct {
+	EventType   string       `json:"eventType"`
+	FromVersion string       `json:"fromVersion"`
+	ToVersion   string       `json:"toVersion"`
+	Rules       []UpcastRule `json:"rules"`
+}
+
+type upcaster struct {
+	toVersion string
+	upcast    UpcastFunc
+}
+
+//
+// UpcasterRegistry
+// @Description: 事件升级注册表，按EventType和EventVersion查找转换，依次转换到最新版本。
+// 本注册表没有的转换到parent中查找。
+//
+type UpcasterRegistry struct {
+	mu        sync.RWMutex
+	upcasters map[string]map[string]*upcaster
+	parent    *UpcasterRegistry
+}
+
+// DefaultUpcasterRegistry 全局注册表，用于注册Go函数实现的转换，各存储的注册表都以它为parent
+var DefaultUpcasterRegistry = NewUpcasterRegistry(nil)
+
+func NewUpcasterRegistry(parent *UpcasterRegistry) *UpcasterRegistry {
+	return &UpcasterRegistry{
+		upcasters: make(map[string]map[string]*upcaster),
+		parent:    parent,
+	}
+}
+
+//
+// NewUpcasterRegistryFromMetadata
+// @Description: 创建存储使用的注册表，以DefaultUpcasterRegistry为parent，并注册metadata中的声明式转换
+// @param metadata
+// @return *UpcasterRegistry
+// @return error
+//
+func NewUpcasterRegistryFromMetadata(metadata common.Metadata) (*UpcasterRegistry, error) {
+	registry := NewUpcasterRegistry(DefaultUpcasterRegistry)
+	if val, ok := metadata.Properties[UpcastersMetadataKey]; ok && val != "" {
+		if err := registry.RegisterJson(val); err != nil {
+			return nil, err
+		}
+	}
+	return registry, nil
+}
+
+//
+// RegisterUpcaster
+// @Description: 在全局注册表中注册转换函数
+// @param eventType
+// @param fromVersion
+// @param toVersion
+// @param fn
+// @return error
+//
+func RegisterUpcaster(eventType, fromVersion, toVersion string, fn UpcastFunc) error {
+	return DefaultUpcasterRegistry.Register(eventType, fromVersion, toVersion, fn)
+}
+
+//
+// Register
+// @Description: 注册转换函数，同一事件类型的同一版本只能注册一次
+// @receiver r
+// @param eventType
+// @param fromVersion
+// @param toVersion
+// @param fn
+// @return error
+//
+func (r *UpcasterRegistry) Register(eventType, fromVersion, toVersion string, fn UpcastFunc) error {
+	if eventType == "" {
+		return errors.New("upcaster eventType cannot be empty")
+	}
+	if fromVersion == toVersion {
+		return errors.New(fmt.Sprintf("upcaster %s fromVersion and toVersion are both %s", eventType, fromVersion))
+	}
+	if fn == nil {
+		return errors.New(fmt.Sprintf("upcaster %s %s is nil", eventType, fromVersion))
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	versions, ok := r.upcasters[eventType]
+	if !ok {
+		versions = make(map[string]*upcaster)
+		r.upcasters[eventType] = versions
+	}
+	if _, ok := versions[fromVersion]; ok {
+		return errors.New(fmt.Sprintf("upcaster %s %s already registered", eventType, fromVersion))
+	}
+	versions[fromVersion] = &upcaster{toVersion: toVersion, upcast: fn}
+	return nil
+}
+
+//
+// RegisterRules
+// @Description: 注册声明式转换规则
+// @receiver r
+// @param eventType
+// @param fromVersion
+// @param toVersion
+// @param rules
+// @return error
+//
+func (r *UpcasterRegistry) RegisterRules(eventType, fromVersion, toVersion string, rules ...UpcastRule) error {
+	for _, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return errors.New(fmt.Sprintf("upcaster %s %s rule error: %s", eventType, fromVersion, err.Error()))
+		}
+	}
+	return r.Register(eventType, fromVersion, toVersion, func(data map[string]interface{}) (map[string]interface{}, error) {
+		for _, rule := range rules {
+			rule.apply(data)
+		}
+		return data, nil
+	})
+}
+
+//
+// RegisterJson
+// @Description: 注册JSON格式的UpcasterConfig数组
+// @receiver r
+// @param data
+// @return error
+//
+func (r *UpcasterRegistry) RegisterJson(data string) error {
+	var configs []UpcasterConfig
+	if err := json.Unmarshal([]byte(data), &configs); err != nil {
+		return errors.New("upcasters json error: " + err.Error())
+	}
+	for _, config := range configs {
+		if err := r.RegisterRules(config.EventType, config.FromVersion, config.ToVersion, config.Rules...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// Upcast
+// @Description: 将事件数据转换到最新版本，没有可用的转换时原样返回。转换前复制数据，不修改存储的数据。
+// @receiver r
+// @param eventType
+// @param eventVersion
+// @param data
+// @return map[string]interface{}
+// @return string 转换后的版本
+// @return error
+//
+func (r *UpcasterRegistry) Upcast(eventType, eventVersion string, data map[string]interface{}) (map[string]interface{}, string, error) {
+	visited := map[string]bool{}
+	copied := false
+	for {
+		u := r.find(eventType, eventVersion)
+		if u == nil {
+			return data, eventVersion, nil
+		}
+		if visited[eventVersion] {
+			return nil, "", errors.New(fmt.Sprintf("upcaster %s has a cycle at version %s", eventType, eventVersion))
+		}
+		visited[eventVersion] = true
+		if !copied {
+			data = copyMap(data)
+			copied = true
+		}
+		upcasted, err := u.upcast(data)
+		if err != nil {
+			return nil, "", errors.New(fmt.Sprintf("upcast %s from %s to %s error: %s", eventType, eventVersion, u.toVersion, err.Error()))
+		}
+		data, eventVersion = upcasted, u.toVersion
+	}
+}
+
+func (r *UpcasterRegistry) find(eventType, eventVersion string) *upcaster {
+	for registry := r; registry != nil; registry = registry.parent {
+		registry.mu.RLock()
+		u := registry.upcasters[eventType][eventVersion]
+		registry.mu.RUnlock()
+		if u != nil {
+			return u
+		}
+	}
+	return nil
+}
+
+func (rule UpcastRule) validate() error {
+	if rule.Field == "" {
+		return errors.New("field cannot be empty")
+	}
+	switch rule.Op {
+	case UpcastRuleRename:
+		if rule.To == "" {
+			return errors.New("rename to cannot be empty")
+		}
+	case UpcastRuleDefault, UpcastRuleRemove:
+	default:
+		return errors.New("op " + rule.Op + " is error")
+	}
+	return nil
+}
+
+func (rule UpcastRule) apply(data map[string]interface{}) {
+	switch rule.Op {
+	case UpcastRuleRename:
+		if value, ok := removeField(data, rule.Field); ok {
+			setField(data, rule.To, value)
+		}
+	case UpcastRuleDefault:
+		if _, ok := getField(data, rule.Field); !ok {
+			setField(data, rule.Field, rule.Value)
+		}
+	case UpcastRuleRemove:
+		removeField(data, rule.Field)
+	}
+}
+
+func getField(data map[string]interface{}, path string) (interface{}, bool) {
+	names := strings.Split(path, ".")
+	for _, name := range names[:len(names)-1] {
+		child, ok := data[name].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		data = child
+	}
+	value, ok := data[names[len(names)-1]]
+	return value, ok
+}
+
+func setField(data map[string]interface{}, path string, value interface{}) {
+	names := strings.Split(path, ".")
+	for _, name := range names[:len(names)-1] {
+		child, ok := data[name].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			data[name] = child
+		}
+		data = child
+	}
+	data[names[len(names)-1]] = value
+}
+
+func removeField(data map[string]interface{}, path string) (interface{}, bool) {
+	names := strings.Split(path, ".")
+	for _, name := range names[:len(names)-1] {
+		child, ok := data[name].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		data = child
+	}
+	name := names[len(names)-1]
+	value, ok := data[name]
+	delete(data, name)
+	return value, ok
+}
+
+// copyMap 深复制嵌套的map与数组
+func copyMap(data map[string]interface{}) map[string]interface{} {
+	if data == nil {
+		return make(map[string]interface{})
+	}
+	res := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		res[k] = copyValue(v)
+	}
+	return res
+}
+
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return copyMap(v)
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, item := range v {
+			res[i] = copyValue(item)
+		}
+		return res
+	}
+	return value
+}
@@ -0,0 +1,54 @@
+package eventstorage
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestUpcasterRegistry_Upcast(t *testing.T) {
+	parent := NewUpcasterRegistry(nil)
+	err := parent.Register("OrderCreated", "2.0", "3.0", func(data map[string]interface{}) (map[string]interface{}, error) {
+		data["total"] = data["amount"].(float64) * 100
+		return data, nil
+	})
+	assert.NoError(t, err)
+
+	registry := NewUpcasterRegistry(parent)
+	err = registry.RegisterJson(`[{"eventType":"OrderCreated","fromVersion":"1.0","toVersion":"2.0","rules":[
+		{"op":"rename","field":"customer.name","to":"customerName"},
+		{"op":"default","field":"amount","value":1.5},
+		{"op":"remove","field":"legacy"}]}]`)
+	assert.NoError(t, err)
+
+	stored := map[string]interface{}{"customer": map[string]interface{}{"name": "c1"}, "legacy": true}
+	data, version, err := registry.Upcast("OrderCreated", "1.0", stored)
+	assert.NoError(t, err)
+	assert.Equal(t, "3.0", version)
+	assert.Equal(t, map[string]interface{}{"customer": map[string]interface{}{}, "customerName": "c1", "amount": 1.5, "total": 150.0}, data)
+	assert.Equal(t, map[string]interface{}{"customer": map[string]interface{}{"name": "c1"}, "legacy": true}, stored)
+
+	data, version, err = registry.Upcast("OrderPaid", "1.0", stored)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.0", version)
+	assert.Equal(t, stored, data)
+
+	assert.EqualError(t, registry.Register("OrderCreated", "1.0", "2.0", func(data map[string]interface{}) (map[string]interface{}, error) {
+		return data, nil
+	}), "upcaster OrderCreated 1.0 already registered")
+	assert.EqualError(t, registry.RegisterRules("OrderPaid", "1.0", "2.0", UpcastRule{Op: "move", Field: "a"}), "upcaster OrderPaid 1.0 rule error: op move is error")
+}
+
+func TestUpcasterRegistry_UpcastError(t *testing.T) {
+	registry := NewUpcasterRegistry(nil)
+	assert.NoError(t, registry.RegisterRules("OrderCreated", "1.0", "2.0"))
+	assert.NoError(t, registry.RegisterRules("OrderCreated", "2.0", "1.0"))
+	_, _, err := registry.Upcast("OrderCreated", "1.0", nil)
+	assert.EqualError(t, err, "upcaster OrderCreated has a cycle at version 1.0")
+
+	assert.NoError(t, registry.Register("OrderPaid", "1.0", "2.0", func(data map[string]interface{}) (map[string]interface{}, error) {
+		return nil, errors.New("amount is missing")
+	}))
+	_, _, err = registry.Upcast("OrderPaid", "1.0", nil)
+	assert.EqualError(t, err, "upcast OrderPaid from 1.0 to 2.0 error: amount is missing")
+}